@@ -1,7 +1,12 @@
 package main
 
 import (
+	"auth"
 	"clustering"
+	"conf"
+	"crypto/hmac"
+	"distributor"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"io/ioutil"
@@ -10,8 +15,10 @@ import (
 	"message"
 	"net/http"
 	"signature"
-	// "ws"
-	//"./users"     // According to your OAuth settings
+	"strconv"
+	"strings"
+	"time"
+	"ws"
 )
 
 var upgrader = websocket.Upgrader{
@@ -20,44 +27,184 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(*http.Request) bool { return true },
 }
 
-// Websocket only works with your oauth set up
-/*
-func handlerWs(w http.ResponseWriter, r *http.Request) {
+var ws_authenticator auth.Authenticator = nil
 
-	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+const (
+	LONG_POLL_TIMEOUT_MAX = 60 * time.Second
+	LONG_POLL_TIMEOUT     = 30 * time.Second
+	SSE_PING_PERIOD       = 15 * time.Second
+	ADMIN_TOKEN_WINDOW    = 5 * time.Minute
+)
 
-	token := r.URL.Query().Get("key")
+// Push clients present their token as "Authorization: Bearer <token>" or,
+// since browsers can't set headers on a websocket or EventSource, as
+// ?token=<token>. The optional ?key= names the connection so "id.key"
+// endpoints reach it.
+func authenticatePush(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
 
-	res := users.GetUser(token)
+	id, err := ws_authenticator.Authenticate(token)
+	if err != nil {
+		log.Println("Push client authentication failed: " + err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"failure":{"msg":"Not authorized"}}`)
+		return "", false
+	}
+	return id, true
+}
 
-	if res == nil {
-		fmt.Fprintf(w, `{"failure":{"msg":"Not authorized"}}`)
-		return
+// The last event id a resuming client saw, from the header EventSource
+// sends on reconnect or ?last_event_id=
+func lastEventId(r *http.Request) string {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return id
 	}
+	return r.URL.Query().Get("last_event_id")
+}
 
-	id, err := res.GetString("id")
+func handlerWs(w http.ResponseWriter, r *http.Request) {
 
-	if err != nil {
-		fmt.Fprintf(w, `{"failure":{"msg":"Internal error"}}`)
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	id, ok := authenticatePush(w, r)
+	if !ok {
 		return
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		// Upgrade has already replied to the client
 		log.Println(err)
-		fmt.Fprintf(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
 		return
 	}
 
-	wsconn := ws.NewWs(conn, id, token)
-	wsconn.Join()
+	wsconn := ws.NewWs(conn, id, r.URL.Query().Get("key"))
+	if r.URL.Query().Get("ack") == "1" {
+		wsconn.EnableAcks()
+	}
+	err = wsconn.Join()
+	if err != nil {
+		log.Println(err)
+		conn.Close()
+		return
+	}
 
 	go wsconn.Heartbeat()
 	go wsconn.GetHeartbeat()
 
 	return
 }
-*/
+
+// Server-Sent Events stream of the messages for id.key
+func handlerSSE(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	id, ok := authenticatePush(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"failure":{"msg":"Streaming not supported"}}`)
+		return
+	}
+
+	client, err := ws.Subscribe(id, r.URL.Query().Get("key"), lastEventId(r))
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+		return
+	}
+	defer client.Leave()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(SSE_PING_PERIOD)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-client.Events():
+			if !ok {
+				return
+			}
+			fmt.Fprint(w, "id: "+strconv.FormatUint(event.Id, 10)+"\n")
+			for _, line := range strings.Split(string(event.Data), "\n") {
+				fmt.Fprint(w, "data: "+line+"\n")
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Long-poll for the messages of id.key. Returns as soon as there is at
+// least one message, or with none after ?timeout= seconds (30 by default).
+func handlerPoll(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	id, ok := authenticatePush(w, r)
+	if !ok {
+		return
+	}
+
+	timeout := LONG_POLL_TIMEOUT
+	if seconds, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && seconds >= 0 {
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > LONG_POLL_TIMEOUT_MAX {
+			timeout = LONG_POLL_TIMEOUT_MAX
+		}
+	}
+
+	client, err := ws.Subscribe(id, r.URL.Query().Get("key"), lastEventId(r))
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+		return
+	}
+
+	events := make([]string, 0)
+	add := func(event *ws.Event) {
+		events = append(events, `{"id":"`+strconv.FormatUint(event.Id, 10)+`","data":`+
+			strconv.Quote(string(event.Data))+`}`)
+	}
+
+	select {
+	case event, ok := <-client.Events():
+		if ok {
+			add(event)
+		}
+	case <-time.After(timeout):
+	case <-r.Context().Done():
+	}
+
+	// Leaving closes the channel, take what arrived in the meantime
+	client.Leave()
+	for event := range client.Events() {
+		add(event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"events":[`+strings.Join(events, ",")+`]}`)
+}
 
 func handler(w http.ResponseWriter, r *http.Request) {
 
@@ -105,9 +252,14 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		m_type := int(m_type_number)
 		endpoint, err := json.GetString("endpoint")
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
-			return
+			// Structured endpoints (e.g. REST targets) are stored as JSON
+			target, err := json.GetObject("endpoint")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+				return
+			}
+			endpoint = target.String()
 		}
 		msg, err := json.GetString("message")
 		if err != nil {
@@ -125,31 +277,298 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		obj, err := message.NewMessageObject(m_type, endpoint, msg, exp)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+			fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
 			return
 		}
 
+		// Bad REST targets fail now rather than when they fire
+		if m_type == message.S_REST_NOTIFICATION {
+			if err := distributor.ValidateRESTEndpoint(endpoint); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+				return
+			}
+		}
+
+		// Messages without a priority are normal
+		priority, _ := json.GetString("priority")
+		obj.Priority, err = message.ParsePriority(priority)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+			fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
 			return
 		}
 
-		_, err = clustering.DistCalls(obj)
-		if err != nil {
+		obj.Tenant, _ = json.GetString("tenant")
+		if len(obj.Tenant) > message.MAX_TENANT_LENGTH {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"failure":{"msg":"`+message.ErrorTenantTooLong.Error()+`"}}`)
+			return
+		}
+
+		// Messages are sent however late unless limited
+		valid_until, _ := json.GetInt64("valid_until")
+		max_lateness, _ := json.GetInt64("max_lateness")
+		if err := obj.SetValidUntil(valid_until, max_lateness); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+			fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+			return
+		}
+
+		// Relayed calls are scheduled here whatever region they name
+		target, _ := json.GetString("region")
+		if target != "" && r.Header.Get("X-Grandma-Relay") == "" {
+			region, err := clustering.Relay(obj, target)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+				return
+			} else if region != "" {
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, `{"success":{"msg": "Message to `+
+					strings.Trim(strconv.Quote(obj.Target()), `"`)+` relayed to region `+region+`", "region": `+
+					strconv.Quote(region)+`}}`)
+				return
+			}
+		}
+
+		schedule_id, err := clustering.DistCalls(obj)
+		if err == clustering.Err_Distribute_Pending {
+			// The slave may have scheduled it, a retry could schedule it twice
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, `{"success":{"msg": "Message to `+
+				strings.Trim(strconv.Quote(obj.Target()), `"`)+` accepted, its slave has not confirmed it yet", "pending": true}}`)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
 			return
 		} else {
 			w.WriteHeader(http.StatusOK)
-			fmt.Fprintf(w, `{"success":{"msg": "Message to `+obj.Endpoint+
-				` scheduled successfully"}}`)
+			fmt.Fprint(w, `{"success":{"msg": "Message to `+
+				strings.Trim(strconv.Quote(obj.Target()), `"`)+` scheduled successfully", "schedule_id": `+
+				strconv.Itoa(schedule_id)+`}}`)
 			return
 		}
 	}
 }
 
+// Delivery receipts from SMS providers, posted to /sms/status/<provider>
+func handlerSMSStatus(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	provider := strings.TrimPrefix(r.URL.Path, "/sms/status/")
+
+	err := distributor.HandleSMSReceipt(provider, r)
+	if err == distributor.ErrorInvalidCallbackKey {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"failure":{"msg":"Not authorized"}}`)
+		return
+	} else if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":{"msg":"Receipt recorded"}}`)
+}
+
+// Admin calls are signed like scheduling calls, ?time=<ms>&token=<token>
+// over the method, the time and the body. The time must be within
+// ADMIN_TOKEN_WINDOW of ours, so a captured call can't be replayed later.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+		return nil, false
+	}
+
+	signed_at := r.URL.Query().Get("time")
+	token := r.URL.Query().Get("token")
+	expected := signature.VToken(r.Method, signed_at, string(body))
+	if !hmac.Equal([]byte(token), []byte(expected)) || !freshAdminTime(signed_at) {
+		log.Println("not authorized")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"failure":{"msg":"Not authorized"}}`)
+		return nil, false
+	}
+	return body, true
+}
+
+func freshAdminTime(signed_at string) bool {
+	ms, err := strconv.ParseInt(signed_at, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(0, ms*int64(time.Millisecond)))
+	return age < ADMIN_TOKEN_WINDOW && age > -ADMIN_TOKEN_WINDOW
+}
+
+// Cluster membership, answered by the master:
+//
+//	GET  /cluster/nodes               lists the slaves
+//	POST /cluster/nodes               {"address": "host:port"} adds a slave
+//	POST /cluster/nodes/drain         {"address": "host:port"}
+//	POST /cluster/nodes/decommission  {"address": "host:port", "force": false}
+func handlerClusterNodes(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	body, ok := authorizeAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == "GET" && r.URL.Path == "/cluster/nodes" {
+		nodes, err := clustering.Nodes()
+		if err != nil {
+			writeClusterError(w, err)
+			return
+		}
+		data, err := json.Marshal(nodes)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{"failure":{"msg":"Internal error"}}`)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, `{"success":{"nodes":`+string(data)+`}}`)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+		return
+	}
+
+	obj, err := jsonwrapper.NewObjectFromBytes(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+		return
+	}
+	address, err := obj.GetString("address")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+		return
+	}
+
+	var done string
+	switch r.URL.Path {
+	case "/cluster/nodes":
+		err = clustering.AddNode(address)
+		done = "added"
+	case "/cluster/nodes/drain":
+		err = clustering.DrainNode(address)
+		done = "drained"
+	case "/cluster/nodes/decommission":
+		force, _ := obj.GetBoolean("force")
+		err = clustering.DecommissionNode(address, force)
+		done = "decommissioned"
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"failure":{"msg":"Not found"}}`)
+		return
+	}
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"success":{"msg":"Node `+
+		strings.Trim(strconv.Quote(address), `"`)+` `+done+`"}}`)
+}
+
+// POST /cluster/rebalance moves pending schedules between nodes, answered
+// by the master
+func handlerClusterRebalance(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	if _, ok := authorizeAdmin(w, r); !ok {
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"failure":{"msg":"Bad request"}}`)
+		return
+	}
+
+	if err := clustering.Rebalance(); err != nil {
+		writeClusterError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, `{"success":{"msg":"Rebalancing started"}}`)
+}
+
+// GET /region names this region, other regions probe it
+func handlerRegion(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"success":{"region":`+strconv.Quote(conf.GetRegion())+`}}`)
+}
+
+// GET /regions lists the regions calls are relayed to and their health
+func handlerRegions(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Powered-By", "GrandmaSchedulerServices")
+
+	if _, ok := authorizeAdmin(w, r); !ok {
+		return
+	}
+
+	data, err := json.Marshal(clustering.Regions())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"failure":{"msg":"Internal error"}}`)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"success":{"regions":`+string(data)+`}}`)
+}
+
+func writeClusterError(w http.ResponseWriter, err error) {
+	switch err {
+	case clustering.Err_Not_Master:
+		w.WriteHeader(http.StatusConflict)
+	case clustering.Err_Unknown_Node:
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprint(w, `{"failure":{"msg":"`+err.Error()+`"}}`)
+}
+
 func routes() {
 	http.HandleFunc("/", handler)
-	//http.HandleFunc("/ws", handlerWs)
+	http.HandleFunc("/sms/status/", handlerSMSStatus)
+	http.HandleFunc("/cluster/nodes", handlerClusterNodes)
+	http.HandleFunc("/cluster/nodes/", handlerClusterNodes)
+	http.HandleFunc("/cluster/rebalance", handlerClusterRebalance)
+	http.HandleFunc("/region", handlerRegion)
+	http.HandleFunc("/regions", handlerRegions)
+
+	if conf.GetWsAuth() == nil {
+		fmt.Println("Websocket, SSE and long-poll disabled, set ws_auth to enable them")
+		return
+	}
+
+	authenticator, err := auth.New(conf.GetWsAuth())
+	if err != nil {
+		panic(err)
+	}
+	ws_authenticator = authenticator
+	http.HandleFunc("/ws", handlerWs)
+	http.HandleFunc("/sse", handlerSSE)
+	http.HandleFunc("/poll", handlerPoll)
 }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"signature"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(signed_at time.Time, token string) *http.Request {
+	at := strconv.FormatInt(signed_at.UnixNano()/int64(time.Millisecond), 10)
+	if token == "" {
+		token = signature.VToken("POST", at, "{}")
+	}
+	return httptest.NewRequest("POST", "/cluster/rebalance?time="+at+"&token="+token, strings.NewReader("{}"))
+}
+
+func TestAuthorizeAdmin(t *testing.T) {
+	for name, c := range map[string]struct {
+		r  *http.Request
+		ok bool
+	}{
+		"signed now":        {adminRequest(time.Now(), ""), true},
+		"clock slightly on": {adminRequest(time.Now().Add(time.Minute), ""), true},
+		"stale":             {adminRequest(time.Now().Add(-ADMIN_TOKEN_WINDOW-time.Second), ""), false},
+		"from the future":   {adminRequest(time.Now().Add(ADMIN_TOKEN_WINDOW+time.Second), ""), false},
+		"bad token":         {adminRequest(time.Now(), "Zm9v"), false},
+		"no time":           {httptest.NewRequest("POST", "/cluster/rebalance?token="+signature.VToken("POST", "", "{}"), strings.NewReader("{}")), false},
+	} {
+		w := httptest.NewRecorder()
+		if _, ok := authorizeAdmin(w, c.r); ok != c.ok {
+			t.Errorf("%s: authorized %v", name, ok)
+		} else if !ok && w.Code != http.StatusForbidden {
+			t.Errorf("%s: answered %d", name, w.Code)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"distributor"
 	"fmt"
 	"net/http"
+	"queue"
 	"schedule"
 )
 
@@ -13,8 +14,13 @@ func main() {
 	if conf.ReadFlags() {
 		conf.Configure()
 
+		if err := queue.Setup(); err != nil {
+			fmt.Println("Failed opening the queue: " + err.Error())
+			return
+		}
+
 		fmt.Println("Setting network...")
-		success, conn := clustering.Network()
+		success := clustering.Network()
 
 		if !success {
 			fmt.Println("Server going down...")
@@ -24,7 +30,7 @@ func main() {
 		fmt.Println("\nStarting scheduler and distributor...")
 
 		go distributor.ProcessMessageQueue()
-		schedule.InitScheduler(conn)
+		schedule.InitScheduler()
 		routes()
 
 		//http.ListenAndServeTLS(conf.GetPort(), "/root/sellyx/certs/cert.pem",
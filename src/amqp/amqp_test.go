@@ -0,0 +1,240 @@
+package amqp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker speaks just enough AMQP for Dial and answers every publish as
+// its mode says:
+//
+//	ack    confirms it
+//	nack   rejects it
+//	close  closes the channel with 404, as for a missing exchange
+//	drop   drops the connection before confirming
+//	silent never answers
+type fakeBroker struct {
+	listener net.Listener
+	mode     string
+	lock     sync.Mutex
+	dials    int
+	bodies   []string
+	types    []string
+}
+
+func startFakeBroker(t *testing.T, mode string) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{listener: l, mode: mode}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.lock.Lock()
+			b.dials++
+			b.lock.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return b
+}
+
+func (b *fakeBroker) url() string {
+	return "amqp://guest:guest@" + b.listener.Addr().String() + "/"
+}
+
+func (b *fakeBroker) published() ([]string, []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string{}, b.bodies...), append([]string{}, b.types...)
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	send := func(channel uint16, method *argWriter) {
+		conn.Write((&frame{FRAME_METHOD, channel, method.Bytes()}).bytes())
+	}
+	expect := func(class_id, method_id uint16) *frame {
+		f, err := readFrame(conn, 0)
+		if err != nil {
+			return nil
+		}
+		if cid, mid := f.methodId(); cid != class_id || mid != method_id {
+			return nil
+		}
+		return f
+	}
+
+	header := make([]byte, 8)
+	if _, err := conn.Read(header); err != nil {
+		return
+	}
+
+	start := newMethod(CLASS_CONNECTION, METHOD_CONNECTION_START)
+	start.writeOctet(0)
+	start.writeOctet(9)
+	start.writeTable(map[string]interface{}{})
+	start.writeLongStr("PLAIN AMQPLAIN")
+	start.writeLongStr("en_US")
+	send(0, start)
+	if expect(CLASS_CONNECTION, METHOD_CONNECTION_START_OK) == nil {
+		return
+	}
+
+	tune := newMethod(CLASS_CONNECTION, METHOD_CONNECTION_TUNE)
+	tune.writeShort(0)
+	tune.writeLong(FRAME_MIN_SIZE)
+	tune.writeShort(0)
+	send(0, tune)
+	if expect(CLASS_CONNECTION, METHOD_CONNECTION_TUNE_OK) == nil || expect(CLASS_CONNECTION, METHOD_CONNECTION_OPEN) == nil {
+		return
+	}
+	open_ok := newMethod(CLASS_CONNECTION, METHOD_CONNECTION_OPEN_OK)
+	open_ok.writeShortStr("")
+	send(0, open_ok)
+
+	if expect(CLASS_CHANNEL, METHOD_CHANNEL_OPEN) == nil {
+		return
+	}
+	channel_ok := newMethod(CLASS_CHANNEL, METHOD_CHANNEL_OPEN_OK)
+	channel_ok.writeLongStr("")
+	send(publish_channel, channel_ok)
+	if expect(CLASS_CONFIRM, METHOD_CONFIRM_SELECT) == nil {
+		return
+	}
+	send(publish_channel, newMethod(CLASS_CONFIRM, METHOD_CONFIRM_SELECT_OK))
+
+	var tag uint64 = 0
+	for {
+		if expect(CLASS_BASIC, METHOD_BASIC_PUBLISH) == nil {
+			return
+		}
+		content, err := readFrame(conn, 0)
+		if err != nil || content.frame_type != FRAME_HEADER {
+			return
+		}
+		size := binary.BigEndian.Uint64(content.payload[4:12])
+		properties := newArgReader(append([]byte{0, 0, 0, 0}, content.payload[12:]...))
+		content_type := ""
+		if properties.readShort()&0x8000 != 0 {
+			content_type = properties.readShortStr()
+		}
+		body := make([]byte, 0, size)
+		for uint64(len(body)) < size {
+			f, err := readFrame(conn, 0)
+			if err != nil || f.frame_type != FRAME_BODY {
+				return
+			}
+			body = append(body, f.payload...)
+		}
+		tag++
+
+		b.lock.Lock()
+		b.bodies = append(b.bodies, string(body))
+		b.types = append(b.types, content_type)
+		b.lock.Unlock()
+
+		switch b.mode {
+		case "ack", "nack":
+			method := METHOD_BASIC_ACK
+			if b.mode == "nack" {
+				method = METHOD_BASIC_NACK
+			}
+			confirm := newMethod(CLASS_BASIC, uint16(method))
+			confirm.writeLongLong(tag)
+			confirm.writeOctet(0)
+			send(publish_channel, confirm)
+		case "close":
+			close_method := newMethod(CLASS_CHANNEL, METHOD_CHANNEL_CLOSE)
+			close_method.writeShort(404)
+			close_method.writeShortStr("NOT_FOUND - no exchange 'missing'")
+			close_method.writeShort(CLASS_BASIC)
+			close_method.writeShort(METHOD_BASIC_PUBLISH)
+			send(publish_channel, close_method)
+			expect(CLASS_CHANNEL, METHOD_CHANNEL_CLOSE_OK)
+			return
+		case "drop":
+			return
+		}
+	}
+}
+
+func publishTo(t *testing.T, b *fakeBroker, body string, timeout time.Duration) (*Connection, error) {
+	conn, err := Dial(b.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := &Properties{ContentType: "application/json", DeliveryMode: DELIVERY_PERSISTENT}
+	return conn, conn.Publish("orders", "created", []byte(body), props, timeout)
+}
+
+func TestPublishConfirmed(t *testing.T) {
+	b := startFakeBroker(t, "ack")
+	// Larger than a frame, the body is split
+	body := string(make([]byte, FRAME_MIN_SIZE*2+10))
+	conn, err := publishTo(t, b, body, time.Second)
+	defer conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies, types := b.published()
+	if len(bodies) != 1 || bodies[0] != body || types[0] != "application/json" {
+		t.Errorf("broker got %d messages, content type %v", len(bodies), types)
+	}
+}
+
+func TestPublishNacked(t *testing.T) {
+	b := startFakeBroker(t, "nack")
+	conn, err := publishTo(t, b, "{}", time.Second)
+	defer conn.Close()
+	if err != ErrorPublishNacked {
+		t.Errorf("expected ErrorPublishNacked, got %v", err)
+	}
+}
+
+func TestPublishChannelClosed(t *testing.T) {
+	b := startFakeBroker(t, "close")
+	conn, err := publishTo(t, b, "{}", time.Second)
+	if err != ErrorChannelClosed {
+		t.Errorf("expected ErrorChannelClosed, got %v", err)
+	}
+	if !conn.Closed() {
+		t.Error("the connection should be closed with its only channel")
+	}
+}
+
+func TestPublishConnectionLost(t *testing.T) {
+	b := startFakeBroker(t, "drop")
+	conn, err := publishTo(t, b, "{}", time.Second)
+	if err != ErrorConfirmLost {
+		t.Errorf("expected ErrorConfirmLost, got %v", err)
+	}
+	if err := conn.Publish("orders", "created", []byte("{}"), &Properties{}, time.Second); err != ErrorConnectionClosed {
+		t.Errorf("publishing on a closed connection: expected ErrorConnectionClosed, got %v", err)
+	}
+}
+
+func TestPublishConfirmTimeout(t *testing.T) {
+	b := startFakeBroker(t, "silent")
+	conn, err := publishTo(t, b, "{}", 100*time.Millisecond)
+	defer conn.Close()
+	if err != ErrorConfirmTimeout {
+		t.Errorf("expected ErrorConfirmTimeout, got %v", err)
+	}
+}
+
+func TestDialRejectsURL(t *testing.T) {
+	if _, err := Dial("http://localhost/"); err != ErrorInvalidURL {
+		t.Errorf("expected ErrorInvalidURL, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package amqp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Frame types and limits defined by AMQP 0-9-1
+const (
+	FRAME_METHOD    byte = 1
+	FRAME_HEADER    byte = 2
+	FRAME_BODY      byte = 3
+	FRAME_HEARTBEAT byte = 8
+	FRAME_END       byte = 0xCE
+
+	FRAME_MIN_SIZE = 4096
+)
+
+var (
+	ErrorBadFrame     = errors.New("Malformed AMQP frame")
+	ErrorFrameTooLong = errors.New("AMQP frame exceeds negotiated size")
+)
+
+type frame struct {
+	frame_type byte
+	channel    uint16
+	payload    []byte
+}
+
+func readFrame(r io.Reader, frame_max uint32) (*frame, error) {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[3:7])
+	if frame_max > 0 && size > frame_max {
+		return nil, ErrorFrameTooLong
+	}
+
+	payload := make([]byte, size+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	if payload[size] != FRAME_END {
+		return nil, ErrorBadFrame
+	}
+
+	return &frame{header[0], binary.BigEndian.Uint16(header[1:3]), payload[:size]}, nil
+}
+
+func (f *frame) bytes() []byte {
+	buffer := make([]byte, 7, len(f.payload)+8)
+	buffer[0] = f.frame_type
+	binary.BigEndian.PutUint16(buffer[1:3], f.channel)
+	binary.BigEndian.PutUint32(buffer[3:7], uint32(len(f.payload)))
+	buffer = append(buffer, f.payload...)
+	return append(buffer, FRAME_END)
+}
+
+// methodId returns class and method id of a method frame
+func (f *frame) methodId() (uint16, uint16) {
+	if f.frame_type != FRAME_METHOD || len(f.payload) < 4 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint16(f.payload[0:2]), binary.BigEndian.Uint16(f.payload[2:4])
+}
+
+// Writer for method arguments and content properties
+type argWriter struct {
+	bytes.Buffer
+}
+
+func newMethod(class_id, method_id uint16) *argWriter {
+	w := new(argWriter)
+	w.writeShort(class_id)
+	w.writeShort(method_id)
+	return w
+}
+
+func (w *argWriter) writeOctet(b byte) {
+	w.WriteByte(b)
+}
+
+func (w *argWriter) writeShort(v uint16) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *argWriter) writeLong(v uint32) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *argWriter) writeLongLong(v uint64) {
+	binary.Write(w, binary.BigEndian, v)
+}
+
+func (w *argWriter) writeShortStr(s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	w.WriteByte(byte(len(s)))
+	w.WriteString(s)
+}
+
+func (w *argWriter) writeLongStr(s string) {
+	w.writeLong(uint32(len(s)))
+	w.WriteString(s)
+}
+
+// writeTable writes a field table holding string and boolean values only,
+// which is all the client needs to send.
+func (w *argWriter) writeTable(table map[string]interface{}) {
+	t := new(argWriter)
+	for key, value := range table {
+		t.writeShortStr(key)
+		switch v := value.(type) {
+		case bool:
+			t.writeOctet('t')
+			if v {
+				t.writeOctet(1)
+			} else {
+				t.writeOctet(0)
+			}
+		case string:
+			t.writeOctet('S')
+			t.writeLongStr(v)
+		case map[string]interface{}:
+			t.writeOctet('F')
+			t.writeTable(v)
+		}
+	}
+	w.writeLong(uint32(t.Len()))
+	w.Write(t.Bytes())
+}
+
+// Reader for method arguments sent by the broker
+type argReader struct {
+	*bytes.Reader
+	err error
+}
+
+func newArgReader(payload []byte) *argReader {
+	// Skip class and method id
+	return &argReader{bytes.NewReader(payload[4:]), nil}
+}
+
+func (r *argReader) readOctet() byte {
+	b, err := r.ReadByte()
+	if err != nil {
+		r.err = ErrorBadFrame
+	}
+	return b
+}
+
+func (r *argReader) readShort() uint16 {
+	var v uint16
+	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+		r.err = ErrorBadFrame
+	}
+	return v
+}
+
+func (r *argReader) readLong() uint32 {
+	var v uint32
+	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+		r.err = ErrorBadFrame
+	}
+	return v
+}
+
+func (r *argReader) readLongLong() uint64 {
+	var v uint64
+	if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+		r.err = ErrorBadFrame
+	}
+	return v
+}
+
+func (r *argReader) readShortStr() string {
+	size := r.readOctet()
+	return r.readN(int(size))
+}
+
+func (r *argReader) readLongStr() string {
+	size := r.readLong()
+	return r.readN(int(size))
+}
+
+func (r *argReader) readN(size int) string {
+	if r.err != nil || size > r.Len() {
+		r.err = ErrorBadFrame
+		return ""
+	}
+	data := make([]byte, size)
+	io.ReadFull(r, data)
+	return string(data)
+}
+
+// skipTable discards a field table, broker properties are not used
+func (r *argReader) skipTable() {
+	size := r.readLong()
+	r.readN(int(size))
+}
@@ -0,0 +1,107 @@
+package amqp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, f := range []*frame{
+		{FRAME_METHOD, 1, newMethod(CLASS_BASIC, METHOD_BASIC_PUBLISH).Bytes()},
+		{FRAME_BODY, 7, []byte("hello")},
+		{FRAME_HEARTBEAT, 0, nil},
+	} {
+		read, err := readFrame(bytes.NewReader(f.bytes()), 0)
+		if err != nil {
+			t.Fatalf("frame type %d: %v", f.frame_type, err)
+		}
+		if read.frame_type != f.frame_type || read.channel != f.channel || !bytes.Equal(read.payload, f.payload) {
+			t.Errorf("frame type %d came back as %+v", f.frame_type, read)
+		}
+	}
+}
+
+func TestReadFrameChecksEnd(t *testing.T) {
+	data := (&frame{FRAME_BODY, 1, []byte("hello")}).bytes()
+	data[len(data)-1] = 0
+	if _, err := readFrame(bytes.NewReader(data), 0); err != ErrorBadFrame {
+		t.Errorf("expected ErrorBadFrame, got %v", err)
+	}
+}
+
+func TestReadFrameChecksSize(t *testing.T) {
+	data := (&frame{FRAME_BODY, 1, make([]byte, 100)}).bytes()
+	if _, err := readFrame(bytes.NewReader(data), 99); err != ErrorFrameTooLong {
+		t.Errorf("expected ErrorFrameTooLong, got %v", err)
+	}
+	if _, err := readFrame(bytes.NewReader(data[:50]), 0); err == nil {
+		t.Error("expected an error for a torn frame")
+	}
+}
+
+func TestArgumentsRoundTrip(t *testing.T) {
+	w := newMethod(CLASS_CHANNEL, METHOD_CHANNEL_CLOSE)
+	w.writeOctet(3)
+	w.writeShort(404)
+	w.writeLong(70000)
+	w.writeLongLong(1 << 40)
+	w.writeShortStr("NOT_FOUND")
+	w.writeTable(map[string]interface{}{
+		"product":      "GrandmaSchedulingServices",
+		"capabilities": map[string]interface{}{"publisher_confirms": true},
+	})
+	w.writeLongStr("PLAIN AMQPLAIN")
+
+	f := &frame{FRAME_METHOD, 1, w.Bytes()}
+	if cid, mid := f.methodId(); cid != CLASS_CHANNEL || mid != METHOD_CHANNEL_CLOSE {
+		t.Errorf("method id %d.%d", cid, mid)
+	}
+
+	r := newArgReader(f.payload)
+	if v := r.readOctet(); v != 3 {
+		t.Errorf("octet %d", v)
+	}
+	if v := r.readShort(); v != 404 {
+		t.Errorf("short %d", v)
+	}
+	if v := r.readLong(); v != 70000 {
+		t.Errorf("long %d", v)
+	}
+	if v := r.readLongLong(); v != 1<<40 {
+		t.Errorf("long long %d", v)
+	}
+	if v := r.readShortStr(); v != "NOT_FOUND" {
+		t.Errorf("short string %q", v)
+	}
+	r.skipTable()
+	if v := r.readLongStr(); v != "PLAIN AMQPLAIN" {
+		t.Errorf("long string after the table %q", v)
+	}
+	if r.err != nil {
+		t.Error(r.err)
+	}
+	r.readOctet()
+	if r.err != ErrorBadFrame {
+		t.Error("reading past the end should fail")
+	}
+}
+
+func TestShortStringsAreCut(t *testing.T) {
+	w := newMethod(CLASS_BASIC, METHOD_BASIC_PUBLISH)
+	w.writeShortStr(strings.Repeat("x", 300))
+	r := newArgReader(w.Bytes())
+	if v := r.readShortStr(); len(v) != 255 || r.err != nil {
+		t.Errorf("got %d bytes, %v", len(v), r.err)
+	}
+}
+
+func TestLongStringPastPayload(t *testing.T) {
+	w := newMethod(CLASS_CONNECTION, METHOD_CONNECTION_START)
+	w.writeLong(1000)
+	w.WriteString("short")
+	r := newArgReader(w.Bytes())
+	if r.readLongStr(); r.err != ErrorBadFrame {
+		t.Errorf("expected ErrorBadFrame, got %v", r.err)
+	}
+}
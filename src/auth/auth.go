@@ -0,0 +1,43 @@
+// Package auth verifies tokens presented by websocket and other push
+// clients and maps them to the id used in "id.key" endpoints.
+package auth
+
+import (
+	"errors"
+	"jsonwrapper"
+)
+
+var (
+	ErrorNotAuthorized       = errors.New("Not authorized")
+	ErrorTokenExpired        = errors.New("Token expired")
+	ErrorUnknownAuthType     = errors.New("Unknown authenticator type")
+	ErrorInvalidAuthSettings = errors.New("Invalid authenticator settings")
+)
+
+// Authenticator checks a client token and returns the id the client is
+// allowed to receive messages for
+type Authenticator interface {
+	Authenticate(token string) (string, error)
+}
+
+// New builds the authenticator described by the ws_auth config object.
+// Supported types are static, hmac, jwt and introspection.
+func New(settings *jsonwrapper.Object) (Authenticator, error) {
+	if settings == nil {
+		return nil, ErrorInvalidAuthSettings
+	}
+
+	auth_type, _ := settings.GetString("type")
+	switch auth_type {
+	case "static":
+		return newStaticAuthenticator(settings)
+	case "hmac":
+		return newHMACAuthenticator(settings)
+	case "jwt":
+		return newJWTAuthenticator(settings)
+	case "introspection":
+		return newIntrospectionAuthenticator(settings)
+	default:
+		return nil, ErrorUnknownAuthType
+	}
+}
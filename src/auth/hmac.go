@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"conf"
+	"crypto/hmac"
+	"jsonwrapper"
+	"signature"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tokens signed with the rest secret by the caller's backend:
+//
+//	token = <id>.<expires-epoch-ms>.<signature>
+//	signature = sign("WS\n" + id + "\n" + expires) as in API Authentication
+//
+//	ws_auth: {"type": "hmac"}
+type hmacAuthenticator struct {
+	secret string
+}
+
+func newHMACAuthenticator(settings *jsonwrapper.Object) (Authenticator, error) {
+	return &hmacAuthenticator{conf.GetRestSecret()}, nil
+}
+
+// HMACToken builds a token accepted by the hmac authenticator
+func HMACToken(id string, expires int64) string {
+	exp := strconv.FormatInt(expires, 10)
+	return id + "." + exp + "." + signature.Sign(conf.GetRestSecret(), "WS", id, exp)
+}
+
+func (a *hmacAuthenticator) Authenticate(token string) (string, error) {
+	sig_index := strings.LastIndex(token, ".")
+	if sig_index < 0 {
+		return "", ErrorNotAuthorized
+	}
+	exp_index := strings.LastIndex(token[:sig_index], ".")
+	if exp_index <= 0 {
+		return "", ErrorNotAuthorized
+	}
+
+	id := token[:exp_index]
+	exp := token[exp_index+1 : sig_index]
+	sig := token[sig_index+1:]
+
+	expected := signature.Sign(a.secret, "WS", id, exp)
+	if !hmac.Equal([]byte(expected), []byte(sig)) {
+		return "", ErrorNotAuthorized
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", ErrorNotAuthorized
+	}
+	if expires < time.Now().UnixNano()/1000000 {
+		return "", ErrorTokenExpired
+	}
+
+	return id, nil
+}
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"signature"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHMACToken(t *testing.T) {
+	a := &hmacAuthenticator{"secret"}
+	token := func(id string, expires time.Time) string {
+		exp := strconv.FormatInt(expires.UnixNano()/1000000, 10)
+		return id + "." + exp + "." + signature.Sign("secret", "WS", id, exp)
+	}
+
+	// Ids may have dots of their own
+	if id, err := a.Authenticate(token("acme.user-3", time.Now().Add(time.Minute))); err != nil || id != "acme.user-3" {
+		t.Errorf("id %q, %v", id, err)
+	}
+	if _, err := a.Authenticate(token("user-3", time.Now().Add(-time.Second))); err != ErrorTokenExpired {
+		t.Errorf("expired: expected ErrorTokenExpired, got %v", err)
+	}
+
+	valid := token("user-3", time.Now().Add(time.Minute))
+	for _, bad := range []string{"user-3", "user-3.1", "admin" + valid[len("user-3"):], valid + "0"} {
+		if _, err := a.Authenticate(bad); err != ErrorNotAuthorized {
+			t.Errorf("%s: expected ErrorNotAuthorized, got %v", bad, err)
+		}
+	}
+}
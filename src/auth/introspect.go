@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"io"
+	"jsonwrapper"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	INTROSPECTION_TIMEOUT   = 5 * time.Second
+	INTROSPECTION_CACHE_TTL = 60 * time.Second
+	INTROSPECTION_MAX_BODY  = 64 * 1024
+)
+
+// Tokens checked against an OAuth 2.0 token introspection endpoint
+// (RFC 7662). Active tokens are cached for a minute.
+//
+//	ws_auth: {"type": "introspection", "url": "https://id.example.com/introspect",
+//	          "client_id": "gss", "client_secret": "...", "id_field": "sub"}
+type introspectionAuthenticator struct {
+	url           string
+	client_id     string
+	client_secret string
+	id_field      string
+	client        *http.Client
+
+	lock  *sync.Mutex
+	cache map[string]*introspectionResult
+}
+
+type introspectionResult struct {
+	id      string
+	expires time.Time
+}
+
+func newIntrospectionAuthenticator(settings *jsonwrapper.Object) (Authenticator, error) {
+	a := new(introspectionAuthenticator)
+
+	var err error
+	a.url, err = settings.GetString("url")
+	if err != nil || a.url == "" {
+		return nil, ErrorInvalidAuthSettings
+	}
+	a.client_id, _ = settings.GetString("client_id")
+	a.client_secret, _ = settings.GetString("client_secret")
+	a.id_field, err = settings.GetString("id_field")
+	if err != nil {
+		a.id_field = "sub"
+	}
+
+	a.client = &http.Client{Timeout: INTROSPECTION_TIMEOUT}
+	a.lock = new(sync.Mutex)
+	a.cache = make(map[string]*introspectionResult)
+
+	return a, nil
+}
+
+func (a *introspectionAuthenticator) cached(token string) string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	for t, res := range a.cache {
+		if now.After(res.expires) {
+			delete(a.cache, t)
+		}
+	}
+
+	if res, ok := a.cache[token]; ok {
+		return res.id
+	}
+	return ""
+}
+
+func (a *introspectionAuthenticator) Authenticate(token string) (string, error) {
+	if token == "" {
+		return "", ErrorNotAuthorized
+	}
+	if id := a.cached(token); id != "" {
+		return id, nil
+	}
+
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequest("POST", a.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.client_id != "" {
+		req.SetBasicAuth(a.client_id, a.client_secret)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		log.Println("Token introspection failed: " + err.Error())
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Token introspection returned " + resp.Status)
+		return "", ErrorNotAuthorized
+	}
+
+	res, err := jsonwrapper.NewObjectFromReader(io.LimitReader(resp.Body, INTROSPECTION_MAX_BODY))
+	if err != nil {
+		return "", ErrorNotAuthorized
+	}
+
+	if active, _ := res.GetBoolean("active"); !active {
+		return "", ErrorNotAuthorized
+	}
+
+	id, err := res.GetString(a.id_field)
+	if err != nil || id == "" {
+		return "", ErrorNotAuthorized
+	}
+
+	expires := time.Now().Add(INTROSPECTION_CACHE_TTL)
+	if exp, err := res.GetInt64("exp"); err == nil && time.Unix(exp, 0).Before(expires) {
+		expires = time.Unix(exp, 0)
+	}
+
+	a.lock.Lock()
+	a.cache[token] = &introspectionResult{id, expires}
+	a.lock.Unlock()
+
+	return id, nil
+}
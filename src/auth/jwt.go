@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"jsonwrapper"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const JWT_LEEWAY = 60 // seconds of clock skew allowed on exp and nbf
+
+var (
+	ErrorMalformedJWT      = errors.New("Malformed JWT")
+	ErrorUnknownJWTKey     = errors.New("JWT signed with an unknown key")
+	ErrorUnsupportedJWTAlg = errors.New("Unsupported JWT algorithm")
+)
+
+// JWTs verified against the keys of a JWKS file (RSA, EC P-256/P-384 and
+// oct keys). The id is read from id_claim, "sub" by default.
+//
+//	ws_auth: {"type": "jwt", "jwks_file": "/etc/gss/jwks.json",
+//	          "issuer": "https://id.example.com", "audience": "gss",
+//	          "id_claim": "sub"}
+type jwtAuthenticator struct {
+	keys     []*jwk
+	issuer   string
+	audience string
+	id_claim string
+}
+
+type jwk struct {
+	kid    string
+	kty    string
+	alg    string
+	rsa    *rsa.PublicKey
+	ec     *ecdsa.PublicKey
+	secret []byte
+}
+
+var jwt_algs = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"HS256": crypto.SHA256,
+	"HS384": crypto.SHA384,
+	"HS512": crypto.SHA512,
+}
+
+func newJWTAuthenticator(settings *jsonwrapper.Object) (Authenticator, error) {
+	file, err := settings.GetString("jwks_file")
+	if err != nil {
+		return nil, ErrorInvalidAuthSettings
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	jwks, err := jsonwrapper.NewObjectFromBytes(content)
+	if err != nil {
+		return nil, ErrorInvalidAuthSettings
+	}
+
+	key_objs, err := jwks.GetObjectArray("keys")
+	if err != nil || len(key_objs) == 0 {
+		return nil, ErrorInvalidAuthSettings
+	}
+
+	a := new(jwtAuthenticator)
+	for _, obj := range key_objs {
+		key, err := parseJWK(obj)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = append(a.keys, key)
+	}
+
+	a.issuer, _ = settings.GetString("issuer")
+	a.audience, _ = settings.GetString("audience")
+	a.id_claim, err = settings.GetString("id_claim")
+	if err != nil {
+		a.id_claim = "sub"
+	}
+
+	return a, nil
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func parseJWK(obj *jsonwrapper.Object) (*jwk, error) {
+	key := new(jwk)
+	key.kid, _ = obj.GetString("kid")
+	key.alg, _ = obj.GetString("alg")
+	key.kty, _ = obj.GetString("kty")
+
+	field := func(name string) []byte {
+		s, err := obj.GetString(name)
+		if err != nil {
+			return nil
+		}
+		b, err := decodeSegment(s)
+		if err != nil {
+			return nil
+		}
+		return b
+	}
+
+	switch key.kty {
+	case "RSA":
+		n, e := field("n"), field("e")
+		if n == nil || e == nil {
+			return nil, ErrorInvalidAuthSettings
+		}
+		key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		x, y := field("x"), field("y")
+		if x == nil || y == nil {
+			return nil, ErrorInvalidAuthSettings
+		}
+		crv, _ := obj.GetString("crv")
+		var curve elliptic.Curve
+		switch crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, ErrorInvalidAuthSettings
+		}
+		key.ec = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case "oct":
+		key.secret = field("k")
+		if key.secret == nil {
+			return nil, ErrorInvalidAuthSettings
+		}
+	default:
+		return nil, ErrorInvalidAuthSettings
+	}
+
+	return key, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrorMalformedJWT
+	}
+
+	header_bytes, err := decodeSegment(parts[0])
+	if err != nil {
+		return "", ErrorMalformedJWT
+	}
+	header, err := jsonwrapper.NewObjectFromBytes(header_bytes)
+	if err != nil {
+		return "", ErrorMalformedJWT
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return "", ErrorMalformedJWT
+	}
+
+	alg, _ := header.GetString("alg")
+	kid, _ := header.GetString("kid")
+	hash, ok := jwt_algs[alg]
+	if !ok {
+		return "", ErrorUnsupportedJWTAlg
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range a.keys {
+		if kid != "" && key.kid != "" && key.kid != kid {
+			continue
+		}
+		if key.alg != "" && key.alg != alg {
+			continue
+		}
+		if key.verify(alg, hash, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", ErrorUnknownJWTKey
+	}
+
+	claim_bytes, err := decodeSegment(parts[1])
+	if err != nil {
+		return "", ErrorMalformedJWT
+	}
+	claims, err := jsonwrapper.NewObjectFromBytes(claim_bytes)
+	if err != nil {
+		return "", ErrorMalformedJWT
+	}
+
+	now := time.Now().Unix()
+	if exp, err := claims.GetInt64("exp"); err == nil && now > exp+JWT_LEEWAY {
+		return "", ErrorTokenExpired
+	}
+	if nbf, err := claims.GetInt64("nbf"); err == nil && now < nbf-JWT_LEEWAY {
+		return "", ErrorNotAuthorized
+	}
+	if a.issuer != "" {
+		if iss, _ := claims.GetString("iss"); iss != a.issuer {
+			return "", ErrorNotAuthorized
+		}
+	}
+	if a.audience != "" && !hasAudience(claims, a.audience) {
+		return "", ErrorNotAuthorized
+	}
+
+	id, err := claims.GetString(a.id_claim)
+	if err != nil || id == "" {
+		return "", ErrorNotAuthorized
+	}
+
+	return id, nil
+}
+
+// aud may be a single string or an array of strings
+func hasAudience(claims *jsonwrapper.Object, audience string) bool {
+	if aud, err := claims.GetString("aud"); err == nil {
+		return aud == audience
+	}
+	auds, err := claims.GetStringArray("aud")
+	if err != nil {
+		return false
+	}
+	for _, aud := range auds {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+func (key *jwk) verify(alg string, hash crypto.Hash, signed []byte, sig []byte) bool {
+	switch alg[:2] {
+	case "HS":
+		if key.secret == nil {
+			return false
+		}
+		mac := hmac.New(hash.New, key.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case "RS":
+		if key.rsa == nil {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		return rsa.VerifyPKCS1v15(key.rsa, hash, h.Sum(nil), sig) == nil
+	case "ES":
+		if key.ec == nil {
+			return false
+		}
+		size := (key.ec.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return false
+		}
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(key.ec, h.Sum(nil), r, s)
+	}
+	return false
+}
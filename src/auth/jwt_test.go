@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"jsonwrapper"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	hs_secret  = []byte("0123456789abcdef0123456789abcdef")
+	rsa_key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	ec_key, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signJWT(t *testing.T, header map[string]interface{}, claims map[string]interface{}) string {
+	header_bytes, _ := json.Marshal(header)
+	claim_bytes, _ := json.Marshal(claims)
+	signed := encodeSegment(header_bytes) + "." + encodeSegment(claim_bytes)
+
+	alg, _ := header["alg"].(string)
+	hash := jwt_algs[alg]
+	var sig []byte
+	switch alg[:2] {
+	case "HS":
+		mac := hmac.New(hash.New, hs_secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS":
+		h := hash.New()
+		h.Write([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, rsa_key, hash, h.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case "ES":
+		h := hash.New()
+		h.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, ec_key, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + encodeSegment(sig)
+}
+
+// An authenticator with one key of each type, read from a JWKS file as
+// configured
+func newTestJWT(t *testing.T, settings string) Authenticator {
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kid": "hs", "kty": "oct", "alg": "HS256", "k": encodeSegment(hs_secret)},
+		{"kid": "rs", "kty": "RSA", "n": encodeSegment(rsa_key.N.Bytes()),
+			"e": encodeSegment(big.NewInt(int64(rsa_key.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "crv": "P-256", "x": encodeSegment(ec_key.X.Bytes()),
+			"y": encodeSegment(ec_key.Y.Bytes())},
+	}})
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(file, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := jsonwrapper.NewObjectFromBytes([]byte(`{"type": "jwt", "jwks_file": "` + file + `"` + settings + `}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	a := newTestJWT(t, "")
+	exp := time.Now().Add(time.Hour).Unix()
+	for _, header := range []map[string]interface{}{
+		{"alg": "HS256", "kid": "hs"},
+		{"alg": "RS256", "kid": "rs"},
+		{"alg": "RS512"},
+		{"alg": "ES256", "kid": "ec"},
+	} {
+		token := signJWT(t, header, map[string]interface{}{"sub": "user-1", "exp": exp})
+		if id, err := a.Authenticate(token); err != nil || id != "user-1" {
+			t.Errorf("%v: id %q, %v", header, id, err)
+		}
+	}
+}
+
+func TestJWTRejectsSignatures(t *testing.T) {
+	a := newTestJWT(t, "")
+	claims := map[string]interface{}{"sub": "user-1"}
+
+	for name, c := range map[string]struct {
+		token string
+		err   error
+	}{
+		// The rs key is not an HMAC secret, the public key can't be used as one
+		"other key's kid": {signJWT(t, map[string]interface{}{"alg": "HS256", "kid": "rs"}, claims), ErrorUnknownJWTKey},
+		"unknown kid":     {signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "gone"}, claims), ErrorUnknownJWTKey},
+		"key's alg":       {signJWT(t, map[string]interface{}{"alg": "HS512", "kid": "hs"}, claims), ErrorUnknownJWTKey},
+		"none":            {encodeSegment([]byte(`{"alg":"none"}`)) + "." + encodeSegment([]byte(`{"sub":"user-1"}`)) + ".", ErrorUnsupportedJWTAlg},
+		"two parts":       {"a.b", ErrorMalformedJWT},
+		"bad header":      {"!!.e30.e30", ErrorMalformedJWT},
+	} {
+		if _, err := a.Authenticate(c.token); err != c.err {
+			t.Errorf("%s: expected %v, got %v", name, c.err, err)
+		}
+	}
+
+	// Claims changed after signing
+	token := signJWT(t, map[string]interface{}{"alg": "ES256"}, claims)
+	forged, _ := json.Marshal(map[string]interface{}{"sub": "admin"})
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + encodeSegment(forged) + "." + parts[2]
+	if _, err := a.Authenticate(tampered); err != ErrorUnknownJWTKey {
+		t.Errorf("tampered claims: expected ErrorUnknownJWTKey, got %v", err)
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	a := newTestJWT(t, `, "issuer": "https://id.example.com", "audience": "gss", "id_claim": "uid"`)
+	header := map[string]interface{}{"alg": "HS256"}
+	now := time.Now().Unix()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"uid": "user-2", "iss": "https://id.example.com", "aud": "gss", "exp": now + 60}
+	}
+
+	for name, c := range map[string]struct {
+		field string
+		value interface{}
+		err   error
+	}{
+		"valid":              {"", nil, nil},
+		"audience in array":  {"aud", []string{"other", "gss"}, nil},
+		"expired in leeway":  {"exp", now - JWT_LEEWAY/2, nil},
+		"expired":            {"exp", now - 2*JWT_LEEWAY, ErrorTokenExpired},
+		"not before leeway":  {"nbf", now + JWT_LEEWAY/2, nil},
+		"not yet valid":      {"nbf", now + 2*JWT_LEEWAY, ErrorNotAuthorized},
+		"other issuer":       {"iss", "https://evil.example.com", ErrorNotAuthorized},
+		"other audience":     {"aud", "billing", ErrorNotAuthorized},
+		"no audience in set": {"aud", []string{"billing"}, ErrorNotAuthorized},
+		"no id":              {"uid", "", ErrorNotAuthorized},
+	} {
+		claims := valid()
+		if c.field != "" {
+			claims[c.field] = c.value
+		}
+		id, err := a.Authenticate(signJWT(t, header, claims))
+		if err != c.err || (err == nil && id != "user-2") {
+			t.Errorf("%s: id %q, expected %v, got %v", name, id, c.err, err)
+		}
+	}
+}
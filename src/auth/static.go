@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"jsonwrapper"
+)
+
+// Tokens listed in a JSON file mapping token to id:
+//
+//	{"3f9a...": "user-1", "b71c...": "user-2"}
+//
+//	ws_auth: {"type": "static", "file": "/etc/gss/ws_tokens.json"}
+type staticAuthenticator struct {
+	tokens map[string]string
+}
+
+func newStaticAuthenticator(settings *jsonwrapper.Object) (Authenticator, error) {
+	file, err := settings.GetString("file")
+	if err != nil {
+		return nil, ErrorInvalidAuthSettings
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := jsonwrapper.NewObjectFromBytes(content)
+	if err != nil {
+		return nil, ErrorInvalidAuthSettings
+	}
+
+	a := &staticAuthenticator{make(map[string]string)}
+	for token := range obj.Map() {
+		id, err := obj.GetString(token)
+		if err != nil || id == "" {
+			return nil, ErrorInvalidAuthSettings
+		}
+		a.tokens[token] = id
+	}
+
+	return a, nil
+}
+
+func (a *staticAuthenticator) Authenticate(token string) (string, error) {
+	// Compare against every entry so timing doesn't reveal near matches
+	found := ""
+	for candidate, id := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			found = id
+		}
+	}
+
+	if found == "" {
+		return "", ErrorNotAuthorized
+	}
+	return found, nil
+}
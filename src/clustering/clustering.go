@@ -2,67 +2,78 @@ package clustering
 
 import (
 	"conf"
+	"container/list"
 	"fmt"
 	"io"
 	"log"
 	"message"
-	"net"
-	"sync"
+	"time"
 )
 
 func DistCalls(msg *message.Obj) (int, error) {
 	log.Println("distributing...")
-	if msg.MessageType != 105 {
-		return distLevel1Calls(msg)
-	} else {
-		return distLevel2Calls(msg)
-	}
+	return distLevel1Calls(msg)
 }
 
 func DistBigDataCalls(content io.Reader) (int, error) {
 	return distBigDataCalls(content)
 }
 
-func Network() (bool, *net.TCPConn) {
+func Network() bool {
 	mode := conf.GetClusterMode()
+	regions()
 
 	if mode {
 		if conf.GetSlaveList() != nil {
 			fmt.Println("Discovering slaves...")
+			term := lead()
 			err, conns := discoverSlaves()
+			if err == Err_Handshake_Status_Stale {
+				fmt.Println("Another node took over as master, joining as slave...")
+				return follower()
+			}
 			if err != nil {
 				fmt.Println("Failed connecting slaves")
-				return false, nil
+				return false
 			}
 			RWLock.Lock()
 			slave_connections = make(NodeQueue, conns.Len())
+			dropped_connections = list.New()
 			i := 0
 			for e := conns.Front(); e != nil; e = e.Next() {
-				slave_connections[i] = e.Value.(*Node)
+				node := e.Value.(*Node)
+				node.index = i
+				slave_connections[i] = node
+				if node.closed {
+					dropped_connections.PushBack(node)
+				}
 				i++
 			}
-			master_connection = &Node{320, 320, 0, false, "", nil, make([]byte, 4096),
-				make([]byte, 4096), 0, new(sync.RWMutex), nil}
+			master_connection = newNode("", 320, 0)
 			RWLock.Unlock()
 			createComplexityRanking()
-			rediscoverSlaves()
-			go executeSlaveQueue()
+			setupMasterPresence()
+			rediscoverSlaves(30*time.Second, term)
+			go renewLeases(term)
+			go heartbeatSlaves(term)
 			startLoopListener()
-			return true, nil
+			acceptAnnouncements()
+			return true
 		} else {
-			err := waitMasterConnection()
-			if err != nil {
-				fmt.Println("\tSlave: Failed connecting master")
-				return false, nil
-			}
-			rediscoverMasterConnection()
-			startPointListener()
-			return true, master_connection.conn
+			return follower()
 		}
 	} else {
-		master_connection = &Node{320, 320, 0, false, "", nil, nil,
-			nil, 0, nil, nil}
+		master_connection = newNode("", 320, 0)
 		fmt.Println("\tSetting as single node mode...")
-		return true, nil
+		return true
+	}
+}
+
+func follower() bool {
+	err := waitMasterConnection()
+	if err != nil {
+		fmt.Println("\tSlave: Failed connecting master")
+		return false
 	}
+	return true
 }
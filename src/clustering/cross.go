@@ -1,101 +1,322 @@
 package clustering
 
-/*
 import (
-	"bytes"
 	"conf"
+	"errors"
 	"log"
 	"message"
 	"queue"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Schedules can be relayed to other regions, each a cluster of its own
+// listed in region_list. A relayed call is the scheduling call itself,
+// POSTed to the region's REST API and signed with its rest_secret:
+//
+//	POST https://gss-eu.example.com/?time=<ms>&token=<token>
+//	X-Grandma-Relay: us-east
+//	X-Grandma-Relay-Type: 101
+//
+// X-Grandma-Relay names the region the call comes from, relayed calls are
+// scheduled where they arrive and never relayed again.
+//
+// Every region has its own queue and sender. Calls to a region that is
+// down stay queued until it's back, their expiration shortened by the time
+// they waited.
 const (
-	COMM_TYPE_ACKNOWLEDGED = 155
-	COMM_TYPE_FAILED       = 156
-
 	REGION_STATUS_OK       = 130
 	REGION_STATUS_DOWN     = 131
 	REGION_STATUS_UNSTABLE = 132
+
+	REGION_DOWN_AFTER   = 3 // Failures in a row
+	REGION_RETRY_PERIOD = 5 * time.Second
+	REGION_CHECK_PERIOD = 15 * time.Second
+
+	REGION_NEAREST = "nearest"
 )
 
-var cross_nodes []*Region
+var (
+	Err_Unknown_Region    = errors.New("No such region")
+	Err_Region_Queue_Full = errors.New("Region queue is full")
+)
 
 type Region struct {
+	Name         string
 	Url          string
+	Secret       string
+	Near         []string
 	Status       byte
 	SendingQueue *queue.GrandmaQueue
+	failures     int
+	rtt          time.Duration
+	queued       map[*message.Obj]time.Time
+	lock         *sync.Mutex
 }
 
-func init() {
-	region_list := conf.GetRegionList()
+// RegionInfo describes a region for the admin API
+type RegionInfo struct {
+	Name   string `json:"name"`
+	Url    string `json:"url"`
+	Status string `json:"status"`
+	Queued int    `json:"queued"`
+	RTT    int64  `json:"rtt_ms"`
+}
+
+var cross_nodes map[string]*Region = nil
+var setupRegions = new(sync.Once)
+
+// regions sets up the regions from region_list on first use, config is
+// read after init
+func regions() map[string]*Region {
+	setupRegions.Do(func() {
+		cross_nodes = make(map[string]*Region)
+		for name, settings := range conf.GetRegionList() {
+			region := &Region{
+				Name:         name,
+				Url:          settings.Url,
+				Secret:       settings.Secret,
+				Near:         settings.Near,
+				Status:       REGION_STATUS_OK,
+				SendingQueue: queue.NewQueue(),
+				queued:       make(map[*message.Obj]time.Time),
+				lock:         new(sync.Mutex),
+			}
+			cross_nodes[name] = region
+			if name == conf.GetRegion() {
+				continue
+			}
 
-	if region_list == nil {
-		cross_nodes = nil
-		return
+			// Calls still queued for the region from before a restart are
+			// replayed from queue_dir
+			sending, err := queue.OpenQueue("region-" + name)
+			if err != nil {
+				log.Println("Calls to region " + name + " are not kept on disk: " + err.Error())
+			} else {
+				region.SendingQueue = sending
+			}
+			go executeCrossQueue(region)
+		}
+		if len(cross_nodes) > 0 {
+			go checkRegions()
+		}
+	})
+	return cross_nodes
+}
+
+// Relay sends msg to the target region, or with "nearest" to the region
+// nearest to its endpoint. It returns the region the call was queued for,
+// "" when it is scheduled here.
+func Relay(msg *message.Obj, target string) (string, error) {
+	if target == "" || target == conf.GetRegion() {
+		return "", nil
 	}
 
-	cross_nodes = make([]*queue.GrandmaQueue, region_list.Len())
+	var region *Region = nil
+	if target == REGION_NEAREST {
+		region = nearestRegion(msg.Endpoint)
+		if region == nil || region.Name == conf.GetRegion() {
+			return "", nil
+		}
+	} else {
+		region = regions()[target]
+		if region == nil {
+			return "", Err_Unknown_Region
+		}
+	}
 
-	index := 0
-	for e := region_list.Front(); e != nil; e = e.Next() {
-		region := new(Region)
-		region.SendingQueue = queue.NewQueue()
-		region.Status = REGION_STATUS_OK
-		region.Url = e.Value()
-		cross_nodes[index] = region
+	if err := region.push(msg); err != nil {
+		return "", err
 	}
+	log.Println("Relaying message to region " + region.Name)
+	return region.Name, nil
 }
 
-// Distribution message mapping
-func preprocessMapping(config []byte) {
-
+// Regions lists the regions and their health
+func Regions() []RegionInfo {
+	infos := make([]RegionInfo, 0, len(regions()))
+	for _, region := range regions() {
+		region.lock.Lock()
+		status := "ok"
+		if region.Status == REGION_STATUS_DOWN {
+			status = "down"
+		} else if region.Status == REGION_STATUS_UNSTABLE {
+			status = "unstable"
+		}
+		infos = append(infos, RegionInfo{region.Name, region.Url, status, region.SendingQueue.Len(), int64(region.rtt / time.Millisecond)})
+		region.lock.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
 }
 
-func pushToCross(msg *message.Obj) {
-	if cross_queue == nil {
-		return
+// nearestRegion matches the endpoint against the regions' near list: a
+// pattern starting with a dot is a host suffix, anything else an endpoint
+// prefix. The longest match wins and regions that are down are skipped.
+func nearestRegion(endpoint string) *Region {
+	host := endpointHost(endpoint)
+
+	var nearest *Region = nil
+	var nearest_rtt time.Duration
+	best := 0
+	for _, region := range regions() {
+		region.lock.Lock()
+		down := region.Status == REGION_STATUS_DOWN && region.Name != conf.GetRegion()
+		rtt := region.rtt
+		region.lock.Unlock()
+		if down {
+			continue
+		}
+
+		for _, pattern := range region.Near {
+			matched := false
+			if strings.HasPrefix(pattern, ".") {
+				matched = host != "" && (strings.HasSuffix(host, pattern) || host == pattern[1:])
+			} else {
+				matched = strings.HasPrefix(endpoint, pattern)
+			}
+			if !matched || len(pattern) < best {
+				continue
+			}
+			if len(pattern) > best || nearest == nil || rtt < nearest_rtt {
+				nearest = region
+				nearest_rtt = rtt
+				best = len(pattern)
+			}
+		}
 	}
+	return nearest
+}
 
-	for i := 0; i < len(cross_queue); i++ {
-		cross_queue[i].PushMessage(msg)
+// endpointHost finds the host of URL, email and REST endpoints
+func endpointHost(endpoint string) string {
+	if i := strings.Index(endpoint, "://"); i >= 0 {
+		host := endpoint[i+3:]
+		if j := strings.IndexAny(host, "/?#\""); j >= 0 {
+			host = host[:j]
+		}
+		if j := strings.LastIndex(host, "@"); j >= 0 {
+			host = host[j+1:]
+		}
+		if j := strings.LastIndex(host, ":"); j >= 0 && !strings.Contains(host[j:], "]") {
+			host = host[:j]
+		}
+		return strings.ToLower(host)
 	}
+	if i := strings.LastIndex(endpoint, "@"); i >= 0 {
+		return strings.ToLower(endpoint[i+1:])
+	}
+	return ""
 }
 
-// Working...
+func (r *Region) push(msg *message.Obj) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 
-func executeCrossQueue() {
-	if cross_queue == nil {
-		return
+	// The client is answered rather than kept waiting for room
+	if r.SendingQueue.IsFull() && !r.SendingQueue.Spills() {
+		return Err_Region_Queue_Full
+	}
+	r.queued[msg] = time.Now()
+	if err := r.SendingQueue.PushMessage(msg); err != nil {
+		delete(r.queued, msg)
+		return Err_Region_Queue_Full
 	}
+	return nil
+}
 
-	var msg = cross_queue.PopMessage()
+func (r *Region) succeeded(rtt time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.Status != REGION_STATUS_OK {
+		log.Println("Region " + r.Name + " is back")
+	}
+	r.Status = REGION_STATUS_OK
+	r.failures = 0
+	r.rtt = rtt
+}
 
-	buffer := bytes.NewBuffer([]byte{COMM_TYPE_SCHEDULE})
-	buffer.Write(msg.GetMessagePayload())
+func (r *Region) failed(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures++
+	if r.failures >= REGION_DOWN_AFTER {
+		if r.Status != REGION_STATUS_DOWN {
+			log.Println("Region " + r.Name + " is down: " + err.Error())
+		}
+		r.Status = REGION_STATUS_DOWN
+	} else {
+		r.Status = REGION_STATUS_UNSTABLE
+	}
+}
 
-	node, err := sendRemote(buffer.Bytes(), 0)
+// executeCrossQueue sends a region's calls in order, a call that fails is
+// put back and tried again after REGION_RETRY_PERIOD until it expires
+func executeCrossQueue(r *Region) {
+	for {
+		msg := r.SendingQueue.PopMessage()
 
-	if err != nil {
-		cluster_queue.PushFront(msg)
-		go executeCrossQueue()
-		return
-	}
+		r.lock.Lock()
+		queued_at, ok := r.queued[msg]
+		if msg.Expired() {
+			delete(r.queued, msg)
+		}
+		r.lock.Unlock()
+		if msg.Expired() {
+			log.Println("Message to " + msg.Target() + " expired waiting for region " + r.Name)
+			continue
+		}
+		if !ok {
+			// Replayed after a restart, its wait before is unknown
+			queued_at = time.Now()
+		}
 
-	log.Println("Waiting for response from slave")
+		relayed := *msg
+		relayed.Expiration -= int64(time.Since(queued_at) / time.Millisecond)
+		if relayed.Expiration < 0 {
+			relayed.Expiration = 0
+		}
 
-	go executeCrossQueue()
+		start := time.Now()
+		err := sendCross(r, &relayed)
+		if err == nil || err == Err_Relay_Rejected {
+			if err == nil {
+				r.succeeded(time.Since(start))
+			} else {
+				log.Println("Region " + r.Name + " rejected a relayed message to " + msg.Target())
+			}
+			r.lock.Lock()
+			delete(r.queued, msg)
+			r.lock.Unlock()
+			continue
+		}
+
+		log.Println("Relaying to region " + r.Name + " failed: " + err.Error())
+		r.failed(err)
+		r.lock.Lock()
+		r.SendingQueue.PushFront(msg)
+		r.lock.Unlock()
+		time.Sleep(REGION_RETRY_PERIOD)
+	}
+}
 
-	select {
-	case <-node.channel:
-		log.Println("Got schedule id")
-		node.update(node.complexity+3, node.index)
-		// Do something with schedule id
-		// Save to db or log
-		break
-	case <-time.After(3 * time.Second):
-		cluster_queue.PushFront(msg)
-		break
+// checkRegions probes every region each REGION_CHECK_PERIOD, so the health
+// of regions without traffic is known too
+func checkRegions() {
+	for {
+		for _, region := range regions() {
+			if region.Name == conf.GetRegion() {
+				continue
+			}
+			start := time.Now()
+			if err := probeRegion(region); err != nil {
+				region.failed(err)
+			} else {
+				region.succeeded(time.Since(start))
+			}
+		}
+		time.Sleep(REGION_CHECK_PERIOD)
 	}
 }
-*/
@@ -0,0 +1,199 @@
+package clustering
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"message"
+	"net/http"
+	"net/http/httptest"
+	"queue"
+	"signature"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withRegions replaces region_list until the returned function puts the
+// old regions back
+func withRegions(list ...*Region) func() {
+	setupRegions.Do(func() {})
+	old := cross_nodes
+	cross_nodes = make(map[string]*Region)
+	for _, region := range list {
+		if region.SendingQueue == nil {
+			region.SendingQueue = queue.NewQueue()
+		}
+		region.queued = make(map[*message.Obj]time.Time)
+		region.lock = new(sync.Mutex)
+		cross_nodes[region.Name] = region
+	}
+	return func() { cross_nodes = old }
+}
+
+func TestEndpointHost(t *testing.T) {
+	for endpoint, expected := range map[string]string{
+		"https://Hooks.Example.com/x?a=b":                   "hooks.example.com",
+		"POST https://user:pw@api.example.com:8443/x":       "api.example.com",
+		"{\"url\": \"https://json.example.com\", \"a\": 1}": "json.example.com",
+		"http://[::1]:8080/x":                               "[::1]",
+		"Bob@Shop.EU":                                       "shop.eu",
+		"+15551234567":                                      "",
+	} {
+		if host := endpointHost(endpoint); host != expected {
+			t.Errorf("%s: host %q, expected %q", endpoint, host, expected)
+		}
+	}
+}
+
+func TestNearestRegion(t *testing.T) {
+	eu := &Region{Name: "eu", Near: []string{".eu", "https://api.example.com/eu/"}, Status: REGION_STATUS_OK}
+	us := &Region{Name: "us", Near: []string{".example.com"}, Status: REGION_STATUS_OK}
+	down := &Region{Name: "down", Near: []string{"https://api.example.com/eu/v2"}, Status: REGION_STATUS_DOWN}
+	far := &Region{Name: "far", Near: []string{".example.org"}, Status: REGION_STATUS_OK, rtt: 80 * time.Millisecond}
+	near := &Region{Name: "near", Near: []string{".example.org"}, Status: REGION_STATUS_OK, rtt: 20 * time.Millisecond}
+	defer withRegions(eu, us, down, far, near)()
+
+	for endpoint, expected := range map[string]*Region{
+		"https://hooks.example.com/x":     us,
+		"https://example.com/x":           us,
+		"https://api.example.com/eu/x":    eu, // Longer than .example.com
+		"https://api.example.com/eu/v2/x": eu, // The longest is down
+		"bob@shop.eu":                     eu,
+		"https://hooks.example.org/x":     near,
+		"https://example.net/x":           nil,
+	} {
+		if region := nearestRegion(endpoint); region != expected {
+			t.Errorf("%s: went to %v", endpoint, region)
+		}
+	}
+}
+
+func TestRegionHealth(t *testing.T) {
+	r := &Region{Name: "eu", Status: REGION_STATUS_OK}
+	defer withRegions(r)()
+
+	for i := 1; i < REGION_DOWN_AFTER; i++ {
+		r.failed(Err_Relay_Status)
+		if r.Status != REGION_STATUS_UNSTABLE {
+			t.Fatalf("status %d after %d failures", r.Status, i)
+		}
+	}
+	r.failed(Err_Relay_Status)
+	if r.Status != REGION_STATUS_DOWN {
+		t.Fatalf("status %d after %d failures", r.Status, REGION_DOWN_AFTER)
+	}
+	r.succeeded(30 * time.Millisecond)
+	if r.Status != REGION_STATUS_OK || r.failures != 0 {
+		t.Errorf("status %d, %d failures after a success", r.Status, r.failures)
+	}
+	if infos := Regions(); len(infos) != 1 || infos[0].Status != "ok" || infos[0].RTT != 30 {
+		t.Errorf("regions %+v", infos)
+	}
+}
+
+func TestSendCross(t *testing.T) {
+	status := http.StatusOK
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		when := req.URL.Query().Get("time")
+		if req.URL.Query().Get("token") != signature.Sign("s3cret", "POST", when, string(body)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get("X-Grandma-Relay") != "true" || req.Header.Get("X-Grandma-Relay-Type") != strconv.Itoa(message.S_REST_NOTIFICATION) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = nil
+		json.Unmarshal(body, &received)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	r := &Region{Name: "eu", Url: server.URL, Secret: "s3cret"}
+	msg := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST https://hooks.example.com/x text/plain",
+		MessageBody: "line 1\nline 2", Expiration: 5000, Priority: message.PRIORITY_HIGH, Tenant: "acme"}
+	if err := sendCross(r, msg); err != nil {
+		t.Fatal(err)
+	}
+	if received["message"] != msg.MessageBody || received["expiration"] != 5000.0 || received["priority"] != "high" ||
+		received["tenant"] != "acme" {
+		t.Errorf("region got %v", received)
+	}
+
+	for code, expected := range map[int]error{http.StatusBadRequest: Err_Relay_Rejected,
+		http.StatusServiceUnavailable: Err_Relay_Status} {
+		status = code
+		if err := sendCross(r, msg); err != expected {
+			t.Errorf("%d: expected %v, got %v", code, expected, err)
+		}
+	}
+	r.Secret = "other"
+	status = http.StatusOK
+	if err := sendCross(r, msg); err != Err_Relay_Status {
+		t.Errorf("wrong secret: expected Err_Relay_Status, got %v", err)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	r := &Region{Name: "eu", Near: []string{".eu"}, Status: REGION_STATUS_OK}
+	defer withRegions(r)()
+	for target, expected := range map[string]string{"": "", "eu": "eu", REGION_NEAREST: "eu"} {
+		msg := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "GET https://shop.eu/x", Expiration: 5000}
+		if region, err := Relay(msg, target); err != nil || region != expected {
+			t.Errorf("%q: relayed to %q, %v", target, region, err)
+		}
+	}
+	if _, err := Relay(&message.Obj{}, "mars"); err != Err_Unknown_Region {
+		t.Errorf("expected Err_Unknown_Region, got %v", err)
+	}
+	if n := r.SendingQueue.Len(); n != 2 || len(r.queued) != 2 {
+		t.Errorf("%d calls queued, %d waiting", n, len(r.queued))
+	}
+}
+
+// A call goes out with what is left of its expiration, expired ones never
+func TestCrossQueue(t *testing.T) {
+	received := make(chan map[string]interface{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var call map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&call)
+		received <- call
+	}))
+	defer server.Close()
+
+	r := &Region{Name: "eu", Url: server.URL, Status: REGION_STATUS_OK}
+	defer withRegions(r)()
+	expired := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "GET https://shop.eu/expired", ValidUntil: 1}
+	waited := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "GET https://shop.eu/waited", Expiration: 5000}
+	r.push(expired)
+	r.push(waited)
+	r.lock.Lock()
+	r.queued[waited] = time.Now().Add(-2 * time.Second)
+	r.lock.Unlock()
+
+	go executeCrossQueue(r)
+	select {
+	case call := <-received:
+		expiration, _ := call["expiration"].(float64)
+		if call["endpoint"] != waited.Endpoint || expiration > 3000 || expiration < 2500 {
+			t.Errorf("region got %v", call)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing relayed")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		left := len(r.queued)
+		r.lock.Unlock()
+		if left == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("relayed calls still waiting")
+}
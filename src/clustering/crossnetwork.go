@@ -1,40 +1,96 @@
 package clustering
 
-/*
 import (
+	"bytes"
 	"conf"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"message"
 	"net/http"
+	"net/url"
+	"signature"
 	"strconv"
+	"time"
 )
 
-var (
-	ErrorInproperResponse = errors.New("Status code not 200")
+const (
+	RELAY_TIMEOUT = 10 * time.Second
 )
 
-func sendCross(msg, url string, msg_type int) error {
-	req, err := http.NewRequest("POST", url, bytes.NewBufferString(msg))
+var (
+	Err_Relay_Status   = errors.New("Status code not 200")
+	Err_Relay_Rejected = errors.New("Region rejected the message")
+)
 
-	req.Header.Add("Content-Type", content_type)
-	req.Header.Add("X-Powered-By", "GrandmaSchedulingServices")
-	req.Header.Add("X-Grandma-Relay-Type", strconv.Itoa(msg_type))
-	req.Header.Add("X-Grandma-Relay", "true")
+var relay_client = &http.Client{Timeout: RELAY_TIMEOUT}
 
-	client := &http.Client{}
-	response, err := client.Do(req)
+// sendCross posts msg to the region as a scheduling call
+func sendCross(r *Region, msg *message.Obj) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"type":        msg.MessageType,
+		"endpoint":    msg.Endpoint,
+		"message":     msg.MessageBody,
+		"expiration":  msg.Expiration,
+		"priority":    message.PriorityName(msg.Priority),
+		"tenant":      msg.Tenant,
+		"valid_until": msg.ValidUntil,
+	})
+	if err != nil {
+		return err
+	}
 
+	now := signature.TimeStamp()
+	token := signature.Sign(r.Secret, "POST", now, string(body))
+	req, err := http.NewRequest("POST", r.Url+"/?time="+now+"&token="+url.QueryEscape(token), bytes.NewBuffer(body))
 	if err != nil {
 		return err
 	}
 
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("X-Powered-By", "GrandmaSchedulingServices")
+	req.Header.Add("X-Grandma-Relay-Type", strconv.Itoa(msg.MessageType))
+	req.Header.Add("X-Grandma-Relay", relayOrigin())
+
+	response, err := relay_client.Do(req)
+	if err != nil {
+		return err
+	}
 	defer response.Body.Close()
-	body, _ := ioutil.ReadAll(response.Body)
+	reply, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
 
-	log.Println(string(body))
+	if response.StatusCode == http.StatusBadRequest {
+		// The message itself is refused, sending it again won't help
+		log.Println(string(reply))
+		return Err_Relay_Rejected
+	}
+	if response.StatusCode != http.StatusOK {
+		return Err_Relay_Status
+	}
+	return nil
+}
 
-	if response.StatusCode != 200 {
-		return ErrorInproperResponse
+// probeRegion asks the region for its name
+func probeRegion(r *Region) error {
+	response, err := relay_client.Get(r.Url + "/region")
+	if err != nil {
+		return err
 	}
+	defer response.Body.Close()
+	ioutil.ReadAll(io.LimitReader(response.Body, 4096))
 
+	if response.StatusCode != http.StatusOK {
+		return Err_Relay_Status
+	}
 	return nil
 }
-*/
+
+// Regions without a name still mark what they relay
+func relayOrigin() string {
+	if conf.GetRegion() == "" {
+		return "true"
+	}
+	return conf.GetRegion()
+}
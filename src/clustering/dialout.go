@@ -0,0 +1,257 @@
+package clustering
+
+import (
+	"conf"
+	"container/heap"
+	crand "crypto/rand"
+	"encoding/hex"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Slaves behind NAT or in autoscaled groups can't be dialed by the master.
+// With cluster_dial_master they dial the master in cluster_master and keep
+// the connection, the rest of the link is as if the master had dialed:
+//
+//	slave:  COMM_TYPE_DIAL_IN  on the master's network_port with the
+//	                           instance id, then the master runs the
+//	                           handshake as usual
+//
+// The dialer takes the client's end of TLS, as with announcements. A slave
+// that dialed in is known by its name and an instance id drawn when the
+// process starts, so instances of an autoscaled group sharing a name are
+// told apart. It is never dialed by the master. A slave that loses the
+// master dials again, going through cluster_master and the slaves of the
+// member list in rank order, which is where a new master comes from after a
+// failover. After a round of failures it waits DIAL_BACKOFF_MIN, doubling
+// up to DIAL_BACKOFF_MAX while it fails. Slaves dialing in get no rank in
+// the member list, so they never take over.
+const (
+	DIAL_BACKOFF_MIN = time.Second
+	DIAL_BACKOFF_MAX = time.Minute
+	DIAL_IN_PREFIX   = "dial-in/"
+)
+
+var instance_id = newInstanceId()
+
+func newInstanceId() string {
+	id := make([]byte, 8)
+	crand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// dialMaster keeps this slave connected to the master in cluster_master,
+// or to the one that took over from it
+func dialMaster() {
+	address := conf.GetClusterMaster()
+	if address == "" {
+		log.Println("Not dialing the master, cluster_master is not set")
+		return
+	}
+
+	backoff := DIAL_BACKOFF_MIN
+	failed := 0
+	for {
+		RWLock.RLock()
+		connected := master_connection != nil && !master_connection.closed
+		RWLock.RUnlock()
+		membershipLock.Lock()
+		left := left_cluster
+		membershipLock.Unlock()
+
+		if connected || left || isLeader() {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err := dialMasterAt(address); err != nil {
+			tried := address
+			candidates := masterCandidates()
+			address = nextCandidate(candidates, tried)
+			failed++
+			if failed < len(candidates) {
+				log.Println("Dialing master " + tried + " failed: " + err.Error() + ", trying " + address)
+				continue
+			}
+
+			// Jittered, so slaves losing the master together don't come back
+			// together
+			wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			log.Println("Dialing master " + tried + " failed: " + err.Error() + ", retrying " + address + " in " + wait.Truncate(time.Millisecond).String())
+			time.Sleep(wait)
+			failed = 0
+			backoff *= 2
+			if backoff > DIAL_BACKOFF_MAX {
+				backoff = DIAL_BACKOFF_MAX
+			}
+			continue
+		}
+		failed = 0
+		backoff = DIAL_BACKOFF_MIN
+	}
+}
+
+// masterCandidates lists where the master may be: cluster_master, then
+// the slaves of the member list in the order they take over
+func masterCandidates() []string {
+	candidates := []string{conf.GetClusterMaster()}
+	electionLock.Lock()
+	for _, address := range members {
+		if address != candidates[0] {
+			candidates = append(candidates, address)
+		}
+	}
+	electionLock.Unlock()
+	return candidates
+}
+
+// nextCandidate is the candidate after address, the first one when address
+// is no longer listed
+func nextCandidate(candidates []string, address string) string {
+	for i, candidate := range candidates {
+		if candidate == address {
+			return candidates[(i+1)%len(candidates)]
+		}
+	}
+	return candidates[0]
+}
+
+func dialMasterAt(address string) error {
+	tcp, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return err
+	}
+	tcp_conn, err := net.DialTCP("tcp", nil, tcp)
+	if err != nil {
+		return err
+	}
+	tcp_conn.SetWriteBuffer(64)
+	tcp_conn.SetReadBuffer(4096)
+
+	conn, err := secureMaster(tcp_conn)
+	if err != nil {
+		tcp_conn.Close()
+		return err
+	}
+
+	w := newPayload(COMM_TYPE_DIAL_IN)
+	w.putString(instance_id)
+	frame, err := encodeFrame(PROTOCOL_V2, w.Bytes(), nextFrameId())
+	if err == nil {
+		_, err = conn.Write(frame)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	status, name, version := handshakeSlave(conn)
+	if status == HANDSHAKE_STATUS_SUCCESS {
+		err = tcp_conn.SetKeepAlive(true)
+	}
+	if status != HANDSHAKE_STATUS_SUCCESS || err != nil {
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		return handshakeError(status)
+	}
+
+	takeMaster(conn, name, version)
+	return nil
+}
+
+func handshakeError(status int8) error {
+	switch status {
+	case HANDSHAKE_STATUS_BADCONN:
+		return Err_Handshake_Status_Badconn
+	case HANDSHAKE_STATUS_REFUSED:
+		return Err_Handshake_Status_Refused
+	case HANDSHAKE_STATUS_TIMEOUT:
+		return Err_Handshake_Status_Timeout
+	case HANDSHAKE_STATUS_SVR_ERR:
+		return Err_Handshake_Status_Svr_Err
+	case HANDSHAKE_STATUS_STALE:
+		return Err_Handshake_Status_Stale
+	}
+	return Err_Handshake_Status_Unknown
+}
+
+// acceptDialIn handshakes with a slave that dialed in and puts it in the
+// cluster, or back on its node if it was there before. Slaves from before
+// instance ids are known by their name only.
+func acceptDialIn(session *net.TCPConn, conn net.Conn, instance string) {
+	if !isLeader() {
+		conn.Close()
+		return
+	}
+
+	status, name, version := handshakeMaster(conn)
+	var err error = nil
+	if status == HANDSHAKE_STATUS_SUCCESS {
+		err = session.SetKeepAlive(true)
+	}
+	if status != HANDSHAKE_STATUS_SUCCESS || err != nil {
+		conn.Close()
+		printHandshakeStatus("Master", status)
+		if status == HANDSHAKE_STATUS_STALE {
+			stepDown("A newer master was elected, rejoining as slave")
+		}
+		return
+	}
+
+	address := DIAL_IN_PREFIX + name
+	if instance != "" {
+		address += "/" + instance
+	}
+	membershipLock.Lock()
+	returning := decommissioned[address]
+	membershipLock.Unlock()
+
+	RWLock.Lock()
+	var node *Node = nil
+	for _, n := range slave_connections {
+		if n.address == address {
+			node = n
+			break
+		}
+	}
+	joined := node == nil
+	if joined {
+		node = newNode(address, 999999, 0)
+		node.saved = 0
+		node.closed = true
+		node.dialed_in = true
+		heap.Push(&slave_connections, node)
+	} else if !node.closed && node.conn != nil {
+		// Dialing again before the master noticed the old connection fail
+		node.conn.Close()
+		node.saved = node.complexity
+	}
+	node.attach(conn, name, version)
+	if returning {
+		// Back after being removed, it hands its schedules over and leaves
+		// again, see evictNodes
+		node.draining = true
+		node.evicting = true
+	}
+	if dropped_connections != nil {
+		for n := dropped_connections.Front(); n != nil; n = n.Next() {
+			if n.Value.(*Node) == node {
+				dropped_connections.Remove(n)
+				break
+			}
+		}
+	}
+	RWLock.Unlock()
+
+	if joined {
+		listenSlave(node)
+		log.Println("Slave " + address + " joined the cluster")
+	}
+	node.update(node.saved)
+	takeOver(address, false)
+	topologyChanged()
+}
@@ -0,0 +1,179 @@
+package clustering
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstanceIds(t *testing.T) {
+	id := newInstanceId()
+	if len(id) != 16 || strings.Trim(id, "0123456789abcdef") != "" {
+		t.Errorf("instance id %q", id)
+	}
+	if newInstanceId() == id {
+		t.Error("two instances drew the same id")
+	}
+}
+
+func TestMasterCandidates(t *testing.T) {
+	restore := withTerm(3)
+	defer restore()
+	updateMembers(3, 2, []string{"10.0.7.1:9090", "10.0.7.2:9090", "10.0.7.3:9090"})
+
+	candidates := masterCandidates()
+	if strings.Join(candidates[1:], ",") != "10.0.7.1:9090,10.0.7.2:9090,10.0.7.3:9090" {
+		t.Fatalf("candidates %v", candidates)
+	}
+	for address, expected := range map[string]string{
+		candidates[0]:   "10.0.7.1:9090",
+		"10.0.7.2:9090": "10.0.7.3:9090",
+		"10.0.7.3:9090": candidates[0], // Round again
+		"10.0.7.9:9090": candidates[0], // Gone from the member list
+	} {
+		if next := nextCandidate(candidates, address); next != expected {
+			t.Errorf("after %s: %s, expected %s", address, next, expected)
+		}
+	}
+}
+
+func TestHandshakeError(t *testing.T) {
+	for status, expected := range map[int8]error{
+		HANDSHAKE_STATUS_BADCONN: Err_Handshake_Status_Badconn,
+		HANDSHAKE_STATUS_REFUSED: Err_Handshake_Status_Refused,
+		HANDSHAKE_STATUS_TIMEOUT: Err_Handshake_Status_Timeout,
+		HANDSHAKE_STATUS_SVR_ERR: Err_Handshake_Status_Svr_Err,
+		HANDSHAKE_STATUS_STALE:   Err_Handshake_Status_Stale,
+		HANDSHAKE_STATUS_UNKNOWN: Err_Handshake_Status_Unknown,
+	} {
+		if err := handshakeError(status); err != expected {
+			t.Errorf("status %d: %v", status, err)
+		}
+	}
+}
+
+// dialIn connects a fake slave named name to this node as the master and
+// runs the slave's end of the handshake
+func dialIn(t *testing.T, listener *net.TCPListener, name string, instance string) net.Conn {
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		acceptDialIn(session, session, instance)
+		close(done)
+	}()
+
+	if _, data := readAndCheckTimeOut(client); !bytes.Equal(data, HANDSHAKE_L1_REQUEST) {
+		t.Fatalf("master sent %x", data)
+	}
+	if code := challengeMaster(client); code != HANDSHAKE_STATUS_SUCCESS {
+		t.Fatalf("challenge: %d", code)
+	}
+	readAndCheckTimeOut(client)
+	client.Write(helloMessage(name, map[string]string{"proto": "2"}))
+	if _, data := readAndCheckTimeOut(client); !bytes.Equal(data, HANDSHAKE_L3_RESPONSE_OK) {
+		t.Fatalf("master answered %x", data)
+	}
+	<-done
+	return client
+}
+
+func TestDialInKeyedByInstance(t *testing.T) {
+	restore_term := withTerm(3)
+	defer restore_term()
+	electionLock.Lock()
+	leader = true
+	electionLock.Unlock()
+	_, restore := withSlaves()
+	defer func() {
+		// Stops their listeners
+		RWLock.Lock()
+		for _, node := range slave_connections {
+			node.removed = true
+		}
+		RWLock.Unlock()
+		restore()
+	}()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// Instances of a group share their name
+	first := dialIn(t, listener, "worker", "aaaa")
+	defer first.Close()
+	second := dialIn(t, listener, "worker", "bbbb")
+	defer second.Close()
+	older := dialIn(t, listener, "old", "")
+	defer older.Close()
+	for _, address := range []string{"dial-in/worker/aaaa", "dial-in/worker/bbbb", "dial-in/old"} {
+		if node := findNode(address); node == nil || !node.dialed_in || node.closed {
+			t.Errorf("%s not connected: %+v", address, node)
+		}
+	}
+
+	// The same instance dialing again replaces its connection
+	again := dialIn(t, listener, "worker", "aaaa")
+	defer again.Close()
+	RWLock.RLock()
+	count := len(slave_connections)
+	RWLock.RUnlock()
+	if count != 3 {
+		t.Errorf("%d slaves, expected 3", count)
+	}
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := first.Read(make([]byte, 1)); err == nil {
+		t.Error("old connection of the instance still open")
+	}
+
+	// A removed instance comes back to hand its schedules over and leave
+	membershipLock.Lock()
+	decommissioned["dial-in/worker/bbbb"] = true
+	membershipLock.Unlock()
+	defer func() {
+		membershipLock.Lock()
+		delete(decommissioned, "dial-in/worker/bbbb")
+		membershipLock.Unlock()
+	}()
+	back := dialIn(t, listener, "worker", "bbbb")
+	defer back.Close()
+	if node := findNode("dial-in/worker/bbbb"); node == nil || !node.draining || !node.evicting {
+		t.Errorf("removed instance back as %+v", node)
+	}
+}
+
+func TestDialInRefusedBySlave(t *testing.T) {
+	restore := withTerm(3)
+	defer restore()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	session, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acceptDialIn(session, session, "aaaa")
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(make([]byte, 8)); err == nil {
+		t.Errorf("a slave answered %d bytes", n)
+	}
+}
@@ -0,0 +1,424 @@
+package clustering
+
+import (
+	"conf"
+	"container/list"
+	"log"
+	"net"
+	"schedule"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Master failover. The master renews a lease on its slaves every
+// LEASE_RENEW_PERIOD with COMM_TYPE_MEMBERS, which also lists the slaves
+// and each slave's rank among them. A slave that hears nothing from the
+// master for cluster_failover_timeout, plus FAILOVER_STAGGER per rank, takes
+// over: it raises the term, becomes master and dials the other slaves and
+// the old master.
+//
+// The term rides along in the handshake. A slave refuses masters from an
+// older term than the one it follows and tells them the current term, so a
+// master coming back after a failover steps down and waits to be dialed
+// as a slave.
+//
+// A master that has not heard from a majority of the nodes able to take
+// over for half the failover timeout steps down before any of them can,
+// so a cut off master stops accepting and firing schedules next to the one
+// taking over. A master with a single slave able to take over never steps
+// down, it would have nobody to hand over to. It keeps the member list and ranks itself after every
+// slave, so it leads again when none of them took over.
+const (
+	LEASE_RENEW_PERIOD = 2 * time.Second
+	FAILOVER_STAGGER   = 5 * time.Second
+)
+
+var (
+	current_term      uint64           = 0
+	leader            bool             = false
+	members           []string         = nil // Slave addresses by rank, from the master
+	member_rank       int              = -1
+	master_address    string           = "" // Where the master listens as a slave
+	last_master_seen  time.Time        = time.Now()
+	follower_listener *net.TCPListener = nil
+	electionLock                       = new(sync.Mutex)
+)
+
+var startFollowing = new(sync.Once)
+
+func isLeader() bool {
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	return leader
+}
+
+// isLeading tells loops started for a term whether it is still on
+func isLeading(term uint64) bool {
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	return leader && current_term == term
+}
+
+func electionCapabilities() map[string]string {
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	return map[string]string{
+		"term": strconv.FormatUint(current_term, 10),
+		"port": strings.TrimPrefix(conf.GetNetworkPort(), ":"),
+	}
+}
+
+// Nodes without failover carry no term
+func peerTerm(caps map[string]string) uint64 {
+	term, _ := strconv.ParseUint(caps["term"], 10, 64)
+	return term
+}
+
+// staleMaster checks a slave's term in the master's handshake, a newer
+// one means another node took over
+func staleMaster(caps map[string]string) bool {
+	term := peerTerm(caps)
+
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	if term <= current_term {
+		return false
+	}
+	current_term = term
+	return true
+}
+
+// acceptMaster checks a master's term in the slave's handshake. Masters of
+// older terms are refused, and so are masters of the current term while
+// its master is still connected.
+func acceptMaster(conn net.Conn, caps map[string]string) bool {
+	term := peerTerm(caps)
+
+	RWLock.RLock()
+	connected := master_connection != nil && !master_connection.closed
+	RWLock.RUnlock()
+
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	if leader || term < current_term || (term == current_term && connected && term > 0) {
+		return false
+	}
+	current_term = term
+	last_master_seen = time.Now()
+
+	master_address = ""
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && caps["port"] != "" {
+		master_address = net.JoinHostPort(host, caps["port"])
+	}
+	return true
+}
+
+func touchMaster() {
+	electionLock.Lock()
+	last_master_seen = time.Now()
+	electionLock.Unlock()
+}
+
+func membersPayload(term uint64, rank int, addresses []string) []byte {
+	w := newPayload(COMM_TYPE_MEMBERS)
+	w.putInt64(int64(term))
+	w.putInt64(int64(rank))
+	w.putInt64(int64(len(addresses)))
+	for _, address := range addresses {
+		w.putString(address)
+	}
+	return w.Bytes()
+}
+
+func decodeMembers(payload []byte) (uint64, int, []string, error) {
+	r := newPayloadReader(payload)
+	term := r.getInt64()
+	rank := r.getInt64()
+	count := r.getInt64()
+	if r.err != nil || count < 0 || count > int64(len(payload)) {
+		return 0, 0, nil, Err_Invalid_Payload
+	}
+	addresses := make([]string, count)
+	for i := range addresses {
+		addresses[i] = r.getString()
+	}
+	return uint64(term), int(rank), addresses, r.err
+}
+
+func updateMembers(term uint64, rank int, addresses []string) {
+	membershipLock.Lock()
+	left := left_cluster
+	membershipLock.Unlock()
+	if left {
+		return
+	}
+
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	if term < current_term {
+		return
+	}
+	members = addresses
+	member_rank = rank
+}
+
+// renewLeases sends every slave the member list and its rank while this
+// node leads for term
+func renewLeases(term uint64) {
+	timeout := time.Duration(conf.GetClusterFailoverTimeout()) * time.Second
+	last_majority := time.Now()
+	for isLeading(term) {
+		RWLock.RLock()
+		nodes := make([]*Node, len(slave_connections))
+		copy(nodes, slave_connections)
+		RWLock.RUnlock()
+
+		// Ranks follow addresses, the ranking by load changes all the time.
+		// Slaves that dial in can't be dialed by a new master, they get no
+		// rank and never take over.
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].address < nodes[j].address })
+		addresses := make([]string, 0, len(nodes))
+		ranks := make(map[*Node]int)
+		for _, node := range nodes {
+			ranks[node] = -1
+			if !node.dialed_in {
+				ranks[node] = len(addresses)
+				addresses = append(addresses, node.address)
+			}
+		}
+
+		for _, node := range nodes {
+			RWLock.RLock()
+			v2 := node.version >= PROTOCOL_V2
+			RWLock.RUnlock()
+			if v2 {
+				sendToNode(node, membersPayload(term, ranks[node], addresses))
+			}
+		}
+
+		if timeout > 0 {
+			if !lostMajority(countVoters(nodes, ranks, timeout)) {
+				last_majority = time.Now()
+			} else if time.Since(last_majority) > timeout/2 {
+				resign(term, addresses)
+				return
+			}
+		}
+		time.Sleep(LEASE_RENEW_PERIOD)
+	}
+}
+
+// countVoters counts the nodes able to take over and those of them heard
+// from within half the failover timeout. Only ranked v2 slaves learn the
+// members and can take over, the master counts itself in both.
+func countVoters(nodes []*Node, ranks map[*Node]int, timeout time.Duration) (int, int) {
+	voters, reached := 1, 1
+	for _, node := range nodes {
+		RWLock.RLock()
+		v2 := node.version >= PROTOCOL_V2
+		closed := node.closed
+		RWLock.RUnlock()
+		if !v2 || ranks[node] < 0 {
+			continue
+		}
+		voters++
+		if _, silence := node.health.status(); !closed && silence < timeout/2 {
+			reached++
+		}
+	}
+	return voters, reached
+}
+
+// lostMajority tells whether a master reaching reached of voters has to
+// step down. With a single slave able to take over there is no majority to
+// lose: when that slave is gone nobody else can lead, so the master stays.
+func lostMajority(voters int, reached int) bool {
+	return voters > 2 && reached*2 <= voters
+}
+
+// resign steps down a master cut off from the majority of its members. It
+// ranks itself after them, so it only takes over again once none of them
+// did.
+func resign(term uint64, addresses []string) {
+	electionLock.Lock()
+	if !leader || current_term != term {
+		electionLock.Unlock()
+		return
+	}
+	members = append([]string{}, addresses...)
+	member_rank = len(addresses)
+	last_master_seen = time.Now()
+	electionLock.Unlock()
+
+	stepDown("Lost the majority of the cluster, stepping down from term " + strconv.FormatUint(term, 10))
+}
+
+// checkMasterLease takes over once the master has been silent for the
+// failover timeout plus this slave's stagger
+func checkMasterLease() {
+	timeout := time.Duration(conf.GetClusterFailoverTimeout()) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	electionLock.Lock()
+	expired := !leader && members != nil && member_rank >= 0 &&
+		time.Since(last_master_seen) > timeout+time.Duration(member_rank)*FAILOVER_STAGGER
+	electionLock.Unlock()
+
+	if expired {
+		promote()
+	}
+}
+
+// lead starts leading a new term, the configured master starts at term 1
+func lead() uint64 {
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	leader = true
+	current_term++
+	return current_term
+}
+
+// promote turns this slave into the master of a new term
+func promote() {
+	electionLock.Lock()
+	if leader {
+		electionLock.Unlock()
+		return
+	}
+	addresses := make([]string, 0, len(members))
+	for rank, address := range members {
+		if rank != member_rank {
+			addresses = append(addresses, address)
+		}
+	}
+	// A master that resigned ranks itself among the members
+	known := master_address == ""
+	for _, address := range addresses {
+		known = known || address == master_address
+	}
+	if !known {
+		addresses = append(addresses, master_address)
+	}
+	listener := follower_listener
+	follower_listener = nil
+	electionLock.Unlock()
+
+	term := lead()
+	log.Println("Master lost, taking over as master for term " + strconv.FormatUint(term, 10))
+
+	if listener != nil {
+		listener.Close()
+	}
+	disconnectMaster()
+	schedule.SetMasterReporter(nil)
+	schedule.SetFireGuard(nil)
+	leadSlaves(addresses, term)
+}
+
+// leadSlaves takes over the given slaves, they are dialed by
+// rediscoverSlaves
+func leadSlaves(addresses []string, term uint64) {
+	RWLock.Lock()
+	slave_connections = make(NodeQueue, len(addresses))
+	dropped_connections = list.New()
+	for i, address := range addresses {
+		node := newNode(address, 999999, i)
+		node.saved = 0
+		node.closed = true
+		slave_connections[i] = node
+		dropped_connections.PushBack(node)
+	}
+	RWLock.Unlock()
+
+	createComplexityRanking()
+	setupMasterPresence()
+	startLoopListener()
+	acceptAnnouncements()
+	rediscoverSlaves(0, term)
+	go renewLeases(term)
+	go heartbeatSlaves(term)
+}
+
+// stepDown gives up leading after another node took over or the majority
+// was lost, this node waits to be dialed by the new master
+func stepDown(reason string) {
+	electionLock.Lock()
+	if !leader {
+		electionLock.Unlock()
+		return
+	}
+	leader = false
+	electionLock.Unlock()
+
+	log.Println(reason)
+	stopAnnouncements()
+
+	RWLock.Lock()
+	nodes := slave_connections
+	slave_connections = nil
+	dropped_connections = nil
+	for _, node := range nodes {
+		node.removed = true
+		if !node.closed && node.conn != nil {
+			node.conn.Close()
+		}
+		node.closed = true
+	}
+	RWLock.Unlock()
+
+	for _, node := range nodes {
+		clearPresence(node)
+	}
+
+	if err := follow(); err != nil {
+		log.Println("Failed rejoining as slave: " + err.Error())
+	}
+}
+
+// follow listens for masters on the network port and sets this node up as
+// a slave
+func follow() error {
+	tcp, err := net.ResolveTCPAddr("tcp", conf.GetNetworkPort())
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenTCP("tcp", tcp)
+	if err != nil {
+		return err
+	}
+
+	electionLock.Lock()
+	leader = false
+	follower_listener = listener
+	electionLock.Unlock()
+
+	RWLock.Lock()
+	if master_connection == nil {
+		master_connection = newNode("", 0, 0)
+	}
+	master_connection.closed = true
+	RWLock.Unlock()
+
+	schedule.SetMasterReporter(sendMaster)
+	if conf.GetClusterReplicas() > 0 {
+		schedule.SetFireGuard(guardFire)
+	}
+	setupSlavePresence()
+	startFollowing.Do(func() {
+		go reportLoad()
+		if conf.GetClusterDialMaster() {
+			go dialMaster()
+		} else {
+			go announce()
+		}
+		rediscoverMasterConnection()
+		startPointListener()
+	})
+	go acceptMasters(listener)
+	return nil
+}
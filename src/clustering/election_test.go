@@ -0,0 +1,174 @@
+package clustering
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Ranked v2 slaves, the first silent ones cut off for as long as given
+func rankedSlaves(silent int, count int) ([]*Node, map[*Node]int) {
+	nodes := make([]*Node, count)
+	ranks := make(map[*Node]int)
+	for i := range nodes {
+		nodes[i] = newNode("10.0.0."+string(rune('1'+i))+":9090", 1, i)
+		nodes[i].version = PROTOCOL_V2
+		if i < silent {
+			nodes[i].health.last_seen = time.Now().Add(-time.Minute)
+		}
+		ranks[nodes[i]] = i
+	}
+	return nodes, ranks
+}
+
+func TestTwoNodesNeverResign(t *testing.T) {
+	nodes, ranks := rankedSlaves(1, 1)
+	voters, reached := countVoters(nodes, ranks, 30*time.Second)
+	if voters != 2 || reached != 1 {
+		t.Fatalf("%d voters, %d reached", voters, reached)
+	}
+	if lostMajority(voters, reached) {
+		t.Error("the master of two nodes resigned with nobody to take over")
+	}
+}
+
+func TestCutOffMasterResigns(t *testing.T) {
+	nodes, ranks := rankedSlaves(2, 2)
+	if voters, reached := countVoters(nodes, ranks, 30*time.Second); !lostMajority(voters, reached) {
+		t.Errorf("a master cut off from both slaves stays with %d of %d", reached, voters)
+	}
+
+	// One slave is enough for two of three
+	nodes, ranks = rankedSlaves(1, 2)
+	if voters, reached := countVoters(nodes, ranks, 30*time.Second); lostMajority(voters, reached) {
+		t.Errorf("a master reaching %d of %d resigned", reached, voters)
+	}
+
+	// Two of four is not a majority
+	nodes, ranks = rankedSlaves(2, 3)
+	if voters, reached := countVoters(nodes, ranks, 30*time.Second); !lostMajority(voters, reached) {
+		t.Errorf("a master reaching %d of %d stays", reached, voters)
+	}
+}
+
+// v1 and dialed in slaves can't take over, they don't vote. Closed ones do
+// but are not reached.
+func TestVoters(t *testing.T) {
+	nodes, ranks := rankedSlaves(0, 4)
+	nodes[0].closed = true
+	nodes[1].version = PROTOCOL_V1
+	ranks[nodes[2]] = -1
+
+	if voters, reached := countVoters(nodes, ranks, 30*time.Second); voters != 3 || reached != 2 {
+		t.Errorf("%d voters, %d reached, expected 3 and 2", voters, reached)
+	}
+}
+
+func TestMembersPayload(t *testing.T) {
+	addresses := []string{"10.0.0.1:9090", "10.0.0.2:9090", ""}
+	data := membersPayload(7, 1, addresses)
+	if data[0] != COMM_TYPE_MEMBERS {
+		t.Fatalf("type %d", data[0])
+	}
+	term, rank, decoded, err := decodeMembers(data[1:])
+	if err != nil || term != 7 || rank != 1 || strings.Join(decoded, ",") != strings.Join(addresses, ",") {
+		t.Errorf("term %d, rank %d, %v, %v", term, rank, decoded, err)
+	}
+
+	for _, cut := range []int{0, 10, 20, len(data) - 2} {
+		if _, _, _, err := decodeMembers(data[1 : 1+cut]); err != Err_Invalid_Payload {
+			t.Errorf("cut at %d: expected Err_Invalid_Payload, got %v", cut, err)
+		}
+	}
+
+	// A count past the payload is not allocated
+	w := newPayload(COMM_TYPE_MEMBERS)
+	w.putInt64(7)
+	w.putInt64(0)
+	w.putInt64(1 << 40)
+	if _, _, _, err := decodeMembers(w.Bytes()[1:]); err != Err_Invalid_Payload {
+		t.Errorf("huge count: expected Err_Invalid_Payload, got %v", err)
+	}
+}
+
+// withTerm runs a test at term as a slave, putting the election state back
+// after
+func withTerm(term uint64) func() {
+	electionLock.Lock()
+	old_term, old_leader, old_members, old_rank := current_term, leader, members, member_rank
+	current_term, leader = term, false
+	electionLock.Unlock()
+	old_master := master_connection
+	master_connection = newNode("", 0, 0)
+	master_connection.closed = true
+
+	return func() {
+		electionLock.Lock()
+		current_term, leader, members, member_rank = old_term, old_leader, old_members, old_rank
+		electionLock.Unlock()
+		master_connection = old_master
+	}
+}
+
+func TestMasterTerms(t *testing.T) {
+	restore := withTerm(5)
+	defer restore()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			defer conn.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if acceptMaster(conn, map[string]string{"term": "4", "port": "9191"}) {
+		t.Error("accepted a master of an older term")
+	}
+	if !acceptMaster(conn, map[string]string{"term": "5", "port": "9191"}) {
+		t.Error("refused the master of the current term")
+	}
+	if master_address != "127.0.0.1:9191" {
+		t.Errorf("master listens at %q as a slave", master_address)
+	}
+
+	// Another master of the term while the first is connected
+	master_connection.closed = false
+	if acceptMaster(conn, map[string]string{"term": "5"}) {
+		t.Error("accepted a second master of the term")
+	}
+	if !acceptMaster(conn, map[string]string{"term": "6"}) || current_term != 6 {
+		t.Errorf("refused a newer master, term %d", current_term)
+	}
+
+	// A master meeting a slave of a newer term learns it
+	if staleMaster(map[string]string{"term": "6"}) {
+		t.Error("stale at the same term")
+	}
+	if !staleMaster(map[string]string{"term": "8"}) || current_term != 8 {
+		t.Errorf("not stale behind a newer term, term %d", current_term)
+	}
+}
+
+func TestMembersFromOlderTerm(t *testing.T) {
+	restore := withTerm(5)
+	defer restore()
+
+	updateMembers(5, 1, []string{"a", "b"})
+	updateMembers(4, 0, []string{"old"})
+	electionLock.Lock()
+	defer electionLock.Unlock()
+	if member_rank != 1 || strings.Join(members, ",") != "a,b" {
+		t.Errorf("members %v, rank %d", members, member_rank)
+	}
+}
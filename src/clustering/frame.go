@@ -0,0 +1,316 @@
+package clustering
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"message"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Wire formats of the cluster link. The version is agreed in the handshake,
+// nodes that don't announce capabilities speak PROTOCOL_V1.
+//
+//	v1: int16 length | type | payload, message fields separated by newlines
+//	v2: uint32 length | type | uint64 frame id | payload, fields length
+//	    prefixed
+const (
+	PROTOCOL_V1      = 1
+	PROTOCOL_V2      = 2
+	PROTOCOL_VERSION = PROTOCOL_V2
+
+	V1_MAX_FRAME_SIZE = 32767
+	MAX_FRAME_SIZE    = 16 * 1024 * 1024
+)
+
+var (
+	Err_Frame_Too_Large = errors.New("Frame too large")
+	Err_Frame_Empty     = errors.New("Empty frame")
+	Err_Invalid_Payload = errors.New("Invalid payload")
+)
+
+type Frame struct {
+	Type    byte
+	Id      uint64 // Always 0 on v1 links
+	Payload []byte
+}
+
+// Seeded from the clock so request ids stay unique across master restarts,
+// slaves dedupe schedules on them
+var last_frame_id uint64 = uint64(time.Now().UnixNano())
+
+func nextFrameId() uint64 {
+	return atomic.AddUint64(&last_frame_id, 1)
+}
+
+// encodeFrame builds the bytes for one frame, data starts with the type
+func encodeFrame(version int, data []byte, id uint64) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, Err_Frame_Empty
+	}
+
+	if version < PROTOCOL_V2 {
+		if len(data) > V1_MAX_FRAME_SIZE {
+			return nil, Err_Frame_Too_Large
+		}
+		frame := make([]byte, 2+len(data))
+		binary.BigEndian.PutUint16(frame, uint16(len(data)))
+		copy(frame[2:], data)
+		return frame, nil
+	}
+
+	size := 1 + 8 + len(data) - 1
+	if size > MAX_FRAME_SIZE {
+		return nil, Err_Frame_Too_Large
+	}
+	frame := make([]byte, 4+size)
+	binary.BigEndian.PutUint32(frame, uint32(size))
+	frame[4] = data[0]
+	binary.BigEndian.PutUint64(frame[5:], id)
+	copy(frame[13:], data[1:])
+	return frame, nil
+}
+
+// readFrame reads one whole frame. Every frame gets its own buffer so
+// handlers running in other goroutines never share memory with the reader.
+func readFrame(version int, reader *bufio.Reader) (*Frame, error) {
+	var size int
+	if version < PROTOCOL_V2 {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, err
+		}
+		size = int(int16(binary.BigEndian.Uint16(header)))
+		if size < 1 {
+			return nil, Err_Frame_Empty
+		}
+	} else {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil, err
+		}
+		size = int(binary.BigEndian.Uint32(header))
+		if size > MAX_FRAME_SIZE {
+			return nil, Err_Frame_Too_Large
+		}
+		if size < 9 {
+			return nil, Err_Frame_Empty
+		}
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	if version < PROTOCOL_V2 {
+		return &Frame{body[0], 0, body[1:]}, nil
+	}
+	return &Frame{body[0], binary.BigEndian.Uint64(body[1:9]), body[9:]}, nil
+}
+
+// Capabilities are appended to the node name in the handshake after a NUL,
+// which v1 nodes take as part of the name:
+//
+//	Grandma-Sharon\x00proto=2,term=1,port=12345
+//
+// Names plus capabilities must stay under 64 bytes, the handshake buffer
+// of v1 nodes.
+func localCapabilities() map[string]string {
+	caps := map[string]string{"proto": strconv.Itoa(PROTOCOL_VERSION)}
+	for k, v := range electionCapabilities() {
+		caps[k] = v
+	}
+	return caps
+}
+
+func helloMessage(name string, caps map[string]string) []byte {
+	pairs := make([]string, 0, len(caps))
+	for k, v := range caps {
+		pairs = append(pairs, k+"="+v)
+	}
+	return []byte(name + "\x00" + strings.Join(pairs, ","))
+}
+
+func parseHello(data []byte) (string, map[string]string) {
+	caps := make(map[string]string)
+	parts := strings.SplitN(string(data), "\x00", 2)
+	if len(parts) < 2 {
+		return parts[0], caps
+	}
+	for _, pair := range strings.Split(parts[1], ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			caps[kv[0]] = kv[1]
+		} else if kv[0] != "" {
+			caps[kv[0]] = ""
+		}
+	}
+	return parts[0], caps
+}
+
+// negotiateVersion picks the highest version both ends speak
+func negotiateVersion(peer map[string]string) int {
+	version, err := strconv.Atoi(peer["proto"])
+	if err != nil || version < PROTOCOL_V1 {
+		return PROTOCOL_V1
+	}
+	if version > PROTOCOL_VERSION {
+		return PROTOCOL_VERSION
+	}
+	return version
+}
+
+// Typed payload fields for v2 frames
+type payloadWriter struct {
+	bytes.Buffer
+}
+
+func newPayload(comm_type byte) *payloadWriter {
+	w := new(payloadWriter)
+	w.WriteByte(comm_type)
+	return w
+}
+
+func (w *payloadWriter) putString(s string) {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(s)))
+	w.Write(length)
+	w.WriteString(s)
+}
+
+func (w *payloadWriter) putInt64(v int64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	w.Write(b)
+}
+
+type payloadReader struct {
+	reader *bytes.Reader
+	err    error
+}
+
+func newPayloadReader(payload []byte) *payloadReader {
+	return &payloadReader{bytes.NewReader(payload), nil}
+}
+
+func (r *payloadReader) getString() string {
+	if r.err != nil {
+		return ""
+	}
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r.reader, length); err != nil {
+		r.err = Err_Invalid_Payload
+		return ""
+	}
+	size := int(binary.BigEndian.Uint32(length))
+	if size > r.reader.Len() {
+		r.err = Err_Invalid_Payload
+		return ""
+	}
+	s := make([]byte, size)
+	io.ReadFull(r.reader, s)
+	return string(s)
+}
+
+func (r *payloadReader) getInt64() int64 {
+	if r.err != nil {
+		return 0
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r.reader, b); err != nil {
+		r.err = Err_Invalid_Payload
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// more tells whether fields are left, newer senders append optional ones
+func (r *payloadReader) more() bool {
+	return r.err == nil && r.reader.Len() > 0
+}
+
+// encodeSchedule builds a COMM_TYPE_SCHEDULE frame for a link version
+func encodeSchedule(version int, msg *message.Obj) []byte {
+	if version < PROTOCOL_V2 {
+		buffer := bytes.NewBuffer([]byte{COMM_TYPE_SCHEDULE})
+		buffer.Write(msg.GetMessagePayload())
+		return buffer.Bytes()
+	}
+
+	w := newPayload(COMM_TYPE_SCHEDULE)
+	w.putInt64(int64(msg.MessageType))
+	w.putString(msg.Endpoint)
+	w.putString(msg.MessageBody)
+	w.putInt64(msg.Expiration)
+	w.putInt64(int64(msg.Priority))
+	w.putString(msg.Tenant)
+	w.putInt64(msg.ValidUntil)
+	return w.Bytes()
+}
+
+func decodeSchedule(version int, payload []byte) (*message.Obj, error) {
+	if version < PROTOCOL_V2 {
+		return message.NewMessageFromPayload(payload)
+	}
+
+	r := newPayloadReader(payload)
+	msg_type := r.getInt64()
+	endpoint := r.getString()
+	body := r.getString()
+	expiration := r.getInt64()
+	priority := int64(message.PRIORITY_NORMAL)
+	if r.more() {
+		priority = r.getInt64()
+	}
+	tenant := ""
+	if r.more() {
+		tenant = r.getString()
+	}
+	var valid_until int64 = 0
+	if r.more() {
+		valid_until = r.getInt64()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	msg, err := message.NewMessageObject(int(msg_type), endpoint, body, expiration)
+	if err == nil {
+		msg.Priority = int(priority)
+		msg.Tenant = tenant
+		msg.ValidUntil = valid_until
+	}
+	return msg, err
+}
+
+// COMM_TYPE_CONSUMED carries the slave's schedule id
+func encodeConsumed(version int, schedule_id int) []byte {
+	if version < PROTOCOL_V2 {
+		data := make([]byte, 5)
+		data[0] = COMM_TYPE_CONSUMED
+		binary.LittleEndian.PutUint32(data[1:], uint32(int32(schedule_id)))
+		return data
+	}
+
+	w := newPayload(COMM_TYPE_CONSUMED)
+	w.putInt64(int64(schedule_id))
+	return w.Bytes()
+}
+
+func decodeConsumed(version int, payload []byte) (int, error) {
+	if version < PROTOCOL_V2 {
+		if len(payload) < 4 {
+			return -1, Err_Invalid_Payload
+		}
+		return int(int32(binary.LittleEndian.Uint32(payload))), nil
+	}
+
+	r := newPayloadReader(payload)
+	schedule_id := r.getInt64()
+	return int(schedule_id), r.err
+}
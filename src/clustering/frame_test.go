@@ -0,0 +1,214 @@
+package clustering
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"message"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, version := range []int{PROTOCOL_V1, PROTOCOL_V2} {
+		data := append([]byte{COMM_TYPE_SCHEDULE}, "payload"...)
+		encoded, err := encodeFrame(version, data, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := readFrame(version, bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		expected_id := uint64(42)
+		if version == PROTOCOL_V1 {
+			expected_id = 0
+		}
+		if frame.Type != COMM_TYPE_SCHEDULE || frame.Id != expected_id || string(frame.Payload) != "payload" {
+			t.Errorf("v%d frame came back as %+v", version, frame)
+		}
+	}
+}
+
+func TestFramesBackToBack(t *testing.T) {
+	stream := new(bytes.Buffer)
+	for id := uint64(1); id <= 3; id++ {
+		encoded, err := encodeFrame(PROTOCOL_V2, []byte{COMM_TYPE_HEARTBEAT, byte(id)}, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.Write(encoded)
+	}
+
+	reader := bufio.NewReader(stream)
+	first, _ := readFrame(PROTOCOL_V2, reader)
+	for id := uint64(1); id <= 3; id++ {
+		frame := first
+		if id > 1 {
+			frame, _ = readFrame(PROTOCOL_V2, reader)
+		}
+		if frame == nil || frame.Id != id || !bytes.Equal(frame.Payload, []byte{byte(id)}) {
+			t.Fatalf("frame %d came back as %+v", id, frame)
+		}
+	}
+	// Each frame has its own buffer, the reader can't overwrite it
+	if first.Payload[0] != 1 {
+		t.Error("first frame changed by later reads")
+	}
+	if _, err := readFrame(PROTOCOL_V2, reader); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+}
+
+func TestEncodeFrameLimits(t *testing.T) {
+	if _, err := encodeFrame(PROTOCOL_V2, nil, 1); err != Err_Frame_Empty {
+		t.Errorf("expected Err_Frame_Empty, got %v", err)
+	}
+	if _, err := encodeFrame(PROTOCOL_V1, make([]byte, V1_MAX_FRAME_SIZE+1), 0); err != Err_Frame_Too_Large {
+		t.Errorf("v1: expected Err_Frame_Too_Large, got %v", err)
+	}
+	if _, err := encodeFrame(PROTOCOL_V2, make([]byte, V1_MAX_FRAME_SIZE+1), 1); err != nil {
+		t.Errorf("v2 frames may be larger than v1 ones: %v", err)
+	}
+	if _, err := encodeFrame(PROTOCOL_V2, make([]byte, MAX_FRAME_SIZE), 1); err != Err_Frame_Too_Large {
+		t.Errorf("v2: expected Err_Frame_Too_Large, got %v", err)
+	}
+}
+
+func TestReadFrameRejects(t *testing.T) {
+	for name, c := range map[string]struct {
+		version int
+		data    []byte
+		err     error
+	}{
+		"v1 empty":     {PROTOCOL_V1, []byte{0, 0}, Err_Frame_Empty},
+		"v1 negative":  {PROTOCOL_V1, []byte{0x80, 0}, Err_Frame_Empty},
+		"v2 no id":     {PROTOCOL_V2, []byte{0, 0, 0, 8, COMM_TYPE_HEARTBEAT, 0, 0, 0, 0, 0, 0, 0}, Err_Frame_Empty},
+		"v2 too large": {PROTOCOL_V2, []byte{0x7f, 0, 0, 0}, Err_Frame_Too_Large},
+		"v2 torn":      {PROTOCOL_V2, []byte{0, 0, 0, 20, COMM_TYPE_HEARTBEAT, 0, 0}, io.ErrUnexpectedEOF},
+		"torn header":  {PROTOCOL_V2, []byte{0, 0}, io.ErrUnexpectedEOF},
+	} {
+		if _, err := readFrame(c.version, bufio.NewReader(bytes.NewReader(c.data))); err != c.err {
+			t.Errorf("%s: expected %v, got %v", name, c.err, err)
+		}
+	}
+}
+
+func TestPayloadFields(t *testing.T) {
+	w := newPayload(COMM_TYPE_WS_DELIVER)
+	w.putString("id")
+	w.putInt64(-7)
+	w.putString("")
+
+	data := w.Bytes()
+	if data[0] != COMM_TYPE_WS_DELIVER {
+		t.Fatalf("type %d", data[0])
+	}
+	r := newPayloadReader(data[1:])
+	if v := r.getString(); v != "id" {
+		t.Errorf("string %q", v)
+	}
+	if v := r.getInt64(); v != -7 {
+		t.Errorf("int64 %d", v)
+	}
+	if v := r.getString(); v != "" || r.more() {
+		t.Errorf("empty string %q, more %v", v, r.more())
+	}
+	if r.getInt64(); r.err != Err_Invalid_Payload {
+		t.Errorf("reading past the end: %v", r.err)
+	}
+
+	// A length past the payload
+	r = newPayloadReader([]byte{0, 0, 1, 0, 'a'})
+	if v := r.getString(); v != "" || r.err != Err_Invalid_Payload || r.more() {
+		t.Errorf("long string %q, %v", v, r.err)
+	}
+}
+
+func TestScheduleRoundTrip(t *testing.T) {
+	msg, err := message.NewMessageObject(message.S_REST_NOTIFICATION, "POST https://hooks.example.com/x application/json",
+		"{\n\"a\": 1}", 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Priority = message.PRIORITY_HIGH
+	msg.Tenant = "acme"
+	msg.ValidUntil = 1500000000000
+
+	for _, version := range []int{PROTOCOL_V1, PROTOCOL_V2} {
+		data := encodeSchedule(version, msg)
+		if data[0] != COMM_TYPE_SCHEDULE {
+			t.Fatalf("v%d type %d", version, data[0])
+		}
+		decoded, err := decodeSchedule(version, data[1:])
+		if err != nil {
+			t.Fatalf("v%d: %v", version, err)
+		}
+		if decoded.MessageType != msg.MessageType || decoded.Endpoint != msg.Endpoint ||
+			decoded.MessageBody != msg.MessageBody || decoded.Expiration != msg.Expiration {
+			t.Errorf("v%d schedule came back as %+v", version, decoded)
+		}
+		if version == PROTOCOL_V2 && (decoded.Priority != msg.Priority || decoded.Tenant != msg.Tenant ||
+			decoded.ValidUntil != msg.ValidUntil) {
+			t.Errorf("v2 dropped fields: %+v", decoded)
+		}
+	}
+}
+
+// Senders before priorities stop after the expiration
+func TestScheduleFromOlderSender(t *testing.T) {
+	w := newPayload(COMM_TYPE_SCHEDULE)
+	w.putInt64(int64(message.S_REST_NOTIFICATION))
+	w.putString("POST https://hooks.example.com/x application/json")
+	w.putString("body")
+	w.putInt64(5000)
+
+	msg, err := decodeSchedule(PROTOCOL_V2, w.Bytes()[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Priority != message.PRIORITY_NORMAL || msg.Tenant != "" || msg.ValidUntil != 0 {
+		t.Errorf("defaults not applied: %+v", msg)
+	}
+
+	if _, err := decodeSchedule(PROTOCOL_V2, w.Bytes()[1:20]); err != Err_Invalid_Payload {
+		t.Errorf("torn schedule: expected Err_Invalid_Payload, got %v", err)
+	}
+}
+
+func TestConsumedRoundTrip(t *testing.T) {
+	for _, version := range []int{PROTOCOL_V1, PROTOCOL_V2} {
+		data := encodeConsumed(version, 123456)
+		if id, err := decodeConsumed(version, data[1:]); err != nil || id != 123456 {
+			t.Errorf("v%d: schedule id %d, %v", version, id, err)
+		}
+	}
+	if _, err := decodeConsumed(PROTOCOL_V1, []byte{1, 2}); err != Err_Invalid_Payload {
+		t.Errorf("short v1 reply: expected Err_Invalid_Payload, got %v", err)
+	}
+}
+
+func TestHelloCapabilities(t *testing.T) {
+	name, caps := parseHello(helloMessage("Grandma-Sharon", map[string]string{"proto": "2", "term": "7"}))
+	if name != "Grandma-Sharon" || caps["proto"] != "2" || caps["term"] != "7" {
+		t.Errorf("hello came back as %s %v", name, caps)
+	}
+
+	// v1 nodes send their name only
+	if name, caps := parseHello([]byte("Grandma-Old")); name != "Grandma-Old" || len(caps) != 0 {
+		t.Errorf("v1 hello came back as %s %v", name, caps)
+	}
+	if len(helloMessage(strings.Repeat("n", 20), localCapabilities())) >= 64 {
+		t.Error("hello no longer fits the handshake buffer of v1 nodes")
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for proto, expected := range map[string]int{"": PROTOCOL_V1, "1": PROTOCOL_V1, "2": PROTOCOL_V2,
+		"9": PROTOCOL_VERSION, "x": PROTOCOL_V1, "-3": PROTOCOL_V1} {
+		if version := negotiateVersion(map[string]string{"proto": proto}); version != expected {
+			t.Errorf("proto %q: version %d, expected %d", proto, version, expected)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package clustering
+
+import (
+	"conf"
+	"log"
+	"sync"
+	"time"
+)
+
+// Failure detection. Every frame read from a node counts as a sign of
+// life. The master pings its slaves with COMM_TYPE_HEARTBEAT every
+// cluster_heartbeat_interval and v2 slaves answer with
+// COMM_TYPE_HEARTBEAT_ACK under the ping's frame id, which gives the round
+// trip time. Slaves send the master a heartbeat as often.
+//
+// A node silent for cluster_suspect_timeout is suspect and gets no new
+// schedules. Once silent for cluster_dead_timeout its connection is
+// dropped: the master dials the slave again through rediscoverSlaves, and
+// a slave frees the master's place so the master can dial back in. Without
+// it a half-open connection only shows on a failed write.
+const (
+	RTT_SMOOTHING = 8 // New samples weigh 1/8, as TCP's SRTT
+)
+
+type nodeHealth struct {
+	last_seen time.Time
+	suspect   bool
+	rtt       time.Duration // Smoothed, 0 while unknown
+	ping_id   uint64
+	ping_at   time.Time
+	answers   int
+	lock      *sync.Mutex
+}
+
+func newHealth() *nodeHealth {
+	return &nodeHealth{time.Now(), false, 0, 0, time.Time{}, 0, new(sync.Mutex)}
+}
+
+// reset starts over for a new connection
+func (h *nodeHealth) reset() {
+	h.lock.Lock()
+	h.last_seen = time.Now()
+	h.suspect = false
+	h.rtt = 0
+	h.ping_id = 0
+	h.answers = 0
+	h.lock.Unlock()
+}
+
+func (h *nodeHealth) seen() {
+	h.lock.Lock()
+	h.last_seen = time.Now()
+	h.lock.Unlock()
+}
+
+// ping notes a heartbeat sent, only the last one is timed
+func (h *nodeHealth) ping(id uint64) {
+	h.lock.Lock()
+	h.ping_id = id
+	h.ping_at = time.Now()
+	h.lock.Unlock()
+}
+
+func (h *nodeHealth) pong(id uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if id == 0 || id != h.ping_id {
+		return
+	}
+	h.ping_id = 0
+	h.answers++
+	if h.answers == 1 {
+		// The peer may still be setting up its reader
+		return
+	}
+	sample := time.Since(h.ping_at)
+	if h.rtt == 0 {
+		h.rtt = sample
+	} else {
+		h.rtt += (sample - h.rtt) / RTT_SMOOTHING
+	}
+}
+
+func (h *nodeHealth) isSuspect() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.suspect
+}
+
+// status returns the round trip time and how long the node has been silent
+func (h *nodeHealth) status() (time.Duration, time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.rtt, time.Since(h.last_seen)
+}
+
+// check updates the suspicion on the node and tells whether it is dead
+func (h *nodeHealth) check(name string) bool {
+	suspect_after := time.Duration(conf.GetClusterSuspectTimeout()) * time.Second
+	dead_after := time.Duration(conf.GetClusterDeadTimeout()) * time.Second
+
+	h.lock.Lock()
+	silence := time.Since(h.last_seen)
+	suspect := silence > suspect_after
+	if suspect != h.suspect {
+		if suspect {
+			log.Printf("%s is suspect, silent for %v", name, silence.Truncate(time.Millisecond))
+		} else {
+			log.Println(name + " is alive again")
+		}
+	}
+	h.suspect = suspect
+	h.lock.Unlock()
+
+	return dead_after > 0 && silence > dead_after
+}
+
+func heartbeatInterval() time.Duration {
+	return time.Duration(conf.GetClusterHeartbeatInterval()) * time.Second
+}
+
+// heartbeatSlaves pings the slaves and drops the dead ones while this node
+// leads for term
+func heartbeatSlaves(term uint64) {
+	for isLeading(term) {
+		heartbeatSlave()
+		time.Sleep(heartbeatInterval())
+	}
+}
+
+func heartbeatSlave() {
+	RWLock.RLock()
+	nodes := make([]*Node, len(slave_connections))
+	copy(nodes, slave_connections)
+	RWLock.RUnlock()
+
+	for _, node := range nodes {
+		RWLock.RLock()
+		closed := node.closed
+		index := node.index
+		RWLock.RUnlock()
+		if closed {
+			continue
+		}
+
+		if node.health.check("Slave " + node.address) {
+			log.Println("Slave " + node.address + " is dead, dropping its connection")
+			disconnectSlave(node)
+			continue
+		}
+
+		id := nextFrameId()
+		node.health.ping(id)
+		sendSlaveFrame([]byte{COMM_TYPE_HEARTBEAT}, index, id)
+	}
+}
+
+func heartbeatMaster() {
+	sendMaster([]byte{COMM_TYPE_HEARTBEAT})
+}
+
+// checkMaster drops the connection of a master gone silent, a master of
+// the current term is refused while it looks connected
+func checkMaster() {
+	RWLock.RLock()
+	closed := master_connection.closed || master_connection.conn == nil
+	health := master_connection.health
+	RWLock.RUnlock()
+
+	if !closed && health.check("Master") {
+		log.Println("Master is dead, dropping its connection")
+		disconnectMaster()
+	}
+}
+
+// answerHeartbeat echoes the master's ping, v1 frames carry no id to echo
+func answerHeartbeat(id uint64, version int) {
+	if version >= PROTOCOL_V2 {
+		sendMasterFrame([]byte{COMM_TYPE_HEARTBEAT_ACK}, id)
+	}
+}
@@ -0,0 +1,121 @@
+package clustering
+
+import (
+	"bufio"
+	"conf"
+	"net"
+	"testing"
+	"time"
+)
+
+// answered times a heartbeat answered after rtt
+func answered(h *nodeHealth, id uint64, rtt time.Duration) {
+	h.ping(id)
+	h.lock.Lock()
+	h.ping_at = time.Now().Add(-rtt)
+	h.lock.Unlock()
+	h.pong(id)
+}
+
+func TestRoundTripSmoothing(t *testing.T) {
+	h := newHealth()
+
+	// The first answer is not timed
+	answered(h, 1, time.Second)
+	if rtt, _ := h.status(); rtt != 0 {
+		t.Fatalf("first answer timed at %v", rtt)
+	}
+	answered(h, 2, 80*time.Millisecond)
+	if rtt, _ := h.status(); rtt < 80*time.Millisecond || rtt > 85*time.Millisecond {
+		t.Fatalf("rtt %v, expected the first sample", rtt)
+	}
+	answered(h, 3, 160*time.Millisecond)
+	if rtt, _ := h.status(); rtt < 90*time.Millisecond || rtt > 95*time.Millisecond {
+		t.Errorf("rtt %v, expected an eighth of the way to the sample", rtt)
+	}
+
+	// Late, repeated and id-less answers are ignored
+	h.ping(5)
+	before, _ := h.status()
+	for _, id := range []uint64{4, 3, 0} {
+		h.pong(id)
+	}
+	if rtt, _ := h.status(); rtt != before || h.ping_id != 5 {
+		t.Errorf("rtt %v, waiting for %d", rtt, h.ping_id)
+	}
+
+	h.reset()
+	if rtt, silence := h.status(); rtt != 0 || silence > time.Second || h.answers != 0 {
+		t.Errorf("rtt %v, silent for %v after a reset", rtt, silence)
+	}
+}
+
+func TestSilentNode(t *testing.T) {
+	suspect_after := time.Duration(conf.GetClusterSuspectTimeout()) * time.Second
+	dead_after := time.Duration(conf.GetClusterDeadTimeout()) * time.Second
+	h := newHealth()
+
+	for name, c := range map[string]struct {
+		silence time.Duration
+		suspect bool
+		dead    bool
+	}{
+		"alive":   {0, false, false},
+		"suspect": {suspect_after + time.Second, true, false},
+		"dead":    {dead_after + time.Second, true, true},
+	} {
+		h.lock.Lock()
+		h.last_seen = time.Now().Add(-c.silence)
+		h.lock.Unlock()
+		if dead := h.check("node"); dead != c.dead || h.isSuspect() != c.suspect {
+			t.Errorf("%s: dead %v, suspect %v", name, dead, h.isSuspect())
+		}
+	}
+
+	h.seen()
+	if h.check("node") || h.isSuspect() {
+		t.Error("still suspect after a frame")
+	}
+}
+
+func TestHeartbeatSlave(t *testing.T) {
+	nodes, restore := withSlaves(0, 0)
+	defer restore()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	nodes[0].attach(local, nodes[0].name, PROTOCOL_V2)
+
+	// The closed one is skipped
+	nodes[1].closed = true
+	go heartbeatSlave()
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	frame, err := readFrame(PROTOCOL_V2, bufio.NewReader(remote))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].health.lock.Lock()
+	ping_id := nodes[0].health.ping_id
+	nodes[0].health.lock.Unlock()
+	if frame.Type != COMM_TYPE_HEARTBEAT || frame.Id == 0 || frame.Id != ping_id {
+		t.Errorf("ping %+v, waiting for %d", frame, ping_id)
+	}
+}
+
+func TestAnswerHeartbeat(t *testing.T) {
+	master, restore := withMaster()
+	defer restore()
+
+	// v1 masters get no answer, the v2 ping comes right after
+	go func() {
+		answerHeartbeat(0, PROTOCOL_V1)
+		answerHeartbeat(31, PROTOCOL_V2)
+	}()
+	frame, err := readFrame(PROTOCOL_V2, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != COMM_TYPE_HEARTBEAT_ACK || frame.Id != 31 {
+		t.Errorf("answered with %+v", frame)
+	}
+}
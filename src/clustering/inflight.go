@@ -0,0 +1,270 @@
+package clustering
+
+import (
+	"errors"
+	"log"
+	"message"
+	"schedule"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Schedules sent to slaves are tracked by request id, the frame id, until
+// the slave answers:
+//
+//	master: COMM_TYPE_SCHEDULE      frame id = request id
+//	slave:  COMM_TYPE_CONSUMED      same frame id, slave's schedule id
+//	        ERR_CONSUME_MESSAGE     same frame id, nothing scheduled
+//
+// A request not answered in time is sent again with the same id. Slaves
+// remember the ids they scheduled and answer a repeat with the schedule
+// they already made, so a message is scheduled once however often it's
+// sent. v1 links carry no ids: replies go to the node's oldest request and
+// nothing is sent again.
+//
+// A request still unanswered after SLAVE_SEND_ATTEMPTS may be scheduled, it
+// fails with Err_Distribute_Pending and is sent again in the background,
+// including after the slave reconnects, for PENDING_REQUEST_TTL. A message
+// the slave then refuses is scheduled on the master.
+const (
+	SLAVE_REPLY_TIMEOUT = 3 * time.Second
+	SLAVE_SEND_ATTEMPTS = 3
+	HANDLED_REQUEST_TTL = 10 * time.Minute
+	PENDING_REQUEST_TTL = HANDLED_REQUEST_TTL / 2 // Slaves still know the id
+)
+
+var (
+	Err_Slave_Rejected    = errors.New("Slave failed to schedule message")
+	Err_Slave_Unreachable = errors.New("Slave unreachable")
+	Err_Slave_Too_Old     = errors.New("Slave protocol can't carry the message")
+)
+
+type slaveReply struct {
+	schedule_id int
+	err         error
+}
+
+type inflightRequest struct {
+	node  *Node
+	msg   *message.Obj
+	sent  time.Time
+	reply chan slaveReply
+}
+
+// Requests waiting for a slave, only used on the master
+var inflight = make(map[uint64]*inflightRequest)
+var inflightLock = new(sync.Mutex)
+
+// scheduleOnSlave sends msg to node and waits for the schedule id
+func scheduleOnSlave(node *Node, msg *message.Obj) (int, error) {
+	RWLock.RLock()
+	version := node.version
+	name := node.name
+	RWLock.RUnlock()
+	if version < PROTOCOL_V2 && !msg.FitsV1Payload() {
+		return -1, Err_Slave_Too_Old
+	}
+
+	id := nextFrameId()
+	req := &inflightRequest{node, msg, time.Now(), make(chan slaveReply, 1)}
+
+	inflightLock.Lock()
+	inflight[id] = req
+	inflightLock.Unlock()
+
+	attempts := SLAVE_SEND_ATTEMPTS
+	if version < PROTOCOL_V2 {
+		attempts = 1
+	}
+
+	data := encodeSchedule(version, msg)
+	for i := 0; i < attempts; i++ {
+		RWLock.RLock()
+		index := node.index
+		closed := node.closed
+		RWLock.RUnlock()
+		if closed && i == 0 {
+			forgetRequest(id)
+			return -1, Err_Slave_Unreachable
+		} else if closed {
+			break
+		}
+
+		// A failed first write leaves at most part of a frame, which the
+		// slave drops with the connection, so the message can go elsewhere
+		if _, err := sendSlaveFrame(data, index, id); err != nil && i == 0 {
+			forgetRequest(id)
+			return -1, Err_Slave_Unreachable
+		} else if err != nil {
+			break
+		}
+
+		select {
+		case reply := <-req.reply:
+			if reply.err == nil {
+				node.adjust(1)
+			}
+			return reply.schedule_id, reply.err
+		case <-time.After(SLAVE_REPLY_TIMEOUT):
+			log.Println("No reply from slave " + name + " for request " + strconv.FormatUint(id, 10))
+		}
+	}
+
+	if version < PROTOCOL_V2 {
+		forgetRequest(id)
+	} else {
+		go resolvePending(node, id, req, data)
+	}
+	return -1, Err_Distribute_Pending
+}
+
+func forgetRequest(id uint64) {
+	inflightLock.Lock()
+	delete(inflight, id)
+	inflightLock.Unlock()
+}
+
+// resolvePending sends a request the slave left unanswered again until the
+// slave answers or may have forgotten its id
+func resolvePending(node *Node, id uint64, req *inflightRequest, data []byte) {
+	defer forgetRequest(id)
+	request := strconv.FormatUint(id, 10)
+
+	for time.Since(req.sent) < PENDING_REQUEST_TTL {
+		select {
+		case reply := <-req.reply:
+			if reply.err == nil {
+				log.Println("Slave " + node.address + " confirmed pending request " + request)
+				node.adjust(1)
+				replicateSchedule(node, reply.schedule_id, req.msg)
+				return
+			}
+			log.Println("Slave " + node.address + " refused pending request " + request + ", scheduling on master")
+			if _, err := schedule.NewSchedule(req.msg); err != nil {
+				log.Println("Failed scheduling message to " + req.msg.Target() + ": " + err.Error())
+			}
+			return
+		case <-time.After(SLAVE_REPLY_TIMEOUT):
+		}
+
+		RWLock.RLock()
+		index := node.index
+		closed := node.closed
+		removed := node.removed
+		RWLock.RUnlock()
+		if removed {
+			break
+		}
+		if !closed {
+			sendSlaveFrame(data, index, id)
+		}
+	}
+	log.Println("Slave " + node.address + " never answered request " + request + ", the message to " +
+		req.msg.Target() + " may not be scheduled")
+}
+
+// answerRequest hands a slave's reply to the waiting request. Replies
+// without an id, from v1 slaves, go to the node's oldest request. The
+// replicas of the schedule are picked before the reply is read on.
+func answerRequest(node *Node, id uint64, reply slaveReply) {
+	inflightLock.Lock()
+	req, ok := inflight[id]
+	if id == 0 {
+		for req_id, r := range inflight {
+			if r.node == node && (!ok || r.sent.Before(req.sent)) {
+				id, req, ok = req_id, r, true
+			}
+		}
+	}
+	if ok && req.node == node {
+		delete(inflight, id)
+	} else {
+		ok = false
+	}
+	inflightLock.Unlock()
+
+	if !ok {
+		log.Println("Reply from slave " + node.name + " for unknown request " + strconv.FormatUint(id, 10))
+		return
+	}
+	if reply.err == nil {
+		recordReplicas(node, reply.schedule_id, req.msg)
+	}
+	req.reply <- reply
+}
+
+type handledRequest struct {
+	done  chan bool // Closed once reply is set
+	reply []byte
+	at    time.Time
+}
+
+// Requests this slave scheduled, by request id
+var handled = make(map[uint64]*handledRequest)
+var handledLock = new(sync.Mutex)
+var last_handled_sweep = time.Now()
+
+func consumeLevel1Calls(frame *Frame, version int) {
+	log.Println("comsuming message...")
+	if version < PROTOCOL_V2 {
+		sendMasterFrame(scheduleFromMaster(frame.Payload, version), frame.Id)
+		return
+	}
+
+	handledLock.Lock()
+	sweepHandled()
+	req, seen := handled[frame.Id]
+	if !seen {
+		req = &handledRequest{make(chan bool), nil, time.Now()}
+		handled[frame.Id] = req
+	}
+	handledLock.Unlock()
+
+	if seen {
+		// The first attempt may still be running
+		<-req.done
+		log.Println("Request " + strconv.FormatUint(frame.Id, 10) + " already handled, answering again")
+		sendMasterFrame(req.reply, frame.Id)
+		return
+	}
+
+	req.reply = scheduleFromMaster(frame.Payload, version)
+	close(req.done)
+	if req.reply[0] == ERR_CONSUME_MESSAGE[0] {
+		// Nothing was scheduled, a retry may try again
+		handledLock.Lock()
+		delete(handled, frame.Id)
+		handledLock.Unlock()
+	}
+	sendMasterFrame(req.reply, frame.Id)
+}
+
+func scheduleFromMaster(payload []byte, version int) []byte {
+	msg, err := decodeSchedule(version, payload)
+	if err != nil {
+		return ERR_CONSUME_MESSAGE
+	}
+
+	s, err := schedule.NewSchedule(msg)
+	if err != nil {
+		return ERR_CONSUME_MESSAGE
+	}
+	return encodeConsumed(version, s.Id)
+}
+
+// sweepHandled forgets requests the master stopped retrying long ago, the
+// caller holds handledLock
+func sweepHandled() {
+	if time.Since(last_handled_sweep) < time.Minute {
+		return
+	}
+	last_handled_sweep = time.Now()
+
+	cutoff := time.Now().Add(-HANDLED_REQUEST_TTL)
+	for id, req := range handled {
+		if req.at.Before(cutoff) {
+			delete(handled, id)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package clustering
+
+import (
+	"bufio"
+	"message"
+	"net"
+	"testing"
+	"time"
+)
+
+// Nodes before v2 split the schedule payload on every newline
+func TestNewlinesNotSentToV1Slaves(t *testing.T) {
+	node := newNode("10.0.2.1:9090", 0, 0)
+	for _, msg := range []*message.Obj{
+		{MessageType: message.S_REST_NOTIFICATION, Endpoint: "{\"url\": \"https://hooks.example.com/x\",\n\"method\": \"PUT\"}",
+			MessageBody: "m", Expiration: 5000},
+		{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST https://hooks.example.com/x text/plain",
+			MessageBody: "line 1\nline 2", Expiration: 5000},
+	} {
+		if _, err := scheduleOnSlave(node, msg); err != Err_Slave_Too_Old {
+			t.Errorf("%q: expected Err_Slave_Too_Old, got %v", msg.Endpoint, err)
+		}
+	}
+
+	inflightLock.Lock()
+	left := len(inflight)
+	inflightLock.Unlock()
+	if left != 0 {
+		t.Errorf("%d requests left in flight", left)
+	}
+}
+
+// withMaster connects this node to a fake master until the returned
+// function puts the old link back
+func withMaster() (*bufio.Reader, func()) {
+	old := master_connection
+	local, remote := net.Pipe()
+	master_connection = newNode("10.0.2.100:9090", 0, 0)
+	master_connection.attach(local, "master", PROTOCOL_V2)
+	return bufio.NewReader(remote), func() {
+		local.Close()
+		remote.Close()
+		master_connection = old
+	}
+}
+
+func TestResentRequestAnsweredAgain(t *testing.T) {
+	master, restore := withMaster()
+	defer restore()
+
+	// The first attempt scheduled the message, its reply was lost
+	done := make(chan bool)
+	close(done)
+	handledLock.Lock()
+	handled[77] = &handledRequest{done, encodeConsumed(PROTOCOL_V2, 1234), time.Now()}
+	handledLock.Unlock()
+	defer forgetHandled(77)
+
+	go consumeLevel1Calls(&Frame{COMM_TYPE_SCHEDULE, 77, []byte("not scheduled again")}, PROTOCOL_V2)
+	frame, err := readFrame(PROTOCOL_V2, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := decodeConsumed(PROTOCOL_V2, frame.Payload); frame.Id != 77 || id != 1234 || err != nil {
+		t.Errorf("answered request %d with schedule %d, %v", frame.Id, id, err)
+	}
+}
+
+func TestResentRequestWaitsForTheFirst(t *testing.T) {
+	master, restore := withMaster()
+	defer restore()
+
+	req := &handledRequest{make(chan bool), nil, time.Now()}
+	handledLock.Lock()
+	handled[78] = req
+	handledLock.Unlock()
+	defer forgetHandled(78)
+
+	answered := make(chan *Frame, 1)
+	go consumeLevel1Calls(&Frame{COMM_TYPE_SCHEDULE, 78, nil}, PROTOCOL_V2)
+	go func() {
+		frame, _ := readFrame(PROTOCOL_V2, master)
+		answered <- frame
+	}()
+
+	select {
+	case frame := <-answered:
+		t.Fatalf("answered %+v before the first attempt finished", frame)
+	case <-time.After(50 * time.Millisecond):
+	}
+	req.reply = encodeConsumed(PROTOCOL_V2, 99)
+	close(req.done)
+	if frame := <-answered; frame == nil || frame.Id != 78 {
+		t.Errorf("answered %+v", frame)
+	}
+}
+
+func forgetHandled(id uint64) {
+	handledLock.Lock()
+	delete(handled, id)
+	handledLock.Unlock()
+}
+
+func TestAnswerRequest(t *testing.T) {
+	node := newNode("10.0.2.2:9090", 0, 0)
+	other := newNode("10.0.2.3:9090", 0, 1)
+	msg := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST https://hooks.example.com/x text/plain"}
+	older := &inflightRequest{node, msg, time.Now().Add(-time.Second), make(chan slaveReply, 1)}
+	newer := &inflightRequest{node, msg, time.Now(), make(chan slaveReply, 1)}
+
+	inflightLock.Lock()
+	inflight[501] = older
+	inflight[502] = newer
+	inflightLock.Unlock()
+	defer forgetRequest(501)
+	defer forgetRequest(502)
+
+	// Only the node a request went to answers it
+	answerRequest(other, 502, slaveReply{1, nil})
+	select {
+	case reply := <-newer.reply:
+		t.Errorf("took %+v from another node", reply)
+	default:
+	}
+
+	answerRequest(node, 502, slaveReply{2, nil})
+	if reply := <-newer.reply; reply.schedule_id != 2 {
+		t.Errorf("reply %+v", reply)
+	}
+
+	// v1 replies carry no id, they go to the node's oldest request
+	inflightLock.Lock()
+	inflight[503] = newer
+	inflightLock.Unlock()
+	defer forgetRequest(503)
+	answerRequest(node, 0, slaveReply{3, nil})
+	if reply := <-older.reply; reply.schedule_id != 3 {
+		t.Errorf("reply %+v", reply)
+	}
+
+	inflightLock.Lock()
+	_, answered := inflight[501]
+	_, waiting := inflight[503]
+	inflightLock.Unlock()
+	if answered || !waiting {
+		t.Error("answered requests must go, the others stay")
+	}
+}
+
+func TestScheduleOnSlave(t *testing.T) {
+	nodes, restore := withSlaves(0)
+	defer restore()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	nodes[0].attach(local, "slave-1", PROTOCOL_V2)
+
+	go func() {
+		frame, err := readFrame(PROTOCOL_V2, bufio.NewReader(remote))
+		if err != nil {
+			return
+		}
+		msg, _ := decodeSchedule(PROTOCOL_V2, frame.Payload)
+		if msg != nil && msg.MessageBody == "line 1\nline 2" {
+			answerRequest(nodes[0], frame.Id, slaveReply{4321, nil})
+		}
+	}()
+
+	msg := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST https://hooks.example.com/x text/plain",
+		MessageBody: "line 1\nline 2", Expiration: 5000}
+	id, err := scheduleOnSlave(nodes[0], msg)
+	if err != nil || id != 4321 {
+		t.Errorf("schedule %d, %v", id, err)
+	}
+	if nodes[0].complexity != 1 {
+		t.Errorf("slave load %d, expected the schedule counted", nodes[0].complexity)
+	}
+}
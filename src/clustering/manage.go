@@ -18,112 +18,125 @@ const (
 	COMM_TYPE_SCHEDULE  byte = 151
 	COMM_TYPE_FINISHED  byte = 152
 	COMM_TYPE_HEARTBEAT byte = 153
+
+	COMM_TYPE_WS_PRESENCE byte = 154
+	COMM_TYPE_WS_FORWARD  byte = 155
+	COMM_TYPE_WS_DELIVER  byte = 156
+	COMM_TYPE_WS_STATUS   byte = 157
+
+	COMM_TYPE_LOAD    byte = 158
+	COMM_TYPE_MEMBERS byte = 159
+
+	COMM_TYPE_REPLICA      byte = 160
+	COMM_TYPE_REPLICA_DROP byte = 161
+	COMM_TYPE_TAKEOVER     byte = 162
+	COMM_TYPE_CLAIM        byte = 163
+
+	COMM_TYPE_HANDOFF      byte = 164
+	COMM_TYPE_HANDOFF_DONE byte = 165
+	COMM_TYPE_DECOMMISSION byte = 166
+	COMM_TYPE_ANNOUNCE     byte = 167
+
+	COMM_TYPE_HEARTBEAT_ACK byte = 168
+	COMM_TYPE_DIAL_IN       byte = 169
 )
 
 var (
-	Err_Distribute_Timeout  = errors.New("Distribute to slave timeout")
+	Err_Distribute_Pending  = errors.New("Slave has not confirmed the schedule yet, don't send it again")
 	Err_Distribute_Internal = errors.New("Distribute to slave internal error")
 )
 
+// NodeQueue is ordered by complexity with drained slaves last, callers of
+// the heap functions hold RWLock
 func (nq NodeQueue) Less(i, j int) bool {
-	RWLock.RLock()
-	first := nq[i].complexity
-	second := nq[j].complexity
-	RWLock.RUnlock()
-
-	return first < second
+	if nq[i].draining != nq[j].draining {
+		return nq[j].draining
+	}
+	return nq[i].complexity < nq[j].complexity
 }
 
 func (nq NodeQueue) Len() int {
-	RWLock.RLock()
-	length := len(nq)
-	RWLock.RUnlock()
-	return length
+	return len(nq)
 }
 
 func (nq NodeQueue) Swap(i, j int) {
-	RWLock.Lock()
-	temp := nq[i]
-	nq[i] = nq[j]
-	nq[j] = temp
-	nq[i].index = j
-	nq[j].index = i
-	RWLock.Unlock()
+	nq[i], nq[j] = nq[j], nq[i]
+	nq[i].index = i
+	nq[j].index = j
 }
 
-func (nq NodeQueue) Push(x interface{}) {
-	return
+func (nq *NodeQueue) Push(x interface{}) {
+	node := x.(*Node)
+	node.index = len(*nq)
+	*nq = append(*nq, node)
 }
 
-func (nq NodeQueue) Pop() interface{} {
-	return nil
+func (nq *NodeQueue) Pop() interface{} {
+	old := *nq
+	node := old[len(old)-1]
+	*nq = old[:len(old)-1]
+	node.index = -1
+	return node
 }
 
-func (n *Node) update(complexity uint, position int) {
+// update sets a slave's complexity, its pending schedule count, and moves
+// it in the ranking
+func (n *Node) update(complexity uint) {
 	RWLock.Lock()
 	n.complexity = complexity
-	heap.Fix(slave_connections, position)
+	n.fix()
 	RWLock.Unlock()
 }
 
-func createComplexityRanking() {
-	heap.Init(slave_connections)
+// adjust counts schedules placed on or fired by a slave between its load
+// reports
+func (n *Node) adjust(delta int) {
+	RWLock.Lock()
+	if !n.closed {
+		complexity := int(n.complexity) + delta
+		if complexity < 0 {
+			complexity = 0
+		}
+		n.complexity = uint(complexity)
+		n.fix()
+	}
+	RWLock.Unlock()
 }
 
-func distLevel1Calls(msg *message.Obj, node_index ...int) (int, error) {
-	var node *Node = nil
-	var index int = 0
-
-	log.Printf("Distribute level 1 at slave %d with address %s", index, node)
-	master_complexity := master_connection.complexity
-
-	if node == nil || node.closed || node.complexity > master_complexity {
-		log.Println("Scheduled on master")
-		s, err := schedule.NewSchedule(msg)
-		master_connection.complexity = master_complexity + 3
-		go func() {
-			select {
-			case <-s.Signal:
-				master_connection.complexity = master_complexity - 3
-				break
-			}
-		}()
-		return s.Id, err
-	} else {
-		log.Println("Preparing to send to slave")
-		pushToSend(msg)
-		return 1, nil
+// fix restores the ranking after a complexity change, the caller holds
+// RWLock
+func (n *Node) fix() {
+	if n.index >= 0 && n.index < len(slave_connections) && slave_connections[n.index] == n {
+		heap.Fix(&slave_connections, n.index)
 	}
+}
 
-	return -1, Err_Distribute_Internal
+func createComplexityRanking() {
+	RWLock.Lock()
+	heap.Init(&slave_connections)
+	RWLock.Unlock()
 }
 
-func consumeLevel1Calls(payload []byte) {
-	log.Println("comsuming message...")
-	msg, err := message.NewMessageFromPayload(payload)
-	if err != nil {
-		sendMaster(ERR_CONSUME_MESSAGE)
+func distLevel1Calls(msg *message.Obj, node_index ...int) (int, error) {
+	node := placeSchedule(msg)
+	if node != nil {
+		log.Println("Preparing to send to slave " + node.address)
+		id, err := scheduleOnSlave(node, msg)
+		if err == nil {
+			replicateSchedule(node, id, msg)
+		}
+		if err != Err_Slave_Unreachable && err != Err_Slave_Too_Old {
+			return id, err
+		}
+		log.Println("Slave " + node.address + ": " + err.Error() + ", scheduling on master")
 	}
 
-	_, err = schedule.NewSchedule(msg)
+	log.Println("Scheduled on master")
+	s, err := schedule.NewSchedule(msg)
 	if err != nil {
-		sendMaster(ERR_CONSUME_MESSAGE)
+		return -1, err
 	}
-}
-
-func distLevel2Calls(msg *message.Obj) (int, error) {
-	s, err := schedule.NewSchedule(msg)
-	master_complexity := master_connection.complexity
-	master_connection.complexity = master_complexity + 3
-	go func() {
-		select {
-		case <-s.Signal:
-			master_connection.complexity = master_complexity + 3
-			log.Println(master_connection.complexity)
-			break
-		}
-	}()
-	return s.Id, err
+	return s.Id, nil
 }
 
 func distBigDataCalls(content io.Reader) (int, error) {
@@ -0,0 +1,808 @@
+package clustering
+
+import (
+	"bufio"
+	"conf"
+	"container/heap"
+	"container/list"
+	"errors"
+	"io"
+	"log"
+	"message"
+	"net"
+	"schedule"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cluster membership changes at runtime. Slaves are added by the admin
+// API or announce themselves to the master given in cluster_master, the
+// master then dials them like the slaves in slave_list:
+//
+//	slave:  COMM_TYPE_ANNOUNCE      the slave's network port, on a short
+//	                                lived connection to the master's
+//	                                network_port
+//	master: 205 | nonce             with a secret, see challengeMaster
+//	slave:  HMAC("announce", nonce)
+//	master: 200 or 203
+//
+// Without a secret only cluster_tls vouches for the slave, with neither
+// announcements are refused. At most MAX_PENDING_ANNOUNCED announced slaves
+// wait for their first connection at a time.
+//
+// A drained slave gets no new schedules. Decommissioning drains it and
+// moves its pending schedules to other nodes before it leaves:
+//
+//	master: COMM_TYPE_HANDOFF       asks for up to a number of pending
+//	                                schedules, 0 for all
+//	slave:  COMM_TYPE_HANDOFF       same frame id, the schedules
+//	master: COMM_TYPE_HANDOFF_DONE  same frame id, the ids placed elsewhere
+//	master: COMM_TYPE_DECOMMISSION  the slave leaves, it won't take over
+//	                                or announce itself again
+//
+// Schedules move in batches of HANDOFF_BATCH. The master places a batch
+// within HANDOFF_TIMEOUT and confirms what it placed, the slave waits twice
+// as long before keeping the batch, so it never fires a schedule that was
+// moved. Schedules the master could not place stay with the slave, which
+// is kept drained. A decommissioned slave that announces itself again, say after a
+// forced removal, hands over the schedules it kept and is removed again.
+const (
+	HANDOFF_TIMEOUT  = 30 * time.Second
+	HANDOFF_BATCH    = 200
+	ANNOUNCE_PERIOD  = 10 * time.Second
+	ANNOUNCE_TIMEOUT = 5 * time.Second
+	MAX_ANNOUNCE     = 512
+
+	MAX_PENDING_ANNOUNCED = 16
+)
+
+const (
+	NODE_STATE_CONNECTED    = "connected"
+	NODE_STATE_DISCONNECTED = "disconnected"
+	NODE_STATE_DRAINING     = "draining"
+	NODE_STATE_LEAVING      = "leaving"
+	NODE_STATE_SUSPECT      = "suspect"
+)
+
+var (
+	Err_Not_Master          = errors.New("This node is not the master")
+	Err_Unknown_Node        = errors.New("No such node in the cluster")
+	Err_Node_Exists         = errors.New("Node is already in the cluster")
+	Err_Handoff_Unsupported = errors.New("Slave can't hand off its schedules")
+	Err_Handoff_Timeout     = errors.New("Slave did not hand off its schedules in time")
+	Err_Handoff_Incomplete  = errors.New("Some schedules could not be placed elsewhere")
+	Err_Too_Many_Announced  = errors.New("Too many announced slaves are waiting to connect")
+)
+
+// NodeInfo describes a slave for the admin API
+type NodeInfo struct {
+	Address string  `json:"address"`
+	Name    string  `json:"name"`
+	State   string  `json:"state"`
+	Load    uint    `json:"load"`
+	RTT     float64 `json:"rtt_ms"`       // Heartbeat round trip, 0 if unknown
+	Silence int64   `json:"last_seen_ms"` // Since the last frame from it
+}
+
+var (
+	decommissioned                     = make(map[string]bool) // Addresses refused, on the master
+	left_cluster                       = false                 // Set on a decommissioned slave
+	announce_listener *net.TCPListener = nil
+	membershipLock                     = new(sync.Mutex)
+	announceLock                       = new(sync.Mutex) // Keeps MAX_PENDING_ANNOUNCED
+)
+
+var (
+	handoff_waiters = make(map[uint64]chan []*message.Obj)
+	handoff_done    = make(map[uint64]chan []int)
+	handoffLock     = new(sync.Mutex)
+)
+
+// Nodes lists the slaves of the cluster
+func Nodes() ([]NodeInfo, error) {
+	if !isLeader() {
+		return nil, Err_Not_Master
+	}
+
+	RWLock.RLock()
+	defer RWLock.RUnlock()
+	nodes := make([]NodeInfo, len(slave_connections))
+	for i, node := range slave_connections {
+		state := NODE_STATE_CONNECTED
+		if node.evicting {
+			state = NODE_STATE_LEAVING
+		} else if node.draining {
+			state = NODE_STATE_DRAINING
+		} else if node.closed {
+			state = NODE_STATE_DISCONNECTED
+		} else if node.health.isSuspect() {
+			state = NODE_STATE_SUSPECT
+		}
+		load := node.complexity
+		if node.closed {
+			load = node.saved
+		}
+		rtt, silence := node.health.status()
+		nodes[i] = NodeInfo{node.address, node.name, state, load, float64(rtt) / float64(time.Millisecond), int64(silence / time.Millisecond)}
+	}
+	return nodes, nil
+}
+
+// AddNode adds the slave at address, or takes a drained one back
+func AddNode(address string) error {
+	if !isLeader() {
+		return Err_Not_Master
+	}
+	if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
+		return err
+	}
+
+	membershipLock.Lock()
+	delete(decommissioned, address)
+	membershipLock.Unlock()
+
+	return addNode(address, true)
+}
+
+// DrainNode stops placing schedules on the slave at address
+func DrainNode(address string) error {
+	if !isLeader() {
+		return Err_Not_Master
+	}
+	node := findNode(address)
+	if node == nil {
+		return Err_Unknown_Node
+	}
+	setDraining(node, true)
+	return nil
+}
+
+// DecommissionNode drains the slave at address, moves its pending
+// schedules to other nodes and removes it. With force it is removed even
+// if its schedules could not be moved.
+func DecommissionNode(address string, force bool) error {
+	if !isLeader() {
+		return Err_Not_Master
+	}
+	node := findNode(address)
+	if node == nil {
+		return Err_Unknown_Node
+	}
+
+	setDraining(node, true)
+	if _, err := handOff(node, 0, placeAnywhere); err != nil {
+		if !force {
+			return err
+		}
+		log.Println("Removing " + address + " without its schedules: " + err.Error())
+	}
+	removeNode(node)
+	return nil
+}
+
+func findNode(address string) *Node {
+	RWLock.RLock()
+	defer RWLock.RUnlock()
+	for _, node := range slave_connections {
+		if node.address == address {
+			return node
+		}
+	}
+	return nil
+}
+
+func setDraining(node *Node, draining bool) {
+	RWLock.Lock()
+	node.draining = draining
+	node.fix()
+	RWLock.Unlock()
+
+	if draining {
+		log.Println("Draining slave " + node.address)
+	}
+}
+
+// addNode puts a new slave in the cluster, closed until rediscoverSlaves
+// dials it
+func addNode(address string, undrain bool) error {
+	RWLock.Lock()
+	for _, node := range slave_connections {
+		if node.address != address {
+			continue
+		}
+		if undrain && node.draining {
+			node.draining = false
+			node.fix()
+			RWLock.Unlock()
+			return nil
+		}
+		RWLock.Unlock()
+		return Err_Node_Exists
+	}
+
+	node := newNode(address, 999999, 0)
+	node.saved = 0
+	node.closed = true
+	heap.Push(&slave_connections, node)
+	if dropped_connections == nil {
+		dropped_connections = list.New()
+	}
+	dropped_connections.PushBack(node)
+	RWLock.Unlock()
+
+	listenSlave(node)
+	log.Println("Slave " + address + " joined the cluster")
+	return nil
+}
+
+// removeNode takes a slave out of the cluster for good
+func removeNode(node *Node) {
+	sendToNode(node, []byte{COMM_TYPE_DECOMMISSION})
+
+	membershipLock.Lock()
+	decommissioned[node.address] = true
+	membershipLock.Unlock()
+
+	RWLock.Lock()
+	node.removed = true
+	if node.index >= 0 && node.index < len(slave_connections) && slave_connections[node.index] == node {
+		heap.Remove(&slave_connections, node.index)
+	}
+	if dropped_connections != nil {
+		for n := dropped_connections.Front(); n != nil; n = n.Next() {
+			if n.Value.(*Node) == node {
+				dropped_connections.Remove(n)
+				break
+			}
+		}
+	}
+	if !node.closed && node.conn != nil {
+		node.conn.Close()
+	}
+	node.closed = true
+	RWLock.Unlock()
+
+	clearPresence(node)
+	placementLock.Lock()
+	delete(rr_current, node)
+	placementLock.Unlock()
+
+	log.Println("Slave " + node.address + " left the cluster")
+}
+
+func handoffPayload(msgs []*message.Obj) []byte {
+	w := newPayload(COMM_TYPE_HANDOFF)
+	w.putInt64(int64(len(msgs)))
+	for _, msg := range msgs {
+		w.putInt64(int64(msg.ScheduleId))
+		w.putInt64(int64(msg.MessageType))
+		w.putString(msg.Endpoint)
+		w.putString(msg.MessageBody)
+		w.putInt64(msg.Expiration)
+	}
+	// Priorities, tenants and expiry follow the schedules, older slaves send
+	// none
+	for _, msg := range msgs {
+		w.putInt64(int64(msg.Priority))
+	}
+	for _, msg := range msgs {
+		w.putString(msg.Tenant)
+	}
+	for _, msg := range msgs {
+		w.putInt64(msg.ValidUntil)
+	}
+	return w.Bytes()
+}
+
+func decodeHandoff(payload []byte) ([]*message.Obj, error) {
+	r := newPayloadReader(payload)
+	count := r.getInt64()
+	if r.err != nil || count < 0 || count > int64(len(payload)) {
+		return nil, Err_Invalid_Payload
+	}
+	msgs := make([]*message.Obj, count)
+	for i := range msgs {
+		msgs[i] = &message.Obj{
+			ScheduleId:  int(r.getInt64()),
+			MessageType: int(r.getInt64()),
+			Endpoint:    r.getString(),
+			MessageBody: r.getString(),
+			Expiration:  r.getInt64(),
+		}
+	}
+	if r.more() {
+		for _, msg := range msgs {
+			msg.Priority = int(r.getInt64())
+		}
+	}
+	if r.more() {
+		for _, msg := range msgs {
+			msg.Tenant = r.getString()
+		}
+	}
+	if r.more() {
+		for _, msg := range msgs {
+			msg.ValidUntil = r.getInt64()
+		}
+	}
+	return msgs, r.err
+}
+
+func handoffDonePayload(ids []int) []byte {
+	w := newPayload(COMM_TYPE_HANDOFF_DONE)
+	w.putInt64(int64(len(ids)))
+	for _, id := range ids {
+		w.putInt64(int64(id))
+	}
+	return w.Bytes()
+}
+
+func decodeHandoffDone(payload []byte) ([]int, error) {
+	r := newPayloadReader(payload)
+	count := r.getInt64()
+	if r.err != nil || count < 0 || count > int64(len(payload)) {
+		return nil, Err_Invalid_Payload
+	}
+	ids := make([]int, count)
+	for i := range ids {
+		ids[i] = int(r.getInt64())
+	}
+	return ids, r.err
+}
+
+func handoffRequest(limit int) []byte {
+	w := newPayload(COMM_TYPE_HANDOFF)
+	w.putInt64(int64(limit))
+	return w.Bytes()
+}
+
+// placeAnywhere counts a pending request as placed, see placeOn
+func placeAnywhere(msg *message.Obj) error {
+	_, err := distLevel1Calls(msg)
+	if err == Err_Distribute_Pending {
+		return nil
+	}
+	return err
+}
+
+// handOff moves up to limit pending schedules of a slave, all of them
+// with no limit, putting each where place does. It returns how many moved.
+func handOff(node *Node, limit int, place func(*message.Obj) error) (int, error) {
+	total := 0
+	for limit == 0 || total < limit {
+		batch := HANDOFF_BATCH
+		if limit > 0 && limit-total < batch {
+			batch = limit - total
+		}
+		moved, offered, err := handOffBatch(node, batch, place)
+		total += moved
+		if err != nil {
+			return total, err
+		}
+		if offered < batch {
+			// The slave has nothing more to give
+			break
+		}
+	}
+	return total, nil
+}
+
+// handOffBatch moves up to limit schedules of a slave, it returns how many
+// moved and how many the slave offered
+func handOffBatch(node *Node, limit int, place func(*message.Obj) error) (int, int, error) {
+	RWLock.RLock()
+	v2 := node.version >= PROTOCOL_V2
+	closed := node.closed
+	index := node.index
+	address := node.address
+	RWLock.RUnlock()
+	if closed || !v2 {
+		return 0, 0, Err_Handoff_Unsupported
+	}
+
+	id := nextFrameId()
+	reply := make(chan []*message.Obj, 1)
+	handoffLock.Lock()
+	handoff_waiters[id] = reply
+	handoffLock.Unlock()
+	defer func() {
+		handoffLock.Lock()
+		delete(handoff_waiters, id)
+		handoffLock.Unlock()
+	}()
+
+	if _, err := sendSlaveFrame(handoffRequest(limit), index, id); err != nil {
+		return 0, 0, err
+	}
+
+	var msgs []*message.Obj
+	deadline := time.After(HANDOFF_TIMEOUT)
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for msgs == nil {
+		select {
+		case msgs = <-reply:
+		case <-deadline:
+			return 0, 0, Err_Handoff_Timeout
+		case <-tick.C:
+			RWLock.RLock()
+			closed = node.closed
+			RWLock.RUnlock()
+			if closed {
+				return 0, 0, Err_Slave_Disconnected
+			}
+		}
+	}
+
+	// Placing one can take a few resends, the slave waits long enough for
+	// the last one started before the deadline
+	place_until := time.Now().Add(HANDOFF_TIMEOUT)
+	moved := make([]int, 0, len(msgs))
+	for _, msg := range msgs {
+		if time.Now().After(place_until) {
+			log.Println("Handoff of " + address + " ran out of time, the slave keeps the rest")
+			break
+		}
+		schedule_id := msg.ScheduleId
+		msg.ScheduleId = 0
+		if err := place(msg); err != nil {
+			log.Println("Failed moving a schedule of " + address + ": " + err.Error())
+			continue
+		}
+		moved = append(moved, schedule_id)
+		// Copies of the moved schedule must not fire
+		claimSchedule(replicaKey{address, schedule_id}, address)
+	}
+
+	RWLock.RLock()
+	index = node.index
+	RWLock.RUnlock()
+	if _, err := sendSlaveFrame(handoffDonePayload(moved), index, id); err != nil {
+		return len(moved), len(msgs), err
+	}
+
+	log.Printf("Moved %d of %d schedules off %s", len(moved), len(msgs), address)
+	if len(moved) < len(msgs) {
+		return len(moved), len(msgs), Err_Handoff_Incomplete
+	}
+	return len(moved), len(msgs), nil
+}
+
+func answerHandoff(id uint64, payload []byte) {
+	msgs, err := decodeHandoff(payload)
+	if err != nil {
+		log.Println("Invalid handoff")
+		return
+	}
+
+	handoffLock.Lock()
+	reply, ok := handoff_waiters[id]
+	handoffLock.Unlock()
+	if ok {
+		reply <- msgs
+	}
+}
+
+// handOffToMaster gives the master the pending schedules it asks for and
+// keeps those it couldn't place
+func handOffToMaster(id uint64, payload []byte) {
+	r := newPayloadReader(payload)
+	limit := r.getInt64()
+	if r.err != nil {
+		log.Println("Invalid handoff request")
+		return
+	}
+
+	done := make(chan []int, 1)
+	handoffLock.Lock()
+	handoff_done[id] = done
+	handoffLock.Unlock()
+	defer func() {
+		handoffLock.Lock()
+		delete(handoff_done, id)
+		handoffLock.Unlock()
+	}()
+
+	msgs, err := schedule.HandOff(int(limit))
+	if err != nil {
+		log.Println("Failed handing off schedules: " + err.Error())
+		sendMasterFrame(handoffPayload(nil), id)
+		return
+	}
+	defer schedule.Restore()
+
+	sendMasterFrame(handoffPayload(msgs), id)
+	select {
+	case moved := <-done:
+		schedule.Release(moved)
+		log.Printf("Handed off %d schedules to the master", len(moved))
+	case <-time.After(2 * HANDOFF_TIMEOUT):
+		log.Println("Master did not confirm the handoff, keeping the schedules")
+	}
+}
+
+func answerHandoffDone(id uint64, payload []byte) {
+	moved, err := decodeHandoffDone(payload)
+	if err != nil {
+		log.Println("Invalid handoff confirmation")
+		return
+	}
+
+	handoffLock.Lock()
+	done, ok := handoff_done[id]
+	handoffLock.Unlock()
+	if ok {
+		done <- moved
+	}
+}
+
+// leaveCluster is run on a decommissioned slave, it stops taking over and
+// announcing itself until a master connects again
+func leaveCluster() {
+	log.Println("Decommissioned by the master")
+
+	membershipLock.Lock()
+	left_cluster = true
+	membershipLock.Unlock()
+
+	electionLock.Lock()
+	members = nil
+	member_rank = -1
+	electionLock.Unlock()
+}
+
+func rejoinCluster() {
+	membershipLock.Lock()
+	left_cluster = false
+	membershipLock.Unlock()
+}
+
+// acceptAnnouncements listens on the network port for slaves announcing
+// themselves while this node leads
+func acceptAnnouncements() {
+	tcp, err := net.ResolveTCPAddr("tcp", conf.GetNetworkPort())
+	if err != nil {
+		log.Println("Not accepting slave announcements: " + err.Error())
+		return
+	}
+	listener, err := net.ListenTCP("tcp", tcp)
+	if err != nil {
+		log.Println("Not accepting slave announcements: " + err.Error())
+		return
+	}
+
+	membershipLock.Lock()
+	announce_listener = listener
+	membershipLock.Unlock()
+
+	go func() {
+		for {
+			session, err := listener.AcceptTCP()
+			if err != nil {
+				if !isLeader() {
+					return
+				}
+				time.Sleep(time.Second)
+				continue
+			}
+			go answerAnnouncement(session)
+		}
+	}()
+}
+
+func stopAnnouncements() {
+	membershipLock.Lock()
+	listener := announce_listener
+	announce_listener = nil
+	membershipLock.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+// answerAnnouncement adds the announcing slave once it proved it belongs
+// to the cluster. It still has to pass the handshake when it is dialed. Slaves
+// dialing in with cluster_dial_master keep the connection, see
+// acceptDialIn.
+func answerAnnouncement(session *net.TCPConn) {
+	// The slave dials here, so the master takes the server's end of TLS
+	conn, err := secureSlave(session)
+	if err != nil {
+		session.Close()
+		return
+	}
+	conn.SetDeadline(time.Now().Add(ANNOUNCE_TIMEOUT))
+
+	// The slave says nothing more until the master answers, the reader
+	// can't take bytes of the handshake
+	frame, err := readFrame(PROTOCOL_V2, bufio.NewReader(io.LimitReader(conn, MAX_ANNOUNCE)))
+	if err == nil && frame.Type == COMM_TYPE_DIAL_IN {
+		r := newPayloadReader(frame.Payload)
+		instance := ""
+		if r.more() {
+			instance = r.getString()
+		}
+		if r.err != nil {
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		acceptDialIn(session, conn, instance)
+		return
+	}
+	defer conn.Close()
+	if err != nil || frame.Type != COMM_TYPE_ANNOUNCE {
+		return
+	}
+	r := newPayloadReader(frame.Payload)
+	port := r.getString()
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if r.err != nil || err != nil || port == "" {
+		return
+	}
+	address := net.JoinHostPort(host, port)
+
+	membershipLock.Lock()
+	returning := decommissioned[address]
+	membershipLock.Unlock()
+
+	if !isLeader() || !authenticateAnnouncement(conn, address) {
+		conn.Write(HANDSHAKE_L1_RESPONSE_REFUSE)
+		return
+	}
+	if err := addAnnouncedNode(address); err != nil && err != Err_Node_Exists {
+		log.Println("Refused announcement from " + address + ": " + err.Error())
+		conn.Write(HANDSHAKE_L1_RESPONSE_REFUSE)
+		return
+	}
+	if returning {
+		// Back after being removed, it hands its schedules over and leaves
+		// again, see evictNodes
+		if node := findNode(address); node != nil {
+			RWLock.Lock()
+			node.draining = true
+			node.evicting = true
+			node.fix()
+			RWLock.Unlock()
+		}
+	}
+	conn.Write(HANDSHAKE_L1_RESPONSE_OK)
+}
+
+// authenticateAnnouncement has the slave prove it knows the secret, or
+// relies on the certificate secureSlave checked
+func authenticateAnnouncement(conn net.Conn, address string) bool {
+	if conf.GetNetworkSecret() == "" {
+		if config, err := clusterTLSConfig(); err == nil && config != nil {
+			return true
+		}
+		log.Println("Refused announcement from " + address + ", announcing needs a secret or cluster_tls")
+		return false
+	}
+
+	nonce, err := newChallenge()
+	if err != nil {
+		return false
+	}
+	if _, err := conn.Write(append(append([]byte{}, HANDSHAKE_L1_RESPONSE_NONCE...), nonce...)); err != nil {
+		return false
+	}
+	response := make([]byte, CHALLENGE_SIZE)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return false
+	}
+	if !checkChallenge("announce", nonce, response) {
+		log.Println("Slave " + address + " failed the announcement challenge")
+		return false
+	}
+	return true
+}
+
+// addAnnouncedNode adds an announced slave unless too many announced
+// slaves never connected yet
+func addAnnouncedNode(address string) error {
+	announceLock.Lock()
+	defer announceLock.Unlock()
+
+	RWLock.Lock()
+	pending := 0
+	for _, node := range slave_connections {
+		if node.address == address {
+			RWLock.Unlock()
+			return Err_Node_Exists
+		}
+		if node.announced && node.closed {
+			pending++
+		}
+	}
+	RWLock.Unlock()
+	if pending >= MAX_PENDING_ANNOUNCED {
+		return Err_Too_Many_Announced
+	}
+
+	if err := addNode(address, false); err != nil {
+		return err
+	}
+	if node := findNode(address); node != nil {
+		RWLock.Lock()
+		node.announced = node.closed
+		RWLock.Unlock()
+	}
+	return nil
+}
+
+// announce tells the master in cluster_master about this slave every
+// ANNOUNCE_PERIOD while no master is connected
+func announce() {
+	address := conf.GetClusterMaster()
+	if address == "" {
+		return
+	}
+
+	for {
+		RWLock.RLock()
+		connected := master_connection != nil && !master_connection.closed
+		RWLock.RUnlock()
+		membershipLock.Lock()
+		left := left_cluster
+		membershipLock.Unlock()
+
+		if !connected && !left && !isLeader() {
+			if err := announceTo(address); err != nil {
+				log.Println("Announcing to master " + address + " failed: " + err.Error())
+			}
+		}
+		time.Sleep(ANNOUNCE_PERIOD)
+	}
+}
+
+func announceTo(address string) error {
+	tcp, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return err
+	}
+	tcp_conn, err := net.DialTCP("tcp", nil, tcp)
+	if err != nil {
+		return err
+	}
+	conn, err := secureMaster(tcp_conn)
+	if err != nil {
+		tcp_conn.Close()
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ANNOUNCE_TIMEOUT))
+
+	w := newPayload(COMM_TYPE_ANNOUNCE)
+	w.putString(strings.TrimPrefix(conf.GetNetworkPort(), ":"))
+	frame, err := encodeFrame(PROTOCOL_V2, w.Bytes(), nextFrameId())
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(frame); err != nil {
+		return err
+	}
+
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return err
+	}
+	if answer[0] == HANDSHAKE_L1_RESPONSE_NONCE[0] {
+		nonce := make([]byte, CHALLENGE_SIZE)
+		if _, err := io.ReadFull(conn, nonce); err != nil {
+			return err
+		}
+		if _, err := conn.Write(challengeResponse("announce", nonce)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, answer); err != nil {
+			return err
+		}
+	}
+	if answer[0] != HANDSHAKE_L1_RESPONSE_OK[0] {
+		return Err_Handshake_Status_Refused
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package clustering
+
+import (
+	"bufio"
+	"message"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestHandoffRoundTrip(t *testing.T) {
+	msgs := []*message.Obj{
+		{ScheduleId: 1, MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST https://hooks.example.com/x text/plain",
+			MessageBody: "line 1\nline 2", Expiration: 5000, Priority: message.PRIORITY_HIGH, Tenant: "acme", ValidUntil: 1500000000000},
+		{ScheduleId: 2, MessageType: message.S_REST_NOTIFICATION, Endpoint: "GET https://hooks.example.com/y",
+			Expiration: 100, Priority: message.PRIORITY_BULK},
+	}
+	data := handoffPayload(msgs)
+	decoded, err := decodeHandoff(data[1:])
+	if err != nil || len(decoded) != len(msgs) {
+		t.Fatalf("%d schedules, %v", len(decoded), err)
+	}
+	for i, msg := range msgs {
+		if !reflect.DeepEqual(decoded[i], msg) {
+			t.Errorf("schedule %d came back as %+v", i, decoded[i])
+		}
+	}
+
+	for _, cut := range []int{0, 4, 20, len(data) - 2} {
+		if _, err := decodeHandoff(data[1 : 1+cut]); err != Err_Invalid_Payload {
+			t.Errorf("cut at %d: expected Err_Invalid_Payload, got %v", cut, err)
+		}
+	}
+
+	w := newPayload(COMM_TYPE_HANDOFF)
+	w.putInt64(1 << 40)
+	if _, err := decodeHandoff(w.Bytes()[1:]); err != Err_Invalid_Payload {
+		t.Errorf("huge count: expected Err_Invalid_Payload, got %v", err)
+	}
+}
+
+// Slaves before priorities send the schedules only
+func TestHandoffFromOlderSlave(t *testing.T) {
+	w := newPayload(COMM_TYPE_HANDOFF)
+	w.putInt64(1)
+	w.putInt64(3)
+	w.putInt64(int64(message.S_REST_NOTIFICATION))
+	w.putString("GET https://hooks.example.com/y")
+	w.putString("")
+	w.putInt64(100)
+
+	msgs, err := decodeHandoff(w.Bytes()[1:])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("%d schedules, %v", len(msgs), err)
+	}
+	if msgs[0].ScheduleId != 3 || msgs[0].Priority != 0 || msgs[0].Tenant != "" || msgs[0].ValidUntil != 0 {
+		t.Errorf("schedule came back as %+v", msgs[0])
+	}
+}
+
+func TestHandoffDoneRoundTrip(t *testing.T) {
+	data := handoffDonePayload([]int{4, 5, 6})
+	if ids, err := decodeHandoffDone(data[1:]); err != nil || !reflect.DeepEqual(ids, []int{4, 5, 6}) {
+		t.Errorf("ids %v, %v", ids, err)
+	}
+	if ids, err := decodeHandoffDone(handoffDonePayload(nil)[1:]); err != nil || len(ids) != 0 {
+		t.Errorf("no ids came back as %v, %v", ids, err)
+	}
+	if _, err := decodeHandoffDone(data[1 : len(data)-3]); err != Err_Invalid_Payload {
+		t.Errorf("torn ids: expected Err_Invalid_Payload, got %v", err)
+	}
+}
+
+func TestHandOffBatch(t *testing.T) {
+	nodes, restore := withSlaves(0)
+	defer restore()
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	nodes[0].attach(local, nodes[0].name, PROTOCOL_V2)
+
+	offered := []*message.Obj{
+		{ScheduleId: 1, MessageType: message.S_REST_NOTIFICATION, Endpoint: "GET https://hooks.example.com/1"},
+		{ScheduleId: 2, MessageType: message.S_REST_NOTIFICATION, Endpoint: "GET https://hooks.example.com/2"},
+		{ScheduleId: 3, MessageType: message.S_REST_NOTIFICATION, Endpoint: "GET https://hooks.example.com/3"},
+	}
+	done := make(chan []int, 1)
+	go func() {
+		reader := bufio.NewReader(remote)
+		frame, err := readFrame(PROTOCOL_V2, reader)
+		if err != nil || frame.Type != COMM_TYPE_HANDOFF {
+			close(done)
+			return
+		}
+		answerHandoff(frame.Id, handoffPayload(offered)[1:])
+		frame, err = readFrame(PROTOCOL_V2, reader)
+		if err != nil || frame.Type != COMM_TYPE_HANDOFF_DONE {
+			close(done)
+			return
+		}
+		ids, _ := decodeHandoffDone(frame.Payload)
+		done <- ids
+	}()
+
+	// The second one can't be placed, the slave keeps it
+	placed := 0
+	moved, count, err := handOffBatch(nodes[0], 10, func(msg *message.Obj) error {
+		if msg.ScheduleId != 0 {
+			t.Errorf("placed with the slave's schedule id %d", msg.ScheduleId)
+		}
+		if msg.Endpoint == offered[1].Endpoint {
+			return Err_No_Available_Slave
+		}
+		placed++
+		return nil
+	})
+	if moved != 2 || count != 3 || placed != 2 || err != Err_Handoff_Incomplete {
+		t.Errorf("moved %d of %d, %v", moved, count, err)
+	}
+	if ids := <-done; !reflect.DeepEqual(ids, []int{1, 3}) {
+		t.Errorf("slave told %v were placed", ids)
+	}
+
+	nodes[0].version = PROTOCOL_V1
+	if _, _, err := handOffBatch(nodes[0], 10, placeAnywhere); err != Err_Handoff_Unsupported {
+		t.Errorf("v1 slave: expected Err_Handoff_Unsupported, got %v", err)
+	}
+}
+
+func TestAnnouncedNodesCapped(t *testing.T) {
+	_, restore := withSlaves()
+	old_dropped := dropped_connections
+	defer func() {
+		// Stops their listeners
+		RWLock.Lock()
+		for _, node := range slave_connections {
+			node.removed = true
+		}
+		RWLock.Unlock()
+		restore()
+		dropped_connections = old_dropped
+	}()
+
+	for i := 0; i < MAX_PENDING_ANNOUNCED; i++ {
+		if err := addAnnouncedNode("10.0.4." + strconv.Itoa(i+1) + ":9090"); err != nil {
+			t.Fatalf("announcement %d: %v", i, err)
+		}
+	}
+	if err := addAnnouncedNode("10.0.4.1:9090"); err != Err_Node_Exists {
+		t.Errorf("announced twice: expected Err_Node_Exists, got %v", err)
+	}
+	if err := addAnnouncedNode("10.0.4.99:9090"); err != Err_Too_Many_Announced {
+		t.Errorf("expected Err_Too_Many_Announced, got %v", err)
+	}
+
+	// One connecting makes room for another
+	RWLock.Lock()
+	slave_connections[0].closed = false
+	RWLock.Unlock()
+	if err := addAnnouncedNode("10.0.4.99:9090"); err != nil {
+		t.Errorf("announcement after one connected: %v", err)
+	}
+}
+
+func TestAnnouncementChallenge(t *testing.T) {
+	for role, expected := range map[string]bool{"announce": true, "slave": false} {
+		master, slave := net.Pipe()
+		result := make(chan bool, 1)
+		go func() { result <- authenticateAnnouncement(master, "10.0.4.1:9090") }()
+
+		code, data := readAndCheckTimeOut(slave)
+		if code != 0 || len(data) != 1+CHALLENGE_SIZE || data[0] != HANDSHAKE_L1_RESPONSE_NONCE[0] {
+			t.Fatalf("challenge %x, %d", data, code)
+		}
+		slave.Write(challengeResponse(role, data[1:]))
+		if accepted := <-result; accepted != expected {
+			t.Errorf("answered as %s, accepted %v", role, accepted)
+		}
+		master.Close()
+		slave.Close()
+	}
+}
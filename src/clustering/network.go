@@ -1,19 +1,21 @@
 package clustering
 
 import (
+	"bufio"
 	"bytes"
 	"conf"
 	"container/list"
-	"encoding/binary"
+	"crypto/hmac"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"schedule"
 	//"net/http/httputil"
 	"strconv"
 	"sync"
 	"time"
+	"ws"
 )
 
 var (
@@ -24,6 +26,7 @@ var (
 	HANDSHAKE_L1_RESPONSE_BAD     = []byte{202}
 	HANDSHAKE_L1_RESPONSE_REFUSE  = []byte{203}
 	HANDSHAKE_L1_RESPONSE_TIMEOUT = []byte{204}
+	HANDSHAKE_L1_RESPONSE_NONCE   = []byte{205} // Followed by the slave's challenge
 
 	HANDSHAKE_L2_RESPONSE_OK      = []byte{210}
 	HANDSHAKE_L2_RESPONSE_BAD     = []byte{211}
@@ -42,6 +45,7 @@ const (
 	HANDSHAKE_STATUS_BADCONN int8 = -1
 	HANDSHAKE_STATUS_SVR_ERR int8 = -3
 	HANDSHAKE_STATUS_UNKNOWN int8 = -4
+	HANDSHAKE_STATUS_STALE   int8 = -6 // The slave follows a newer master
 )
 
 var (
@@ -50,6 +54,7 @@ var (
 	Err_Handshake_Status_Badconn = errors.New("bad connection")
 	Err_Handshake_Status_Svr_Err = errors.New("internal server error")
 	Err_Handshake_Status_Unknown = errors.New("unknown error")
+	Err_Handshake_Status_Stale   = errors.New("a newer master was elected")
 
 	Err_No_Available_Slave = errors.New("No slave node connected")
 
@@ -58,17 +63,37 @@ var (
 )
 
 type Node struct {
-	complexity          uint
-	saved               uint
-	index               int
-	closed              bool
-	address             string
-	conn                *net.TCPConn
-	read_buffer         []byte
-	level_2_buffer      []byte
-	level_2_buffer_size int
-	bufferLock          *sync.RWMutex
-	channel             chan int
+	complexity uint
+	saved      uint
+	index      int
+	closed     bool
+	address    string
+	name       string
+	conn       net.Conn
+	reader     *bufio.Reader
+	version    int  // Protocol version agreed in the handshake
+	removed    bool // No longer part of the cluster, its listener stops
+	draining   bool // Gets no new schedules
+	evicting   bool // Removed once its schedules are moved off
+	dialed_in  bool // Dials the master, it is never dialed
+	announced  bool // Announced itself and was never connected yet
+	health     *nodeHealth
+}
+
+func newNode(address string, complexity uint, index int) *Node {
+	return &Node{complexity, complexity, index, false, address, "", nil, nil, PROTOCOL_V1, false, false, false, false, false, newHealth()}
+}
+
+// attach puts a freshly handshaken connection on the node, the caller
+// holds RWLock if the node is shared
+func (n *Node) attach(conn net.Conn, name string, version int) {
+	n.conn = conn
+	n.reader = bufio.NewReaderSize(conn, 4096)
+	n.name = name
+	n.version = version
+	n.closed = false
+	n.announced = false
+	n.health.reset()
 }
 
 type NodeQueue []*Node
@@ -78,504 +103,511 @@ var master_connection *Node = nil
 var dropped_connections *list.List = nil
 var RWLock = new(sync.RWMutex)
 
+// dialSlave connects and handshakes with the slave at address
+func dialSlave(address string) (int8, net.Conn, string, int) {
+	tcp, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return HANDSHAKE_STATUS_BADCONN, nil, "", PROTOCOL_V1
+	}
+
+	tcp_conn, err := net.DialTCP("tcp", nil, tcp)
+	if err != nil {
+		return HANDSHAKE_STATUS_BADCONN, nil, "", PROTOCOL_V1
+	}
+
+	tcp_conn.SetWriteBuffer(4096)
+	tcp_conn.SetReadBuffer(64)
+
+	conn, err := secureMaster(tcp_conn)
+	if err != nil {
+		log.Println("TLS handshake with slave " + address + " failed: " + err.Error())
+		tcp_conn.Close()
+		return HANDSHAKE_STATUS_BADCONN, nil, "", PROTOCOL_V1
+	}
+
+	status, name, version := handshakeMaster(conn)
+	if status == HANDSHAKE_STATUS_SUCCESS {
+		err = tcp_conn.SetKeepAlive(true)
+	}
+	if status != HANDSHAKE_STATUS_SUCCESS || err != nil {
+		conn.Close()
+		return status, nil, "", PROTOCOL_V1
+	}
+	return status, conn, name, version
+}
+
+func printHandshakeStatus(role string, status int8) {
+	switch status {
+	case HANDSHAKE_STATUS_BADCONN:
+		fmt.Println("\t" + role + ": " + Err_Handshake_Status_Badconn.Error())
+	case HANDSHAKE_STATUS_REFUSED:
+		fmt.Println("\t" + role + ": " + Err_Handshake_Status_Refused.Error())
+	case HANDSHAKE_STATUS_TIMEOUT:
+		fmt.Println("\t" + role + ": " + Err_Handshake_Status_Timeout.Error())
+	case HANDSHAKE_STATUS_UNKNOWN:
+		fmt.Println("\t" + role + ": " + Err_Handshake_Status_Unknown.Error())
+	case HANDSHAKE_STATUS_STALE:
+		fmt.Println("\t" + role + ": " + Err_Handshake_Status_Stale.Error())
+	}
+}
+
+// discoverSlaves connects the slaves in slave_list. Slaves that can't be
+// reached are kept closed and dialed again by rediscoverSlaves.
 func discoverSlaves() (error, *list.List) {
 	count := 1
+	connected := 0
 	slave_list := conf.GetSlaveList()
 	nslaves := slave_list.Len()
 	var connection_pool = list.New()
 	for e := slave_list.Front(); e != nil; e = e.Next() {
 		fmt.Println("\tMaster: Connecting slave " + strconv.Itoa(count) + " of " + strconv.Itoa(nslaves))
-		tcp, err := net.ResolveTCPAddr("tcp", e.Value.(string))
-		if err != nil {
-			return err, nil
-		}
-
-		tcp_conn, err := net.DialTCP("tcp", nil, tcp)
-
-		if err != nil {
-			return err, nil
-		}
+		count++
 
-		tcp_conn.SetWriteBuffer(4096)
-		tcp_conn.SetReadBuffer(64)
+		node := newNode(e.Value.(string), 0, connection_pool.Len())
+		connection_pool.PushBack(node)
 
-		status := handshakeMaster(tcp_conn)
+		status, conn, name, version := dialSlave(node.address)
+		printHandshakeStatus("Master", status)
 
-		switch status {
-		case HANDSHAKE_STATUS_BADCONN:
-			fmt.Println("\tMaster: " + Err_Handshake_Status_Badconn.Error())
-			continue
-		case HANDSHAKE_STATUS_REFUSED:
-			fmt.Println("\tMaster: " + Err_Handshake_Status_Refused.Error())
-			continue
-		case HANDSHAKE_STATUS_TIMEOUT:
-			fmt.Println("\tMaster: " + Err_Handshake_Status_Timeout.Error())
-			continue
-		case HANDSHAKE_STATUS_UNKNOWN:
-			fmt.Println("\tMaster: " + Err_Handshake_Status_Unknown.Error())
-			continue
+		if status == HANDSHAKE_STATUS_STALE {
+			// Another node took over while this one was away
+			for n := connection_pool.Front(); n != nil; n = n.Next() {
+				if c := n.Value.(*Node).conn; c != nil {
+					c.Close()
+				}
+			}
+			return Err_Handshake_Status_Stale, nil
 		}
 
 		if status == HANDSHAKE_STATUS_SUCCESS {
-			err := tcp_conn.SetKeepAlive(true)
-			if err != nil {
-				return err, nil
-			}
-			connection_pool.PushBack(&Node{100, 100, count - 1, false, e.Value.(string), tcp_conn,
-				make([]byte, 4096), make([]byte, 4096), 0, new(sync.RWMutex), make(chan int, 1)})
+			node.attach(conn, name, version)
+			connected++
+		} else {
+			node.closed = true
+			node.complexity = 999999
 		}
-
-		count++
-
 	}
 
-	if connection_pool.Len() < 1 {
+	// An empty slave_list waits for slaves to announce themselves
+	if nslaves > 0 && connected < 1 {
 		return Err_No_Available_Slave, nil
 	}
 
 	return nil, connection_pool
 }
 
-func rediscoverSlaves() {
-	dropped_connections = list.New()
+// rediscoverSlaves dials dropped slaves again until this node stops
+// leading for term
+func rediscoverSlaves(delay time.Duration, term uint64) {
+	RWLock.Lock()
+	if dropped_connections == nil {
+		dropped_connections = list.New()
+	}
+	RWLock.Unlock()
+
 	go func() {
 		// Time for handshake with all slaves
-		time.Sleep(time.Second * 30)
+		time.Sleep(delay)
 		log.Println("Rediscovering loop")
-		for {
-			heartbeatSlave()
-			if dropped_connections.Len() > 0 {
-				for n := dropped_connections.Front(); n != nil; n = n.Next() {
-					node := n.Value.(*Node)
+		for isLeading(term) {
+			RWLock.RLock()
+			dropped := make([]*Node, 0, dropped_connections.Len())
+			for n := dropped_connections.Front(); n != nil; n = n.Next() {
+				dropped = append(dropped, n.Value.(*Node))
+			}
+			RWLock.RUnlock()
 
-					if node.closed != true {
-						RWLock.Lock()
-						dropped_connections.Remove(n)
-						RWLock.Unlock()
-						continue
-					}
+			for _, node := range dropped {
+				RWLock.RLock()
+				closed := node.closed
+				removed := node.removed
+				RWLock.RUnlock()
 
-					tcp, err := net.ResolveTCPAddr("tcp", node.address)
-					if err != nil {
-						continue
+				if removed {
+					continue
+				}
+				if closed && node.dialed_in {
+					// Back once it dials in, see acceptDialIn
+					takeOver(node.address, true)
+					continue
+				}
+				if closed {
+					status, conn, name, version := dialSlave(node.address)
+					if status == HANDSHAKE_STATUS_STALE {
+						fmt.Println("\tMaster: " + Err_Handshake_Status_Stale.Error())
+						stepDown("A newer master was elected, rejoining as slave")
+						return
 					}
-
-					tcp_conn, err := net.DialTCP("tcp", nil, tcp)
-
-					if err != nil {
+					if status != HANDSHAKE_STATUS_SUCCESS {
+						takeOver(node.address, true)
 						continue
 					}
 
-					tcp_conn.SetWriteBuffer(4096)
-					tcp_conn.SetReadBuffer(64)
-
-					status := handshakeMaster(tcp_conn)
-
-					switch status {
-					case HANDSHAKE_STATUS_BADCONN:
-						fmt.Println("\tMaster: " + Err_Handshake_Status_Badconn.Error())
-						continue
-					case HANDSHAKE_STATUS_REFUSED:
-						fmt.Println("\tMaster: " + Err_Handshake_Status_Refused.Error())
-						continue
-					case HANDSHAKE_STATUS_TIMEOUT:
-						fmt.Println("\tMaster: " + Err_Handshake_Status_Timeout.Error())
-						continue
-					case HANDSHAKE_STATUS_UNKNOWN:
-						fmt.Println("\tMaster: " + Err_Handshake_Status_Unknown.Error())
+					RWLock.Lock()
+					if node.removed {
+						RWLock.Unlock()
+						conn.Close()
 						continue
 					}
+					node.attach(conn, name, version)
+					RWLock.Unlock()
+					node.update(node.saved)
+					takeOver(node.address, false)
+					topologyChanged()
+				}
 
-					if status == HANDSHAKE_STATUS_SUCCESS {
-						err := tcp_conn.SetKeepAlive(true)
-						if err != nil {
-							continue
-						}
-						RWLock.Lock()
-						node.conn = tcp_conn
-						node.closed = false
+				RWLock.Lock()
+				for n := dropped_connections.Front(); n != nil; n = n.Next() {
+					if n.Value.(*Node) == node {
 						dropped_connections.Remove(n)
-						RWLock.Unlock()
-						node.update(node.saved, node.index)
+						break
 					}
 				}
+				RWLock.Unlock()
 			}
 			time.Sleep(5 * time.Second)
 		}
 	}()
 }
 
-func heartbeatSlave() {
-	for index, _ := range slave_connections {
-		sendSlave(bytes.NewBuffer([]byte{COMM_TYPE_HEARTBEAT}).Bytes(), index)
-	}
-}
-
-func heartbeatMaster() {
-	sendMaster(bytes.NewBuffer([]byte{COMM_TYPE_HEARTBEAT}).Bytes())
-}
+var first_master = make(chan bool, 1)
 
+// waitMasterConnection starts following and blocks until a master has
+// connected
 func waitMasterConnection() error {
-	port := conf.GetNetworkPort()
-
-	tcp, err := net.ResolveTCPAddr("tcp", port)
-	if err != nil {
-		return err
-	}
-	tcp_conn, err := net.ListenTCP("tcp", tcp)
+	err := follow()
 	if err != nil {
 		return err
 	}
+	fmt.Println("\tSlave: Waiting for master...")
+	<-first_master
+	return nil
+}
 
+// acceptMasters takes connections from masters until this node leads. A
+// master with a newer term replaces the current one.
+func acceptMasters(listener *net.TCPListener) {
 	for {
-		fmt.Println("\tSlave: Waiting for master...")
-
-		session, err := tcp_conn.AcceptTCP()
+		session, err := listener.AcceptTCP()
 		if err != nil {
-			return err
+			if isLeader() {
+				return
+			}
+			log.Println("Accepting master failed: " + err.Error())
+			time.Sleep(time.Second)
+			continue
 		}
 		session.SetWriteBuffer(64)
 		session.SetReadBuffer(4096)
-		status := handshakeSlave(session)
-
-		switch status {
-		case HANDSHAKE_STATUS_BADCONN:
-			fmt.Println("\tSlave: " + Err_Handshake_Status_Badconn.Error())
-			continue
-		case HANDSHAKE_STATUS_REFUSED:
-			fmt.Println("\tSlave: " + Err_Handshake_Status_Refused.Error())
-			continue
-		case HANDSHAKE_STATUS_TIMEOUT:
-			fmt.Println("\tSlave: " + Err_Handshake_Status_Timeout.Error())
-			continue
-		case HANDSHAKE_STATUS_UNKNOWN:
-			fmt.Println("\tSlave: " + Err_Handshake_Status_Unknown.Error())
+		conn, err := secureSlave(session)
+		if err != nil {
+			fmt.Println("\tSlave: TLS handshake failed: " + err.Error())
+			session.Close()
 			continue
 		}
-
+		status, name, version := handshakeSlave(conn)
 		if status == HANDSHAKE_STATUS_SUCCESS {
-			err := session.SetKeepAlive(true)
-			if err != nil {
-				return err
-			}
-			master_connection = &Node{320, 320, 0, false, "", session, make([]byte, 4096),
-				make([]byte, 4096), 0, new(sync.RWMutex), nil}
-			break
+			err = session.SetKeepAlive(true)
+		}
+		if status != HANDSHAKE_STATUS_SUCCESS || err != nil {
+			conn.Close()
+			printHandshakeStatus("Slave", status)
+			continue
 		}
+
+		takeMaster(conn, name, version)
 	}
+}
 
-	return nil
+// takeMaster follows the master on a handshaken connection
+func takeMaster(conn net.Conn, name string, version int) {
+	RWLock.Lock()
+	if !master_connection.closed && master_connection.conn != nil {
+		master_connection.conn.Close()
+	}
+	master_connection.attach(conn, name, version)
+	RWLock.Unlock()
+	touchMaster()
+	clearTakeovers()
+	rejoinCluster()
+	announceAllPresence()
 
+	select {
+	case first_master <- true:
+	default:
+	}
 }
 
+// rediscoverMasterConnection keeps the master's lease and health in check
+// and the heartbeat going while this node follows
 func rediscoverMasterConnection() {
 	go func() {
-		// Time for handshake with master
-		time.Sleep(time.Second * 30)
-		log.Println("Rediscovering loop")
-		for {
-			heartbeatMaster()
-			if master_connection.closed {
-				port := conf.GetNetworkPort()
-
-				tcp, err := net.ResolveTCPAddr("tcp", port)
-				if err != nil {
-					continue
-				}
-				tcp_conn, err := net.ListenTCP("tcp", tcp)
-				if err != nil {
-					continue
-				}
-
-				for {
-					fmt.Println("\tSlave: Waiting for master...")
-
-					session, err := tcp_conn.AcceptTCP()
-					if err != nil {
-						continue
-					}
-					session.SetWriteBuffer(64)
-					session.SetReadBuffer(4096)
-					status := handshakeSlave(session)
-
-					switch status {
-					case HANDSHAKE_STATUS_BADCONN:
-						fmt.Println("\tSlave: " + Err_Handshake_Status_Badconn.Error())
-						continue
-					case HANDSHAKE_STATUS_REFUSED:
-						fmt.Println("\tSlave: " + Err_Handshake_Status_Refused.Error())
-						continue
-					case HANDSHAKE_STATUS_TIMEOUT:
-						fmt.Println("\tSlave: " + Err_Handshake_Status_Timeout.Error())
-						continue
-					case HANDSHAKE_STATUS_UNKNOWN:
-						fmt.Println("\tSlave: " + Err_Handshake_Status_Unknown.Error())
-						continue
-					}
-
-					if status == HANDSHAKE_STATUS_SUCCESS {
-						err := session.SetKeepAlive(true)
-						if err != nil {
-							continue
-						}
-						RWLock.Lock()
-						master_connection.conn = session
-						master_connection.closed = false
-						RWLock.Unlock()
-						schedule.ChangeConnection(session)
-						break
-					}
-				}
+		last_heartbeat := time.Time{}
+		for range time.Tick(time.Second) {
+			if isLeader() {
+				continue
+			}
+			if time.Since(last_heartbeat) >= heartbeatInterval() {
+				heartbeatMaster()
+				last_heartbeat = time.Now()
 			}
-			time.Sleep(1 * time.Second)
+			checkMaster()
+			checkMasterLease()
 		}
 	}()
 }
 
-func handshakeMaster(conn *net.TCPConn) int8 {
+func handshakeMaster(conn net.Conn) (int8, string, int) {
 	_, err := conn.Write(HANDSHAKE_L1_REQUEST)
 	if err != nil {
-		return HANDSHAKE_STATUS_SVR_ERR
+		return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
 	}
 
 	code, data := readAndCheckTimeOut(conn)
 	if code != 0 {
-		return code
+		return code, "", PROTOCOL_V1
 	}
 
-	if bytes.Compare(data, HANDSHAKE_L1_RESPONSE_AUTH) == 0 {
+	if len(data) == 1+CHALLENGE_SIZE && data[0] == HANDSHAKE_L1_RESPONSE_NONCE[0] {
+		fmt.Println("\tMaster: Answering authentication challenge...")
+		code := answerSlaveChallenge(conn, data[1:])
+		if code != HANDSHAKE_STATUS_SUCCESS {
+			return code, "", PROTOCOL_V1
+		}
+	} else if bytes.Compare(data, HANDSHAKE_L1_RESPONSE_AUTH) == 0 {
+		// Slaves asking for the secret itself predate the challenge
+		if !conf.GetClusterLegacyAuth() {
+			fmt.Println("\tMaster: Slave asked for the plaintext secret, set cluster_legacy_auth to allow it")
+			return HANDSHAKE_STATUS_REFUSED, "", PROTOCOL_V1
+		}
 		fmt.Println("\tMaster: Sending authentication secret...")
 		_, err := conn.Write([]byte(conf.GetNetworkSecret()))
 		if err != nil {
-			return HANDSHAKE_STATUS_SVR_ERR
+			return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
 		}
 		code, data := readAndCheckTimeOut(conn)
 		if code != 0 {
-			return code
+			return code, "", PROTOCOL_V1
 		}
 
 		if bytes.Compare(data, HANDSHAKE_L2_RESPONSE_OK) != 0 {
-			return HANDSHAKE_STATUS_REFUSED
+			return HANDSHAKE_STATUS_REFUSED, "", PROTOCOL_V1
 		}
 	} else if bytes.Compare(data, HANDSHAKE_L1_RESPONSE_OK) == 0 {
 
 	} else {
-		return HANDSHAKE_STATUS_UNKNOWN // more work for other responses
+		return HANDSHAKE_STATUS_UNKNOWN, "", PROTOCOL_V1 // more work for other responses
 	}
 
-	_, err = conn.Write([]byte(conf.GetGrandmaName()))
+	_, err = conn.Write(helloMessage(conf.GetGrandmaName(), localCapabilities()))
 	if err != nil {
-		return HANDSHAKE_STATUS_SVR_ERR
+		return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
 	}
 
 	code, data = readAndCheckTimeOut(conn)
 	if code == HANDSHAKE_STATUS_BADCONN {
 		conn.Write(HANDSHAKE_L3_RESPONSE_BAD)
-		return HANDSHAKE_STATUS_BADCONN
+		return HANDSHAKE_STATUS_BADCONN, "", PROTOCOL_V1
 	} else if code == HANDSHAKE_STATUS_TIMEOUT {
 		conn.Write(HANDSHAKE_L3_RESPONSE_TIMEOUT)
-		return HANDSHAKE_STATUS_TIMEOUT
+		return HANDSHAKE_STATUS_TIMEOUT, "", PROTOCOL_V1
 	}
 
-	slave_name := string(data)
-	fmt.Println("\tMaster: Connected to slave " + slave_name)
+	slave_name, caps := parseHello(data)
+	version := negotiateVersion(caps)
+	if staleMaster(caps) {
+		conn.Write(HANDSHAKE_L3_RESPONSE_BAD)
+		return HANDSHAKE_STATUS_STALE, "", PROTOCOL_V1
+	}
+	fmt.Println("\tMaster: Connected to slave " + slave_name + " (protocol v" + strconv.Itoa(version) + ")")
 
 	_, err = conn.Write(HANDSHAKE_L3_RESPONSE_OK)
 	if err != nil {
-		return HANDSHAKE_STATUS_SVR_ERR
+		return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
 	}
 
-	return HANDSHAKE_STATUS_SUCCESS
+	return HANDSHAKE_STATUS_SUCCESS, slave_name, version
 }
 
-func handshakeSlave(conn *net.TCPConn) int8 {
+func handshakeSlave(conn net.Conn) (int8, string, int) {
 	//var data []byte
 
 	code, data := readAndCheckTimeOut(conn)
 	if code == HANDSHAKE_STATUS_BADCONN {
 		conn.Write(HANDSHAKE_L1_RESPONSE_BAD)
-		return HANDSHAKE_STATUS_BADCONN
+		return HANDSHAKE_STATUS_BADCONN, "", PROTOCOL_V1
 	} else if code == HANDSHAKE_STATUS_TIMEOUT {
 		conn.Write(HANDSHAKE_L1_RESPONSE_TIMEOUT)
-		return HANDSHAKE_STATUS_TIMEOUT
+		return HANDSHAKE_STATUS_TIMEOUT, "", PROTOCOL_V1
 	}
 
 	if bytes.Compare(data, HANDSHAKE_L1_REQUEST) != 0 {
 		log.Println("l1 refuse slave")
 		conn.Write(HANDSHAKE_L1_RESPONSE_REFUSE)
-		return HANDSHAKE_STATUS_BADCONN
+		return HANDSHAKE_STATUS_BADCONN, "", PROTOCOL_V1
 	}
 
-	if conf.GetNetworkSecret() != "" {
-		fmt.Println("\tSlave: Authenticating master...")
+	if conf.GetNetworkSecret() != "" && conf.GetClusterLegacyAuth() {
+		fmt.Println("\tSlave: Authenticating master with plaintext secret...")
 		_, err := conn.Write(HANDSHAKE_L1_RESPONSE_AUTH)
 		if err != nil {
 			conn.Write(HANDSHAKE_L1_RESPONSE_BAD)
-			return HANDSHAKE_STATUS_SVR_ERR
+			return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
 		}
 
 		code, data := readAndCheckTimeOut(conn)
 		if code == HANDSHAKE_STATUS_BADCONN {
 			conn.Write(HANDSHAKE_L2_RESPONSE_BAD)
-			return HANDSHAKE_STATUS_BADCONN
+			return HANDSHAKE_STATUS_BADCONN, "", PROTOCOL_V1
 		} else if code == HANDSHAKE_STATUS_TIMEOUT {
 			conn.Write(HANDSHAKE_L2_RESPONSE_TIMEOUT)
-			return HANDSHAKE_STATUS_TIMEOUT
+			return HANDSHAKE_STATUS_TIMEOUT, "", PROTOCOL_V1
 		}
 
-		if bytes.Compare(data, []byte(conf.GetNetworkSecret())) != 0 {
+		if !hmac.Equal(data, []byte(conf.GetNetworkSecret())) {
 			conn.Write(HANDSHAKE_L2_RESPONSE_REFUSE)
-			return HANDSHAKE_STATUS_BADCONN
+			return HANDSHAKE_STATUS_BADCONN, "", PROTOCOL_V1
 		}
 
 		_, err = conn.Write(HANDSHAKE_L2_RESPONSE_OK)
 		if err != nil {
 			conn.Write(HANDSHAKE_L2_RESPONSE_BAD)
-			return HANDSHAKE_STATUS_SVR_ERR
+			return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
+		}
+	} else if conf.GetNetworkSecret() != "" {
+		fmt.Println("\tSlave: Authenticating master...")
+		code := challengeMaster(conn)
+		if code != HANDSHAKE_STATUS_SUCCESS {
+			return code, "", PROTOCOL_V1
 		}
 	} else {
 		_, err := conn.Write(HANDSHAKE_L1_RESPONSE_OK)
 		if err != nil {
 			conn.Write(HANDSHAKE_L1_RESPONSE_BAD)
-			return HANDSHAKE_STATUS_SVR_ERR
+			return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
 		}
 	}
 
 	code, data = readAndCheckTimeOut(conn)
 	if code == HANDSHAKE_STATUS_BADCONN {
 		conn.Write(HANDSHAKE_L3_RESPONSE_BAD)
-		return HANDSHAKE_STATUS_BADCONN
+		return HANDSHAKE_STATUS_BADCONN, "", PROTOCOL_V1
 	} else if code == HANDSHAKE_STATUS_TIMEOUT {
 		conn.Write(HANDSHAKE_L3_RESPONSE_TIMEOUT)
-		return HANDSHAKE_STATUS_TIMEOUT
+		return HANDSHAKE_STATUS_TIMEOUT, "", PROTOCOL_V1
 	}
 
-	master_name := string(data)
-	fmt.Println("\tSlave: Connected to master " + master_name)
+	master_name, caps := parseHello(data)
+	version := negotiateVersion(caps)
+	fmt.Println("\tSlave: Connected to master " + master_name + " (protocol v" + strconv.Itoa(version) + ")")
 
-	_, err := conn.Write([]byte(conf.GetGrandmaName()))
+	// A v1 master takes the capabilities as part of the name, answering
+	// with them is harmless
+	_, err := conn.Write(helloMessage(conf.GetGrandmaName(), localCapabilities()))
 	if err != nil {
 		conn.Write(HANDSHAKE_L1_RESPONSE_BAD)
-		return HANDSHAKE_STATUS_SVR_ERR
+		return HANDSHAKE_STATUS_SVR_ERR, "", PROTOCOL_V1
 	}
 
-	code, data = readAndCheckTimeOut(conn)
+	// The master's first frames may follow right behind its answer
+	code, data = readHandshakeByte(conn)
 	if code != 0 {
-		return code
+		return code, "", PROTOCOL_V1
 	}
 
 	if bytes.Compare(data, HANDSHAKE_L3_RESPONSE_OK) != 0 {
-		return HANDSHAKE_STATUS_REFUSED
+		return HANDSHAKE_STATUS_REFUSED, "", PROTOCOL_V1
 	}
 
-	return HANDSHAKE_STATUS_SUCCESS
+	if !acceptMaster(conn, caps) {
+		fmt.Println("\tSlave: Refused master " + master_name + " from an older term")
+		return HANDSHAKE_STATUS_REFUSED, "", PROTOCOL_V1
+	}
 
-}
+	return HANDSHAKE_STATUS_SUCCESS, master_name, version
 
-func readData(node *Node) uint {
-	if node == nil || node.conn == nil {
-		return 0
-	}
-
-	temp_buffer := make([]byte, 4096)
-	var size int = 0
-	var err error = nil
-
-	if node.level_2_buffer_size > 1 {
-		// Data available in level 2 buffer
-		append_buffer(temp_buffer, node.level_2_buffer, 0, 0, node.level_2_buffer_size)
-		size = node.level_2_buffer_size
-		// Clear level 2 buffer
-		node.level_2_buffer_size = 0
-	} else if node.level_2_buffer_size == 1 {
-		// Partial data available in level 2 buffer
-		append_buffer(temp_buffer, node.level_2_buffer, 0, 0, node.level_2_buffer_size)
-		size = node.level_2_buffer_size
-		// Clear level 2 buffer
-		node.level_2_buffer_size = 0
-		// Continue reading data
-		size, err = node.conn.Read(temp_buffer[1:])
-		if err != nil {
-			return 0
-		}
+}
 
-		size = size + 1
-	} else {
-		// No level 2 buffer data available, read directly from socket
-		if node.conn == nil {
-			return 0
-		}
-		size, err = node.conn.Read(temp_buffer)
-		if err != nil {
-			return 0
-		}
+// challengeMaster has the master prove it knows the secret, then proves it
+// back:
+//
+//	slave:  205 | slave nonce
+//	master: HMAC("master", slave nonce) | master nonce
+//	slave:  210 | HMAC("slave", master nonce)
+func challengeMaster(conn net.Conn) int8 {
+	nonce, err := newChallenge()
+	if err != nil {
+		conn.Write(HANDSHAKE_L1_RESPONSE_BAD)
+		return HANDSHAKE_STATUS_SVR_ERR
+	}
+	_, err = conn.Write(append(append([]byte{}, HANDSHAKE_L1_RESPONSE_NONCE...), nonce...))
+	if err != nil {
+		return HANDSHAKE_STATUS_SVR_ERR
 	}
 
-	sofar := size - 2
-	// bufferLock := node.bufferLock
-
-	// log.Println("Reading data in progress...")
-	// Consume all bytes in temp_buffer before continue
-	// Read first 2 bytes and get message size
-	var msg_size int16 = 0
-	msg_size = ((msg_size | int16(temp_buffer[0])) << 8) | int16(temp_buffer[1])
-	var msg_size_int int = int(msg_size)
-	// log.Printf("Size of data: %d", size-2)
-	// log.Printf("Size of message: %d", msg_size_int)
-	if msg_size_int < 0 {
-		return 0
+	code, data := readAndCheckTimeOut(conn)
+	if code == HANDSHAKE_STATUS_BADCONN {
+		conn.Write(HANDSHAKE_L2_RESPONSE_BAD)
+		return HANDSHAKE_STATUS_BADCONN
+	} else if code == HANDSHAKE_STATUS_TIMEOUT {
+		conn.Write(HANDSHAKE_L2_RESPONSE_TIMEOUT)
+		return HANDSHAKE_STATUS_TIMEOUT
 	}
-	// Copy rest to buffer
-	if msg_size_int <= size-2 {
-		// bufferLock.Lock()
-		append_buffer(node.read_buffer, temp_buffer, 0, 2, msg_size_int)
-		append_buffer(node.level_2_buffer, temp_buffer, 0, msg_size_int+2, size-2-msg_size_int)
-		node.level_2_buffer_size = size - 2 - msg_size_int
-		// bufferLock.Unlock()
-		return uint(msg_size_int)
+
+	if len(data) != 2*CHALLENGE_SIZE || !checkChallenge("master", nonce, data[:CHALLENGE_SIZE]) {
+		conn.Write(HANDSHAKE_L2_RESPONSE_REFUSE)
+		return HANDSHAKE_STATUS_REFUSED
 	}
-	// bufferLock.Lock()
-	append_buffer(node.read_buffer, temp_buffer, 0, 2, size-2)
-	// bufferLock.Unlock()
 
-	for {
-		log.Println("Long data to read")
+	response := append(append([]byte{}, HANDSHAKE_L2_RESPONSE_OK...), challengeResponse("slave", data[CHALLENGE_SIZE:])...)
+	_, err = conn.Write(response)
+	if err != nil {
+		return HANDSHAKE_STATUS_SVR_ERR
+	}
+	return HANDSHAKE_STATUS_SUCCESS
+}
 
-		bytes_to_read := msg_size_int - sofar
+// answerSlaveChallenge is the master's side of challengeMaster
+func answerSlaveChallenge(conn net.Conn, slave_nonce []byte) int8 {
+	nonce, err := newChallenge()
+	if err != nil {
+		return HANDSHAKE_STATUS_SVR_ERR
+	}
+	_, err = conn.Write(append(challengeResponse("master", slave_nonce), nonce...))
+	if err != nil {
+		return HANDSHAKE_STATUS_SVR_ERR
+	}
 
-		if node.conn == nil {
-			return 0
-		}
-		size, err = node.conn.Read(temp_buffer)
-		if err != nil {
-			return 0
-		}
+	code, data := readAndCheckTimeOut(conn)
+	if code != 0 {
+		return code
+	}
+	if len(data) != 1+CHALLENGE_SIZE || data[0] != HANDSHAKE_L2_RESPONSE_OK[0] {
+		return HANDSHAKE_STATUS_REFUSED
+	}
+	if !checkChallenge("slave", nonce, data[1:]) {
+		fmt.Println("\tMaster: Slave failed the authentication challenge")
+		return HANDSHAKE_STATUS_REFUSED
+	}
+	return HANDSHAKE_STATUS_SUCCESS
+}
 
-		current := sofar + size
-		if current >= msg_size_int {
-			// Save rest to level 2 buffer
+// readHandshakeByte reads a one byte answer and nothing past it
+func readHandshakeByte(conn net.Conn) (int8, []byte) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
 
-			// bufferLock.Lock()
-			append_buffer(node.level_2_buffer, temp_buffer, 0, bytes_to_read, current-msg_size_int)
-			node.level_2_buffer_size = current - msg_size_int
-			// Save data for this packet to buffer
-			append_buffer(node.read_buffer, temp_buffer, sofar, 0, bytes_to_read)
-			// bufferLock.Unlock()
-			sofar = msg_size_int
-			break
-		} else {
-			// Append message if more in buffer
-			// bufferLock.Lock()
-			append_buffer(node.read_buffer, temp_buffer, sofar, 0, size)
-			// bufferLock.Unlock()
-			sofar = current
-		}
+	data := make([]byte, 1)
+	_, err := io.ReadFull(conn, data)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return HANDSHAKE_STATUS_TIMEOUT, nil
+	} else if err != nil {
+		return HANDSHAKE_STATUS_BADCONN, nil
 	}
-
-	return uint(sofar)
+	return 0, data
 }
 
-func readHandshakeData(conn *net.TCPConn, buffer []byte) <-chan uint {
+func readHandshakeData(conn net.Conn, buffer []byte) <-chan uint {
 	out := make(chan uint, 1)
 	go func() {
 		temp_buffer := make([]byte, 512)
@@ -593,9 +625,9 @@ func readHandshakeData(conn *net.TCPConn, buffer []byte) <-chan uint {
 	return out
 }
 
-func readAndCheckTimeOut(conn *net.TCPConn) (int8, []byte) {
+func readAndCheckTimeOut(conn net.Conn) (int8, []byte) {
 	var ret []byte = nil
-	buff := make([]byte, 64)
+	buff := make([]byte, 512)
 	select {
 	case res := <-readHandshakeData(conn, buff):
 		if res == 0 {
@@ -611,159 +643,327 @@ func readAndCheckTimeOut(conn *net.TCPConn) (int8, []byte) {
 }
 
 func sendSlave(data []byte, slave_num int) (*Node, error) {
+	return sendSlaveFrame(data, slave_num, nextFrameId())
+}
+
+// sendSlaveFrame sends with a given frame id, replies carry the id back
+func sendSlaveFrame(data []byte, slave_num int, id uint64) (*Node, error) {
 	RWLock.RLock()
+	if slave_num < 0 || slave_num >= len(slave_connections) {
+		RWLock.RUnlock()
+		return nil, Err_No_Available_Slave
+	}
 	slave := slave_connections[slave_num]
+	closed := slave.closed
+	slave_conn := slave.conn
+	version := slave.version
 	RWLock.RUnlock()
 
-	if slave.closed {
+	if closed {
 		return slave, nil
 	}
 
-	slave_conn := slave.conn
-
-	msg_size := int16(len(data))
-	msg_size_header := make([]byte, 2)
-	binary.BigEndian.PutUint16(msg_size_header, uint16(msg_size))
+	frame, err := encodeFrame(version, data, id)
+	if err != nil {
+		log.Println("Not sending to slave: " + err.Error())
+		return slave, err
+	}
 
-	_, err := slave_conn.Write(msg_size_header)
-	_, err = slave_conn.Write(data)
+	// One write per frame, concurrent senders can't interleave
+	_, err = slave_conn.Write(frame)
 
 	if err != nil {
 		log.Println("Connection failed")
-		disconnectSlave(slave_num)
+		disconnectSlave(slave)
 		return slave, Err_Slave_Disconnected
 	}
 	return slave, nil
 }
 
 func sendMaster(data []byte) {
-	if master_connection.closed {
-		return
-	}
+	sendMasterFrame(data, nextFrameId())
+}
 
-	msg_size := int16(len(data))
-	msg_size_header := make([]byte, 2)
-	binary.BigEndian.PutUint16(msg_size_header, uint16(msg_size))
+func sendMasterFrame(data []byte, id uint64) {
 	RWLock.RLock()
-	_, err := master_connection.conn.Write(msg_size_header)
-	_, err = master_connection.conn.Write(data)
+	if master_connection.closed || master_connection.conn == nil {
+		RWLock.RUnlock()
+		return
+	}
+	master_conn := master_connection.conn
+	version := master_connection.version
 	RWLock.RUnlock()
 
+	frame, err := encodeFrame(version, data, id)
+	if err != nil {
+		log.Println("Not sending to master: " + err.Error())
+		return
+	}
+
+	_, err = master_conn.Write(frame)
+
 	if err != nil {
 		log.Println("Connection failed")
 		disconnectMaster()
 	}
 }
 
-func disconnectSlave(slave_num int) {
+func disconnectSlave(node *Node) {
 
 	RWLock.Lock()
-	node := slave_connections[slave_num]
+	if node.closed {
+		RWLock.Unlock()
+		return
+	}
 	node.conn.Close()
 
 	node.closed = true
 	node.saved = node.complexity
 	RWLock.Unlock()
 
-	node.update(999999, slave_num)
-	dropped_connections.PushBack(node)
+	node.update(999999)
+	clearPresence(node)
+
+	dropped := 0
+	RWLock.Lock()
+	if !node.removed && dropped_connections != nil {
+		dropped_connections.PushBack(node)
+		dropped = dropped_connections.Len()
+	}
+	RWLock.Unlock()
 
-	log.Printf("slave number %d has been disconnected, %d nodes is not connected", slave_num, dropped_connections.Len())
+	log.Printf("slave %s has been disconnected, %d nodes is not connected", node.address, dropped)
 }
 
 func disconnectMaster() {
 	RWLock.Lock()
-	master_connection.closed = true
-	master_connection.conn.Close()
+	if !master_connection.closed {
+		master_connection.closed = true
+		if master_connection.conn != nil {
+			master_connection.conn.Close()
+		}
+	}
 	RWLock.Unlock()
 }
 
-func masterHandler(data []byte, node *Node) {
-	buffer := bytes.NewReader(data)
-
-	data_type, err := buffer.ReadByte()
-
-	if err != nil {
-		log.Println("Read byte error")
-		return
-	}
-
-	switch data_type {
+func masterHandler(frame *Frame, node *Node, version int) {
+	switch frame.Type {
 	case COMM_TYPE_CONSUMED:
 		log.Println("slave job comsumed")
-		var schedule_id int32
-		err := binary.Read(buffer, binary.LittleEndian, &schedule_id)
+		schedule_id, err := decodeConsumed(version, frame.Payload)
 		if err != nil {
 			log.Println("Error reading schedule id")
 			return
 		}
-		node.channel <- int(schedule_id)
+		answerRequest(node, frame.Id, slaveReply{schedule_id, nil})
+		break
+	case ERR_CONSUME_MESSAGE[0]:
+		answerRequest(node, frame.Id, slaveReply{-1, Err_Slave_Rejected})
 		break
 	case COMM_TYPE_FINISHED:
 		log.Println("slave job finished")
-		node.update(node.complexity-3, node.index)
+		node.adjust(-1)
 		break
 	case COMM_TYPE_HEARTBEAT:
 		break
+	case COMM_TYPE_HEARTBEAT_ACK:
+		node.health.pong(frame.Id)
+		break
+	case COMM_TYPE_LOAD:
+		pending, err := decodeLoad(frame.Payload)
+		if err != nil {
+			log.Println("Invalid load report")
+			return
+		}
+		node.update(uint(pending))
+		break
+	case COMM_TYPE_WS_PRESENCE:
+		id, online, err := decodePresence(frame.Payload)
+		if err != nil {
+			log.Println("Error reading presence")
+			return
+		}
+		updatePresence(node, id, online)
+		break
+	case COMM_TYPE_WS_FORWARD:
+		id, key, msg_id, msg, valid_until, err := decodeWsMessage(frame.Payload)
+		if err != nil {
+			log.Println("Invalid websocket forward")
+			return
+		}
+		if ws.Send(id, key, msg_id, msg, valid_until) == ws.ErrorMessageExpired {
+			reportWsExpired(msg_id, valid_until)
+		}
+		break
+	case COMM_TYPE_WS_STATUS:
+		msg_id, status, detail, err := decodeWsStatus(frame.Payload)
+		if err != nil {
+			log.Println("Invalid websocket status")
+			return
+		}
+		applyStatus(msg_id, status, detail)
+		broadcastStatus(msg_id, status, detail)
+		break
+	case COMM_TYPE_CLAIM:
+		answerSlaveClaim(frame, node)
+		break
+	case COMM_TYPE_HANDOFF:
+		answerHandoff(frame.Id, frame.Payload)
+		break
 	default:
 		log.Println("unknown type")
 	}
 }
 
-func slaveHandler(data []byte) {
-	buffer := bytes.NewReader(data)
-	data_type, err := buffer.ReadByte()
-
-	if err != nil {
-		return
-	}
+func slaveHandler(frame *Frame, version int) {
+	touchMaster()
 
-	switch data_type {
+	switch frame.Type {
 	case COMM_TYPE_SCHEDULE:
 		log.Println("received from master fc")
-		byte_data := make([]byte, buffer.Len())
-		buffer.Read(byte_data)
-		consumeLevel1Calls(byte_data)
+		consumeLevel1Calls(frame, version)
 		break
 	case COMM_TYPE_HEARTBEAT:
+		answerHeartbeat(frame.Id, version)
+		break
+	case COMM_TYPE_MEMBERS:
+		term, rank, addresses, err := decodeMembers(frame.Payload)
+		if err != nil {
+			log.Println("Invalid member list")
+			return
+		}
+		updateMembers(term, rank, addresses)
+		break
+	case COMM_TYPE_REPLICA:
+		key, fire_at, msg, err := decodeReplica(frame.Payload)
+		if err != nil {
+			log.Println("Invalid replica")
+			return
+		}
+		storeReplica(key, fire_at, msg)
+		break
+	case COMM_TYPE_REPLICA_DROP:
+		key, err := decodeKey(frame.Payload)
+		if err != nil {
+			log.Println("Invalid replica drop")
+			return
+		}
+		dropReplica(key)
+		break
+	case COMM_TYPE_TAKEOVER:
+		primary, on, err := decodeTakeover(frame.Payload)
+		if err != nil {
+			log.Println("Invalid takeover")
+			return
+		}
+		setTakeover(primary, on)
+		break
+	case COMM_TYPE_CLAIM:
+		answerClaim(frame.Id, frame.Payload)
+		break
+	case COMM_TYPE_HANDOFF:
+		handOffToMaster(frame.Id, frame.Payload)
 		break
+	case COMM_TYPE_HANDOFF_DONE:
+		answerHandoffDone(frame.Id, frame.Payload)
+		break
+	case COMM_TYPE_DECOMMISSION:
+		leaveCluster()
+		break
+	case COMM_TYPE_WS_DELIVER:
+		id, key, msg_id, msg, valid_until, err := decodeWsMessage(frame.Payload)
+		if err != nil {
+			log.Println("Invalid websocket delivery")
+			return
+		}
+		if ws.Deliver(id, key, msg_id, msg, valid_until) == ws.ErrorMessageExpired {
+			reportWsExpired(msg_id, valid_until)
+		}
+		break
+	case COMM_TYPE_WS_STATUS:
+		msg_id, status, detail, err := decodeWsStatus(frame.Payload)
+		if err != nil {
+			log.Println("Invalid websocket status")
+			return
+		}
+		applyStatus(msg_id, status, detail)
+		break
+	}
+}
+
+// listen reads frames from a node until the process ends. A read error
+// drops the connection and waits for it to be replaced by a reconnect.
+// Frames are handled concurrently, but those whose effects depend on their
+// order, see inOrder, are handled one at a time as they are read.
+func listen(n *Node, handle func(*Frame, int), disconnect func()) {
+	for {
+		RWLock.RLock()
+		reader := n.reader
+		version := n.version
+		closed := n.closed
+		removed := n.removed
+		RWLock.RUnlock()
+
+		if removed {
+			return
+		}
+		if closed || reader == nil {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		frame, err := readFrame(version, reader)
+		if err != nil {
+			RWLock.RLock()
+			replaced := n.reader != reader
+			RWLock.RUnlock()
+			if !replaced {
+				log.Println("Reading from " + n.name + " failed: " + err.Error())
+				disconnect()
+			}
+			continue
+		}
+
+		n.health.seen()
+		if inOrder(frame.Type) {
+			handle(frame, version)
+		} else {
+			go handle(frame, version)
+		}
 	}
 }
 
+// inOrder tells whether frames of a type must be handled in the order they
+// came, a replica dropped before it is stored would stay and a claim read
+// before the schedule's replicas are picked would be granted unrecorded.
+// Their handlers don't block.
+func inOrder(comm_type byte) bool {
+	switch comm_type {
+	case COMM_TYPE_REPLICA, COMM_TYPE_REPLICA_DROP, COMM_TYPE_TAKEOVER, COMM_TYPE_CONSUMED:
+		return true
+	}
+	return false
+}
+
 func startLoopListener() {
 	var nslaves int = len(slave_connections)
 	log.Println(nslaves)
 
 	for i := 0; i < nslaves; i++ {
-		node := slave_connections[i]
-		go func(n *Node) {
-			for {
-				size := readData(n)
-				if size > 0 {
-					log.Println(size)
-					// node.bufferLock.RLock()
-					data := make([]byte, size)
-					copy(data, n.read_buffer)
-					go masterHandler(data, n)
-				}
-			}
-		}(node)
+		listenSlave(slave_connections[i])
 	}
 }
 
+func listenSlave(node *Node) {
+	go listen(node, func(frame *Frame, version int) {
+		masterHandler(frame, node, version)
+	}, func() {
+		disconnectSlave(node)
+	})
+}
+
 func startPointListener() {
-	go func() {
-		for {
-			size := readData(master_connection)
-			if size > 0 {
-				data := make([]byte, size)
-				// master_connection.bufferLock.RLock()
-				copy(data, master_connection.read_buffer)
-				// master_connection.bufferLock.Unlock()
-				go slaveHandler(data)
-			}
-		}
-	}()
+	go listen(master_connection, slaveHandler, disconnectMaster)
 }
 
 // func setupProxyServer() {
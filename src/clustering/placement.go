@@ -0,0 +1,193 @@
+package clustering
+
+import (
+	"conf"
+	"hash/fnv"
+	"message"
+	"schedule"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the master places a schedule, set with cluster_placement:
+//
+//	least_loaded     the node with the fewest pending schedules, slaves
+//	                 report theirs every LOAD_REPORT_PERIOD
+//	round_robin      weighted round robin, weights from cluster_weights
+//	consistent_hash  by endpoint, schedules for an endpoint stay on one
+//	                 node while the nodes don't change
+//
+// The master takes part too, a nil node means the master. A node with
+// weight 0 gets nothing from round_robin and consistent_hash.
+const (
+	LOAD_REPORT_PERIOD = 5 * time.Second
+	HASH_REPLICAS      = 100 // Points on the ring per unit of weight
+)
+
+type candidate struct {
+	node   *Node
+	key    string // Stable across restarts, ring points hash it
+	weight int
+	load   int // Pending schedules
+}
+
+type ringPoint struct {
+	hash uint32
+	node *Node
+}
+
+var placementLock = new(sync.Mutex)
+var rr_current = make(map[*Node]int)
+var ring []ringPoint = nil
+var ring_members string = ""
+
+func placeSchedule(msg *message.Obj) *Node {
+	switch conf.GetClusterPlacement() {
+	case conf.PLACEMENT_ROUND_ROBIN:
+		return placeRoundRobin()
+	case conf.PLACEMENT_CONSISTENT_HASH:
+		return placeByEndpoint(msg.Endpoint)
+	default:
+		return placeLeastLoaded()
+	}
+}
+
+// placeLeastLoaded takes the candidate with the fewest pending schedules,
+// ties go to the master
+func placeLeastLoaded() *Node {
+	return leastLoaded(placementCandidates())
+}
+
+func leastLoaded(candidates []candidate) *Node {
+	var picked *Node = nil
+	least := candidates[0].load
+	for _, c := range candidates[1:] {
+		if c.load < least {
+			picked = c.node
+			least = c.load
+		}
+	}
+	return picked
+}
+
+// placementCandidates lists the master and the connected slaves neither
+// drained nor suspect, the master first
+func placementCandidates() []candidate {
+	pending := schedule.PendingCount()
+
+	RWLock.RLock()
+	defer RWLock.RUnlock()
+
+	name := conf.GetGrandmaName()
+	candidates := []candidate{{nil, "master/" + name, conf.GetClusterWeight(name), pending}}
+	for _, node := range slave_connections {
+		if !node.closed && !node.draining && !node.health.isSuspect() {
+			candidates = append(candidates, candidate{node, node.address, conf.GetClusterWeight(node.name), int(node.complexity)})
+		}
+	}
+	return candidates
+}
+
+// placeRoundRobin is smooth weighted round robin: every node gains its
+// weight, the richest is picked and pays the total
+func placeRoundRobin() *Node {
+	candidates := placementCandidates()
+
+	placementLock.Lock()
+	defer placementLock.Unlock()
+
+	total := 0
+	var picked *candidate = nil
+	for i := range candidates {
+		c := &candidates[i]
+		if c.weight <= 0 {
+			continue
+		}
+		rr_current[c.node] += c.weight
+		total += c.weight
+		if picked == nil || rr_current[c.node] > rr_current[picked.node] {
+			picked = c
+		}
+	}
+	if picked == nil {
+		return nil
+	}
+	rr_current[picked.node] -= total
+	return picked.node
+}
+
+func placeByEndpoint(endpoint string) *Node {
+	candidates := placementCandidates()
+
+	members := make([]string, len(candidates))
+	for i, c := range candidates {
+		members[i] = c.key + "=" + strconv.Itoa(c.weight)
+	}
+
+	placementLock.Lock()
+	defer placementLock.Unlock()
+
+	if signature := strings.Join(members, ","); signature != ring_members {
+		ring = buildRing(candidates)
+		ring_members = signature
+	}
+	if len(ring) == 0 {
+		return nil
+	}
+
+	hash := hashKey(endpoint)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].node
+}
+
+func buildRing(candidates []candidate) []ringPoint {
+	points := make([]ringPoint, 0)
+	for _, c := range candidates {
+		for i := 0; i < c.weight*HASH_REPLICAS; i++ {
+			points = append(points, ringPoint{hashKey(c.key + "#" + strconv.Itoa(i)), c.node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+	return points
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func loadPayload(pending int) []byte {
+	w := newPayload(COMM_TYPE_LOAD)
+	w.putInt64(int64(pending))
+	return w.Bytes()
+}
+
+func decodeLoad(payload []byte) (int, error) {
+	r := newPayloadReader(payload)
+	pending := r.getInt64()
+	if pending < 0 {
+		return 0, Err_Invalid_Payload
+	}
+	return int(pending), r.err
+}
+
+// reportLoad sends the pending schedule count to the master, v1 masters
+// don't know the message
+func reportLoad() {
+	for range time.Tick(LOAD_REPORT_PERIOD) {
+		RWLock.RLock()
+		ready := !master_connection.closed && master_connection.version >= PROTOCOL_V2
+		RWLock.RUnlock()
+
+		if ready {
+			sendMaster(loadPayload(schedule.PendingCount()))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package clustering
+
+import (
+	"strconv"
+	"testing"
+)
+
+// withSlaves makes nodes the connected slaves, with the loads given, until
+// the returned function puts the old ones back
+func withSlaves(loads ...uint) ([]*Node, func()) {
+	nodes := make([]*Node, len(loads))
+	RWLock.Lock()
+	old := slave_connections
+	slave_connections = make(NodeQueue, 0, len(loads))
+	for i, load := range loads {
+		nodes[i] = newNode("10.0.1."+strconv.Itoa(i+1)+":9090", load, i)
+		nodes[i].name = "slave-" + strconv.Itoa(i+1)
+		slave_connections.Push(nodes[i])
+	}
+	RWLock.Unlock()
+	createComplexityRanking()
+
+	// Listeners of the test's nodes may still be dropping them
+	return nodes, func() {
+		RWLock.Lock()
+		slave_connections = old
+		RWLock.Unlock()
+	}
+}
+
+func TestLeastLoadedSkipsUnusable(t *testing.T) {
+	nodes, restore := withSlaves(0, 1, 2)
+	defer restore()
+	nodes[0].draining = true
+	nodes[1].health.suspect = true
+
+	candidates := placementCandidates()
+	candidates[0].load = 10
+	if node := leastLoaded(candidates); node != nodes[2] {
+		t.Errorf("placed on %v, expected %s", node, nodes[2].address)
+	}
+
+	// Ties go to the master
+	candidates[0].load = 2
+	if node := leastLoaded(candidates); node != nil {
+		t.Errorf("a tie went to %s, not the master", node.address)
+	}
+}
+
+func TestLeastLoadedPastTopOfRanking(t *testing.T) {
+	nodes, restore := withSlaves(0, 5, 3)
+	defer restore()
+
+	// The top of the ranking is gone, the next least loaded slave still
+	// beats a loaded master
+	if slave_connections[0] != nodes[0] {
+		t.Fatal("ranking not by load")
+	}
+	nodes[0].closed = true
+	candidates := placementCandidates()
+	if len(candidates) != 3 {
+		t.Errorf("closed slave listed: %+v", candidates)
+	}
+	candidates[0].load = 100
+	if node := leastLoaded(candidates); node != nodes[2] {
+		t.Errorf("placed on %v, expected %s", node, nodes[2].address)
+	}
+}
+
+func TestRoundRobinSkipsUnusable(t *testing.T) {
+	nodes, restore := withSlaves(0, 0, 0)
+	defer restore()
+	nodes[0].draining = true
+	nodes[1].health.suspect = true
+
+	counts := make(map[*Node]int)
+	for i := 0; i < 10; i++ {
+		counts[placeRoundRobin()]++
+	}
+	if counts[nodes[0]] != 0 || counts[nodes[1]] != 0 {
+		t.Errorf("placed on drained or suspect slaves: %v", counts)
+	}
+	if counts[nil] != 5 || counts[nodes[2]] != 5 {
+		t.Errorf("uneven round robin between the master and the healthy slave: %v", counts)
+	}
+}
+
+func TestConsistentHashSkipsUnusable(t *testing.T) {
+	nodes, restore := withSlaves(0, 0)
+	defer restore()
+
+	placed := make(map[string]*Node)
+	for i := 0; i < 50; i++ {
+		endpoint := "https://hooks.example.com/" + strconv.Itoa(i)
+		placed[endpoint] = placeByEndpoint(endpoint)
+	}
+
+	nodes[0].draining = true
+	for endpoint, before := range placed {
+		after := placeByEndpoint(endpoint)
+		if after == nodes[0] {
+			t.Fatalf("%s placed on a drained slave", endpoint)
+		}
+		// Only the drained slave's endpoints move
+		if before != nodes[0] && after != before {
+			t.Errorf("%s moved without its node changing", endpoint)
+		}
+	}
+}
+
+func TestLoadReport(t *testing.T) {
+	data := loadPayload(1234)
+	if data[0] != COMM_TYPE_LOAD {
+		t.Fatalf("type %d", data[0])
+	}
+	if pending, err := decodeLoad(data[1:]); err != nil || pending != 1234 {
+		t.Errorf("load %d, %v", pending, err)
+	}
+
+	w := newPayload(COMM_TYPE_LOAD)
+	w.putInt64(-1)
+	if _, err := decodeLoad(w.Bytes()[1:]); err != Err_Invalid_Payload {
+		t.Errorf("negative load: expected Err_Invalid_Payload, got %v", err)
+	}
+	if _, err := decodeLoad(data[1:4]); err != Err_Invalid_Payload {
+		t.Errorf("torn load: expected Err_Invalid_Payload, got %v", err)
+	}
+}
+
+// A slave's load report moves it in the ranking
+func TestLoadUpdatesRanking(t *testing.T) {
+	nodes, restore := withSlaves(1, 2, 3)
+	defer restore()
+
+	nodes[0].update(10)
+	if slave_connections[0] != nodes[1] {
+		t.Errorf("%s tops the ranking", slave_connections[0].address)
+	}
+	nodes[2].adjust(-3)
+	if slave_connections[0] != nodes[2] || nodes[2].complexity != 0 {
+		t.Errorf("%s tops the ranking", slave_connections[0].address)
+	}
+
+	// Drained slaves go after the others whatever their load
+	setDraining(nodes[2], true)
+	if slave_connections[0] != nodes[1] {
+		t.Errorf("%s tops the ranking", slave_connections[0].address)
+	}
+}
@@ -0,0 +1,235 @@
+package clustering
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"ws"
+)
+
+// Websocket presence. Slaves tell the master which ids have a live
+// connection on them, so a websocket message fired on any node reaches
+// the node holding the connection:
+//
+//	slave fires, no local connection  -> COMM_TYPE_WS_FORWARD to master
+//	master, no local connection       -> COMM_TYPE_WS_DELIVER to holders
+//	nobody holds the id               -> kept in the master's mailbox and
+//	                                     delivered when the id comes online
+//
+// Acks are reported wherever the client is connected. They go to the
+// master in COMM_TYPE_WS_STATUS, and the master passes them to every slave.
+// Each node updates the delivery status of its own scheduled messages.
+//
+// Forwarded messages carry their valid_until after the message, nodes
+// that predate it read none and keep them until delivered.
+
+// Slaves holding a live connection for each id, only used on the master
+var ws_presence = make(map[string]map[*Node]bool)
+var presenceLock = new(sync.Mutex)
+
+// Applies a delivery status to this node's own messages
+var applyWsStatus func(msg_id string, status string, detail string) = nil
+var captureWsStatus = new(sync.Once)
+
+// A node switches roles on failover, the hooks always wrap the
+// distributor's own status hook
+func keepWsStatus() {
+	captureWsStatus.Do(func() {
+		applyWsStatus = ws.OnDeliveryStatus
+	})
+}
+
+func setupMasterPresence() {
+	keepWsStatus()
+	ws.OnPresence = nil
+	ws.Forward = forwardToHolders
+	ws.OnDeliveryStatus = func(msg_id string, status string, detail string) {
+		applyStatus(msg_id, status, detail)
+		broadcastStatus(msg_id, status, detail)
+	}
+}
+
+func setupSlavePresence() {
+	keepWsStatus()
+	ws.OnPresence = announcePresence
+	ws.Forward = forwardToMaster
+	ws.OnDeliveryStatus = func(msg_id string, status string, detail string) {
+		applyStatus(msg_id, status, detail)
+		sendMaster(wsStatusPayload(msg_id, status, detail))
+	}
+}
+
+// reportWsExpired tells the node that fired a forwarded message it expired
+// before reaching a client
+func reportWsExpired(msg_id string, valid_until int64) {
+	if msg_id != "" && ws.OnDeliveryStatus != nil {
+		ws.OnDeliveryStatus(msg_id, ws.STATUS_EXPIRED, "valid until "+strconv.FormatInt(valid_until, 10))
+	}
+}
+
+func applyStatus(msg_id string, status string, detail string) {
+	if applyWsStatus != nil {
+		applyWsStatus(msg_id, status, detail)
+	}
+}
+
+func broadcastStatus(msg_id string, status string, detail string) {
+	RWLock.RLock()
+	nodes := make([]*Node, len(slave_connections))
+	copy(nodes, slave_connections)
+	RWLock.RUnlock()
+
+	for _, node := range nodes {
+		sendToNode(node, wsStatusPayload(msg_id, status, detail))
+	}
+}
+
+func wsPayload(comm_type byte, id string, key string, msg_id string, msg string, valid_until int64) []byte {
+	w := newPayload(comm_type)
+	w.putString(id)
+	w.putString(key)
+	w.putString(msg_id)
+	w.putString(msg)
+	w.putInt64(valid_until)
+	return w.Bytes()
+}
+
+func decodeWsMessage(payload []byte) (string, string, string, string, int64, error) {
+	r := newPayloadReader(payload)
+	id := r.getString()
+	key := r.getString()
+	msg_id := r.getString()
+	msg := r.getString()
+	var valid_until int64 = 0
+	if r.more() {
+		valid_until = r.getInt64()
+	}
+	return id, key, msg_id, msg, valid_until, r.err
+}
+
+func wsStatusPayload(msg_id string, status string, detail string) []byte {
+	w := newPayload(COMM_TYPE_WS_STATUS)
+	w.putString(msg_id)
+	w.putString(status)
+	w.putString(detail)
+	return w.Bytes()
+}
+
+func decodeWsStatus(payload []byte) (string, string, string, error) {
+	r := newPayloadReader(payload)
+	msg_id := r.getString()
+	status := r.getString()
+	detail := r.getString()
+	return msg_id, status, detail, r.err
+}
+
+func decodePresence(payload []byte) (string, bool, error) {
+	r := newPayloadReader(payload)
+	online := r.getInt64()
+	id := r.getString()
+	return id, online == 1, r.err
+}
+
+func announcePresence(id string, online bool) {
+	state := int64(0)
+	if online {
+		state = 1
+	}
+	w := newPayload(COMM_TYPE_WS_PRESENCE)
+	w.putInt64(state)
+	w.putString(id)
+	sendMaster(w.Bytes())
+}
+
+// announceAllPresence tells a reconnected master every id online here
+func announceAllPresence() {
+	for _, id := range ws.OnlineIds() {
+		announcePresence(id, true)
+	}
+}
+
+func forwardToMaster(id string, key string, msg_id string, msg string, valid_until int64) bool {
+	// v1 masters don't know about websocket forwarding
+	RWLock.RLock()
+	usable := master_connection != nil && !master_connection.closed && master_connection.version >= PROTOCOL_V2
+	RWLock.RUnlock()
+	if !usable {
+		return false
+	}
+	sendMaster(wsPayload(COMM_TYPE_WS_FORWARD, id, key, msg_id, msg, valid_until))
+
+	RWLock.RLock()
+	defer RWLock.RUnlock()
+	return !master_connection.closed
+}
+
+func forwardToHolders(id string, key string, msg_id string, msg string, valid_until int64) bool {
+	presenceLock.Lock()
+	holders := make([]*Node, 0, len(ws_presence[id]))
+	for node := range ws_presence[id] {
+		holders = append(holders, node)
+	}
+	presenceLock.Unlock()
+
+	forwarded := false
+	for _, node := range holders {
+		if sendToNode(node, wsPayload(COMM_TYPE_WS_DELIVER, id, key, msg_id, msg, valid_until)) {
+			forwarded = true
+		}
+	}
+	return forwarded
+}
+
+func sendToNode(node *Node, data []byte) bool {
+	RWLock.RLock()
+	index := node.index
+	closed := node.closed
+	RWLock.RUnlock()
+
+	if closed {
+		return false
+	}
+	_, err := sendSlave(data, index)
+	return err == nil
+}
+
+// updatePresence records a slave's presence announcement. An id coming
+// online gets the messages the master kept for it.
+func updatePresence(node *Node, id string, online bool) {
+	presenceLock.Lock()
+	if online {
+		if ws_presence[id] == nil {
+			ws_presence[id] = make(map[*Node]bool)
+		}
+		ws_presence[id][node] = true
+	} else if ws_presence[id] != nil {
+		delete(ws_presence[id], node)
+		if len(ws_presence[id]) == 0 {
+			delete(ws_presence, id)
+		}
+	}
+	presenceLock.Unlock()
+
+	if !online {
+		return
+	}
+	for _, kept := range ws.TakeMailbox(id) {
+		if !sendToNode(node, wsPayload(COMM_TYPE_WS_DELIVER, id, kept.Key, kept.MessageId, kept.Message, kept.ValidUntil)) {
+			log.Println("Failed handing kept websocket message to slave " + node.address)
+		}
+	}
+}
+
+// clearPresence forgets the ids of a disconnected slave, it announces them
+// again when it reconnects
+func clearPresence(node *Node) {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	for id, holders := range ws_presence {
+		delete(holders, node)
+		if len(holders) == 0 {
+			delete(ws_presence, id)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package clustering
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWsPayload(t *testing.T) {
+	data := wsPayload(COMM_TYPE_WS_FORWARD, "user-1", "app", "msg-9", "hello", 1234)
+	if data[0] != COMM_TYPE_WS_FORWARD {
+		t.Fatalf("type %d", data[0])
+	}
+	id, key, msg_id, msg, valid_until, err := decodeWsMessage(data[1:])
+	if err != nil || id != "user-1" || key != "app" || msg_id != "msg-9" || msg != "hello" || valid_until != 1234 {
+		t.Errorf("decoded %q %q %q %q %d, %v", id, key, msg_id, msg, valid_until, err)
+	}
+
+	// Older nodes send no valid_until
+	w := newPayload(COMM_TYPE_WS_FORWARD)
+	for _, s := range []string{"user-1", "", "", "hello"} {
+		w.putString(s)
+	}
+	if _, _, _, msg, valid_until, err := decodeWsMessage(w.Bytes()[1:]); err != nil || msg != "hello" || valid_until != 0 {
+		t.Errorf("old forward decoded %q until %d, %v", msg, valid_until, err)
+	}
+
+	// Cut anywhere inside the strings
+	for cut := 0; cut < len(w.Bytes())-1; cut++ {
+		if _, _, _, _, _, err := decodeWsMessage(w.Bytes()[1 : 1+cut]); err != Err_Invalid_Payload {
+			t.Errorf("cut at %d: %v", cut, err)
+		}
+	}
+}
+
+func TestWsStatusAndPresencePayloads(t *testing.T) {
+	data := wsStatusPayload("msg-9", "delivered", "acked")
+	if data[0] != COMM_TYPE_WS_STATUS {
+		t.Fatalf("type %d", data[0])
+	}
+	if msg_id, status, detail, err := decodeWsStatus(data[1:]); err != nil || msg_id != "msg-9" || status != "delivered" || detail != "acked" {
+		t.Errorf("decoded %q %q %q, %v", msg_id, status, detail, err)
+	}
+	if _, _, _, err := decodeWsStatus(data[1:8]); err != Err_Invalid_Payload {
+		t.Errorf("truncated status: %v", err)
+	}
+
+	for _, online := range []bool{true, false} {
+		state := int64(0)
+		if online {
+			state = 1
+		}
+		w := newPayload(COMM_TYPE_WS_PRESENCE)
+		w.putInt64(state)
+		w.putString("user-1")
+		if id, got, err := decodePresence(w.Bytes()[1:]); err != nil || id != "user-1" || got != online {
+			t.Errorf("presence %q online %v, %v", id, got, err)
+		}
+	}
+}
+
+// expectDelivery reads the COMM_TYPE_WS_DELIVER frame a fake slave got
+func expectDelivery(t *testing.T, remote *bufio.Reader, id string, msg string) {
+	frame, err := readFrame(PROTOCOL_V2, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got_id, _, _, got_msg, _, err := decodeWsMessage(frame.Payload)
+	if frame.Type != COMM_TYPE_WS_DELIVER || err != nil || got_id != id || got_msg != msg {
+		t.Errorf("slave got type %d: %q %q, %v", frame.Type, got_id, got_msg, err)
+	}
+}
+
+func TestForwardToHolders(t *testing.T) {
+	nodes, restore := withSlaves(0, 0)
+	defer restore()
+	remotes := make([]*bufio.Reader, len(nodes))
+	for i, node := range nodes {
+		local, remote := net.Pipe()
+		defer local.Close()
+		defer remote.Close()
+		remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+		node.attach(local, node.name, PROTOCOL_V2)
+		remotes[i] = bufio.NewReader(remote)
+	}
+	defer clearPresence(nodes[0])
+	defer clearPresence(nodes[1])
+
+	forward := func(id string, msg string) chan bool {
+		forwarded := make(chan bool, 1)
+		go func() { forwarded <- forwardToHolders(id, "", "", msg, 0) }()
+		return forwarded
+	}
+
+	if <-forward("nobody", "lost") {
+		t.Error("forwarded to nobody")
+	}
+
+	updatePresence(nodes[0], "user-1", true)
+	forwarded := forward("user-1", "first")
+	expectDelivery(t, remotes[0], "user-1", "first")
+	if !<-forwarded {
+		t.Error("not forwarded to the holder")
+	}
+
+	// The id moves to the other slave
+	updatePresence(nodes[1], "user-1", true)
+	updatePresence(nodes[0], "user-1", false)
+	forwarded = forward("user-1", "second")
+	expectDelivery(t, remotes[1], "user-1", "second")
+	if !<-forwarded {
+		t.Error("not forwarded to the new holder")
+	}
+
+	// A disconnected slave holds nothing
+	clearPresence(nodes[1])
+	presenceLock.Lock()
+	_, held := ws_presence["user-1"]
+	presenceLock.Unlock()
+	if held || <-forward("user-1", "third") {
+		t.Error("forwarded after its holder left")
+	}
+
+	// Closed holders are skipped
+	updatePresence(nodes[1], "user-2", true)
+	RWLock.Lock()
+	nodes[1].closed = true
+	RWLock.Unlock()
+	if <-forward("user-2", "closed") {
+		t.Error("forwarded to a closed holder")
+	}
+}
+
+func TestForwardToMaster(t *testing.T) {
+	master, restore := withMaster()
+	defer restore()
+
+	forwarded := make(chan bool, 1)
+	go func() { forwarded <- forwardToMaster("user-1", "app", "msg-9", "hello", 1234) }()
+	frame, err := readFrame(PROTOCOL_V2, master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, key, msg_id, msg, valid_until, err := decodeWsMessage(frame.Payload)
+	if frame.Type != COMM_TYPE_WS_FORWARD || err != nil || id != "user-1" || key != "app" || msg_id != "msg-9" ||
+		msg != "hello" || valid_until != 1234 {
+		t.Errorf("master got type %d: %q %q %q %q %d, %v", frame.Type, id, key, msg_id, msg, valid_until, err)
+	}
+	if !<-forwarded {
+		t.Error("not forwarded")
+	}
+
+	// v1 masters don't know about websocket forwarding
+	RWLock.Lock()
+	master_connection.version = PROTOCOL_V1
+	RWLock.Unlock()
+	if forwardToMaster("user-1", "", "", "hello", 0) {
+		t.Error("forwarded to a v1 master")
+	}
+}
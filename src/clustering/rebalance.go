@@ -0,0 +1,283 @@
+package clustering
+
+import (
+	"conf"
+	"log"
+	"message"
+	"schedule"
+	"sync"
+	"time"
+)
+
+// The rebalancer moves pending schedules from the busiest node to the
+// least busy one, the master included, until they are within
+// REBALANCE_SPREAD of each other. Drained slaves are emptied first and
+// slaves evicted after coming back from a decommission leave.
+//
+// A move goes through the handoff of the source: the schedules are taken
+// out of its key store, placed on the target, and given up by the source
+// once placed. At most REBALANCE_BATCH move at once, REBALANCE_PAUSE
+// apart, so the cluster never sees a burst.
+//
+// It runs REBALANCE_DELAY after a slave connects, with cluster_rebalance,
+// and on demand from the admin API.
+const (
+	REBALANCE_DELAY      = 10 * time.Second // Slaves report their load meanwhile
+	REBALANCE_BATCH      = 100
+	REBALANCE_PAUSE      = time.Second
+	REBALANCE_SPREAD     = 10 // Or a tenth of the average, if more
+	REBALANCE_MAX_ROUNDS = 10000
+)
+
+type nodeLoad struct {
+	node     *Node // nil is the master
+	pending  int
+	draining bool
+	movable  bool // Can hand its schedules off
+}
+
+var (
+	topology_changed  = make(chan bool, 1)
+	rebalance_now     = make(chan bool, 1)
+	startRebalancer   = new(sync.Once)
+	rebalanceRunLock  = new(sync.Mutex)
+	rebalance_running = false
+)
+
+// Rebalance moves pending schedules between nodes now
+func Rebalance() error {
+	if !isLeader() {
+		return Err_Not_Master
+	}
+	startRebalancer.Do(func() {
+		go rebalancer()
+	})
+	select {
+	case rebalance_now <- true:
+	default:
+	}
+	return nil
+}
+
+// topologyChanged lets the rebalancer run once things settle
+func topologyChanged() {
+	startRebalancer.Do(func() {
+		go rebalancer()
+	})
+	select {
+	case topology_changed <- true:
+	default:
+	}
+}
+
+func rebalancer() {
+	var settled <-chan time.Time = nil
+	for {
+		select {
+		case <-topology_changed:
+			settled = time.After(REBALANCE_DELAY)
+		case <-settled:
+			settled = nil
+			rebalance(conf.GetClusterRebalance())
+		case <-rebalance_now:
+			rebalance(true)
+		}
+	}
+}
+
+// rebalance evicts the slaves that came back after a decommission and,
+// with balance, evens out the pending schedules
+func rebalance(balance bool) {
+	rebalanceRunLock.Lock()
+	if rebalance_running {
+		rebalanceRunLock.Unlock()
+		return
+	}
+	rebalance_running = true
+	rebalanceRunLock.Unlock()
+	defer func() {
+		rebalanceRunLock.Lock()
+		rebalance_running = false
+		rebalanceRunLock.Unlock()
+	}()
+
+	evictNodes()
+	if !balance {
+		return
+	}
+
+	total := 0
+	for round := 0; round < REBALANCE_MAX_ROUNDS && isLeader(); round++ {
+		source, target, count := pickMove(nodeLoads())
+		if count == 0 {
+			break
+		}
+
+		moved, err := moveSchedules(source, target, count)
+		total += moved
+		if err != nil {
+			log.Println("Rebalancing stopped: " + err.Error())
+			break
+		}
+		if moved == 0 {
+			break
+		}
+		time.Sleep(REBALANCE_PAUSE)
+	}
+	if total > 0 {
+		log.Printf("Rebalanced %d schedules", total)
+	}
+}
+
+// evictNodes moves the schedules off the connected evicted slaves and
+// removes them
+func evictNodes() {
+	RWLock.RLock()
+	evicting := make([]*Node, 0)
+	for _, node := range slave_connections {
+		if node.evicting && !node.closed {
+			evicting = append(evicting, node)
+		}
+	}
+	RWLock.RUnlock()
+
+	for _, node := range evicting {
+		if _, err := handOff(node, 0, placeAnywhere); err != nil {
+			log.Println("Evicting " + node.address + " failed: " + err.Error())
+			continue
+		}
+		removeNode(node)
+	}
+}
+
+// nodeLoads lists the pending schedules of the master and the connected
+// slaves
+func nodeLoads() []nodeLoad {
+	loads := []nodeLoad{{nil, schedule.PendingCount(), false, true}}
+
+	RWLock.RLock()
+	defer RWLock.RUnlock()
+	for _, node := range slave_connections {
+		if !node.closed && !node.evicting {
+			loads = append(loads, nodeLoad{node, int(node.complexity), node.draining, node.version >= PROTOCOL_V2})
+		}
+	}
+	return loads
+}
+
+// pickMove finds the next batch to move, nothing once drained slaves are
+// empty and the others are close enough
+func pickMove(loads []nodeLoad) (*Node, *Node, int) {
+	var target *nodeLoad = nil
+	total, targets := 0, 0
+	for i := range loads {
+		l := &loads[i]
+		total += l.pending
+		if l.draining {
+			continue
+		}
+		targets++
+		if target == nil || l.pending < target.pending {
+			target = l
+		}
+	}
+	if target == nil {
+		return nil, nil, 0
+	}
+
+	for _, l := range loads {
+		if l.draining && l.movable && l.pending > 0 {
+			return l.node, target.node, minInt(REBALANCE_BATCH, l.pending)
+		}
+	}
+
+	var source *nodeLoad = nil
+	for i := range loads {
+		l := &loads[i]
+		if !l.draining && l.movable && (source == nil || l.pending > source.pending) {
+			source = l
+		}
+	}
+	if source == nil || source == target {
+		return nil, nil, 0
+	}
+
+	average := total / targets
+	spread := REBALANCE_SPREAD
+	if average/10 > spread {
+		spread = average / 10
+	}
+	if source.pending-target.pending <= spread {
+		return nil, nil, 0
+	}
+
+	count := minInt(REBALANCE_BATCH, minInt(source.pending-average, average-target.pending))
+	if count < 1 {
+		count = 1
+	}
+	return source.node, target.node, count
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// moveSchedules moves count schedules from source to target
+func moveSchedules(source *Node, target *Node, count int) (int, error) {
+	place := func(msg *message.Obj) error {
+		return placeOn(target, msg)
+	}
+	if source == nil {
+		return handOffMaster(count, place)
+	}
+
+	moved, err := handOff(source, count, place)
+	if moved > 0 {
+		source.adjust(-moved)
+	}
+	return moved, err
+}
+
+// placeOn schedules msg on node, nil being the master. A pending request
+// counts as placed, keeping the schedule too could fire it twice.
+func placeOn(node *Node, msg *message.Obj) error {
+	if node == nil {
+		_, err := schedule.NewSchedule(msg)
+		return err
+	}
+	id, err := scheduleOnSlave(node, msg)
+	if err == Err_Distribute_Pending {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	replicateSchedule(node, id, msg)
+	return nil
+}
+
+// handOffMaster moves up to limit of the master's own schedules, which are
+// never replicated
+func handOffMaster(limit int, place func(*message.Obj) error) (int, error) {
+	msgs, err := schedule.HandOff(limit)
+	if err != nil {
+		return 0, err
+	}
+	defer schedule.Restore()
+
+	moved := make([]int, 0, len(msgs))
+	for _, msg := range msgs {
+		schedule_id := msg.ScheduleId
+		msg.ScheduleId = 0
+		if err := place(msg); err != nil {
+			log.Println("Failed moving a schedule of the master: " + err.Error())
+			continue
+		}
+		moved = append(moved, schedule_id)
+	}
+	schedule.Release(moved)
+	return len(moved), nil
+}
@@ -0,0 +1,75 @@
+package clustering
+
+import (
+	"testing"
+)
+
+func TestPickMove(t *testing.T) {
+	a := newNode("10.0.5.1:9090", 0, 0)
+	b := newNode("10.0.5.2:9090", 0, 1)
+	d := newNode("10.0.5.3:9090", 0, 2)
+	name := func(node *Node) string {
+		if node == nil {
+			return "master"
+		}
+		return node.address
+	}
+
+	for case_name, c := range map[string]struct {
+		loads  []nodeLoad
+		source *Node
+		target *Node
+		count  int
+	}{
+		"within spread": {[]nodeLoad{{nil, 10, false, true}, {a, 20, false, true}}, nil, nil, 0},
+		"busiest to idlest": {[]nodeLoad{{nil, 0, false, true}, {a, 60, false, true}, {b, 30, false, true}},
+			a, nil, 30},
+		"up to the average": {[]nodeLoad{{nil, 25, false, true}, {a, 40, false, true}, {b, 25, false, true}, {d, 10, false, true}},
+			a, d, 15},
+		"capped at a batch": {[]nodeLoad{{nil, 1000, false, true}, {a, 0, false, true}}, nil, a, REBALANCE_BATCH},
+		"spread of a tenth": {[]nodeLoad{{nil, 1050, false, true}, {a, 950, false, true}}, nil, nil, 0},
+		"drained first": {[]nodeLoad{{nil, 30, false, true}, {a, 5, true, true}, {b, 20, false, true}},
+			a, b, 5},
+		"drained batches": {[]nodeLoad{{nil, 0, false, true}, {a, 500, true, true}}, a, nil, REBALANCE_BATCH},
+		"v1 stays put": {[]nodeLoad{{nil, 0, false, true}, {a, 90, false, false}, {b, 60, false, true}},
+			b, nil, 10},
+		"drained v1 stays put": {[]nodeLoad{{nil, 10, false, true}, {a, 50, true, false}, {b, 10, false, true}},
+			nil, nil, 0},
+		"all drained":   {[]nodeLoad{{a, 50, true, true}, {b, 50, true, true}}, nil, nil, 0},
+		"busiest is v1": {[]nodeLoad{{nil, 0, false, true}, {a, 90, false, false}}, nil, nil, 0},
+	} {
+		source, target, count := pickMove(c.loads)
+		if source != c.source || target != c.target || count != c.count {
+			t.Errorf("%s: moves %d from %s to %s, expected %d from %s to %s", case_name, count, name(source), name(target),
+				c.count, name(c.source), name(c.target))
+		}
+	}
+}
+
+func TestNodeLoads(t *testing.T) {
+	nodes, restore := withSlaves(5, 7, 9, 11)
+	defer restore()
+	nodes[0].version = PROTOCOL_V2
+	nodes[1].closed = true
+	nodes[2].evicting = true
+	nodes[3].draining = true
+
+	loads := nodeLoads()
+	if len(loads) != 3 || loads[0].node != nil || !loads[0].movable {
+		t.Fatalf("loads %+v, expected the master first", loads)
+	}
+	for _, l := range loads[1:] {
+		switch l.node {
+		case nodes[0]:
+			if l.pending != 5 || !l.movable || l.draining {
+				t.Errorf("v2 slave %+v", l)
+			}
+		case nodes[3]:
+			if l.pending != 11 || l.movable || !l.draining {
+				t.Errorf("drained v1 slave %+v", l)
+			}
+		default:
+			t.Errorf("%s is not placed on", l.node.address)
+		}
+	}
+}
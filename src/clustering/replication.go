@@ -0,0 +1,513 @@
+package clustering
+
+import (
+	"conf"
+	"errors"
+	"log"
+	"message"
+	"schedule"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Schedule replication. With cluster_replicas set, a schedule placed on a
+// slave, its primary, is also copied to that many other nodes, the master
+// included:
+//
+//	master: COMM_TYPE_REPLICA       primary, schedule id, fire time, message
+//	master: COMM_TYPE_REPLICA_DROP  primary, schedule id
+//	master: COMM_TYPE_TAKEOVER      primary, on or off
+//	slave:  COMM_TYPE_CLAIM         primary or "" for itself, schedule id
+//	master: COMM_TYPE_CLAIM         same frame id, granted or not
+//
+// Before firing, a slave claims the schedule from the master, which grants
+// the first claim only and drops the other copies. While the master can't
+// reach a primary it tells the holders to take over, and they claim and
+// fire their copies when due. A primary back from the dead finds its
+// overdue schedules claimed and skips them, so a message is delivered once.
+//
+// Claims live on the master and are lost with it, a schedule due around a
+// failover may still be delivered twice.
+const (
+	REPLICA_CHECK_PERIOD = time.Second
+	CLAIM_RETRY_PERIOD   = time.Second
+	CLAIM_DEADLINE       = 30 * time.Second
+	CLAIM_RETENTION      = 24 * time.Hour
+)
+
+var (
+	Err_Claim_Unsupported = errors.New("Master does not arbitrate claims")
+	Err_Claim_Timeout     = errors.New("No answer to claim from master")
+)
+
+type replicaKey struct {
+	primary     string // Primary's address
+	schedule_id int    // Schedule id on the primary
+}
+
+type replicaSet struct {
+	holders []*Node // nil is the master itself
+	fire_at int64
+}
+
+type claim struct {
+	owner string // Claimer's address, "" for the master
+	at    time.Time
+}
+
+type replica struct {
+	msg     *message.Obj
+	fire_at int64
+}
+
+// Kept by the master
+var (
+	replica_sets       = make(map[replicaKey]*replicaSet)
+	claims             = make(map[replicaKey]claim)
+	last_claim_sweep   = time.Now()
+	replicationLock    = new(sync.Mutex)
+	claim_waiters      = make(map[uint64]chan bool)
+	claimLock          = new(sync.Mutex)
+	startReplicaFiring = new(sync.Once)
+)
+
+// Kept by every holder
+var (
+	replicas    = make(map[replicaKey]*replica)
+	taken_over  = make(map[string]bool)
+	replicaLock = new(sync.Mutex)
+)
+
+func replicaPayload(key replicaKey, fire_at int64, msg *message.Obj) []byte {
+	w := newPayload(COMM_TYPE_REPLICA)
+	w.putString(key.primary)
+	w.putInt64(int64(key.schedule_id))
+	w.putInt64(fire_at)
+	w.putInt64(int64(msg.MessageType))
+	w.putString(msg.Endpoint)
+	w.putString(msg.MessageBody)
+	w.putInt64(int64(msg.Priority))
+	w.putString(msg.Tenant)
+	w.putInt64(msg.ValidUntil)
+	return w.Bytes()
+}
+
+func decodeReplica(payload []byte) (replicaKey, int64, *message.Obj, error) {
+	r := newPayloadReader(payload)
+	primary := r.getString()
+	schedule_id := r.getInt64()
+	fire_at := r.getInt64()
+	msg_type := r.getInt64()
+	endpoint := r.getString()
+	body := r.getString()
+	priority := int64(message.PRIORITY_NORMAL)
+	if r.more() {
+		priority = r.getInt64()
+	}
+	tenant := ""
+	if r.more() {
+		tenant = r.getString()
+	}
+	var valid_until int64 = 0
+	if r.more() {
+		valid_until = r.getInt64()
+	}
+	if r.err != nil {
+		return replicaKey{}, 0, nil, r.err
+	}
+	msg, err := message.NewMessageObject(int(msg_type), endpoint, body, 0)
+	if err == nil {
+		msg.Priority = int(priority)
+		msg.Tenant = tenant
+		msg.ValidUntil = valid_until
+	}
+	return replicaKey{primary, int(schedule_id)}, fire_at, msg, err
+}
+
+// Used by COMM_TYPE_REPLICA_DROP and COMM_TYPE_CLAIM requests
+func keyPayload(comm_type byte, key replicaKey) []byte {
+	w := newPayload(comm_type)
+	w.putString(key.primary)
+	w.putInt64(int64(key.schedule_id))
+	return w.Bytes()
+}
+
+func decodeKey(payload []byte) (replicaKey, error) {
+	r := newPayloadReader(payload)
+	primary := r.getString()
+	schedule_id := r.getInt64()
+	return replicaKey{primary, int(schedule_id)}, r.err
+}
+
+func takeoverPayload(primary string, on bool) []byte {
+	w := newPayload(COMM_TYPE_TAKEOVER)
+	w.putString(primary)
+	if on {
+		w.putInt64(1)
+	} else {
+		w.putInt64(0)
+	}
+	return w.Bytes()
+}
+
+func decodeTakeover(payload []byte) (string, bool, error) {
+	r := newPayloadReader(payload)
+	primary := r.getString()
+	on := r.getInt64()
+	return primary, on == 1, r.err
+}
+
+func claimReply(granted bool) []byte {
+	w := newPayload(COMM_TYPE_CLAIM)
+	if granted {
+		w.putInt64(1)
+	} else {
+		w.putInt64(0)
+	}
+	return w.Bytes()
+}
+
+// replicateSchedule copies a schedule a slave took to the holders picked
+// for it
+func replicateSchedule(primary *Node, schedule_id int, msg *message.Obj) {
+	RWLock.RLock()
+	key := replicaKey{primary.address, schedule_id}
+	RWLock.RUnlock()
+
+	// Gone when never replicated or already claimed by its primary
+	replicationLock.Lock()
+	set, ok := replica_sets[key]
+	replicationLock.Unlock()
+	if !ok {
+		return
+	}
+
+	data := replicaPayload(key, set.fire_at, msg)
+	for _, holder := range set.holders {
+		if holder == nil {
+			storeReplica(key, set.fire_at, msg)
+		} else if !sendToNode(holder, data) {
+			log.Println("Failed sending replica to " + holder.address)
+		}
+	}
+}
+
+// recordReplicas picks the holders of a schedule a slave just took, before
+// the slave can claim it. The caller is handling the slave's reply in order,
+// so a claim read after it finds the set.
+func recordReplicas(primary *Node, schedule_id int, msg *message.Obj) {
+	count := conf.GetClusterReplicas()
+	if count == 0 || msg.Expiration < 1000 {
+		return
+	}
+
+	RWLock.RLock()
+	v2 := primary.version >= PROTOCOL_V2
+	address := primary.address
+	RWLock.RUnlock()
+	if !v2 {
+		// v1 slaves don't claim before firing
+		return
+	}
+
+	key := replicaKey{address, schedule_id}
+	fire_at := time.Now().UnixNano()/1000000 + msg.Expiration
+	holders := replicaHolders(primary, count)
+
+	replicationLock.Lock()
+	replica_sets[key] = &replicaSet{holders, fire_at}
+	replicationLock.Unlock()
+}
+
+// replicaHolders picks up to count nodes other than primary, walking a
+// ring of the master and the v2 slaves from a point given by the primary
+func replicaHolders(primary *Node, count int) []*Node {
+	RWLock.RLock()
+	nodes := make([]*Node, 0, len(slave_connections))
+	for _, node := range slave_connections {
+		if node != primary && !node.closed && !node.draining && node.version >= PROTOCOL_V2 {
+			nodes = append(nodes, node)
+		}
+	}
+	RWLock.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].address < nodes[j].address })
+	nodes = append([]*Node{nil}, nodes...)
+	if count > len(nodes) {
+		count = len(nodes)
+	}
+
+	start := int(hashKey(primary.address) % uint32(len(nodes)))
+	holders := make([]*Node, count)
+	for i := range holders {
+		holders[i] = nodes[(start+i)%len(nodes)]
+	}
+	return holders
+}
+
+// claimSchedule grants the first claim on a replicated schedule, again to
+// the same claimer, and drops the copies of the other holders. Schedules
+// never replicated are granted to their primary without being recorded.
+func claimSchedule(key replicaKey, claimer string) bool {
+	replicationLock.Lock()
+	sweepClaims()
+	if c, claimed := claims[key]; claimed {
+		replicationLock.Unlock()
+		return c.owner == claimer
+	}
+	set, replicated := replica_sets[key]
+	delete(replica_sets, key)
+	if replicated || claimer != key.primary {
+		claims[key] = claim{claimer, time.Now()}
+	}
+	replicationLock.Unlock()
+
+	if !replicated {
+		return true
+	}
+	data := keyPayload(COMM_TYPE_REPLICA_DROP, key)
+	for _, holder := range set.holders {
+		if holder == nil {
+			if claimer != "" {
+				dropReplica(key)
+			}
+			continue
+		}
+
+		RWLock.RLock()
+		address := holder.address
+		RWLock.RUnlock()
+		if address != claimer {
+			sendToNode(holder, data)
+		}
+	}
+	return true
+}
+
+// sweepClaims forgets old claims and copies, the caller holds
+// replicationLock
+func sweepClaims() {
+	if time.Since(last_claim_sweep) < time.Minute {
+		return
+	}
+	last_claim_sweep = time.Now()
+
+	cutoff := time.Now().Add(-CLAIM_RETENTION)
+	for key, c := range claims {
+		if c.at.Before(cutoff) {
+			delete(claims, key)
+		}
+	}
+	for key, set := range replica_sets {
+		if set.fire_at < cutoff.UnixNano()/1000000 {
+			delete(replica_sets, key)
+		}
+	}
+}
+
+// takeOver tells every holder whether the master reaches a primary
+func takeOver(primary string, on bool) {
+	if conf.GetClusterReplicas() == 0 {
+		return
+	}
+	setTakeover(primary, on)
+
+	RWLock.RLock()
+	nodes := make([]*Node, 0, len(slave_connections))
+	for _, node := range slave_connections {
+		if node.address != primary && !node.closed && node.version >= PROTOCOL_V2 {
+			nodes = append(nodes, node)
+		}
+	}
+	RWLock.RUnlock()
+
+	data := takeoverPayload(primary, on)
+	for _, node := range nodes {
+		sendToNode(node, data)
+	}
+}
+
+func storeReplica(key replicaKey, fire_at int64, msg *message.Obj) {
+	replicaLock.Lock()
+	replicas[key] = &replica{msg, fire_at}
+	replicaLock.Unlock()
+
+	startReplicaFiring.Do(func() {
+		go fireReplicas()
+	})
+}
+
+func dropReplica(key replicaKey) {
+	replicaLock.Lock()
+	delete(replicas, key)
+	replicaLock.Unlock()
+}
+
+func setTakeover(primary string, on bool) {
+	replicaLock.Lock()
+	if on && !taken_over[primary] {
+		log.Println("Taking over schedules of " + primary)
+	}
+	if on {
+		taken_over[primary] = true
+	} else {
+		delete(taken_over, primary)
+	}
+	replicaLock.Unlock()
+}
+
+// clearTakeovers forgets the last master's view, a new one tells again
+func clearTakeovers() {
+	replicaLock.Lock()
+	taken_over = make(map[string]bool)
+	replicaLock.Unlock()
+}
+
+// fireReplicas fires the copies that are due for primaries taken over
+func fireReplicas() {
+	for range time.Tick(REPLICA_CHECK_PERIOD) {
+		now := time.Now().UnixNano() / 1000000
+		cutoff := now - int64(CLAIM_RETENTION/time.Millisecond)
+
+		due := make(map[replicaKey]*replica)
+		replicaLock.Lock()
+		for key, r := range replicas {
+			if r.fire_at < cutoff {
+				delete(replicas, key)
+			} else if r.fire_at <= now && taken_over[key.primary] {
+				due[key] = r
+			}
+		}
+		replicaLock.Unlock()
+
+		for key, r := range due {
+			fireReplica(key, r)
+		}
+	}
+}
+
+func fireReplica(key replicaKey, r *replica) {
+	var granted bool
+	if isLeader() {
+		granted = claimSchedule(key, "")
+	} else {
+		var err error
+		granted, err = claimFromMaster(key)
+		if err != nil {
+			// Tried again on the next check
+			return
+		}
+	}
+
+	dropReplica(key)
+	if !granted {
+		return
+	}
+
+	log.Println("Firing schedule " + strconv.Itoa(key.schedule_id) + " of " + key.primary)
+	msg := *r.msg
+	msg.Expiration = 0
+	if _, err := schedule.NewSchedule(&msg); err != nil {
+		log.Println("Failed firing replica: " + err.Error())
+	}
+}
+
+// claimFromMaster asks the master for the right to fire a schedule, an
+// empty primary claims one of this node's own
+func claimFromMaster(key replicaKey) (bool, error) {
+	RWLock.RLock()
+	connected := master_connection != nil && !master_connection.closed
+	v2 := connected && master_connection.version >= PROTOCOL_V2
+	RWLock.RUnlock()
+	if !connected {
+		return false, Err_Master_Disconnected
+	} else if !v2 {
+		return false, Err_Claim_Unsupported
+	}
+
+	id := nextFrameId()
+	reply := make(chan bool, 1)
+	claimLock.Lock()
+	claim_waiters[id] = reply
+	claimLock.Unlock()
+	defer func() {
+		claimLock.Lock()
+		delete(claim_waiters, id)
+		claimLock.Unlock()
+	}()
+
+	sendMasterFrame(keyPayload(COMM_TYPE_CLAIM, key), id)
+	select {
+	case granted := <-reply:
+		return granted, nil
+	case <-time.After(SLAVE_REPLY_TIMEOUT):
+		return false, Err_Claim_Timeout
+	}
+}
+
+func answerClaim(id uint64, payload []byte) {
+	r := newPayloadReader(payload)
+	granted := r.getInt64() == 1
+	if r.err != nil {
+		log.Println("Invalid claim reply")
+		return
+	}
+
+	claimLock.Lock()
+	reply, ok := claim_waiters[id]
+	claimLock.Unlock()
+	if ok {
+		reply <- granted
+	}
+}
+
+// guardFire makes a slave claim its schedules before firing them. It
+// waits up to CLAIM_DEADLINE for the master, then cluster_claim_fallback
+// decides. Schedules are fired when the master can't arbitrate.
+func guardFire(schedule_id int) bool {
+	deadline := time.Now().Add(CLAIM_DEADLINE)
+	for {
+		granted, err := claimFromMaster(replicaKey{"", schedule_id})
+		if err == nil {
+			return granted
+		} else if err == Err_Claim_Unsupported {
+			return true
+		}
+		log.Println("Claiming schedule " + strconv.Itoa(schedule_id) + " failed: " + err.Error())
+		if time.Now().After(deadline) {
+			fire := conf.GetClusterClaimFallback() == conf.CLAIM_FALLBACK_FIRE
+			if fire {
+				log.Println("Firing schedule " + strconv.Itoa(schedule_id) + " unclaimed, the master is unreachable")
+			} else {
+				log.Println("Skipping schedule " + strconv.Itoa(schedule_id) + ", the master is unreachable")
+			}
+			return fire
+		}
+		time.Sleep(CLAIM_RETRY_PERIOD)
+	}
+}
+
+// answerSlaveClaim handles COMM_TYPE_CLAIM on the master
+func answerSlaveClaim(frame *Frame, node *Node) {
+	key, err := decodeKey(frame.Payload)
+	if err != nil {
+		log.Println("Invalid claim")
+		return
+	}
+
+	RWLock.RLock()
+	address := node.address
+	RWLock.RUnlock()
+	if key.primary == "" {
+		key.primary = address
+	}
+
+	granted := claimSchedule(key, address)
+
+	RWLock.RLock()
+	index := node.index
+	RWLock.RUnlock()
+	sendSlaveFrame(claimReply(granted), index, frame.Id)
+}
@@ -0,0 +1,167 @@
+package clustering
+
+import (
+	"bufio"
+	"message"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplicaRoundTrip(t *testing.T) {
+	msg := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST https://hooks.example.com/x text/plain",
+		MessageBody: "line 1\nline 2", Priority: message.PRIORITY_HIGH, Tenant: "acme", ValidUntil: 1500000000000}
+	key := replicaKey{"10.0.3.1:9090", 42}
+
+	data := replicaPayload(key, 1234, msg)
+	decoded_key, fire_at, decoded, err := decodeReplica(data[1:])
+	if err != nil || decoded_key != key || fire_at != 1234 {
+		t.Fatalf("key %v, fire at %d, %v", decoded_key, fire_at, err)
+	}
+	if decoded.Endpoint != msg.Endpoint || decoded.MessageBody != msg.MessageBody || decoded.Priority != msg.Priority ||
+		decoded.Tenant != msg.Tenant || decoded.ValidUntil != msg.ValidUntil {
+		t.Errorf("replica came back as %+v", decoded)
+	}
+	if _, _, _, err := decodeReplica(data[1:20]); err != Err_Invalid_Payload {
+		t.Errorf("torn replica: expected Err_Invalid_Payload, got %v", err)
+	}
+
+	if decoded_key, err := decodeKey(keyPayload(COMM_TYPE_CLAIM, key)[1:]); err != nil || decoded_key != key {
+		t.Errorf("claim key %v, %v", decoded_key, err)
+	}
+	if primary, on, err := decodeTakeover(takeoverPayload(key.primary, true)[1:]); err != nil || primary != key.primary || !on {
+		t.Errorf("takeover %s %v, %v", primary, on, err)
+	}
+}
+
+func TestReplicaHolders(t *testing.T) {
+	nodes, restore := withSlaves(0, 0, 0, 0)
+	defer restore()
+	for _, node := range nodes[:3] {
+		node.version = PROTOCOL_V2
+	}
+	nodes[2].draining = true
+
+	// Neither the primary, a draining node nor a v1 one holds copies
+	holders := replicaHolders(nodes[0], 5)
+	if len(holders) != 2 {
+		t.Fatalf("%d holders, expected the master and one slave", len(holders))
+	}
+	for _, holder := range holders {
+		if holder != nil && holder != nodes[1] {
+			t.Errorf("%s holds a copy", holder.address)
+		}
+	}
+	if holders[0] == holders[1] {
+		t.Error("the same node holds two copies")
+	}
+	if holders := replicaHolders(nodes[0], 1); len(holders) != 1 {
+		t.Errorf("%d holders, expected 1", len(holders))
+	}
+}
+
+// expectDrop reads a COMM_TYPE_REPLICA_DROP for key off a holder, or
+// expects nothing when key is nil
+func expectDrop(t *testing.T, name string, reader *bufio.Reader, remote net.Conn, key *replicaKey) {
+	remote.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	frame, err := readFrame(PROTOCOL_V2, reader)
+	if key == nil {
+		if err == nil {
+			t.Errorf("%s got a frame of type %d", name, frame.Type)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if dropped, err := decodeKey(frame.Payload); frame.Type != COMM_TYPE_REPLICA_DROP || err != nil || dropped != *key {
+		t.Errorf("%s got type %d for %v, %v", name, frame.Type, dropped, err)
+	}
+}
+
+func TestClaimArbitration(t *testing.T) {
+	nodes, restore := withSlaves(0, 0)
+	defer restore()
+	readers := make([]*bufio.Reader, len(nodes))
+	remotes := make([]net.Conn, len(nodes))
+	for i, node := range nodes {
+		local, remote := net.Pipe()
+		defer local.Close()
+		defer remote.Close()
+		node.attach(local, node.name, PROTOCOL_V2)
+		readers[i], remotes[i] = bufio.NewReader(remote), remote
+	}
+
+	key := replicaKey{"10.0.3.2:9090", 7}
+	defer func() {
+		replicationLock.Lock()
+		delete(claims, key)
+		delete(replica_sets, key)
+		replicationLock.Unlock()
+	}()
+	msg := &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST https://hooks.example.com/x text/plain"}
+	replicationLock.Lock()
+	replica_sets[key] = &replicaSet{[]*Node{nil, nodes[0], nodes[1]}, time.Now().UnixNano() / 1000000}
+	replicationLock.Unlock()
+	storeReplica(key, 0, msg)
+
+	// The first holder to claim fires, the other copies are dropped
+	done := make(chan bool)
+	go func() {
+		expectDrop(t, "other holder", readers[1], remotes[1], &key)
+		expectDrop(t, "claimer", readers[0], remotes[0], nil)
+		close(done)
+	}()
+	if !claimSchedule(key, nodes[0].address) {
+		t.Error("first claim refused")
+	}
+	<-done
+	replicaLock.Lock()
+	_, kept := replicas[key]
+	replicaLock.Unlock()
+	if kept {
+		t.Error("the master kept its copy")
+	}
+
+	for claimer, expected := range map[string]bool{
+		nodes[1].address: false,
+		key.primary:      false,
+		"":               false,
+		nodes[0].address: true,
+	} {
+		if granted := claimSchedule(key, claimer); granted != expected {
+			t.Errorf("claim of %q granted %v", claimer, granted)
+		}
+	}
+}
+
+func TestClaimNeverReplicated(t *testing.T) {
+	own := replicaKey{"10.0.3.3:9090", 8}
+	other := replicaKey{"10.0.3.3:9090", 9}
+	defer func() {
+		replicationLock.Lock()
+		delete(claims, own)
+		delete(claims, other)
+		replicationLock.Unlock()
+	}()
+
+	// A primary firing its own schedule leaves nothing behind
+	if !claimSchedule(own, own.primary) || !claimSchedule(own, own.primary) {
+		t.Error("primary refused its own schedule")
+	}
+	replicationLock.Lock()
+	_, recorded := claims[own]
+	replicationLock.Unlock()
+	if recorded {
+		t.Error("claim recorded for a schedule never replicated")
+	}
+
+	// Anyone else's claim keeps a primary back from the dead off it
+	if !claimSchedule(other, "") {
+		t.Error("master's claim refused")
+	}
+	if claimSchedule(other, other.primary) {
+		t.Error("primary fired a schedule claimed by the master")
+	}
+}
@@ -0,0 +1,148 @@
+package clustering
+
+import (
+	"conf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// Cluster links are authenticated in two ways, both optional:
+//
+//	cluster_tls  every link is TLS, master and slave present certificates
+//	             signed by the cluster CA
+//	secret       proven with an HMAC challenge-response in the handshake,
+//	             the secret itself never crosses the network
+//
+// Peers are known by address rather than host name, so certificates are
+// checked against the CA only.
+const (
+	TLS_HANDSHAKE_TIMEOUT = 5 * time.Second
+	CHALLENGE_SIZE        = 32
+)
+
+var (
+	Err_No_Peer_Certificate = errors.New("Peer sent no certificate")
+	Err_Invalid_CA_File     = errors.New("No certificate found in CA file")
+)
+
+var cluster_tls_config *tls.Config = nil
+var clusterTLSLock = new(sync.Mutex)
+
+// clusterTLSConfig loads the cluster certificates once, nil when
+// cluster_tls is not configured
+func clusterTLSConfig() (*tls.Config, error) {
+	files := conf.GetClusterTLS()
+	if files == nil {
+		return nil, nil
+	}
+
+	clusterTLSLock.Lock()
+	defer clusterTLSLock.Unlock()
+	if cluster_tls_config != nil {
+		return cluster_tls_config, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(files.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, Err_Invalid_CA_File
+	}
+
+	cluster_tls_config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		// Both ends check the chain in verifyClusterPeer, see above
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyClusterPeer(pool),
+	}
+	return cluster_tls_config, nil
+}
+
+func verifyClusterPeer(pool *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return Err_No_Peer_Certificate
+		}
+		certs := make([]*x509.Certificate, len(raw))
+		for i, der := range raw {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		return err
+	}
+}
+
+// secureMaster wraps the master's end of a link, the conn is returned as
+// is without cluster_tls
+func secureMaster(conn *net.TCPConn) (net.Conn, error) {
+	config, err := clusterTLSConfig()
+	if err != nil || config == nil {
+		return conn, err
+	}
+	tls_conn := tls.Client(conn, config)
+	return tls_conn, tlsHandshake(tls_conn)
+}
+
+func secureSlave(conn *net.TCPConn) (net.Conn, error) {
+	config, err := clusterTLSConfig()
+	if err != nil || config == nil {
+		return conn, err
+	}
+	tls_conn := tls.Server(conn, config)
+	return tls_conn, tlsHandshake(tls_conn)
+}
+
+func tlsHandshake(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+	return conn.Handshake()
+}
+
+func newChallenge() ([]byte, error) {
+	nonce := make([]byte, CHALLENGE_SIZE)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// challengeResponse proves knowledge of the secret for a nonce. The role
+// keeps a master's answer from being replayed as a slave's.
+func challengeResponse(role string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(conf.GetNetworkSecret()))
+	mac.Write([]byte(role))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+func checkChallenge(role string, nonce []byte, response []byte) bool {
+	return hmac.Equal(challengeResponse(role, nonce), response)
+}
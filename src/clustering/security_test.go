@@ -0,0 +1,137 @@
+package clustering
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newCert makes a certificate for name signed by parent, self-signed
+// without one
+func newCert(t *testing.T, name string, ca bool, parent *x509.Certificate, parent_key *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parent_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parent_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyClusterPeer(t *testing.T) {
+	ca, ca_key := newCert(t, "cluster-ca", true, nil, nil)
+	intermediate, intermediate_key := newCert(t, "cluster-intermediate", true, ca, ca_key)
+	node, _ := newCert(t, "10.0.3.1", false, ca, ca_key)
+	chained, _ := newCert(t, "10.0.3.2", false, intermediate, intermediate_key)
+	stranger, _ := newCert(t, "10.0.3.3", false, nil, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	verify := verifyClusterPeer(pool)
+
+	if err := verify([][]byte{node.Raw}, nil); err != nil {
+		t.Errorf("node signed by the CA: %v", err)
+	}
+	if err := verify([][]byte{chained.Raw, intermediate.Raw}, nil); err != nil {
+		t.Errorf("node signed through an intermediate: %v", err)
+	}
+	if err := verify([][]byte{chained.Raw}, nil); err == nil {
+		t.Error("chain without its intermediate accepted")
+	}
+	if err := verify([][]byte{stranger.Raw}, nil); err == nil {
+		t.Error("self-signed node accepted")
+	}
+	if err := verify(nil, nil); err != Err_No_Peer_Certificate {
+		t.Errorf("expected Err_No_Peer_Certificate, got %v", err)
+	}
+	if err := verify([][]byte{[]byte("not a certificate")}, nil); err == nil {
+		t.Error("garbage accepted")
+	}
+}
+
+func TestChallengeResponse(t *testing.T) {
+	nonce, err := newChallenge()
+	if err != nil || len(nonce) != CHALLENGE_SIZE {
+		t.Fatalf("nonce %x, %v", nonce, err)
+	}
+	other, _ := newChallenge()
+
+	response := challengeResponse("slave", nonce)
+	if !checkChallenge("slave", nonce, response) {
+		t.Error("right response refused")
+	}
+	// A master's answer can't be replayed as a slave's, nor for another nonce
+	if checkChallenge("master", nonce, response) {
+		t.Error("response accepted for another role")
+	}
+	if checkChallenge("slave", other, response) {
+		t.Error("response accepted for another nonce")
+	}
+	if checkChallenge("slave", nonce, response[:16]) {
+		t.Error("truncated response accepted")
+	}
+}
+
+func TestChallengeHandshake(t *testing.T) {
+	slave, master := net.Pipe()
+	defer slave.Close()
+	defer master.Close()
+
+	result := make(chan int8, 1)
+	go func() { result <- challengeMaster(slave) }()
+
+	code, data := readAndCheckTimeOut(master)
+	if code != 0 || len(data) != 1+CHALLENGE_SIZE || data[0] != HANDSHAKE_L1_RESPONSE_NONCE[0] {
+		t.Fatalf("challenge %x, %d", data, code)
+	}
+	if code := answerSlaveChallenge(master, data[1:]); code != HANDSHAKE_STATUS_SUCCESS {
+		t.Errorf("master side: %d", code)
+	}
+	if code := <-result; code != HANDSHAKE_STATUS_SUCCESS {
+		t.Errorf("slave side: %d", code)
+	}
+}
+
+// A peer answering with the slave's role is not a master
+func TestChallengeRefusesWrongRole(t *testing.T) {
+	slave, master := net.Pipe()
+	defer slave.Close()
+	defer master.Close()
+
+	result := make(chan int8, 1)
+	go func() { result <- challengeMaster(slave) }()
+
+	_, data := readAndCheckTimeOut(master)
+	nonce, _ := newChallenge()
+	master.Write(append(challengeResponse("slave", data[1:]), nonce...))
+	if _, answer := readAndCheckTimeOut(master); len(answer) != 1 || answer[0] != HANDSHAKE_L2_RESPONSE_REFUSE[0] {
+		t.Errorf("answered %x", answer)
+	}
+	if code := <-result; code != HANDSHAKE_STATUS_REFUSED {
+		t.Errorf("slave side: %d", code)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"jsonwrapper"
+	"math"
+	"strings"
 )
 
 const (
@@ -16,13 +18,54 @@ const (
 	DEFAULT_BIND_PORT              = "443"
 	DEFAULT_GRANDMA_NAME           = "Grandma-Sharon"
 	DEFAULT_MSG_START_TYPE         = 100
-	DEFAULT_MSG_END_TYPE           = 109
+	DEFAULT_MSG_END_TYPE           = 110
 	DEFAULT_QUEUE_LENGTH           = 1000
 	DEFAULT_NETWORK_SECRET         = "GrandmaService"
 	DEFAULT_REST_SECRET            = "GrandmaSecret"
 	DEFAULT_CLUSTER_MODE           = false
 	DEFAULT_NETWORK_PORT           = "12345"
 	DEFAULT_SCHEDULE_TTL_MAX int64 = 30 * 24 * 60 * 60 * 1000
+	DEFAULT_SMS_MAX_SEGMENTS       = 10
+	DEFAULT_WS_MAILBOX_SIZE        = 100
+)
+
+// Values of cluster_placement
+const (
+	PLACEMENT_LEAST_LOADED    = "least_loaded"
+	PLACEMENT_ROUND_ROBIN     = "round_robin"
+	PLACEMENT_CONSISTENT_HASH = "consistent_hash"
+
+	DEFAULT_CLUSTER_PLACEMENT = PLACEMENT_LEAST_LOADED
+
+	DEFAULT_CLUSTER_FAILOVER_TIMEOUT = 30
+)
+
+// Values of cluster_claim_fallback
+const (
+	CLAIM_FALLBACK_FIRE = "fire"
+	CLAIM_FALLBACK_SKIP = "skip"
+)
+
+// Values of queue_overflow
+const (
+	QUEUE_OVERFLOW_SPILL = "spill"
+	QUEUE_OVERFLOW_BLOCK = "block"
+	QUEUE_OVERFLOW_ERROR = "error"
+)
+
+// Keys of rate_limits, what messages are limited by
+const (
+	RATE_LIMIT_ENDPOINT = "endpoint"
+	RATE_LIMIT_HOST     = "host"
+	RATE_LIMIT_CHANNEL  = "channel"
+	RATE_LIMIT_TENANT   = "tenant"
+)
+
+// Heartbeat defaults, in seconds
+const (
+	DEFAULT_CLUSTER_HEARTBEAT_INTERVAL = 1
+	DEFAULT_CLUSTER_SUSPECT_TIMEOUT    = 5
+	DEFAULT_CLUSTER_DEAD_TIMEOUT       = 15
 )
 
 const (
@@ -42,11 +85,49 @@ const (
 
 	CONF_SMS_ID         = "sms_id"
 	CONF_SMS_SECRET     = "sms_secret"
+	CONF_SMS_PROVIDER   = "sms_provider"
+	CONF_SMS_CALLBACK   = "sms_callback_url"
+	CONF_SMS_SEGMENTS   = "sms_max_segments"
 	CONF_EMAIL_SENDER   = "email_sender"
 	CONF_EMAIL_SMTP     = "email_smtp"
 	CONF_EMAIL_UNAME    = "email_username"
 	CONF_EMAIL_PWORD    = "email_password"
+	CONF_EMAIL_TLS      = "email_tls"
 	CONF_GCM_APP_SECRET = "gcm_secret"
+
+	CONF_AMQP_PROFILES  = "amqp_profiles"
+	CONF_KAFKA_PROFILES = "kafka_profiles"
+
+	CONF_REST_TLS_PROFILES = "rest_tls_profiles"
+
+	CONF_WS_AUTH         = "ws_auth"
+	CONF_WS_MAILBOX_TTL  = "ws_mailbox_ttl"
+	CONF_WS_MAILBOX_SIZE = "ws_mailbox_size"
+
+	CONF_CLUSTER_TLS         = "cluster_tls"
+	CONF_CLUSTER_LEGACY_AUTH = "cluster_legacy_auth"
+	CONF_CLUSTER_PLACEMENT   = "cluster_placement"
+	CONF_CLUSTER_WEIGHTS     = "cluster_weights"
+
+	CONF_CLUSTER_FAILOVER_TIMEOUT = "cluster_failover_timeout"
+	CONF_CLUSTER_REPLICAS         = "cluster_replicas"
+	CONF_CLUSTER_MASTER           = "cluster_master"
+	CONF_CLUSTER_REBALANCE        = "cluster_rebalance"
+
+	CONF_REGION = "region"
+
+	CONF_CLUSTER_HEARTBEAT_INTERVAL = "cluster_heartbeat_interval"
+	CONF_CLUSTER_SUSPECT_TIMEOUT    = "cluster_suspect_timeout"
+	CONF_CLUSTER_DEAD_TIMEOUT       = "cluster_dead_timeout"
+
+	CONF_CLUSTER_DIAL_MASTER = "cluster_dial_master"
+
+	CONF_CLUSTER_CLAIM_FALLBACK = "cluster_claim_fallback"
+
+	CONF_QUEUE_DIR      = "queue_dir"
+	CONF_QUEUE_OVERFLOW = "queue_overflow"
+
+	CONF_RATE_LIMITS = "rate_limits"
 )
 
 var (
@@ -57,7 +138,6 @@ var (
 	cluster_mode       bool       = DEFAULT_CLUSTER_MODE
 	queue_length       int        = DEFAULT_QUEUE_LENGTH
 	slave_list         *list.List = nil
-	region_list        *list.List = nil
 	ws_slave_list      *list.List = nil
 	ttl_max            int64      = DEFAULT_SCHEDULE_TTL_MAX
 	network_port       string     = DEFAULT_NETWORK_PORT
@@ -65,6 +145,129 @@ var (
 	rest_secret        string     = DEFAULT_REST_SECRET
 )
 
+// Delivery channel profiles keyed by profile name
+var (
+	amqp_profiles     = make(map[string]string)
+	kafka_profiles    = make(map[string][]string)
+	rest_tls_profiles = make(map[string]*TLSFiles)
+)
+
+// SMTP settings for the email channel. TLSMode is starttls, implicit or
+// none.
+type EmailSettings struct {
+	Server   string
+	Username string
+	Password string
+	Sender   string
+	TLSMode  string
+}
+
+var email_settings = EmailSettings{TLSMode: "starttls"}
+
+// SMS provider settings, see distributor.SMSProvider
+var (
+	sms_provider     *jsonwrapper.Object = nil
+	sms_callback_url string              = ""
+	sms_max_segments int                 = DEFAULT_SMS_MAX_SEGMENTS
+)
+
+// Websocket client settings. ws_auth is described in auth.New, messages
+// for offline ids are kept for ws_mailbox_ttl seconds (0 disables it).
+var (
+	ws_auth         *jsonwrapper.Object = nil
+	ws_mailbox_ttl  int64               = 0
+	ws_mailbox_size int                 = DEFAULT_WS_MAILBOX_SIZE
+)
+
+// Cluster link security. With cluster_tls every link is TLS with
+// certificates checked against the CA on both ends. cluster_legacy_auth
+// lets the secret go in plaintext to and from nodes older than the
+// challenge-response handshake.
+var (
+	cluster_tls         *TLSFiles = nil
+	cluster_legacy_auth bool      = false
+)
+
+// How the master places schedules, see clustering.placeSchedule. Weights
+// are keyed by node name, nodes left out weigh 1.
+var (
+	cluster_placement = DEFAULT_CLUSTER_PLACEMENT
+	cluster_weights   = make(map[string]int)
+)
+
+// Seconds a slave waits without hearing from the master before taking
+// over, 0 disables failover
+var cluster_failover_timeout int64 = DEFAULT_CLUSTER_FAILOVER_TIMEOUT
+
+// Copies kept of each schedule placed on a slave, on other nodes
+var cluster_replicas int = 0
+
+// What a slave does with a schedule it couldn't claim from the master in
+// time, fire it at the risk of a second delivery or skip it
+var cluster_claim_fallback string = CLAIM_FALLBACK_FIRE
+
+// Where a slave announces itself, the master's network_port
+var cluster_master string = ""
+
+// Move pending schedules between nodes when slaves join
+var cluster_rebalance bool = true
+
+// Seconds between heartbeats, and of silence before a node is suspect and
+// before it is dropped, 0 never drops it
+var (
+	cluster_heartbeat_interval int64 = DEFAULT_CLUSTER_HEARTBEAT_INTERVAL
+	cluster_suspect_timeout    int64 = DEFAULT_CLUSTER_SUSPECT_TIMEOUT
+	cluster_dead_timeout       int64 = DEFAULT_CLUSTER_DEAD_TIMEOUT
+)
+
+// Where queues keep their log and spill over, nowhere when empty. What a
+// full queue does with new messages, spilling needs queue_dir and blocks
+// without it.
+var (
+	queue_dir      string = ""
+	queue_overflow string = QUEUE_OVERFLOW_SPILL
+)
+
+// Slaves dial the master in cluster_master instead of waiting to be dialed
+var cluster_dial_master bool = false
+
+// A token bucket: Rate messages a second on average, up to Burst at once
+// after a quiet spell
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Limits of one kind of rate_limits. Default applies to every key without
+// its own limit in Keys, nil leaves them unlimited.
+type RateLimitSettings struct {
+	Default *RateLimit
+	Keys    map[string]*RateLimit
+}
+
+// Delivery rate limits by kind, kinds left out are not limited
+var rate_limits = make(map[string]*RateLimitSettings)
+
+// Another region schedules are relayed to
+type RegionSettings struct {
+	Url    string   // Base URL of the region's REST API, https
+	Secret string   // The region's rest_secret, relayed calls are signed with it
+	Near   []string // Endpoint prefixes and host suffixes the region is nearest to
+}
+
+// Name of this region and the other regions by name
+var (
+	region      string = ""
+	region_list        = make(map[string]*RegionSettings)
+)
+
+// Certificate and key files used to set up a TLS connection
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
 var (
 	ErrorInvalidSettings       = errors.New("Invalid settings read from config file")
 	ErrorNotSupportMessageType = errors.New("Message type not supported")
@@ -130,7 +333,11 @@ func GetSlaveList() *list.List {
 	return slave_list
 }
 
-func GetRegionList() *list.List {
+func GetRegion() string {
+	return region
+}
+
+func GetRegionList() map[string]*RegionSettings {
 	return region_list
 }
 
@@ -138,6 +345,86 @@ func GetNetworkSecret() string {
 	return network_secret
 }
 
+// Returns the certificate files for cluster links, nil when cluster links
+// are not encrypted
+func GetClusterTLS() *TLSFiles {
+	return cluster_tls
+}
+
+func GetClusterLegacyAuth() bool {
+	return cluster_legacy_auth
+}
+
+func GetClusterPlacement() string {
+	return cluster_placement
+}
+
+func GetClusterFailoverTimeout() int64 {
+	return cluster_failover_timeout
+}
+
+func GetClusterReplicas() int {
+	return cluster_replicas
+}
+
+func GetClusterClaimFallback() string {
+	return cluster_claim_fallback
+}
+
+func GetClusterMaster() string {
+	return cluster_master
+}
+
+func GetClusterRebalance() bool {
+	return cluster_rebalance
+}
+
+func GetClusterHeartbeatInterval() int64 {
+	return cluster_heartbeat_interval
+}
+
+func GetClusterSuspectTimeout() int64 {
+	return cluster_suspect_timeout
+}
+
+func GetClusterDeadTimeout() int64 {
+	return cluster_dead_timeout
+}
+
+func GetQueueDir() string {
+	return queue_dir
+}
+
+func GetQueueOverflow() string {
+	return queue_overflow
+}
+
+func GetClusterDialMaster() bool {
+	return cluster_dial_master
+}
+
+// GetRateLimit returns the limit on key of a kind of rate_limits, nil when
+// it has none
+func GetRateLimit(kind string, key string) *RateLimit {
+	settings, ok := rate_limits[kind]
+	if !ok {
+		return nil
+	}
+	if limit, ok := settings.Keys[key]; ok {
+		return limit
+	}
+	return settings.Default
+}
+
+// Returns the placement weight of a node by name
+func GetClusterWeight(name string) int {
+	weight, ok := cluster_weights[name]
+	if !ok {
+		return 1
+	}
+	return weight
+}
+
 func GetRestSecret() string {
 	return rest_secret
 }
@@ -146,6 +433,56 @@ func GetQueueLength() int {
 	return queue_length
 }
 
+// Returns the AMQP url registered under the given profile name
+func GetAMQPProfile(name string) (string, bool) {
+	url, ok := amqp_profiles[name]
+	return url, ok
+}
+
+// Returns the bootstrap brokers registered under the given profile name
+func GetKafkaProfile(name string) ([]string, bool) {
+	brokers, ok := kafka_profiles[name]
+	return brokers, ok
+}
+
+// Returns the client certificate files registered for REST calls
+func GetRestTLSProfile(name string) (*TLSFiles, bool) {
+	files, ok := rest_tls_profiles[name]
+	return files, ok
+}
+
+func GetEmailSettings() EmailSettings {
+	return email_settings
+}
+
+// Returns the sms_provider object, nil if no provider is configured
+func GetSMSProvider() *jsonwrapper.Object {
+	return sms_provider
+}
+
+// Returns the public base url the SMS status callback is reachable at
+func GetSMSCallbackURL() string {
+	return sms_callback_url
+}
+
+func GetSMSMaxSegments() int {
+	return sms_max_segments
+}
+
+// Returns the ws_auth object, nil if websocket clients are not enabled
+func GetWsAuth() *jsonwrapper.Object {
+	return ws_auth
+}
+
+// Returns how long, in seconds, messages wait for an offline websocket id
+func GetWsMailboxTTL() int64 {
+	return ws_mailbox_ttl
+}
+
+func GetWsMailboxSize() int {
+	return ws_mailbox_size
+}
+
 func Configure() {
 	err := readConfigFromFile()
 	if err != nil {
@@ -243,6 +580,44 @@ func setKey(key string, obj *jsonwrapper.Object) error {
 		}
 		queue_length = int(data)
 		break
+	case CONF_QUEUE_DIR:
+		data, err := obj.GetString(CONF_QUEUE_DIR)
+		if err != nil {
+			return err
+		}
+		queue_dir = data
+		break
+	case CONF_QUEUE_OVERFLOW:
+		data, err := obj.GetString(CONF_QUEUE_OVERFLOW)
+		if err != nil {
+			return err
+		}
+		if data != QUEUE_OVERFLOW_SPILL && data != QUEUE_OVERFLOW_BLOCK && data != QUEUE_OVERFLOW_ERROR {
+			return ErrorInvalidSettings
+		}
+		queue_overflow = data
+		break
+	case CONF_RATE_LIMITS:
+		data, err := obj.GetObject(CONF_RATE_LIMITS)
+		if err != nil {
+			return err
+		}
+		for kind := range data.Map() {
+			if kind != RATE_LIMIT_ENDPOINT && kind != RATE_LIMIT_HOST &&
+				kind != RATE_LIMIT_CHANNEL && kind != RATE_LIMIT_TENANT {
+				return ErrorInvalidSettings
+			}
+			limits, err := data.GetObject(kind)
+			if err != nil {
+				return err
+			}
+			settings, err := readRateLimits(limits)
+			if err != nil {
+				return err
+			}
+			rate_limits[kind] = settings
+		}
+		break
 	case CONF_REST_SIG_SECRET:
 		data, err := obj.GetString(CONF_REST_SIG_SECRET)
 
@@ -252,12 +627,368 @@ func setKey(key string, obj *jsonwrapper.Object) error {
 
 		rest_secret = data
 		break
+	case CONF_AMQP_PROFILES:
+		data, err := obj.GetObject(CONF_AMQP_PROFILES)
+		if err != nil {
+			return err
+		}
+		for name, value := range data.Map() {
+			url, err := value.String()
+			if err != nil {
+				return err
+			}
+			amqp_profiles[name] = url
+		}
+		break
+	case CONF_KAFKA_PROFILES:
+		data, err := obj.GetObject(CONF_KAFKA_PROFILES)
+		if err != nil {
+			return err
+		}
+		for name := range data.Map() {
+			brokers, err := data.GetStringArray(name)
+			if err != nil {
+				return err
+			}
+			if len(brokers) == 0 {
+				return ErrorInvalidSettings
+			}
+			kafka_profiles[name] = brokers
+		}
+		break
+	case CONF_EMAIL_SMTP:
+		data, err := obj.GetString(CONF_EMAIL_SMTP)
+		if err != nil {
+			return err
+		}
+		email_settings.Server = data
+		break
+	case CONF_EMAIL_UNAME:
+		data, err := obj.GetString(CONF_EMAIL_UNAME)
+		if err != nil {
+			return err
+		}
+		email_settings.Username = data
+		break
+	case CONF_EMAIL_PWORD:
+		data, err := obj.GetString(CONF_EMAIL_PWORD)
+		if err != nil {
+			return err
+		}
+		email_settings.Password = data
+		break
+	case CONF_EMAIL_SENDER:
+		data, err := obj.GetString(CONF_EMAIL_SENDER)
+		if err != nil {
+			return err
+		}
+		email_settings.Sender = data
+		break
+	case CONF_EMAIL_TLS:
+		data, err := obj.GetString(CONF_EMAIL_TLS)
+		if err != nil {
+			return err
+		}
+		if data != "starttls" && data != "implicit" && data != "none" {
+			return ErrorInvalidSettings
+		}
+		email_settings.TLSMode = data
+		break
+	case CONF_SMS_PROVIDER:
+		data, err := obj.GetObject(CONF_SMS_PROVIDER)
+		if err != nil {
+			return err
+		}
+		sms_provider = data
+		break
+	case CONF_SMS_CALLBACK:
+		data, err := obj.GetString(CONF_SMS_CALLBACK)
+		if err != nil {
+			return err
+		}
+		sms_callback_url = strings.TrimRight(data, "/")
+		break
+	case CONF_SMS_SEGMENTS:
+		data, err := obj.GetInt64(CONF_SMS_SEGMENTS)
+		if err != nil {
+			return err
+		}
+		if data < 1 {
+			return ErrorInvalidSettings
+		}
+		sms_max_segments = int(data)
+		break
+	case CONF_WS_AUTH:
+		data, err := obj.GetObject(CONF_WS_AUTH)
+		if err != nil {
+			return err
+		}
+		ws_auth = data
+		break
+	case CONF_WS_MAILBOX_TTL:
+		data, err := obj.GetInt64(CONF_WS_MAILBOX_TTL)
+		if err != nil {
+			return err
+		}
+		if data < 0 {
+			return ErrorInvalidSettings
+		}
+		ws_mailbox_ttl = data
+		break
+	case CONF_WS_MAILBOX_SIZE:
+		data, err := obj.GetInt64(CONF_WS_MAILBOX_SIZE)
+		if err != nil {
+			return err
+		}
+		if data < 1 {
+			return ErrorInvalidSettings
+		}
+		ws_mailbox_size = int(data)
+		break
+	case CONF_REST_TLS_PROFILES:
+		data, err := obj.GetObject(CONF_REST_TLS_PROFILES)
+		if err != nil {
+			return err
+		}
+		for name := range data.Map() {
+			profile, err := data.GetObject(name)
+			if err != nil {
+				return err
+			}
+			files, err := readTLSFiles(profile)
+			if err != nil {
+				return err
+			}
+			rest_tls_profiles[name] = files
+		}
+		break
+	case CONF_REGION:
+		data, err := obj.GetString(CONF_REGION)
+		if err != nil {
+			return err
+		}
+		region = data
+		break
+	case CONF_REGION_LIST:
+		data, err := obj.GetObject(CONF_REGION_LIST)
+		if err != nil {
+			return err
+		}
+		for name := range data.Map() {
+			settings, err := data.GetObject(name)
+			if err != nil {
+				return err
+			}
+			url, err := settings.GetString("url")
+			if err != nil {
+				return err
+			}
+			if !strings.HasPrefix(url, "https://") {
+				return ErrorInvalidSettings
+			}
+			secret, _ := settings.GetString("secret")
+			near, _ := settings.GetStringArray("near")
+			region_list[name] = &RegionSettings{strings.TrimSuffix(url, "/"), secret, near}
+		}
+		break
+	case CONF_CLUSTER_TLS:
+		data, err := obj.GetObject(CONF_CLUSTER_TLS)
+		if err != nil {
+			return err
+		}
+		files, err := readTLSFiles(data)
+		if err != nil {
+			return err
+		}
+		// Both ends present a certificate, so all three files are needed
+		if files.CertFile == "" || files.CAFile == "" {
+			return ErrorInvalidSettings
+		}
+		cluster_tls = files
+		break
+	case CONF_CLUSTER_LEGACY_AUTH:
+		data, err := obj.GetBoolean(CONF_CLUSTER_LEGACY_AUTH)
+		if err != nil {
+			return err
+		}
+		cluster_legacy_auth = data
+		break
+	case CONF_CLUSTER_CLAIM_FALLBACK:
+		data, err := obj.GetString(CONF_CLUSTER_CLAIM_FALLBACK)
+		if err != nil {
+			return err
+		}
+		if data != CLAIM_FALLBACK_FIRE && data != CLAIM_FALLBACK_SKIP {
+			return ErrorInvalidSettings
+		}
+		cluster_claim_fallback = data
+		break
+	case CONF_CLUSTER_PLACEMENT:
+		data, err := obj.GetString(CONF_CLUSTER_PLACEMENT)
+		if err != nil {
+			return err
+		}
+		if data != PLACEMENT_LEAST_LOADED && data != PLACEMENT_ROUND_ROBIN && data != PLACEMENT_CONSISTENT_HASH {
+			return ErrorInvalidSettings
+		}
+		cluster_placement = data
+		break
+	case CONF_CLUSTER_FAILOVER_TIMEOUT:
+		data, err := obj.GetInt64(CONF_CLUSTER_FAILOVER_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		if data < 0 {
+			return ErrorInvalidSettings
+		}
+		cluster_failover_timeout = data
+		break
+	case CONF_CLUSTER_REPLICAS:
+		data, err := obj.GetInt64(CONF_CLUSTER_REPLICAS)
+		if err != nil {
+			return err
+		}
+		if data < 0 {
+			return ErrorInvalidSettings
+		}
+		cluster_replicas = int(data)
+		break
+	case CONF_CLUSTER_MASTER:
+		data, err := obj.GetString(CONF_CLUSTER_MASTER)
+		if err != nil {
+			return err
+		}
+		cluster_master = data
+		break
+	case CONF_CLUSTER_REBALANCE:
+		data, err := obj.GetBoolean(CONF_CLUSTER_REBALANCE)
+		if err != nil {
+			return err
+		}
+		cluster_rebalance = data
+		break
+	case CONF_CLUSTER_HEARTBEAT_INTERVAL:
+		data, err := obj.GetInt64(CONF_CLUSTER_HEARTBEAT_INTERVAL)
+		if err != nil {
+			return err
+		}
+		if data < 1 {
+			return ErrorInvalidSettings
+		}
+		cluster_heartbeat_interval = data
+		break
+	case CONF_CLUSTER_SUSPECT_TIMEOUT:
+		data, err := obj.GetInt64(CONF_CLUSTER_SUSPECT_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		if data < 1 {
+			return ErrorInvalidSettings
+		}
+		cluster_suspect_timeout = data
+		break
+	case CONF_CLUSTER_DEAD_TIMEOUT:
+		data, err := obj.GetInt64(CONF_CLUSTER_DEAD_TIMEOUT)
+		if err != nil {
+			return err
+		}
+		if data < 0 {
+			return ErrorInvalidSettings
+		}
+		cluster_dead_timeout = data
+		break
+	case CONF_CLUSTER_DIAL_MASTER:
+		data, err := obj.GetBoolean(CONF_CLUSTER_DIAL_MASTER)
+		if err != nil {
+			return err
+		}
+		cluster_dial_master = data
+		break
+	case CONF_CLUSTER_WEIGHTS:
+		data, err := obj.GetObject(CONF_CLUSTER_WEIGHTS)
+		if err != nil {
+			return err
+		}
+		for name := range data.Map() {
+			weight, err := data.GetInt64(name)
+			if err != nil {
+				return err
+			}
+			if weight < 0 {
+				return ErrorInvalidSettings
+			}
+			cluster_weights[name] = int(weight)
+		}
+		break
 	default:
 		return ErrorUnknownConfigKey
 	}
 	return nil
 }
 
+// Reads cert_file, key_file and ca_file. Certificate and key must be set
+// together, the CA file is optional.
+func readTLSFiles(obj *jsonwrapper.Object) (*TLSFiles, error) {
+	files := new(TLSFiles)
+	files.CertFile, _ = obj.GetString("cert_file")
+	files.KeyFile, _ = obj.GetString("key_file")
+	files.CAFile, _ = obj.GetString("ca_file")
+
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, ErrorInvalidSettings
+	}
+
+	return files, nil
+}
+
+// Reads a default rate and burst and a "keys" object of the same by key
+func readRateLimits(obj *jsonwrapper.Object) (*RateLimitSettings, error) {
+	settings := &RateLimitSettings{nil, make(map[string]*RateLimit)}
+	if _, err := obj.GetValue("rate"); err == nil {
+		limit, err := readRateLimit(obj)
+		if err != nil {
+			return nil, err
+		}
+		settings.Default = limit
+	}
+
+	if _, err := obj.GetValue("keys"); err != nil {
+		return settings, nil
+	}
+	keys, err := obj.GetObject("keys")
+	if err != nil {
+		return nil, err
+	}
+	for key := range keys.Map() {
+		data, err := keys.GetObject(key)
+		if err != nil {
+			return nil, err
+		}
+		limit, err := readRateLimit(data)
+		if err != nil {
+			return nil, err
+		}
+		settings.Keys[key] = limit
+	}
+	return settings, nil
+}
+
+// The burst defaults to a second's worth of messages
+func readRateLimit(obj *jsonwrapper.Object) (*RateLimit, error) {
+	rate, err := obj.GetFloat64("rate")
+	if err != nil || rate <= 0 {
+		return nil, ErrorInvalidSettings
+	}
+	burst, err := obj.GetInt64("burst")
+	if err != nil {
+		burst = int64(math.Ceil(rate))
+	}
+	if burst < 1 {
+		return nil, ErrorInvalidSettings
+	}
+	return &RateLimit{rate, int(burst)}, nil
+}
+
 func readConfigFromFile() error {
 	setDefault()
 
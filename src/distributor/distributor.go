@@ -8,6 +8,20 @@ import (
 func ProcessMessageQueue() {
 	var msg = queue.Main_Queue.PopMessage()
 
+	if msg.MessageType != message.S_DELETE_MESSAGE {
+		if msg.Expired() {
+			unbook(msg)
+			expire(msg)
+			go ProcessMessageQueue()
+			return
+		}
+		if wait := throttle(msg); wait > 0 {
+			requeue(msg, wait)
+			go ProcessMessageQueue()
+			return
+		}
+	}
+
 	var dist_type = msg.MessageType
 	var endpoint = msg.Endpoint
 	var msg_body = msg.MessageBody
@@ -15,13 +29,13 @@ func ProcessMessageQueue() {
 	case message.S_DELETE_MESSAGE:
 		go ProcessMessageQueue()
 	case message.S_REST_NOTIFICATION:
-		go sendRESTCall(endpoint, msg_body)
+		go func() { expireIf(msg, sendRESTCall(endpoint, msg_body, msg.ValidUntil)) }()
 		go ProcessMessageQueue()
 	case message.S_WEBSOCKET_NOTIFICATION:
-		go sendWebSocketMsg(endpoint, msg_body)
+		go func() { expireIf(msg, sendWebSocketMsg(endpoint, msg_body, msg.ScheduleId, msg.ValidUntil)) }()
 		go ProcessMessageQueue()
 	case message.S_SMS_NOTIFICATION:
-		go sendSMSMessage(endpoint, msg_body)
+		go func() { expireIf(msg, sendSMSMessage(endpoint, msg_body, msg.ScheduleId, msg.ValidUntil)) }()
 		go ProcessMessageQueue()
 	case message.S_GCM_NOTIFICATION:
 		go sendGCMPushNotification(endpoint, msg_body)
@@ -32,8 +46,14 @@ func ProcessMessageQueue() {
 	// case message.S_TOPIC_NOTIFICATION:
 	// 	go sendTopicPushNotification(endpoint, msg_body)
 	// 	go ProcessMessageQueue()
+	case message.S_RABBITMQ_NOTIFICATION:
+		go func() { expireIf(msg, sendRabbitMQMessage(endpoint, msg_body, msg.ValidUntil)) }()
+		go ProcessMessageQueue()
+	case message.S_KAFKA_NOTIFICATION:
+		go func() { expireIf(msg, sendKafkaMessage(endpoint, msg_body, msg.ValidUntil)) }()
+		go ProcessMessageQueue()
 	case message.S_EMAIL_NOTIFICATION:
-		go sendEmailMsg(endpoint, msg_body)
+		go func() { expireIf(msg, sendEmailMsg(endpoint, msg_body, msg.ValidUntil)) }()
 		go ProcessMessageQueue()
 	default:
 		go ProcessMessageQueue()
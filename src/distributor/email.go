@@ -1,17 +1,524 @@
 package distributor
 
 import (
+	"bytes"
+	"conf"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"jsonwrapper"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
-func sendEmailMsg(endpoint string, message string) error {
-	auth := smtp.PlainAuth("", "email", "sTech123", "smtp.gmail.com")
+const (
+	EMAIL_IDLE_TIMEOUT    = 30 * time.Second
+	EMAIL_DIAL_TIMEOUT    = 10 * time.Second
+	MAX_ATTACHMENT_SIZE   = 10 * 1024 * 1024
+	ATTACHMENT_TIMEOUT    = 20 * time.Second
+	DEFAULT_EMAIL_SUBJECT = "Notification"
+)
+
+var (
+	ErrorInvalidEmailAddress = errors.New("Invalid email address")
+	ErrorNoEmailRecipient    = errors.New("No email recipient")
+	ErrorInvalidAttachment   = errors.New("Invalid email attachment")
+	ErrorEmailNotConfigured  = errors.New("SMTP server not configured")
+	ErrorStartTLSUnsupported = errors.New("SMTP server does not support STARTTLS")
+)
+
+// Structured email payload carried in the message body:
+//
+//	{
+//		"from": "Grandma <grandma@example.com>",
+//		"to": ["a@example.com"], "cc": [], "bcc": [],
+//		"subject": "Your ride",
+//		"text": "plain text part",
+//		"html": "<p>html part</p>",
+//		"attachments": [
+//			{"filename": "ticket.pdf", "content_type": "application/pdf", "url": "https://..."},
+//			{"filename": "note.txt", "data": "<base64>"}
+//		]
+//	}
+//
+// Recipients in the endpoint (comma separated) are added to "to". A body
+// that is not a JSON object is sent as plain text.
+type email struct {
+	from        string
+	to          []string
+	cc          []string
+	bcc         []string
+	subject     string
+	text        string
+	html        string
+	attachments []*attachment
+	valid_until int64 // Milliseconds, not sent after it, 0 if it never expires
+}
+
+type attachment struct {
+	filename     string
+	content_type string
+	data         []byte
+}
+
+// Connection settings for the SMTP server. tls_mode is starttls, implicit
+// or none.
+type mailSettings struct {
+	host     string
+	username string
+	password string
+	sender   string
+	tls_mode string
+}
+
+// mailer keeps one SMTP connection open between sends so bulk deliveries
+// don't pay for a new handshake each time. The connection is closed after
+// it has been idle for EMAIL_IDLE_TIMEOUT.
+type mailer struct {
+	settings *mailSettings
+	client   *smtp.Client
+	lock     *sync.Mutex
+	idle     *time.Timer
+}
+
+var default_mailer *mailer = nil
+var mailerLock = new(sync.Mutex)
+
+func getMailer() (*mailer, error) {
+	mailerLock.Lock()
+	defer mailerLock.Unlock()
+
+	if default_mailer != nil {
+		return default_mailer, nil
+	}
+
+	settings := conf.GetEmailSettings()
+	if settings.Server == "" {
+		return nil, ErrorEmailNotConfigured
+	}
+
+	default_mailer = newMailer(&mailSettings{settings.Server, settings.Username,
+		settings.Password, settings.Sender, settings.TLSMode})
+	return default_mailer, nil
+}
+
+func newMailer(settings *mailSettings) *mailer {
+	return &mailer{settings: settings, lock: new(sync.Mutex)}
+}
+
+func sendEmailMsg(endpoint string, message string, valid_until int64) error {
+	e, err := parseEmail(endpoint, message)
+	if err != nil {
+		log.Println("email parsing error")
+		return err
+	}
+	e.valid_until = valid_until
+
+	m, err := getMailer()
+	if err != nil {
+		return err
+	}
+
+	return m.send(e)
+}
+
+func parseEmail(endpoint string, message string) (*email, error) {
+	e := new(email)
+
+	for _, address := range strings.Split(endpoint, ",") {
+		if strings.TrimSpace(address) != "" {
+			e.to = append(e.to, strings.TrimSpace(address))
+		}
+	}
+
+	obj, err := jsonwrapper.NewObjectFromBytes([]byte(message))
+	if err != nil {
+		e.subject = DEFAULT_EMAIL_SUBJECT
+		e.text = message
+		return e, e.validate()
+	}
+
+	e.from, _ = obj.GetString("from")
+	e.subject, _ = obj.GetString("subject")
+	e.text, _ = obj.GetString("text")
+	e.html, _ = obj.GetString("html")
+
+	to, _ := obj.GetStringArray("to")
+	e.to = append(e.to, to...)
+	e.cc, _ = obj.GetStringArray("cc")
+	e.bcc, _ = obj.GetStringArray("bcc")
+
+	if e.subject == "" {
+		e.subject = DEFAULT_EMAIL_SUBJECT
+	}
+
+	attachments, _ := obj.GetObjectArray("attachments")
+	for _, a := range attachments {
+		parsed, err := parseAttachment(a)
+		if err != nil {
+			return nil, err
+		}
+		e.attachments = append(e.attachments, parsed)
+	}
+
+	return e, e.validate()
+}
+
+func (e *email) validate() error {
+	if len(e.to)+len(e.cc)+len(e.bcc) == 0 {
+		return ErrorNoEmailRecipient
+	}
+
+	for _, list := range [][]string{e.to, e.cc, e.bcc} {
+		for _, address := range list {
+			if _, err := mail.ParseAddress(address); err != nil {
+				return ErrorInvalidEmailAddress
+			}
+		}
+	}
+
+	if e.from != "" {
+		if _, err := mail.ParseAddress(e.from); err != nil {
+			return ErrorInvalidEmailAddress
+		}
+	}
+
+	return nil
+}
+
+func parseAttachment(obj *jsonwrapper.Object) (*attachment, error) {
+	a := new(attachment)
+	a.filename, _ = obj.GetString("filename")
+	a.content_type, _ = obj.GetString("content_type")
+
+	if data, err := obj.GetString("data"); err == nil {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, ErrorInvalidAttachment
+		}
+		a.data = decoded
+	} else if url, err := obj.GetString("url"); err == nil {
+		client := &http.Client{Timeout: ATTACHMENT_TIMEOUT}
+		response, err := client.Get(url)
+		if err != nil {
+			return nil, ErrorInvalidAttachment
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return nil, ErrorInvalidAttachment
+		}
+
+		a.data, err = ioutil.ReadAll(io.LimitReader(response.Body, MAX_ATTACHMENT_SIZE+1))
+		if err != nil {
+			return nil, ErrorInvalidAttachment
+		}
+		if a.content_type == "" {
+			a.content_type = response.Header.Get("Content-Type")
+		}
+		if a.filename == "" {
+			a.filename = path.Base(response.Request.URL.Path)
+		}
+	} else {
+		return nil, ErrorInvalidAttachment
+	}
+
+	if len(a.data) > MAX_ATTACHMENT_SIZE || a.filename == "" {
+		return nil, ErrorInvalidAttachment
+	}
+
+	if a.content_type == "" {
+		a.content_type = mime.TypeByExtension(path.Ext(a.filename))
+	}
+	if a.content_type == "" {
+		a.content_type = "application/octet-stream"
+	}
+
+	return a, nil
+}
+
+// build renders the message as MIME. Text and HTML parts go into a
+// multipart/alternative, attachments wrap it in a multipart/mixed.
+func (e *email) build(from string) []byte {
+	buffer := new(bytes.Buffer)
+
+	writeHeader(buffer, "From", from)
+	writeHeader(buffer, "To", strings.Join(e.to, ", "))
+	if len(e.cc) > 0 {
+		writeHeader(buffer, "Cc", strings.Join(e.cc, ", "))
+	}
+	writeHeader(buffer, "Subject", mime.QEncoding.Encode("utf-8", e.subject))
+	writeHeader(buffer, "Date", time.Now().Format(time.RFC1123Z))
+	writeHeader(buffer, "Message-ID", "<"+randomId()+"@"+hostOf(from)+">")
+	writeHeader(buffer, "MIME-Version", "1.0")
+
+	if len(e.attachments) == 0 {
+		e.writeBody(buffer)
+		return buffer.Bytes()
+	}
+
+	mixed := multipart.NewWriter(buffer)
+	writeHeader(buffer, "Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buffer.WriteString("\r\n")
+
+	body := new(bytes.Buffer)
+	e.writeBody(body)
+	header, content := splitHeader(body.Bytes())
+	part, _ := mixed.CreatePart(header)
+	part.Write(content)
+
+	for _, a := range e.attachments {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", a.content_type)
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": a.filename}))
+		part, _ := mixed.CreatePart(header)
+		writeBase64(part, a.data)
+	}
+	mixed.Close()
+
+	return buffer.Bytes()
+}
+
+// writeBody writes Content-Type headers followed by the text and html parts
+func (e *email) writeBody(buffer *bytes.Buffer) {
+	if e.html == "" || e.text == "" {
+		content_type := "text/plain; charset=utf-8"
+		content := e.text
+		if e.html != "" {
+			content_type = "text/html; charset=utf-8"
+			content = e.html
+		}
+		writeHeader(buffer, "Content-Type", content_type)
+		writeHeader(buffer, "Content-Transfer-Encoding", "quoted-printable")
+		buffer.WriteString("\r\n")
+		writeQuotedPrintable(buffer, content)
+		return
+	}
+
+	alternative := multipart.NewWriter(buffer)
+	writeHeader(buffer, "Content-Type", "multipart/alternative; boundary="+alternative.Boundary())
+	buffer.WriteString("\r\n")
+
+	for _, p := range []struct{ content_type, content string }{
+		{"text/plain; charset=utf-8", e.text},
+		{"text/html; charset=utf-8", e.html},
+	} {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", p.content_type)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		part, _ := alternative.CreatePart(header)
+		writeQuotedPrintable(part, p.content)
+	}
+	alternative.Close()
+}
+
+func (e *email) recipients() []string {
+	var ret []string
+	for _, list := range [][]string{e.to, e.cc, e.bcc} {
+		for _, address := range list {
+			parsed, err := mail.ParseAddress(address)
+			if err == nil {
+				ret = append(ret, parsed.Address)
+			}
+		}
+	}
+	return ret
+}
+
+func (m *mailer) send(e *email) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	from := e.from
+	if from == "" {
+		from = m.settings.sender
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return ErrorInvalidEmailAddress
+	}
+
+	content := e.build(from)
+
+	// A reused connection may have been closed by the server, retry once on
+	// a fresh one. Messages queue for the connection, they may expire waiting.
+	for attempt := 0; attempt < 2; attempt++ {
+		if pastValidUntil(e.valid_until) {
+			return ErrorMessageExpired
+		}
+		if err = m.connect(); err != nil {
+			return err
+		}
+
+		err = m.transmit(sender.Address, e.recipients(), content)
+		if err == nil {
+			m.touch()
+			return nil
+		}
+
+		log.Println("SMTP send failed: " + err.Error())
+		m.close()
+	}
+
+	return err
+}
+
+func (m *mailer) transmit(from string, to []string, content []byte) error {
+	if err := m.client.Reset(); err != nil {
+		return err
+	}
+	if err := m.client.Mail(from); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := m.client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+
+	w, err := m.client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	return w.Close()
+}
 
-	to := []string{endpoint}
-	msg := []byte("To: " + endpoint + "\r\n" + message)
-	err := smtp.SendMail("email", auth, "toemail", to, msg)
+func (m *mailer) connect() error {
+	if m.client != nil {
+		if err := m.client.Noop(); err == nil {
+			return nil
+		}
+		m.close()
+	}
+
+	host, _, err := net.SplitHostPort(m.settings.host)
+	if err != nil {
+		return ErrorEmailNotConfigured
+	}
+
+	var conn net.Conn
+	if m.settings.tls_mode == "implicit" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: EMAIL_DIAL_TIMEOUT}, "tcp",
+			m.settings.host, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", m.settings.host, EMAIL_DIAL_TIMEOUT)
+	}
 	if err != nil {
+		return ErrorNetworkDisconnect
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
 		return err
 	}
+
+	if m.settings.tls_mode == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return ErrorStartTLSUnsupported
+		}
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			client.Close()
+			return err
+		}
+	}
+
+	if m.settings.username != "" {
+		auth := smtp.PlainAuth("", m.settings.username, m.settings.password, host)
+		if err := client.Auth(auth); err != nil {
+			client.Close()
+			return err
+		}
+	}
+
+	m.client = client
 	return nil
 }
+
+// touch restarts the idle timer after a successful send
+func (m *mailer) touch() {
+	if m.idle != nil {
+		m.idle.Stop()
+	}
+	m.idle = time.AfterFunc(EMAIL_IDLE_TIMEOUT, func() {
+		m.lock.Lock()
+		m.close()
+		m.lock.Unlock()
+	})
+}
+
+func (m *mailer) close() {
+	if m.client == nil {
+		return
+	}
+	if err := m.client.Quit(); err != nil {
+		m.client.Close()
+	}
+	m.client = nil
+}
+
+func writeHeader(buffer *bytes.Buffer, name, value string) {
+	buffer.WriteString(name + ": " + value + "\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, content string) {
+	qp := quotedprintable.NewWriter(w)
+	qp.Write([]byte(content))
+	qp.Close()
+}
+
+func writeBase64(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		io.WriteString(w, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(w, encoded+"\r\n")
+}
+
+// splitHeader separates a rendered part into its MIME header and content
+func splitHeader(part []byte) (textproto.MIMEHeader, []byte) {
+	header := make(textproto.MIMEHeader)
+	end := bytes.Index(part, []byte("\r\n\r\n"))
+	for _, line := range strings.Split(string(part[:end]), "\r\n") {
+		kv := strings.SplitN(line, ": ", 2)
+		header.Set(kv[0], kv[1])
+	}
+	return header, part[end+4:]
+}
+
+func randomId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func hostOf(address string) string {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "localhost"
+	}
+	at := strings.LastIndex(parsed.Address, "@")
+	return parsed.Address[at+1:]
+}
@@ -0,0 +1,199 @@
+package distributor
+
+import (
+	"bufio"
+	"mime"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts connections and records every message it receives
+type fakeSMTP struct {
+	listener    net.Listener
+	lock        sync.Mutex
+	connections int
+	messages    []string
+	recipients  [][]string
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSMTP{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.connections++
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 fake ESMTP")
+	var rcpt []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-fake")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(command, "MAIL"), strings.HasPrefix(command, "NOOP"):
+			reply("250 OK")
+		case strings.HasPrefix(command, "RSET"):
+			rcpt = nil
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT"):
+			rcpt = append(rcpt, strings.Trim(strings.TrimSpace(line)[8:], "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 go ahead")
+			data := ""
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data += l
+			}
+			s.lock.Lock()
+			s.messages = append(s.messages, data)
+			s.recipients = append(s.recipients, rcpt)
+			s.lock.Unlock()
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("500 unknown")
+		}
+	}
+}
+
+func TestEmailMultipartWithAttachment(t *testing.T) {
+	server := startFakeSMTP(t)
+	defer server.listener.Close()
+
+	m := newMailer(&mailSettings{server.listener.Addr().String(), "", "",
+		"Grandma <grandma@example.com>", "none"})
+
+	e, err := parseEmail("a@example.com", `{
+		"cc": ["b@example.com"],
+		"bcc": ["c@example.com"],
+		"subject": "Héllo",
+		"text": "plain part",
+		"html": "<p>html part</p>",
+		"attachments": [{"filename": "note.txt", "data": "aGVsbG8gd29ybGQ="}]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.send(e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(server.messages))
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(server.messages[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != "Héllo" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if msg.Header.Get("Cc") != "b@example.com" || msg.Header.Get("Bcc") != "" {
+		t.Errorf("unexpected cc/bcc headers")
+	}
+	if !strings.HasPrefix(msg.Header.Get("Content-Type"), "multipart/mixed") {
+		t.Errorf("unexpected content type %s", msg.Header.Get("Content-Type"))
+	}
+	for _, expected := range []string{"multipart/alternative", "plain part", "<p>html part</p>",
+		"filename=note.txt", "aGVsbG8gd29ybGQ="} {
+		if !strings.Contains(server.messages[0], expected) {
+			t.Errorf("message does not contain %s", expected)
+		}
+	}
+	if strings.Join(server.recipients[0], ",") != "a@example.com,b@example.com,c@example.com" {
+		t.Errorf("unexpected recipients %v", server.recipients[0])
+	}
+}
+
+func TestEmailConnectionReuse(t *testing.T) {
+	server := startFakeSMTP(t)
+	defer server.listener.Close()
+
+	m := newMailer(&mailSettings{server.listener.Addr().String(), "", "",
+		"grandma@example.com", "none"})
+
+	for i := 0; i < 3; i++ {
+		e, err := parseEmail("a@example.com", "plain text body")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.send(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(server.messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(server.messages))
+	}
+	if server.connections != 1 {
+		t.Errorf("expected 1 connection, got %d", server.connections)
+	}
+}
+
+func TestEmailInvalidRecipient(t *testing.T) {
+	if _, err := parseEmail("not an address", "body"); err != ErrorInvalidEmailAddress {
+		t.Errorf("expected invalid address error, got %v", err)
+	}
+}
+
+func TestEmailExpiredNotSent(t *testing.T) {
+	server := startFakeSMTP(t)
+	defer server.listener.Close()
+
+	m := newMailer(&mailSettings{server.listener.Addr().String(), "", "",
+		"grandma@example.com", "none"})
+
+	e, err := parseEmail("a@example.com", "plain text body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Waited for the connection past its valid_until
+	e.valid_until = time.Now().Add(-time.Second).UnixNano() / 1000000
+	if err := m.send(e); err != ErrorMessageExpired {
+		t.Errorf("expected ErrorMessageExpired, got %v", err)
+	}
+	if len(server.messages) != 0 {
+		t.Errorf("expected no message, got %d", len(server.messages))
+	}
+}
@@ -0,0 +1,36 @@
+package distributor
+
+import (
+	"errors"
+	"log"
+	"message"
+	"schedule"
+	"strconv"
+	"time"
+)
+
+var ErrorMessageExpired = errors.New("Message expired")
+
+// pastValidUntil tells channels that wait or retry to give up on a message,
+// they return ErrorMessageExpired and the message is reported by expire
+func pastValidUntil(valid_until int64) bool {
+	return valid_until != 0 && time.Now().UnixNano()/1000000 > valid_until
+}
+
+// expireIf reports msg when its channel gave up on it
+func expireIf(msg *message.Obj, err error) {
+	if err == ErrorMessageExpired {
+		expire(msg)
+	}
+}
+
+// expire reports a message past its valid_until in place of sending it,
+// after a restart, a long wait in the queue or retries
+func expire(msg *message.Obj) {
+	late := time.Duration(time.Now().UnixNano()/1000000-msg.ValidUntil) * time.Millisecond
+	log.Println("Message to " + msg.Target() + " expired " + late.String() + " ago, not sending it")
+	if msg.ScheduleId > 0 {
+		schedule.RecordDelivery(msg.ScheduleId, channel_names[msg.MessageType], "", schedule.DELIVERY_STATUS_EXPIRED,
+			"valid until "+strconv.FormatInt(msg.ValidUntil, 10))
+	}
+}
@@ -0,0 +1,124 @@
+package distributor
+
+import (
+	"conf"
+	"errors"
+	"kafka"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorUnknownKafkaProfile = errors.New("Kafka profile not configured")
+)
+
+var kafka_producers = make(map[string]*kafka.Producer)
+var kafkaLock = new(sync.Mutex)
+
+type kafkaTarget struct {
+	profile string
+	topic   string
+	key     []byte
+	headers []kafka.Header
+}
+
+// Endpoint format for Kafka messages is
+//
+//	kafka-profile/topic[/key][?header=value&header=value]
+//
+// where kafka-profile is a key of kafka_profiles in grandma.conf. Records
+// without a key are spread over partitions round robin.
+func parseKafkaEndpoint(endpoint string) (*kafkaTarget, error) {
+	path := endpoint
+	query := ""
+	if i := strings.Index(endpoint, "?"); i >= 0 {
+		path = endpoint[:i]
+		query = endpoint[i+1:]
+	}
+
+	components := strings.SplitN(path, "/", 3)
+	if len(components) < 2 || components[0] == "" || components[1] == "" {
+		return nil, ErrorInvalidEndpointOrBody
+	}
+
+	target := &kafkaTarget{profile: components[0], topic: components[1]}
+	if len(components) == 3 && components[2] != "" {
+		target.key = []byte(components[2])
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, ErrorInvalidEndpointOrBody
+	}
+	for name, list := range values {
+		for _, value := range list {
+			target.headers = append(target.headers, kafka.Header{Key: name, Value: []byte(value)})
+		}
+	}
+
+	return target, nil
+}
+
+func getKafkaProducer(profile string) (*kafka.Producer, error) {
+	brokers, ok := conf.GetKafkaProfile(profile)
+	if !ok {
+		return nil, ErrorUnknownKafkaProfile
+	}
+
+	kafkaLock.Lock()
+	defer kafkaLock.Unlock()
+
+	producer := kafka_producers[profile]
+	if producer == nil {
+		producer = kafka.NewProducer(brokers, strings.Replace(conf.GetGrandmaName(), " ", "_", -1))
+		kafka_producers[profile] = producer
+	}
+
+	return producer, nil
+}
+
+func sendKafkaMessage(endpoint string, msg string, valid_until int64) error {
+	target, err := parseKafkaEndpoint(endpoint)
+	if err != nil {
+		log.Println("endpoint parsing error")
+		return err
+	}
+
+	producer, err := getKafkaProducer(target.profile)
+	if err != nil {
+		return err
+	}
+
+	content_type := "text/plain"
+	trimmed := strings.TrimSpace(msg)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		content_type = "application/json"
+	}
+
+	headers := append([]kafka.Header{
+		{Key: "content-type", Value: []byte(content_type)},
+		{Key: "grandma-node", Value: []byte(conf.GetGrandmaName())},
+	}, target.headers...)
+
+	// Records wait for the ones before them, and retry until valid_until
+	deadline := time.Time{}
+	if valid_until != 0 {
+		deadline = time.Unix(0, valid_until*int64(time.Millisecond))
+	}
+	partition, offset, err := producer.ProduceBefore(target.topic, target.key, []byte(msg), headers, deadline)
+	if err == kafka.ErrorProduceExpired {
+		return ErrorMessageExpired
+	}
+	if err != nil {
+		log.Println("Kafka message to " + endpoint + " failed: " + err.Error())
+		return err
+	}
+
+	log.Println("Kafka message written to " + target.topic + "/" + strconv.Itoa(int(partition)) +
+		" at offset " + strconv.FormatInt(offset, 10))
+	return nil
+}
@@ -1,5 +1,131 @@
 package distributor
 
-func abc() {
-	return
+import (
+	"amqp"
+	"conf"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RABBIT_CONFIRM_TIMEOUT = 5 * time.Second
+	RABBIT_MAX_ATTEMPTS    = 4
+	RABBIT_RETRY_BASE      = 500 * time.Millisecond
+)
+
+var (
+	ErrorUnknownAMQPProfile = errors.New("AMQP profile not configured")
+)
+
+var rabbit_connections = make(map[string]*amqp.Connection)
+var rabbitLock = new(sync.Mutex)
+
+// Endpoint format for RabbitMQ messages is
+//
+//	amqp-profile/exchange/routing-key
+//
+// where amqp-profile is a key of amqp_profiles in grandma.conf. An empty
+// exchange ("profile//queue") publishes through the default exchange
+// directly to the queue named by the routing key.
+func parseRabbitEndpoint(endpoint string) (string, string, string, error) {
+	components := strings.SplitN(endpoint, "/", 3)
+
+	if len(components) != 3 || components[0] == "" {
+		return "", "", "", ErrorInvalidEndpointOrBody
+	}
+
+	return components[0], components[1], components[2], nil
+}
+
+// getRabbitConnection returns a live connection for the profile, dialing a
+// new one when there is none or the previous one has been closed.
+func getRabbitConnection(profile string) (*amqp.Connection, error) {
+	url, ok := conf.GetAMQPProfile(profile)
+	if !ok {
+		return nil, ErrorUnknownAMQPProfile
+	}
+
+	rabbitLock.Lock()
+	defer rabbitLock.Unlock()
+
+	conn := rabbit_connections[profile]
+	if conn != nil && !conn.Closed() {
+		return conn, nil
+	}
+
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("AMQP connected for profile " + profile)
+	rabbit_connections[profile] = conn
+	return conn, nil
+}
+
+// Only publishes that never reached the broker are retried, until the
+// message is past valid_until, see message.Obj. One that may wait for its
+// confirm could be delivered twice, and a closed channel means the broker
+// refused it, as for a missing exchange.
+func sendRabbitMQMessage(endpoint string, msg string, valid_until int64) error {
+	profile, exchange, routing_key, err := parseRabbitEndpoint(endpoint)
+	if err != nil {
+		log.Println("endpoint parsing error")
+		return err
+	}
+
+	content_type := "text/plain"
+	trimmed := strings.TrimSpace(msg)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		content_type = "application/json"
+	}
+
+	props := &amqp.Properties{
+		ContentType:  content_type,
+		DeliveryMode: amqp.DELIVERY_PERSISTENT,
+		Timestamp:    time.Now().Unix(),
+		AppId:        "GrandmaSchedulingServices",
+	}
+
+	backoff := RABBIT_RETRY_BASE
+	for attempt := 1; attempt <= RABBIT_MAX_ATTEMPTS; attempt++ {
+		conn, err := getRabbitConnection(profile)
+		if err == ErrorUnknownAMQPProfile {
+			return err
+		}
+
+		if err == nil {
+			err = conn.Publish(exchange, routing_key, []byte(msg), props, RABBIT_CONFIRM_TIMEOUT)
+			if err == nil {
+				return nil
+			}
+			switch err {
+			case amqp.ErrorPublishNacked:
+				log.Println("AMQP message nacked by broker")
+				return err
+			case amqp.ErrorChannelClosed:
+				log.Println("AMQP message to " + endpoint + " refused by broker")
+				return err
+			case amqp.ErrorConfirmTimeout, amqp.ErrorConfirmLost:
+				log.Println("AMQP message to " + endpoint + " not confirmed, not retried: " + err.Error())
+				return err
+			}
+		}
+
+		log.Printf("AMQP publish attempt %d to %s failed: %s", attempt, endpoint, err.Error())
+		if attempt == RABBIT_MAX_ATTEMPTS {
+			return ErrorNetworkDisconnect
+		}
+
+		time.Sleep(backoff)
+		backoff = backoff * 2
+		if pastValidUntil(valid_until) {
+			return ErrorMessageExpired
+		}
+	}
+
+	return ErrorNetworkDisconnect
 }
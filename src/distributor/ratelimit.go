@@ -0,0 +1,175 @@
+package distributor
+
+import (
+	"conf"
+	"log"
+	"message"
+	"net/mail"
+	"net/url"
+	"queue"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery rate limits from rate_limits in grandma.conf. A message takes a
+// token from the bucket of its endpoint, its destination host, its channel
+// and its tenant, of those that have a limit. When one of them is out of
+// tokens the message books the next ones due and goes back to the queue,
+// which holds it aside until they are and serves the others meanwhile. It is
+// never dropped, and a restart finds it in the queue.
+//
+// Destination hosts are the URL host of REST calls, the domain of the first
+// email recipient and the profile of RabbitMQ and Kafka endpoints. Other
+// channels have none.
+const (
+	RATE_LIMIT_SWEEP_PERIOD = time.Minute
+)
+
+var channel_names = map[int]string{
+	message.S_GCM_NOTIFICATION:       "gcm",
+	message.S_WEBSOCKET_NOTIFICATION: WEBSOCKET_CHANNEL,
+	message.S_EMAIL_NOTIFICATION:     "email",
+	message.S_REST_NOTIFICATION:      "rest",
+	message.S_RABBITMQ_NOTIFICATION:  "rabbitmq",
+	message.S_SMS_NOTIFICATION:       SMS_CHANNEL,
+	message.S_KAFKA_NOTIFICATION:     "kafka",
+}
+
+type bucket struct {
+	tokens float64 // Below 0 when booked ahead
+	last   time.Time
+	limit  *conf.RateLimit
+}
+
+var (
+	buckets    = make(map[string]*bucket)
+	booked     = make(map[*message.Obj]bool) // Throttled messages that hold their tokens
+	last_sweep = time.Now()
+	bucketLock = new(sync.Mutex)
+)
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+}
+
+// wait is how long until the bucket has a token
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// throttle takes the tokens msg needs and says how long it has to wait for
+// them, 0 when it can go now
+func throttle(msg *message.Obj) time.Duration {
+	now := time.Now()
+	bucketLock.Lock()
+	defer bucketLock.Unlock()
+
+	if booked[msg] {
+		delete(booked, msg)
+		return 0
+	}
+	sweepBuckets(now)
+
+	var wait time.Duration = 0
+	taken := make([]*bucket, 0, 4)
+	for kind, key := range rateLimitKeys(msg) {
+		limit := conf.GetRateLimit(kind, key)
+		if limit == nil {
+			continue
+		}
+		b, ok := buckets[kind+"/"+key]
+		if !ok {
+			b = &bucket{float64(limit.Burst), now, limit}
+			buckets[kind+"/"+key] = b
+		}
+		b.refill(now)
+		if w := b.wait(); w > wait {
+			wait = w
+		}
+		taken = append(taken, b)
+	}
+
+	for _, b := range taken {
+		b.tokens--
+	}
+	if wait > 0 {
+		booked[msg] = true
+	}
+	return wait
+}
+
+// unbook forgets the tokens of a throttled message that won't be sent
+func unbook(msg *message.Obj) {
+	bucketLock.Lock()
+	delete(booked, msg)
+	bucketLock.Unlock()
+}
+
+// sweepBuckets forgets the buckets that are full again, the caller holds
+// bucketLock
+func sweepBuckets(now time.Time) {
+	if now.Sub(last_sweep) < RATE_LIMIT_SWEEP_PERIOD {
+		return
+	}
+	last_sweep = now
+	for key, b := range buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(buckets, key)
+		}
+	}
+}
+
+func rateLimitKeys(msg *message.Obj) map[string]string {
+	keys := map[string]string{conf.RATE_LIMIT_ENDPOINT: msg.Endpoint}
+	if host := destinationHost(msg); host != "" {
+		keys[conf.RATE_LIMIT_HOST] = host
+	}
+	if channel, ok := channel_names[msg.MessageType]; ok {
+		keys[conf.RATE_LIMIT_CHANNEL] = channel
+	}
+	if msg.Tenant != "" {
+		keys[conf.RATE_LIMIT_TENANT] = msg.Tenant
+	}
+	return keys
+}
+
+func destinationHost(msg *message.Obj) string {
+	switch msg.MessageType {
+	case message.S_REST_NOTIFICATION:
+		target, err := parseRESTEndpoint(msg.Endpoint)
+		if err != nil {
+			return ""
+		}
+		parsed, err := url.Parse(target.url)
+		if err != nil {
+			return ""
+		}
+		return strings.ToLower(parsed.Hostname())
+	case message.S_EMAIL_NOTIFICATION:
+		first := strings.TrimSpace(strings.Split(msg.Endpoint, ",")[0])
+		parsed, err := mail.ParseAddress(first)
+		if err != nil {
+			return ""
+		}
+		return strings.ToLower(parsed.Address[strings.LastIndex(parsed.Address, "@")+1:])
+	case message.S_RABBITMQ_NOTIFICATION, message.S_KAFKA_NOTIFICATION:
+		return strings.SplitN(msg.Endpoint, "/", 2)[0]
+	}
+	return ""
+}
+
+// requeue puts a throttled message back in the queue until its tokens are
+// due
+func requeue(msg *message.Obj, wait time.Duration) {
+	log.Printf("Message to %s throttled for %v", msg.Target(), wait.Truncate(time.Millisecond))
+	queue.Main_Queue.Delay(msg, time.Now().Add(wait))
+}
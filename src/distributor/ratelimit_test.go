@@ -0,0 +1,114 @@
+package distributor
+
+import (
+	"conf"
+	"io/ioutil"
+	"message"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The rate limits of every test in the package, tests use their own
+// endpoints so they don't share buckets
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "distributor")
+	if err != nil {
+		panic(err)
+	}
+	config := filepath.Join(dir, "grandma.conf")
+	err = ioutil.WriteFile(config, []byte(`{"queue_length": 10, "rate_limits": {
+		"endpoint": {"rate": 10, "burst": 2},
+		"host": {"keys": {"slow.example.com": {"rate": 1}}},
+		"tenant": {"keys": {"small": {"rate": 100, "burst": 1}}}
+	}}`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	// Keeps the test flags, ReadFlags parses them all
+	os.Args = append([]string{os.Args[0], "-c", config}, os.Args[1:]...)
+	conf.ReadFlags()
+	conf.Configure()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func restMessage(url string) *message.Obj {
+	return &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST " + url + " text/plain",
+		MessageBody: "m", Expiration: 1000}
+}
+
+// About, as tokens refill while the test runs
+func expectWait(t *testing.T, wait time.Duration, expected time.Duration) {
+	if wait > expected || wait < expected-20*time.Millisecond {
+		t.Errorf("waits %v, expected %v", wait, expected)
+	}
+}
+
+func TestThrottleBooksAhead(t *testing.T) {
+	msgs := make([]*message.Obj, 4)
+	waits := make([]time.Duration, 4)
+	for i := range msgs {
+		msgs[i] = restMessage("https://hooks.example.com/ahead")
+		waits[i] = throttle(msgs[i])
+	}
+
+	// The burst goes at once, the others book the next tokens at 10/s
+	expectWait(t, waits[0], 0)
+	expectWait(t, waits[1], 0)
+	expectWait(t, waits[2], 100*time.Millisecond)
+	expectWait(t, waits[3], 200*time.Millisecond)
+
+	// A booked message goes once it comes back, without a new token
+	if wait := throttle(msgs[2]); wait != 0 {
+		t.Errorf("booked message waits %v again", wait)
+	}
+	expectWait(t, throttle(restMessage("https://hooks.example.com/ahead")), 300*time.Millisecond)
+}
+
+func TestThrottleTakesTheLongestWait(t *testing.T) {
+	// Each endpoint has its burst, their host has a token a second
+	expectWait(t, throttle(restMessage("https://slow.example.com/a")), 0)
+	expectWait(t, throttle(restMessage("https://slow.example.com/b")), time.Second)
+}
+
+func TestThrottleByTenant(t *testing.T) {
+	first := restMessage("https://hooks.example.com/tenant-a")
+	first.Tenant = "small"
+	second := restMessage("https://hooks.example.com/tenant-b")
+	second.Tenant = "small"
+	other := restMessage("https://hooks.example.com/tenant-c")
+	other.Tenant = "large"
+
+	expectWait(t, throttle(first), 0)
+	expectWait(t, throttle(second), 10*time.Millisecond)
+	expectWait(t, throttle(other), 0)
+}
+
+func TestUnbook(t *testing.T) {
+	msgs := make([]*message.Obj, 3)
+	for i := range msgs {
+		msgs[i] = restMessage("https://hooks.example.com/unbook")
+		throttle(msgs[i])
+	}
+	unbook(msgs[2])
+	if wait := throttle(msgs[2]); wait == 0 {
+		t.Error("an unbooked message has to take a token again")
+	}
+}
+
+func TestDestinationHost(t *testing.T) {
+	for expected, msg := range map[string]*message.Obj{
+		"hooks.example.com": restMessage("https://Hooks.Example.com:8443/x"),
+		"example.org":       {MessageType: message.S_EMAIL_NOTIFICATION, Endpoint: "Ann <ann@Example.org>, bob@example.net"},
+		"events":            {MessageType: message.S_RABBITMQ_NOTIFICATION, Endpoint: "events/orders/created"},
+		"":                  {MessageType: message.S_SMS_NOTIFICATION, Endpoint: "+15550100"},
+	} {
+		if host := destinationHost(msg); host != expected {
+			t.Errorf("%s: host %q, expected %q", msg.Endpoint, host, expected)
+		}
+	}
+}
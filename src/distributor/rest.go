@@ -2,58 +2,495 @@ package distributor
 
 import (
 	"bytes"
+	"conf"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
-	// "io/ioutil"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"jsonwrapper"
 	"log"
+	"message"
 	"net/http"
+	"net/url"
+	"signature"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_REST_TIMEOUT  = 10 * time.Second
+	MAX_REST_TIMEOUT      = 120 * time.Second
+	MAX_REST_RESPONSE     = 1024 * 1024
+	DEFAULT_HMAC_HEADER   = "X-Grandma-Signature"
+	HMAC_TIMESTAMP_HEADER = "X-Grandma-Timestamp"
 )
 
 var (
 	ErrorInvalidEndpointOrBody = errors.New("Invalid endpoint or body")
 	ErrorNetworkDisconnect     = errors.New("Network error")
 	ErrorInproperResponse      = errors.New("Status code not 200")
+	ErrorUnexpectedStatus      = errors.New("Status code not accepted")
+	ErrorAssertionFailed       = errors.New("Response assertion failed")
+	ErrorUnknownAuthType       = errors.New("Unknown auth type")
+	ErrorUnknownTLSProfile     = errors.New("REST TLS profile not configured")
+	ErrorMissingCredentials    = errors.New("REST auth is missing credentials")
+	ErrorInvalidStatusRange    = errors.New("Invalid accepted status range")
+	ErrorInvalidRESTURL        = errors.New("REST url must be absolute http or https")
+	ErrorUnknownPlaceholder    = errors.New("Unknown placeholder in REST body")
 )
 
-func sendRESTCall(endpoint string, msg string) error {
-	endpoint_components := strings.Split(endpoint, " ")
+// Placeholders of a templated REST body
+const (
+	PLACEHOLDER_MESSAGE      = "{{message}}"      // The message as is
+	PLACEHOLDER_MESSAGE_JSON = "{{message_json}}" // The message as a JSON string
+	PLACEHOLDER_SENT_AT      = "{{sent_at}}"      // Unix time in ms of the call
+)
 
-	log.Println(endpoint)
+// Structured REST target, sent as a JSON object in place of the legacy
+// "METHOD URL CONTENT-TYPE" endpoint string:
+//
+//	{
+//		"method": "POST",
+//		"url": "https://hooks.example.com/reminder",
+//		"content_type": "application/json",
+//		"headers": {"X-Tenant": "acme"},
+//		"auth": {"type": "bearer", "token": "..."},
+//		"timeout": 5000,
+//		"accept": ["2xx", "409"],
+//		"expect": {"body_contains": "queued", "json": {"status": "ok"}},
+//		"tls": "partner-profile",
+//		"body": "{\"text\": {{message_json}}, \"at\": {{sent_at}}}"
+//	}
+//
+// auth types are basic (username, password), bearer (token) and hmac
+// (secret, header). hmac signs the call like GSS API requests are signed,
+// falling back to rest_secret when no secret is given. tls names a client
+// certificate profile from rest_tls_profiles in grandma.conf. body is sent
+// in place of the message, with the PLACEHOLDER_* filled in. Targets are
+// checked when scheduled, see ValidateRESTEndpoint.
+type restTarget struct {
+	method       string
+	url          string
+	content_type string
+	headers      map[string]string
+	auth         *jsonwrapper.Object
+	timeout      time.Duration
+	accept       []statusRange
+	expect       *jsonwrapper.Object
+	tls_profile  string
+	body         string // Template, empty to send the message as is
+}
 
-	if len(endpoint_components) != 3 {
+type statusRange struct {
+	low  int
+	high int
+}
+
+var rest_transports = make(map[string]*http.Transport)
+var restTransportLock = new(sync.Mutex)
+
+func sendRESTCall(endpoint string, msg string, valid_until int64) error {
+	log.Println(message.DescribeEndpoint(message.S_REST_NOTIFICATION, endpoint))
+
+	target, err := parseRESTEndpoint(endpoint)
+	if err != nil {
 		log.Println("endpoint parsing error")
-		return ErrorInvalidEndpointOrBody
+		return err
+	}
+
+	return target.call(msg, valid_until)
+}
+
+// ValidateRESTEndpoint checks a REST endpoint before it is scheduled
+func ValidateRESTEndpoint(endpoint string) error {
+	_, err := parseRESTEndpoint(endpoint)
+	return err
+}
+
+func parseRESTEndpoint(endpoint string) (*restTarget, error) {
+	if strings.HasPrefix(strings.TrimSpace(endpoint), "{") {
+		return parseRESTTarget(endpoint)
+	}
+	return parseLegacyRESTEndpoint(endpoint)
+}
+
+func parseLegacyRESTEndpoint(endpoint string) (*restTarget, error) {
+	endpoint_components := strings.Split(endpoint, " ")
+
+	if len(endpoint_components) != 3 {
+		return nil, ErrorInvalidEndpointOrBody
+	}
+
+	target := new(restTarget)
+	target.method = endpoint_components[0]
+	target.url = endpoint_components[1]
+	target.content_type = endpoint_components[2]
+	target.timeout = DEFAULT_REST_TIMEOUT
+	target.accept = []statusRange{{200, 299}}
+
+	if err := checkRESTURL(target.url); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func parseRESTTarget(endpoint string) (*restTarget, error) {
+	obj, err := jsonwrapper.NewObjectFromBytes([]byte(endpoint))
+	if err != nil {
+		return nil, ErrorInvalidEndpointOrBody
+	}
+
+	target := new(restTarget)
+	target.url, err = obj.GetString("url")
+	if err != nil || target.url == "" {
+		return nil, ErrorInvalidEndpointOrBody
+	}
+	if err := checkRESTURL(target.url); err != nil {
+		return nil, err
+	}
+
+	target.method, err = obj.GetString("method")
+	if err != nil {
+		target.method = "POST"
+	}
+	target.method = strings.ToUpper(target.method)
+
+	target.content_type, err = obj.GetString("content_type")
+	if err != nil {
+		target.content_type = "application/json"
+	}
+
+	target.headers = make(map[string]string)
+	if headers, err := obj.GetObject("headers"); err == nil {
+		for name := range headers.Map() {
+			value, err := headers.GetString(name)
+			if err != nil {
+				return nil, ErrorInvalidEndpointOrBody
+			}
+			target.headers[name] = value
+		}
+	}
+
+	if _, ok := obj.Map()["auth"]; ok {
+		if target.auth, err = obj.GetObject("auth"); err != nil {
+			return nil, ErrorInvalidEndpointOrBody
+		}
+		if err := checkRESTAuth(target.auth); err != nil {
+			return nil, err
+		}
+	}
+	target.expect, _ = obj.GetObject("expect")
+
+	target.tls_profile, _ = obj.GetString("tls")
+	if target.tls_profile != "" {
+		if _, ok := conf.GetRestTLSProfile(target.tls_profile); !ok {
+			return nil, ErrorUnknownTLSProfile
+		}
+	}
+
+	if _, ok := obj.Map()["body"]; ok {
+		if target.body, err = obj.GetString("body"); err != nil {
+			return nil, ErrorInvalidEndpointOrBody
+		}
+		if err := checkRESTBody(target.body); err != nil {
+			return nil, err
+		}
+	}
+
+	target.timeout = DEFAULT_REST_TIMEOUT
+	if timeout, err := obj.GetInt64("timeout"); err == nil && timeout > 0 {
+		target.timeout = time.Duration(timeout) * time.Millisecond
+		if target.timeout > MAX_REST_TIMEOUT {
+			target.timeout = MAX_REST_TIMEOUT
+		}
+	}
+
+	target.accept = []statusRange{{200, 299}}
+	if accept, err := obj.GetValueArray("accept"); err == nil && len(accept) > 0 {
+		target.accept = nil
+		for _, value := range accept {
+			r, err := parseStatusRange(fmt.Sprint(value.Interface()))
+			if err != nil {
+				return nil, err
+			}
+			target.accept = append(target.accept, r)
+		}
 	}
 
-	method := endpoint_components[0]
-	url := endpoint_components[1]
-	content_type := endpoint_components[2]
-	req, err := http.NewRequest(method, url, bytes.NewBufferString(msg))
+	return target, nil
+}
 
-	log.Println(url)
+// Accepts "200", "2xx" or "200-204", within 100 to 599
+func parseStatusRange(s string) (statusRange, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if len(s) == 3 && strings.HasSuffix(s, "xx") {
+		class, err := strconv.Atoi(s[:1])
+		if err != nil || class < 1 || class > 5 {
+			return statusRange{}, ErrorInvalidStatusRange
+		}
+		return statusRange{class * 100, class*100 + 99}, nil
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return statusRange{}, ErrorInvalidStatusRange
+	}
+	high := low
+	if len(bounds) == 2 {
+		high, err = strconv.Atoi(bounds[1])
+		if err != nil || high < low {
+			return statusRange{}, ErrorInvalidStatusRange
+		}
+	}
+	if low < 100 || high > 599 {
+		return statusRange{}, ErrorInvalidStatusRange
+	}
+	return statusRange{low, high}, nil
+}
+
+func checkRESTURL(raw_url string) error {
+	parsed, err := url.Parse(raw_url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ErrorInvalidRESTURL
+	}
+	return nil
+}
+
+func checkRESTAuth(auth *jsonwrapper.Object) error {
+	auth_type, _ := auth.GetString("type")
+	switch auth_type {
+	case "basic":
+		if username, _ := auth.GetString("username"); username == "" {
+			return ErrorMissingCredentials
+		}
+	case "bearer":
+		if token, _ := auth.GetString("token"); token == "" {
+			return ErrorMissingCredentials
+		}
+	case "hmac":
+		secret, _ := auth.GetString("secret")
+		if secret == "" && conf.GetRestSecret() == "" {
+			return ErrorMissingCredentials
+		}
+	default:
+		return ErrorUnknownAuthType
+	}
+	return nil
+}
+
+// checkRESTBody refuses placeholders that would be sent as they are
+func checkRESTBody(body string) error {
+	rest := body
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			return nil
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return ErrorUnknownPlaceholder
+		}
+		switch rest[start : start+end+2] {
+		case PLACEHOLDER_MESSAGE, PLACEHOLDER_MESSAGE_JSON, PLACEHOLDER_SENT_AT:
+		default:
+			return ErrorUnknownPlaceholder
+		}
+		rest = rest[start+end+2:]
+	}
+}
+
+// render fills the body template in, or returns msg without one
+func (t *restTarget) render(msg string, now time.Time) string {
+	if t.body == "" {
+		return msg
+	}
+	quoted, _ := json.Marshal(msg)
+	return strings.NewReplacer(
+		PLACEHOLDER_MESSAGE, msg,
+		PLACEHOLDER_MESSAGE_JSON, string(quoted),
+		PLACEHOLDER_SENT_AT, strconv.FormatInt(now.UnixNano()/1000000, 10),
+	).Replace(t.body)
+}
+
+func (t *restTarget) call(msg string, valid_until int64) error {
+	msg = t.render(msg, time.Now())
+	req, err := http.NewRequest(t.method, t.url, bytes.NewBufferString(msg))
 
 	if err != nil {
 		return ErrorInvalidEndpointOrBody
 	}
 
-	req.Header.Add("Content-Type", content_type)
+	req.Header.Add("Content-Type", t.content_type)
 	req.Header.Add("Powered-By", "GrandmaSchedulerServices")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+
+	if err := t.authorize(req, msg); err != nil {
+		return err
+	}
 
-	client := &http.Client{}
+	transport, err := getRESTTransport(t.tls_profile)
+	if err != nil {
+		return err
+	}
+
+	// Waiting for a connection to the host may take a while
+	if pastValidUntil(valid_until) {
+		return ErrorMessageExpired
+	}
+	client := &http.Client{Transport: transport, Timeout: t.timeout}
 	response, err := client.Do(req)
 
 	if err != nil {
+		// Its message holds the full URL
+		if url_err, ok := err.(*url.Error); ok {
+			err = url_err.Err
+		}
+		log.Println("REST call to " + message.RedactURL(t.url) + " failed: " + err.Error())
 		return ErrorNetworkDisconnect
 	}
 
 	defer response.Body.Close()
-	// body, _ := ioutil.ReadAll(response.Body)
 
-	// log.Println(string(body))
+	if !t.accepted(response.StatusCode) {
+		log.Println("REST call to " + message.RedactURL(t.url) + " returned " + strconv.Itoa(response.StatusCode))
+		return ErrorUnexpectedStatus
+	}
 
-	if response.StatusCode != 200 {
-		return ErrorInproperResponse
+	if t.expect == nil {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, MAX_REST_RESPONSE))
+	if err != nil {
+		return ErrorNetworkDisconnect
+	}
+
+	return t.assert(body)
+}
+
+func (t *restTarget) authorize(req *http.Request, msg string) error {
+	if t.auth == nil {
+		return nil
+	}
+
+	auth_type, _ := t.auth.GetString("type")
+	switch auth_type {
+	case "basic":
+		username, _ := t.auth.GetString("username")
+		password, _ := t.auth.GetString("password")
+		req.SetBasicAuth(username, password)
+	case "bearer":
+		token, _ := t.auth.GetString("token")
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "hmac":
+		secret, err := t.auth.GetString("secret")
+		if err != nil || secret == "" {
+			secret = conf.GetRestSecret()
+		}
+		header, err := t.auth.GetString("header")
+		if err != nil || header == "" {
+			header = DEFAULT_HMAC_HEADER
+		}
+		now := signature.TimeStamp()
+		req.Header.Set(HMAC_TIMESTAMP_HEADER, now)
+		req.Header.Set(header, signature.Sign(secret, t.method, now, msg))
+	default:
+		return ErrorUnknownAuthType
 	}
 
 	return nil
 }
+
+func (t *restTarget) accepted(status int) bool {
+	for _, r := range t.accept {
+		if status >= r.low && status <= r.high {
+			return true
+		}
+	}
+	return false
+}
+
+// assert checks body_contains and json field equality, json keys are dot
+// separated paths into the response document
+func (t *restTarget) assert(body []byte) error {
+	if contains, err := t.expect.GetString("body_contains"); err == nil {
+		if !strings.Contains(string(body), contains) {
+			log.Println("REST response from " + message.RedactURL(t.url) + " does not contain " + contains)
+			return ErrorAssertionFailed
+		}
+	}
+
+	fields, err := t.expect.GetObject("json")
+	if err != nil {
+		return nil
+	}
+
+	response, err := jsonwrapper.NewObjectFromBytes(body)
+	if err != nil {
+		log.Println("REST response from " + message.RedactURL(t.url) + " is not a JSON object")
+		return ErrorAssertionFailed
+	}
+
+	for path, expected := range fields.Map() {
+		actual, err := response.GetValue(strings.Split(path, ".")...)
+		if err != nil || fmt.Sprint(actual.Interface()) != fmt.Sprint(expected.Interface()) {
+			log.Println("REST response from " + message.RedactURL(t.url) + " failed assertion on " + path)
+			return ErrorAssertionFailed
+		}
+	}
+
+	return nil
+}
+
+// getRESTTransport shares one transport per TLS profile so connections are
+// reused between calls
+func getRESTTransport(profile string) (*http.Transport, error) {
+	restTransportLock.Lock()
+	defer restTransportLock.Unlock()
+
+	if transport, ok := rest_transports[profile]; ok {
+		return transport, nil
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+
+	if profile != "" {
+		files, ok := conf.GetRestTLSProfile(profile)
+		if !ok {
+			return nil, ErrorUnknownTLSProfile
+		}
+
+		tls_config := new(tls.Config)
+		if files.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+			if err != nil {
+				log.Println(err)
+				return nil, ErrorUnknownTLSProfile
+			}
+			tls_config.Certificates = []tls.Certificate{cert}
+		}
+		if files.CAFile != "" {
+			pem, err := ioutil.ReadFile(files.CAFile)
+			if err != nil {
+				log.Println(err)
+				return nil, ErrorUnknownTLSProfile
+			}
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(pem)
+			tls_config.RootCAs = pool
+		}
+		transport.TLSClientConfig = tls_config
+	}
+
+	rest_transports[profile] = transport
+	return transport, nil
+}
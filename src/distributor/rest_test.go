@@ -0,0 +1,74 @@
+package distributor
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidateRESTEndpoint(t *testing.T) {
+	for endpoint, expected := range map[string]error{
+		"POST https://hooks.example.com/x application/json":                                nil,
+		`{"url": "https://hooks.example.com/x"}`:                                           nil,
+		`{"url": "https://hooks.example.com/x", "auth": {"type": "bearer", "token": "t"}}`: nil,
+		`{"url": "https://hooks.example.com/x", "accept": ["2xx", "409", "200-204"]}`:      nil,
+		`{"url": "https://hooks.example.com/x", "body": "{\"m\": {{message_json}}}"}`:      nil,
+		"POST hooks.example.com/x application/json":                                        ErrorInvalidRESTURL,
+		`{"url": "ftp://hooks.example.com/x"}`:                                             ErrorInvalidRESTURL,
+		`{"method": "POST"}`:                                                               ErrorInvalidEndpointOrBody,
+		`{"url": "https://hooks.example.com/x", "auth": {"type": "digest"}}`:               ErrorUnknownAuthType,
+		`{"url": "https://hooks.example.com/x", "auth": {"type": "basic"}}`:                ErrorMissingCredentials,
+		`{"url": "https://hooks.example.com/x", "auth": {"type": "bearer"}}`:               ErrorMissingCredentials,
+		`{"url": "https://hooks.example.com/x", "auth": "secret"}`:                         ErrorInvalidEndpointOrBody,
+		`{"url": "https://hooks.example.com/x", "tls": "nowhere"}`:                         ErrorUnknownTLSProfile,
+		`{"url": "https://hooks.example.com/x", "accept": ["6xx"]}`:                        ErrorInvalidStatusRange,
+		`{"url": "https://hooks.example.com/x", "accept": ["204-200"]}`:                    ErrorInvalidStatusRange,
+		`{"url": "https://hooks.example.com/x", "accept": ["99"]}`:                         ErrorInvalidStatusRange,
+		`{"url": "https://hooks.example.com/x", "body": "{{recipient}}"}`:                  ErrorUnknownPlaceholder,
+		`{"url": "https://hooks.example.com/x", "body": "{{message"}`:                      ErrorUnknownPlaceholder,
+	} {
+		if err := ValidateRESTEndpoint(endpoint); err != expected {
+			t.Errorf("%s: expected %v, got %v", endpoint, expected, err)
+		}
+	}
+}
+
+func TestRenderRESTBody(t *testing.T) {
+	target, err := parseRESTEndpoint(`{"url": "https://hooks.example.com/x",
+		"body": "{\"raw\": {{message}}, \"text\": {{message_json}}, \"at\": {{sent_at}}}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := target.render(`{"a":"b\"c"}`, time.Unix(1500000000, 0))
+	expected := `{"raw": {"a":"b\"c"}, "text": "{\"a\":\"b\\\"c\"}", "at": 1500000000000}`
+	if body != expected {
+		t.Errorf("rendered %s\nexpected %s", body, expected)
+	}
+
+	target.body = ""
+	if body := target.render("as is", time.Now()); body != "as is" {
+		t.Errorf("without a template the message goes as is, got %s", body)
+	}
+}
+
+func TestRESTCallSendsRenderedBody(t *testing.T) {
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.Header.Get("Authorization") + " " + string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	endpoint := `{"url": "` + server.URL + `/hook?key=k", "auth": {"type": "bearer", "token": "t"},
+		"body": "{\"text\": {{message_json}}}"}`
+	if err := sendRESTCall(endpoint, "hello", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != `Bearer t {"text": "hello"}` {
+		t.Errorf("server got %s", got)
+	}
+}
@@ -1,43 +1,201 @@
 package distributor
 
 import (
+	"conf"
+	"errors"
+	"jsonwrapper"
+	"log"
 	"net/http"
 	"net/url"
-	"strings"
+	"regexp"
+	"schedule"
+	"signature"
+	"strconv"
+	"sync"
+	"unicode/utf16"
 )
 
-func sendSMSMessage(endpoint string, msg string) error {
-	// Set initial variables
-	account_sid := "ACdd27abf6914ae131ad2248a529eff4aa"
-	auth_token := "9e2f645e33b1ac624a84deea89cebcc6"
-	url_str := "https://api.twilio.com/2010-04-01/Accounts/" + account_sid + "/Messages.json"
+const (
+	SMS_ENCODING_GSM7 = "gsm7"
+	SMS_ENCODING_UCS2 = "ucs2"
 
-	// Build out the data for our message
-	v := url.Values{}
-	v.Set("To", endpoint)
-	v.Set("From", "+14152149780")
-	v.Set("Body", msg)
-	rb := *strings.NewReader(v.Encode())
+	SMS_CHANNEL = "sms"
+)
+
+var (
+	ErrorInvalidPhoneNumber  = errors.New("Phone number is not in E.164 format")
+	ErrorTooManySegments     = errors.New("SMS message exceeds max segments")
+	ErrorSMSNotConfigured    = errors.New("SMS provider not configured")
+	ErrorUnknownSMSProvider  = errors.New("Unknown SMS provider type")
+	ErrorInvalidSMSReceipt   = errors.New("Invalid SMS delivery receipt")
+	ErrorInvalidCallbackKey  = errors.New("Invalid SMS callback key")
+	ErrorSMSProviderMismatch = errors.New("SMS receipt for another provider")
+)
+
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
+// SMSProvider sends messages through one SMS gateway and understands its
+// delivery receipts
+type SMSProvider interface {
+	// Name is used in the status callback path /sms/status/<name>
+	Name() string
+	// Send returns the provider's message reference
+	Send(to, body, encoding, callback_url string) (string, error)
+	// ParseReceipt reads a delivery receipt posted to the callback
+	ParseReceipt(r *http.Request) (*SMSReceipt, error)
+}
+
+type SMSReceipt struct {
+	Reference string
+	Status    string // One of schedule.DELIVERY_STATUS_*
+	Detail    string
+}
+
+// Constructors for provider types accepted in sms_provider "type"
+var sms_provider_types = map[string]func(*jsonwrapper.Object) (SMSProvider, error){
+	"twilio": newTwilioProvider,
+	"nexmo":  newNexmoProvider,
+	"vonage": newNexmoProvider,
+	"http":   newHTTPSMSProvider,
+}
+
+var sms_provider SMSProvider = nil
+var smsProviderLock = new(sync.Mutex)
+
+func getSMSProvider() (SMSProvider, error) {
+	smsProviderLock.Lock()
+	defer smsProviderLock.Unlock()
+
+	if sms_provider != nil {
+		return sms_provider, nil
+	}
+
+	settings := conf.GetSMSProvider()
+	if settings == nil {
+		return nil, ErrorSMSNotConfigured
+	}
+
+	provider_type, _ := settings.GetString("type")
+	constructor, ok := sms_provider_types[provider_type]
+	if !ok {
+		return nil, ErrorUnknownSMSProvider
+	}
+
+	provider, err := constructor(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	sms_provider = provider
+	return sms_provider, nil
+}
+
+// smsSegments works out the encoding the message needs and how many
+// segments it is split into. GSM-7 fits 160 characters in one segment and
+// 153 per segment when concatenated, UCS-2 fits 70 and 67.
+func smsSegments(body string) (string, int) {
+	septets := 0
+	for _, r := range body {
+		if gsm7_basic[r] {
+			septets++
+		} else if gsm7_extension[r] {
+			septets += 2
+		} else {
+			units := len(utf16.Encode([]rune(body)))
+			if units <= 70 {
+				return SMS_ENCODING_UCS2, 1
+			}
+			return SMS_ENCODING_UCS2, (units + 66) / 67
+		}
+	}
+
+	if septets <= 160 {
+		return SMS_ENCODING_GSM7, 1
+	}
+	return SMS_ENCODING_GSM7, (septets + 152) / 153
+}
+
+var gsm7_basic = make(map[rune]bool)
+var gsm7_extension = make(map[rune]bool)
+
+func init() {
+	for _, r := range "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà" {
+		gsm7_basic[r] = true
+	}
+	for _, r := range "^{}\\[~]|€\f" {
+		gsm7_extension[r] = true
+	}
+}
+
+// smsCallbackKey protects the status callback from forged receipts
+func smsCallbackKey(provider string) string {
+	return signature.Sign(conf.GetRestSecret(), "SMS", provider, "")
+}
+
+func smsCallbackURL(provider string) string {
+	base := conf.GetSMSCallbackURL()
+	if base == "" {
+		return ""
+	}
+	return base + "/sms/status/" + provider + "?key=" + url.QueryEscape(smsCallbackKey(provider))
+}
+
+func sendSMSMessage(endpoint string, msg string, schedule_id int, valid_until int64) error {
+	if !e164.MatchString(endpoint) {
+		log.Println("SMS endpoint " + endpoint + " is not E.164")
+		schedule.RecordDelivery(schedule_id, SMS_CHANNEL, "", schedule.DELIVERY_STATUS_FAILED,
+			ErrorInvalidPhoneNumber.Error())
+		return ErrorInvalidPhoneNumber
+	}
 
-	// Create client
-	client := &http.Client{}
+	encoding, segments := smsSegments(msg)
+	log.Println("SMS to " + endpoint + " uses " + strconv.Itoa(segments) + " " + encoding + " segment(s)")
+	if segments > conf.GetSMSMaxSegments() {
+		schedule.RecordDelivery(schedule_id, SMS_CHANNEL, "", schedule.DELIVERY_STATUS_FAILED,
+			ErrorTooManySegments.Error())
+		return ErrorTooManySegments
+	}
 
-	req, err := http.NewRequest("POST", url_str, &rb)
+	provider, err := getSMSProvider()
+	if err != nil {
+		return err
+	}
 
+	if pastValidUntil(valid_until) {
+		return ErrorMessageExpired
+	}
+	reference, err := provider.Send(endpoint, msg, encoding, smsCallbackURL(provider.Name()))
 	if err != nil {
-		return ErrorNetworkDisconnect
+		log.Println("SMS to " + endpoint + " failed: " + err.Error())
+		schedule.RecordDelivery(schedule_id, SMS_CHANNEL, reference, schedule.DELIVERY_STATUS_FAILED, err.Error())
+		return err
 	}
 
-	req.SetBasicAuth(account_sid, auth_token)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	return schedule.RecordDelivery(schedule_id, SMS_CHANNEL, reference, schedule.DELIVERY_STATUS_SENT, provider.Name())
+}
 
-	// Make request
-	response, _ := client.Do(req)
+// HandleSMSReceipt records a delivery receipt posted by the provider to
+// /sms/status/<provider>?key=<callback key>
+func HandleSMSReceipt(provider_name string, r *http.Request) error {
+	if r.URL.Query().Get("key") != smsCallbackKey(provider_name) {
+		return ErrorInvalidCallbackKey
+	}
 
-	if response.StatusCode != 200 {
-		return ErrorInproperResponse
+	provider, err := getSMSProvider()
+	if err != nil {
+		return err
+	}
+
+	if provider.Name() != provider_name {
+		return ErrorSMSProviderMismatch
+	}
+
+	receipt, err := provider.ParseReceipt(r)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	log.Println("SMS receipt " + receipt.Reference + ": " + receipt.Status)
+	return schedule.UpdateDeliveryByReference(SMS_CHANNEL, receipt.Reference, receipt.Status, receipt.Detail)
 }
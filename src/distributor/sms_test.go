@@ -0,0 +1,270 @@
+package distributor
+
+import (
+	"io/ioutil"
+	"jsonwrapper"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"schedule"
+	"strings"
+	"testing"
+)
+
+// redirect sends every request to the test server, whatever its URL
+type redirect struct {
+	server *httptest.Server
+}
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(r.server.URL)
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// smsGateway answers the SMS providers' API calls with handler until the
+// returned function puts the real client back
+func smsGateway(handler http.HandlerFunc) func() {
+	server := httptest.NewServer(handler)
+	old := sms_client
+	sms_client = &http.Client{Transport: redirect{server}}
+	return func() {
+		sms_client = old
+		server.Close()
+	}
+}
+
+func newTestSMSProvider(t *testing.T, settings string) SMSProvider {
+	obj, err := jsonwrapper.NewObjectFromBytes([]byte(settings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider_type, _ := obj.GetString("type")
+	provider, err := sms_provider_types[provider_type](obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestE164(t *testing.T) {
+	for number, valid := range map[string]bool{
+		"+14155550100":      true,
+		"+442071838750":     true,
+		"+123456789012345":  true,
+		"+1234567890123456": false,
+		"14155550100":       false,
+		"+04155550100":      false,
+		"+1 415 555 0100":   false,
+		"+1415555010a":      false,
+		"+1":                false,
+		"+14155550100\n":    false,
+	} {
+		if e164.MatchString(number) != valid {
+			t.Errorf("%q: valid %v", number, !valid)
+		}
+	}
+}
+
+func TestSMSSegments(t *testing.T) {
+	for name, c := range map[string]struct {
+		body     string
+		encoding string
+		segments int
+	}{
+		"one gsm7":         {strings.Repeat("a", 160), SMS_ENCODING_GSM7, 1},
+		"two gsm7":         {strings.Repeat("a", 161), SMS_ENCODING_GSM7, 2},
+		"three gsm7":       {strings.Repeat("a", 307), SMS_ENCODING_GSM7, 3},
+		"extension counts": {strings.Repeat("€", 81), SMS_ENCODING_GSM7, 2},
+		"one ucs2":         {strings.Repeat("ж", 70), SMS_ENCODING_UCS2, 1},
+		"two ucs2":         {strings.Repeat("ж", 71), SMS_ENCODING_UCS2, 2},
+		"surrogate pairs":  {strings.Repeat("😀", 35), SMS_ENCODING_UCS2, 1},
+		"one ucs2 char":    {strings.Repeat("a", 100) + "ж", SMS_ENCODING_UCS2, 2},
+	} {
+		if encoding, segments := smsSegments(c.body); encoding != c.encoding || segments != c.segments {
+			t.Errorf("%s: %d %s segments, expected %d %s", name, segments, encoding, c.segments, c.encoding)
+		}
+	}
+}
+
+func TestTwilioSend(t *testing.T) {
+	status := http.StatusCreated
+	restore := smsGateway(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		r.ParseForm()
+		if r.URL.Path != "/2010-04-01/Accounts/AC1/Messages.json" || user != "AC1" || password != "token" ||
+			r.Form.Get("To") != "+14155550100" || r.Form.Get("From") != "+14155550199" ||
+			r.Form.Get("Body") != "hi & bye" || r.Form.Get("StatusCallback") != "https://gss.example.com/cb" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"sid": "SM123", "status": "queued"}`))
+	})
+	defer restore()
+
+	p := newTestSMSProvider(t, `{"type": "twilio", "account_sid": "AC1", "auth_token": "token", "from": "+14155550199"}`)
+	reference, err := p.Send("+14155550100", "hi & bye", SMS_ENCODING_GSM7, "https://gss.example.com/cb")
+	if err != nil || reference != "SM123" {
+		t.Errorf("reference %q, %v", reference, err)
+	}
+
+	status = http.StatusBadRequest
+	if _, err := p.Send("+14155550100", "hi & bye", SMS_ENCODING_GSM7, "https://gss.example.com/cb"); err != ErrorUnexpectedStatus {
+		t.Errorf("expected ErrorUnexpectedStatus, got %v", err)
+	}
+}
+
+func TestNexmoSend(t *testing.T) {
+	reply := `{"messages": [{"status": "0", "message-id": "0A1"}, {"status": "0", "message-id": "0A2"}]}`
+	restore := smsGateway(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("api_key") != "key" || r.Form.Get("to") != "14155550100" || r.Form.Get("type") != "unicode" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(reply))
+	})
+	defer restore()
+
+	p := newTestSMSProvider(t, `{"type": "vonage", "api_key": "key", "api_secret": "secret", "from": "Grandma"}`)
+	if reference, err := p.Send("+14155550100", "привет", SMS_ENCODING_UCS2, ""); err != nil || reference != "0A1" {
+		t.Errorf("reference %q, %v", reference, err)
+	}
+
+	reply = `{"messages": [{"status": "4", "error-text": "Bad Credentials"}]}`
+	_, err := p.Send("+14155550100", "привет", SMS_ENCODING_UCS2, "")
+	if err == nil || err.Error() != "SMS provider error: Bad Credentials" {
+		t.Errorf("expected the provider's error, got %v", err)
+	}
+	reply = `{"messages": []}`
+	if _, err := p.Send("+14155550100", "привет", SMS_ENCODING_UCS2, ""); err != ErrorInproperResponse {
+		t.Errorf("expected ErrorInproperResponse, got %v", err)
+	}
+}
+
+func TestHTTPSMSSend(t *testing.T) {
+	received := make(chan string, 1)
+	restore := smsGateway(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r.Method + " " + r.Header.Get("Content-Type") + " " + r.Header.Get("Authorization") + " " + string(body)
+		w.Write([]byte(`{"message": {"id": 42}}`))
+	})
+	defer restore()
+
+	p := newTestSMSProvider(t, `{"type": "http", "name": "acme", "url": "https://sms.example.com/send",
+		"content_type": "application/json", "headers": {"Authorization": "Bearer t"},
+		"body": "{\"to\":\"{{to}}\",\"text\":\"{{body}}\",\"enc\":\"{{encoding}}\"}", "id_field": "message.id"}`)
+	reference, err := p.Send("+14155550100", "say \"hi\"\n", SMS_ENCODING_GSM7, "")
+	if err != nil || reference != "42" {
+		t.Errorf("reference %q, %v", reference, err)
+	}
+	expected := `POST application/json Bearer t {"to":"+14155550100","text":"say \"hi\"\n","enc":"gsm7"}`
+	if got := <-received; got != expected {
+		t.Errorf("gateway got %s\nexpected %s", got, expected)
+	}
+
+	// Form bodies by default
+	p = newTestSMSProvider(t, `{"type": "http", "name": "acme", "url": "https://sms.example.com/send",
+		"body": "to={{to}}&text={{body}}"}`)
+	if reference, err := p.Send("+14155550100", "a&b=c", SMS_ENCODING_GSM7, ""); err != nil || reference != "" {
+		t.Errorf("reference %q, %v", reference, err)
+	}
+	if got := <-received; got != "POST application/x-www-form-urlencoded  to=%2B14155550100&text=a%26b%3Dc" {
+		t.Errorf("gateway got %s", got)
+	}
+}
+
+func TestSMSProviderSettings(t *testing.T) {
+	for settings, expected := range map[string]error{
+		`{"type": "twilio", "account_sid": "AC1", "auth_token": "token"}`: ErrorSMSNotConfigured,
+		`{"type": "nexmo", "api_key": "key", "from": "Grandma"}`:          ErrorSMSNotConfigured,
+		`{"type": "http", "name": "acme", "body": "{{to}}"}`:              ErrorSMSNotConfigured,
+	} {
+		obj, _ := jsonwrapper.NewObjectFromBytes([]byte(settings))
+		provider_type, _ := obj.GetString("type")
+		if _, err := sms_provider_types[provider_type](obj); err != expected {
+			t.Errorf("%s: expected %v, got %v", settings, expected, err)
+		}
+	}
+}
+
+func receiptRequest(content_type string, body string) *http.Request {
+	r := httptest.NewRequest("POST", "/sms/status/test", strings.NewReader(body))
+	r.Header.Set("Content-Type", content_type)
+	return r
+}
+
+func TestSMSReceipts(t *testing.T) {
+	twilio := newTestSMSProvider(t, `{"type": "twilio", "account_sid": "AC1", "auth_token": "token", "from": "+14155550199"}`)
+	nexmo := newTestSMSProvider(t, `{"type": "nexmo", "api_key": "key", "api_secret": "secret", "from": "Grandma"}`)
+	acme := newTestSMSProvider(t, `{"type": "http", "name": "acme", "url": "https://sms.example.com/send", "body": "{{to}}",
+		"receipt": {"reference_field": "sms.id", "status_field": "sms.state", "detail_field": "error",
+			"statuses": {"DELIVRD": "delivered", "UNDELIV": "undelivered"}}}`)
+	form := "application/x-www-form-urlencoded"
+
+	for name, c := range map[string]struct {
+		provider SMSProvider
+		request  *http.Request
+		receipt  SMSReceipt
+		err      error
+	}{
+		"twilio delivered": {twilio, receiptRequest(form, "MessageSid=SM1&MessageStatus=delivered"),
+			SMSReceipt{"SM1", schedule.DELIVERY_STATUS_DELIVERED, ""}, nil},
+		"twilio undelivered": {twilio, receiptRequest(form, "MessageSid=SM1&MessageStatus=undelivered&ErrorCode=30003"),
+			SMSReceipt{"SM1", schedule.DELIVERY_STATUS_UNDELIVERED, "30003"}, nil},
+		"twilio in flight": {twilio, receiptRequest(form, "MessageSid=SM1&MessageStatus=accepted"),
+			SMSReceipt{"SM1", schedule.DELIVERY_STATUS_QUEUED, ""}, nil},
+		"twilio no sid": {twilio, receiptRequest(form, "MessageStatus=delivered"), SMSReceipt{}, ErrorInvalidSMSReceipt},
+		"nexmo json": {nexmo, receiptRequest("application/json", `{"messageId": "0A1", "status": "rejected", "err-code": "6"}`),
+			SMSReceipt{"0A1", schedule.DELIVERY_STATUS_UNDELIVERED, "6"}, nil},
+		"nexmo form": {nexmo, receiptRequest(form, "messageId=0A1&status=delivered"),
+			SMSReceipt{"0A1", schedule.DELIVERY_STATUS_DELIVERED, ""}, nil},
+		"nexmo bad json": {nexmo, receiptRequest("application/json", `{"messageId"`), SMSReceipt{}, ErrorInvalidSMSReceipt},
+		"http nested": {acme, receiptRequest("application/json", `{"sms": {"id": 7, "state": "UNDELIV"}, "error": "absent"}`),
+			SMSReceipt{"7", schedule.DELIVERY_STATUS_UNDELIVERED, "absent"}, nil},
+		"http unknown status": {acme, receiptRequest("application/json", `{"sms": {"id": "x", "state": "ENROUTE"}}`),
+			SMSReceipt{"x", schedule.DELIVERY_STATUS_QUEUED, ""}, nil},
+		"http no reference": {acme, receiptRequest(form, "state=DELIVRD"), SMSReceipt{}, ErrorInvalidSMSReceipt},
+	} {
+		receipt, err := c.provider.ParseReceipt(c.request)
+		if err != c.err || (err == nil && *receipt != c.receipt) {
+			t.Errorf("%s: receipt %+v, expected %v, got %v", name, receipt, c.err, err)
+		}
+	}
+
+	// Without receipt settings the gateway's receipts can't be read
+	bare := newTestSMSProvider(t, `{"type": "http", "name": "bare", "url": "https://sms.example.com/send", "body": "{{to}}"}`)
+	if _, err := bare.ParseReceipt(receiptRequest(form, "id=1")); err != ErrorInvalidSMSReceipt {
+		t.Errorf("expected ErrorInvalidSMSReceipt, got %v", err)
+	}
+}
+
+func TestSMSReceiptCallback(t *testing.T) {
+	smsProviderLock.Lock()
+	old := sms_provider
+	sms_provider = newTestSMSProvider(t, `{"type": "twilio", "account_sid": "AC1", "auth_token": "token", "from": "+14155550199"}`)
+	smsProviderLock.Unlock()
+	defer func() {
+		smsProviderLock.Lock()
+		sms_provider = old
+		smsProviderLock.Unlock()
+	}()
+
+	for name, c := range map[string]struct {
+		provider string
+		key      string
+		err      error
+	}{
+		"forged key":     {"twilio", "forged", ErrorInvalidCallbackKey},
+		"other's key":    {"twilio", smsCallbackKey("nexmo"), ErrorInvalidCallbackKey},
+		"other provider": {"nexmo", smsCallbackKey("nexmo"), ErrorSMSProviderMismatch},
+	} {
+		r := receiptRequest("application/x-www-form-urlencoded", "MessageSid=SM1&MessageStatus=delivered")
+		r.URL.RawQuery = "key=" + url.QueryEscape(c.key)
+		if err := HandleSMSReceipt(c.provider, r); err != c.err {
+			t.Errorf("%s: expected %v, got %v", name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package distributor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"jsonwrapper"
+	"net/http"
+	"net/url"
+	"schedule"
+	"strings"
+	"time"
+)
+
+const (
+	SMS_REQUEST_TIMEOUT = 15 * time.Second
+	MAX_SMS_RESPONSE    = 64 * 1024
+)
+
+var sms_client = &http.Client{Timeout: SMS_REQUEST_TIMEOUT}
+
+// readSMSResponse returns the response body, or an error when the request
+// failed on the network or returned a non 2xx status
+func readSMSResponse(response *http.Response, err error) ([]byte, error) {
+	if err != nil || response == nil {
+		return nil, ErrorNetworkDisconnect
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, MAX_SMS_RESPONSE))
+	if err != nil {
+		return nil, ErrorNetworkDisconnect
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return body, ErrorUnexpectedStatus
+	}
+
+	return body, nil
+}
+
+// Twilio, sms_provider: {"type": "twilio", "account_sid", "auth_token", "from"}
+type twilioProvider struct {
+	account_sid string
+	auth_token  string
+	from        string
+}
+
+func newTwilioProvider(settings *jsonwrapper.Object) (SMSProvider, error) {
+	p := new(twilioProvider)
+	p.account_sid, _ = settings.GetString("account_sid")
+	p.auth_token, _ = settings.GetString("auth_token")
+	p.from, _ = settings.GetString("from")
+
+	if p.account_sid == "" || p.auth_token == "" || p.from == "" {
+		return nil, ErrorSMSNotConfigured
+	}
+	return p, nil
+}
+
+func (p *twilioProvider) Name() string {
+	return "twilio"
+}
+
+func (p *twilioProvider) Send(to, body, encoding, callback_url string) (string, error) {
+	url_str := "https://api.twilio.com/2010-04-01/Accounts/" + p.account_sid + "/Messages.json"
+
+	v := url.Values{}
+	v.Set("To", to)
+	v.Set("From", p.from)
+	v.Set("Body", body)
+	if callback_url != "" {
+		v.Set("StatusCallback", callback_url)
+	}
+
+	req, err := http.NewRequest("POST", url_str, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", ErrorInvalidEndpointOrBody
+	}
+
+	req.SetBasicAuth(p.account_sid, p.auth_token)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	// Twilio answers 201 Created on success
+	response, err := readSMSResponse(sms_client.Do(req))
+	if err != nil {
+		return "", err
+	}
+
+	obj, err := jsonwrapper.NewObjectFromBytes(response)
+	if err != nil {
+		return "", ErrorInproperResponse
+	}
+	sid, _ := obj.GetString("sid")
+	return sid, nil
+}
+
+func (p *twilioProvider) ParseReceipt(r *http.Request) (*SMSReceipt, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, ErrorInvalidSMSReceipt
+	}
+
+	receipt := &SMSReceipt{Reference: r.Form.Get("MessageSid"), Detail: r.Form.Get("ErrorCode")}
+	if receipt.Reference == "" {
+		return nil, ErrorInvalidSMSReceipt
+	}
+
+	switch r.Form.Get("MessageStatus") {
+	case "delivered":
+		receipt.Status = schedule.DELIVERY_STATUS_DELIVERED
+	case "undelivered":
+		receipt.Status = schedule.DELIVERY_STATUS_UNDELIVERED
+	case "failed":
+		receipt.Status = schedule.DELIVERY_STATUS_FAILED
+	case "sent":
+		receipt.Status = schedule.DELIVERY_STATUS_SENT
+	default:
+		receipt.Status = schedule.DELIVERY_STATUS_QUEUED
+	}
+
+	return receipt, nil
+}
+
+// Nexmo / Vonage SMS API, sms_provider:
+// {"type": "nexmo", "api_key", "api_secret", "from"}
+type nexmoProvider struct {
+	api_key    string
+	api_secret string
+	from       string
+}
+
+func newNexmoProvider(settings *jsonwrapper.Object) (SMSProvider, error) {
+	p := new(nexmoProvider)
+	p.api_key, _ = settings.GetString("api_key")
+	p.api_secret, _ = settings.GetString("api_secret")
+	p.from, _ = settings.GetString("from")
+
+	if p.api_key == "" || p.api_secret == "" || p.from == "" {
+		return nil, ErrorSMSNotConfigured
+	}
+	return p, nil
+}
+
+func (p *nexmoProvider) Name() string {
+	return "nexmo"
+}
+
+func (p *nexmoProvider) Send(to, body, encoding, callback_url string) (string, error) {
+	v := url.Values{}
+	v.Set("api_key", p.api_key)
+	v.Set("api_secret", p.api_secret)
+	v.Set("from", p.from)
+	// Nexmo expects numbers without the leading plus
+	v.Set("to", strings.TrimPrefix(to, "+"))
+	v.Set("text", body)
+	if encoding == SMS_ENCODING_UCS2 {
+		v.Set("type", "unicode")
+	}
+	if callback_url != "" {
+		v.Set("callback", callback_url)
+	}
+
+	response, err := readSMSResponse(sms_client.PostForm("https://rest.nexmo.com/sms/json", v))
+	if err != nil {
+		return "", err
+	}
+
+	obj, err := jsonwrapper.NewObjectFromBytes(response)
+	if err != nil {
+		return "", ErrorInproperResponse
+	}
+
+	messages, err := obj.GetObjectArray("messages")
+	if err != nil || len(messages) == 0 {
+		return "", ErrorInproperResponse
+	}
+
+	// Long messages are split by Nexmo, the first part is the reference
+	status, _ := messages[0].GetString("status")
+	reference, _ := messages[0].GetString("message-id")
+	if status != "0" {
+		text, _ := messages[0].GetString("error-text")
+		return reference, errorWithDetail(text)
+	}
+
+	return reference, nil
+}
+
+func (p *nexmoProvider) ParseReceipt(r *http.Request) (*SMSReceipt, error) {
+	values, err := receiptValues(r)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &SMSReceipt{Reference: values["messageId"], Detail: values["err-code"]}
+	if receipt.Reference == "" {
+		return nil, ErrorInvalidSMSReceipt
+	}
+
+	switch values["status"] {
+	case "delivered":
+		receipt.Status = schedule.DELIVERY_STATUS_DELIVERED
+	case "expired", "rejected":
+		receipt.Status = schedule.DELIVERY_STATUS_UNDELIVERED
+	case "failed":
+		receipt.Status = schedule.DELIVERY_STATUS_FAILED
+	default:
+		receipt.Status = schedule.DELIVERY_STATUS_QUEUED
+	}
+
+	return receipt, nil
+}
+
+// Generic HTTP gateway described entirely in config:
+//
+//	{
+//		"type": "http", "name": "acme",
+//		"url": "https://sms.example.com/send", "method": "POST",
+//		"content_type": "application/json",
+//		"headers": {"Authorization": "Bearer ..."},
+//		"body": "{\"to\":\"{{to}}\",\"text\":\"{{body}}\",\"from\":\"{{from}}\",\"dlr\":\"{{callback}}\"}",
+//		"from": "+14155550100",
+//		"id_field": "message.id",
+//		"receipt": {"reference_field": "id", "status_field": "status", "detail_field": "error",
+//			"statuses": {"DELIVRD": "delivered", "UNDELIV": "undelivered", "FAILED": "failed"}}
+//	}
+//
+// Placeholders in body are escaped for the content type. Fields in the
+// response and receipts are dot separated JSON paths, receipts can also be
+// form encoded.
+type httpSMSProvider struct {
+	name            string
+	url             string
+	method          string
+	content_type    string
+	headers         map[string]string
+	body            string
+	from            string
+	id_field        string
+	reference_field string
+	status_field    string
+	detail_field    string
+	statuses        map[string]string
+}
+
+func newHTTPSMSProvider(settings *jsonwrapper.Object) (SMSProvider, error) {
+	p := new(httpSMSProvider)
+	p.name, _ = settings.GetString("name")
+	p.url, _ = settings.GetString("url")
+	p.method, _ = settings.GetString("method")
+	p.content_type, _ = settings.GetString("content_type")
+	p.body, _ = settings.GetString("body")
+	p.from, _ = settings.GetString("from")
+	p.id_field, _ = settings.GetString("id_field")
+
+	if p.name == "" || p.url == "" || p.body == "" {
+		return nil, ErrorSMSNotConfigured
+	}
+	if p.method == "" {
+		p.method = "POST"
+	}
+	if p.content_type == "" {
+		p.content_type = "application/x-www-form-urlencoded"
+	}
+
+	p.headers = make(map[string]string)
+	if headers, err := settings.GetObject("headers"); err == nil {
+		for name := range headers.Map() {
+			p.headers[name], _ = headers.GetString(name)
+		}
+	}
+
+	p.statuses = make(map[string]string)
+	if receipt, err := settings.GetObject("receipt"); err == nil {
+		p.reference_field, _ = receipt.GetString("reference_field")
+		p.status_field, _ = receipt.GetString("status_field")
+		p.detail_field, _ = receipt.GetString("detail_field")
+		if statuses, err := receipt.GetObject("statuses"); err == nil {
+			for name := range statuses.Map() {
+				p.statuses[name], _ = statuses.GetString(name)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+func (p *httpSMSProvider) Name() string {
+	return p.name
+}
+
+func (p *httpSMSProvider) escape(s string) string {
+	if strings.Contains(p.content_type, "json") {
+		quoted, _ := json.Marshal(s)
+		return string(quoted[1 : len(quoted)-1])
+	}
+	if strings.Contains(p.content_type, "x-www-form-urlencoded") {
+		return url.QueryEscape(s)
+	}
+	return s
+}
+
+func (p *httpSMSProvider) Send(to, body, encoding, callback_url string) (string, error) {
+	payload := strings.NewReplacer(
+		"{{to}}", p.escape(to),
+		"{{body}}", p.escape(body),
+		"{{from}}", p.escape(p.from),
+		"{{encoding}}", p.escape(encoding),
+		"{{callback}}", p.escape(callback_url),
+	).Replace(p.body)
+
+	req, err := http.NewRequest(p.method, p.url, bytes.NewBufferString(payload))
+	if err != nil {
+		return "", ErrorInvalidEndpointOrBody
+	}
+
+	req.Header.Set("Content-Type", p.content_type)
+	req.Header.Set("Powered-By", "GrandmaSchedulerServices")
+	for name, value := range p.headers {
+		req.Header.Set(name, value)
+	}
+
+	response, err := readSMSResponse(sms_client.Do(req))
+	if err != nil {
+		return "", err
+	}
+
+	if p.id_field == "" {
+		return "", nil
+	}
+
+	obj, err := jsonwrapper.NewObjectFromBytes(response)
+	if err != nil {
+		return "", nil
+	}
+	reference, err := obj.GetValue(strings.Split(p.id_field, ".")...)
+	if err != nil {
+		return "", nil
+	}
+	return fmt.Sprint(reference.Interface()), nil
+}
+
+func (p *httpSMSProvider) ParseReceipt(r *http.Request) (*SMSReceipt, error) {
+	if p.reference_field == "" || p.status_field == "" {
+		return nil, ErrorInvalidSMSReceipt
+	}
+
+	values, err := receiptValues(r)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &SMSReceipt{Reference: values[p.reference_field], Detail: values[p.detail_field]}
+	if receipt.Reference == "" {
+		return nil, ErrorInvalidSMSReceipt
+	}
+
+	status := values[p.status_field]
+	if mapped, ok := p.statuses[status]; ok {
+		receipt.Status = mapped
+	} else {
+		receipt.Status = schedule.DELIVERY_STATUS_QUEUED
+	}
+
+	return receipt, nil
+}
+
+// receiptValues flattens a JSON or form encoded receipt into dot separated
+// keys and string values
+func receiptValues(r *http.Request) (map[string]string, error) {
+	values := make(map[string]string)
+
+	if strings.Contains(r.Header.Get("Content-Type"), "json") {
+		obj, err := jsonwrapper.NewObjectFromReader(io.LimitReader(r.Body, MAX_SMS_RESPONSE))
+		if err != nil {
+			return nil, ErrorInvalidSMSReceipt
+		}
+		flatten(values, "", obj.Map())
+		return values, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, ErrorInvalidSMSReceipt
+	}
+	for key := range r.Form {
+		values[key] = r.Form.Get(key)
+	}
+	return values, nil
+}
+
+func flatten(values map[string]string, prefix string, m map[string]*jsonwrapper.Value) {
+	for key, value := range m {
+		if obj, err := value.Object(); err == nil {
+			flatten(values, prefix+key+".", obj.Map())
+			continue
+		}
+		values[prefix+key] = fmt.Sprint(value.Interface())
+	}
+}
+
+type errorWithDetail string
+
+func (e errorWithDetail) Error() string {
+	return "SMS provider error: " + string(e)
+}
@@ -1,11 +1,29 @@
 package distributor
 
 import (
+	"conf"
+	"schedule"
+	"strconv"
 	"strings"
 	"ws"
 )
 
-func sendWebSocketMsg(endpoint string, message string) error {
+const WEBSOCKET_CHANNEL = "websocket"
+
+func init() {
+	ws.OnDeliveryStatus = recordWebSocketStatus
+}
+
+// Scheduled messages are identified to clients as "<node name>/<schedule
+// id>" so acks can find their way back to the node that fired them
+func webSocketMessageId(schedule_id int) string {
+	if schedule_id <= 0 {
+		return ""
+	}
+	return conf.GetGrandmaName() + "/" + strconv.Itoa(schedule_id)
+}
+
+func sendWebSocketMsg(endpoint string, message string, schedule_id int, valid_until int64) error {
 	ep := strings.Split(endpoint, ".")
 
 	if len(ep) < 2 {
@@ -13,5 +31,42 @@ func sendWebSocketMsg(endpoint string, message string) error {
 	}
 	id := ep[0]
 	key := ep[1]
-	return ws.Send(id, key, message)
+	msg_id := webSocketMessageId(schedule_id)
+
+	// Unacked messages are sent again until valid_until, see ws
+	if msg_id == "" {
+		if err := ws.Send(id, key, msg_id, message, valid_until); err != ws.ErrorMessageExpired {
+			return err
+		}
+		return ErrorMessageExpired
+	}
+	if pastValidUntil(valid_until) {
+		return ErrorMessageExpired
+	}
+
+	// Recorded first, the client may ack before Send returns
+	schedule.RecordDelivery(schedule_id, WEBSOCKET_CHANNEL, msg_id, schedule.DELIVERY_STATUS_SENT, "")
+	err := ws.Send(id, key, msg_id, message, valid_until)
+	if err == ws.ErrorMessageExpired {
+		schedule.UpdateDeliveryByReference(WEBSOCKET_CHANNEL, msg_id, schedule.DELIVERY_STATUS_EXPIRED, err.Error())
+	} else if err != nil {
+		schedule.UpdateDeliveryByReference(WEBSOCKET_CHANNEL, msg_id, schedule.DELIVERY_STATUS_FAILED, err.Error())
+	}
+	return err
+}
+
+// recordWebSocketStatus applies client acks, and ack timeouts, to messages
+// fired on this node
+func recordWebSocketStatus(msg_id string, status string, detail string) {
+	if !strings.HasPrefix(msg_id, conf.GetGrandmaName()+"/") {
+		return
+	}
+	if status == ws.STATUS_DELIVERED {
+		status = schedule.DELIVERY_STATUS_DELIVERED
+	} else if status == ws.STATUS_EXPIRED {
+		status = schedule.DELIVERY_STATUS_EXPIRED
+	} else {
+		status = schedule.DELIVERY_STATUS_UNDELIVERED
+	}
+	schedule.UpdateDeliveryByReference(WEBSOCKET_CHANNEL, msg_id, status, detail)
 }
@@ -0,0 +1,398 @@
+// Package kafka is a minimal idempotent Kafka producer used by the Kafka
+// distributor. Each record is sent in its own batch with acks=all and a
+// producer id, epoch and per partition sequence number, so retries after a
+// lost response are deduplicated by the broker. Retries go to the partition
+// the first attempt picked, where the sequence number counts.
+//
+// A broker that lost the producer session can't dedupe a retry. When an
+// attempt before may have been written the record isn't sent again but
+// fails with ErrorProduceUncertain, and so do records whose attempts ran
+// out then. Either way the next record starts a new session, its sequence
+// number may be taken. A record given a deadline isn't tried after it, it
+// fails with ErrorProduceExpired unless an attempt may have been written.
+package kafka
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PRODUCE_TIMEOUT_MS  int32 = 10000
+	MAX_PRODUCE_ATTEMPT       = 5
+	RETRY_BACKOFF             = 300 * time.Millisecond
+)
+
+var (
+	ErrorNoBrokerAvailable = errors.New("No Kafka broker available")
+	ErrorUnknownTopic      = errors.New("Kafka topic not found")
+	ErrorInitProducerId    = errors.New("Failed to get Kafka producer id")
+	ErrorProduceFailed     = errors.New("Kafka produce failed")
+	ErrorRetriesExhausted  = errors.New("Kafka produce retries exhausted")
+	ErrorProduceUncertain  = errors.New("Kafka produce may have been written, not retried")
+	ErrorPartitionGone     = errors.New("Kafka partition no longer in topic")
+	ErrorProduceExpired    = errors.New("Kafka record deadline passed before it was written")
+)
+
+type partition struct {
+	id     int32
+	leader int32
+}
+
+type Producer struct {
+	seeds          []string
+	client_id      string
+	lock           *sync.Mutex
+	brokers        map[int32]string
+	conns          map[string]*brokerConn
+	partitions     map[string][]partition
+	producer_id    int64
+	producer_epoch int16
+	sequences      map[string]int32
+	round_robin    int
+}
+
+func NewProducer(seeds []string, client_id string) *Producer {
+	return &Producer{
+		seeds:       seeds,
+		client_id:   client_id,
+		lock:        new(sync.Mutex),
+		brokers:     make(map[int32]string),
+		conns:       make(map[string]*brokerConn),
+		partitions:  make(map[string][]partition),
+		producer_id: -1,
+		sequences:   make(map[string]int32),
+	}
+}
+
+// Produce writes one record to topic and returns the partition and offset
+// it was written at. Records with the same key go to the same partition.
+func (p *Producer) Produce(topic string, key, value []byte, headers []Header) (int32, int64, error) {
+	return p.ProduceBefore(topic, key, value, headers, time.Time{})
+}
+
+// ProduceBefore is Produce giving up once deadline passes, a zero deadline
+// never passes
+func (p *Producer) ProduceBefore(topic string, key, value []byte, headers []Header, deadline time.Time) (int32, int64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var last_err error = ErrorRetriesExhausted
+	var pinned *partition = nil // Picked on the first attempt, kept on retries
+	uncertain := false          // An attempt may have been written
+	for attempt := 1; attempt <= MAX_PRODUCE_ATTEMPT; attempt++ {
+		if attempt > 1 {
+			time.Sleep(RETRY_BACKOFF * time.Duration(attempt-1))
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			if uncertain {
+				p.resetSession()
+				return -1, -1, ErrorProduceUncertain
+			}
+			return -1, -1, ErrorProduceExpired
+		}
+
+		if p.producer_id < 0 {
+			if err := p.initProducerId(); err != nil {
+				last_err = err
+				continue
+			}
+		}
+
+		partitions, err := p.topicPartitions(topic, attempt > 1)
+		if err != nil {
+			last_err = err
+			continue
+		}
+
+		if pinned == nil {
+			chosen := p.choosePartition(key, partitions)
+			pinned = &chosen
+		}
+		part, ok := findPartition(partitions, pinned.id)
+		if !ok {
+			last_err = ErrorPartitionGone
+			continue
+		}
+		tp := topic + "/" + strconv.Itoa(int(part.id))
+		sequence := p.sequences[tp]
+
+		addr, ok := p.brokers[part.leader]
+		if !ok {
+			last_err = ErrorNoBrokerAvailable
+			continue
+		}
+
+		conn, err := p.connect(addr)
+		if err != nil {
+			last_err = err
+			continue
+		}
+
+		batch := encodeRecordBatch(key, value, headers, time.Now().UnixNano()/1000000,
+			p.producer_id, p.producer_epoch, sequence)
+
+		code, offset, err := p.produce(conn, topic, part.id, batch)
+		if err != nil {
+			// The batch may have been written, the retry reuses the sequence
+			// number so the broker reports it as a duplicate instead
+			log.Println("Kafka produce to " + addr + " failed: " + err.Error())
+			p.disconnect(addr)
+			uncertain = true
+			last_err = err
+			continue
+		}
+
+		switch code {
+		case ERR_NONE, ERR_DUPLICATE_SEQUENCE_NUMBER:
+			p.sequences[tp] = sequence + 1
+			return part.id, offset, nil
+		case ERR_NOT_LEADER_FOR_PARTITION, ERR_UNKNOWN_TOPIC_OR_PARTITION, ERR_LEADER_NOT_AVAILABLE,
+			ERR_REQUEST_TIMED_OUT, ERR_NOT_ENOUGH_REPLICAS, ERR_NOT_ENOUGH_REPLICAS_AFTER:
+			last_err = ErrorProduceFailed
+			continue
+		case ERR_OUT_OF_ORDER_SEQUENCE, ERR_UNKNOWN_PRODUCER_ID, ERR_INVALID_PRODUCER_EPOCH:
+			// Producer state is lost on the broker, start a new producer session
+			log.Println("Kafka producer session reset, error code " + strconv.Itoa(int(code)))
+			p.resetSession()
+			if uncertain {
+				// The new session can't dedupe the attempt that may be written
+				return part.id, -1, ErrorProduceUncertain
+			}
+			last_err = ErrorProduceFailed
+			continue
+		default:
+			log.Println("Kafka produce error code " + strconv.Itoa(int(code)))
+			return part.id, -1, ErrorProduceFailed
+		}
+	}
+
+	if uncertain {
+		p.resetSession()
+		return -1, -1, ErrorProduceUncertain
+	}
+	return -1, -1, last_err
+}
+
+func (p *Producer) resetSession() {
+	p.producer_id = -1
+	p.sequences = make(map[string]int32)
+}
+
+func findPartition(partitions []partition, id int32) (partition, bool) {
+	for _, part := range partitions {
+		if part.id == id {
+			return part, true
+		}
+	}
+	return partition{}, false
+}
+
+func (p *Producer) choosePartition(key []byte, partitions []partition) partition {
+	if key == nil {
+		p.round_robin++
+		return partitions[p.round_robin%len(partitions)]
+	}
+	return partitions[int(murmur2(key)&0x7fffffff)%len(partitions)]
+}
+
+func (p *Producer) connect(addr string) (*brokerConn, error) {
+	if conn, ok := p.conns[addr]; ok {
+		return conn, nil
+	}
+
+	conn, err := dialBroker(addr)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[addr] = conn
+	return conn, nil
+}
+
+func (p *Producer) disconnect(addr string) {
+	if conn, ok := p.conns[addr]; ok {
+		conn.close()
+		delete(p.conns, addr)
+	}
+}
+
+// anyBroker returns a connection to a known broker, falling back to the
+// configured seed list
+func (p *Producer) anyBroker() (*brokerConn, error) {
+	for _, conn := range p.conns {
+		return conn, nil
+	}
+
+	candidates := make([]string, 0, len(p.brokers)+len(p.seeds))
+	for _, addr := range p.brokers {
+		candidates = append(candidates, addr)
+	}
+	candidates = append(candidates, p.seeds...)
+
+	for _, addr := range candidates {
+		conn, err := p.connect(addr)
+		if err == nil {
+			return conn, nil
+		}
+		log.Println("Kafka broker " + addr + " unreachable")
+	}
+
+	return nil, ErrorNoBrokerAvailable
+}
+
+func (p *Producer) initProducerId() error {
+	conn, err := p.anyBroker()
+	if err != nil {
+		return err
+	}
+
+	body := new(encoder)
+	body.putNullableString(nil)
+	body.putInt32(60000)
+
+	response, err := conn.request(p.client_id, API_INIT_PRODUCER_ID, VERSION_INIT_PRODUCER_ID, body.Bytes())
+	if err != nil {
+		p.disconnect(conn.addr)
+		return err
+	}
+
+	d := newDecoder(response)
+	d.getInt32() // throttle time
+	code := d.getInt16()
+	producer_id := d.getInt64()
+	producer_epoch := d.getInt16()
+	if d.err != nil {
+		return d.err
+	}
+	if code != ERR_NONE {
+		log.Println("Kafka init producer id error code " + strconv.Itoa(int(code)))
+		return ErrorInitProducerId
+	}
+
+	p.producer_id = producer_id
+	p.producer_epoch = producer_epoch
+	return nil
+}
+
+func (p *Producer) topicPartitions(topic string, refresh bool) ([]partition, error) {
+	if partitions, ok := p.partitions[topic]; ok && !refresh {
+		return partitions, nil
+	}
+
+	conn, err := p.anyBroker()
+	if err != nil {
+		return nil, err
+	}
+
+	body := new(encoder)
+	body.putInt32(1)
+	body.putString(topic)
+
+	response, err := conn.request(p.client_id, API_METADATA, VERSION_METADATA, body.Bytes())
+	if err != nil {
+		p.disconnect(conn.addr)
+		return nil, err
+	}
+
+	d := newDecoder(response)
+	nbrokers := d.getArrayLen()
+	for i := 0; i < nbrokers; i++ {
+		node_id := d.getInt32()
+		host := d.getString()
+		port := d.getInt32()
+		d.getString() // rack
+		p.brokers[node_id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.getInt32() // controller id
+
+	ntopics := d.getArrayLen()
+	for i := 0; i < ntopics; i++ {
+		code := d.getInt16()
+		name := d.getString()
+		d.getInt8() // is internal
+
+		nparts := d.getArrayLen()
+		partitions := make([]partition, 0, nparts)
+		for j := 0; j < nparts; j++ {
+			d.getInt16() // partition error code
+			id := d.getInt32()
+			leader := d.getInt32()
+			nreplicas := d.getArrayLen()
+			for k := 0; k < nreplicas; k++ {
+				d.getInt32()
+			}
+			nisr := d.getArrayLen()
+			for k := 0; k < nisr; k++ {
+				d.getInt32()
+			}
+			partitions = append(partitions, partition{id, leader})
+		}
+
+		if code == ERR_NONE && len(partitions) > 0 {
+			p.partitions[name] = partitions
+		} else {
+			delete(p.partitions, name)
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	partitions, ok := p.partitions[topic]
+	if !ok {
+		return nil, ErrorUnknownTopic
+	}
+	return partitions, nil
+}
+
+func (p *Producer) produce(conn *brokerConn, topic string, partition_id int32, batch []byte) (int16, int64, error) {
+	body := new(encoder)
+	body.putNullableString(nil)
+	body.putInt16(-1) // acks from all in sync replicas, required for idempotence
+	body.putInt32(PRODUCE_TIMEOUT_MS)
+	body.putInt32(1)
+	body.putString(topic)
+	body.putInt32(1)
+	body.putInt32(partition_id)
+	body.putBytes(batch)
+
+	response, err := conn.request(p.client_id, API_PRODUCE, VERSION_PRODUCE, body.Bytes())
+	if err != nil {
+		return 0, -1, err
+	}
+
+	d := newDecoder(response)
+	ntopics := d.getArrayLen()
+	for i := 0; i < ntopics; i++ {
+		d.getString()
+		nparts := d.getArrayLen()
+		for j := 0; j < nparts; j++ {
+			id := d.getInt32()
+			code := d.getInt16()
+			offset := d.getInt64()
+			d.getInt64() // log append time
+			if d.err == nil && id == partition_id {
+				return code, offset, nil
+			}
+		}
+	}
+
+	if d.err != nil {
+		return 0, -1, d.err
+	}
+	return 0, -1, ErrorMalformedResponse
+}
+
+// Close drops all broker connections
+func (p *Producer) Close() {
+	p.lock.Lock()
+	for addr := range p.conns {
+		p.disconnect(addr)
+	}
+	p.lock.Unlock()
+}
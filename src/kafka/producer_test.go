@@ -0,0 +1,296 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type producedBatch struct {
+	partition   int32
+	producer_id int64
+	sequence    int32
+}
+
+// fakeBroker is a single broker leading every partition of one topic. Each
+// produce request is answered by the next entry of answers, the last one
+// repeating. ANSWER_DROP closes the connection without a response, after
+// the batch was taken.
+type fakeBroker struct {
+	listener   net.Listener
+	topic      string
+	partitions int32
+	answers    []int16
+	lock       sync.Mutex
+	produced   []producedBatch
+	inits      int
+}
+
+const ANSWER_DROP int16 = -100
+
+func startFakeBroker(t *testing.T, topic string, partitions int32, answers ...int16) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBroker{listener: l, topic: topic, partitions: partitions, answers: answers}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return b
+}
+
+func (b *fakeBroker) batches() []producedBatch {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]producedBatch{}, b.produced...)
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		size_header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size_header); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(size_header))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+
+		d := newDecoder(request)
+		api_key := d.getInt16()
+		d.getInt16() // version
+		correlation_id := d.getInt32()
+		d.getString() // client id
+
+		response := new(encoder)
+		response.putInt32(correlation_id)
+		switch api_key {
+		case API_METADATA:
+			b.metadata(response)
+		case API_INIT_PRODUCER_ID:
+			b.lock.Lock()
+			b.inits++
+			producer_id := int64(1000 + b.inits)
+			b.lock.Unlock()
+			response.putInt32(0) // throttle time
+			response.putInt16(ERR_NONE)
+			response.putInt64(producer_id)
+			response.putInt16(0)
+		case API_PRODUCE:
+			d.getString() // transactional id
+			d.getInt16()  // acks
+			d.getInt32()  // timeout
+			d.getInt32()  // topics
+			d.getString()
+			d.getInt32() // partitions
+			partition := d.getInt32()
+			d.getInt32() // batch size
+			batch := make([]byte, d.Len())
+			d.Read(batch)
+
+			b.lock.Lock()
+			b.produced = append(b.produced, producedBatch{partition,
+				int64(binary.BigEndian.Uint64(batch[43:51])), int32(binary.BigEndian.Uint32(batch[53:57]))})
+			answer := b.answers[len(b.answers)-1]
+			if len(b.produced) <= len(b.answers) {
+				answer = b.answers[len(b.produced)-1]
+			}
+			offset := int64(len(b.produced))
+			b.lock.Unlock()
+
+			if answer == ANSWER_DROP {
+				return
+			}
+			response.putInt32(1)
+			response.putString(b.topic)
+			response.putInt32(1)
+			response.putInt32(partition)
+			response.putInt16(answer)
+			response.putInt64(offset)
+			response.putInt64(-1)
+			response.putInt32(0) // throttle time
+		default:
+			return
+		}
+
+		packet := new(encoder)
+		packet.putInt32(int32(response.Len()))
+		packet.Write(response.Bytes())
+		conn.Write(packet.Bytes())
+	}
+}
+
+func (b *fakeBroker) metadata(response *encoder) {
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	port_number, _ := strconv.Atoi(port)
+
+	response.putInt32(1)
+	response.putInt32(1) // node id
+	response.putString(host)
+	response.putInt32(int32(port_number))
+	response.putNullableString(nil) // rack
+	response.putInt32(1)            // controller id
+
+	response.putInt32(1)
+	response.putInt16(ERR_NONE)
+	response.putString(b.topic)
+	response.putInt8(0)
+	response.putInt32(b.partitions)
+	for id := int32(0); id < b.partitions; id++ {
+		response.putInt16(ERR_NONE)
+		response.putInt32(id)
+		response.putInt32(1) // leader
+		response.putInt32(1)
+		response.putInt32(1) // replicas
+		response.putInt32(1)
+		response.putInt32(1) // in sync replicas
+	}
+}
+
+func newTestProducer(b *fakeBroker) *Producer {
+	return NewProducer([]string{b.listener.Addr().String()}, "test")
+}
+
+func TestRetryKeepsPartitionAndSequence(t *testing.T) {
+	b := startFakeBroker(t, "orders", 3, ERR_NOT_LEADER_FOR_PARTITION, ERR_NONE)
+	p := newTestProducer(b)
+	defer p.Close()
+
+	// Round robin would move on to the next partition
+	partition, _, err := p.Produce("orders", nil, []byte("v"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batches := b.batches()
+	if len(batches) != 2 {
+		t.Fatalf("%d batches produced", len(batches))
+	}
+	if batches[0].partition != batches[1].partition || batches[1].partition != partition {
+		t.Errorf("retry moved from partition %d to %d", batches[0].partition, batches[1].partition)
+	}
+	if batches[0].sequence != batches[1].sequence {
+		t.Errorf("retry changed sequence from %d to %d", batches[0].sequence, batches[1].sequence)
+	}
+}
+
+func TestLostResponseIsDeduplicated(t *testing.T) {
+	b := startFakeBroker(t, "orders", 1, ANSWER_DROP, ERR_DUPLICATE_SEQUENCE_NUMBER, ERR_NONE)
+	p := newTestProducer(b)
+	defer p.Close()
+
+	if _, _, err := p.Produce("orders", []byte("k"), []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Produce("orders", []byte("k"), []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := b.batches()
+	if len(batches) != 3 || batches[0].sequence != 0 || batches[1].sequence != 0 || batches[2].sequence != 1 {
+		t.Errorf("batches %+v", batches)
+	}
+}
+
+func TestNotResentUnderNewSession(t *testing.T) {
+	b := startFakeBroker(t, "orders", 1, ANSWER_DROP, ERR_UNKNOWN_PRODUCER_ID, ERR_NONE)
+	p := newTestProducer(b)
+	defer p.Close()
+
+	if _, _, err := p.Produce("orders", []byte("k"), []byte("v"), nil); err != ErrorProduceUncertain {
+		t.Fatalf("expected ErrorProduceUncertain, got %v", err)
+	}
+	if _, _, err := p.Produce("orders", []byte("k"), []byte("w"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := b.batches()
+	if len(batches) != 3 {
+		t.Fatalf("batches %+v", batches)
+	}
+	if batches[2].producer_id == batches[0].producer_id || batches[2].sequence != 0 {
+		t.Errorf("the next record should start a new session: %+v", batches)
+	}
+}
+
+func TestSessionResetWhenNothingWritten(t *testing.T) {
+	b := startFakeBroker(t, "orders", 1, ERR_OUT_OF_ORDER_SEQUENCE, ERR_NONE)
+	p := newTestProducer(b)
+	defer p.Close()
+
+	if _, _, err := p.Produce("orders", []byte("k"), []byte("v"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	batches := b.batches()
+	if len(batches) != 2 || batches[0].producer_id == batches[1].producer_id || batches[1].sequence != 0 {
+		t.Errorf("batches %+v", batches)
+	}
+}
+
+func TestKeyedRecordsShareAPartition(t *testing.T) {
+	b := startFakeBroker(t, "orders", 8, ERR_NONE)
+	p := newTestProducer(b)
+	defer p.Close()
+
+	first, _, err := p.Produce("orders", []byte("customer-7"), []byte("v"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		partition, _, err := p.Produce("orders", []byte("customer-7"), []byte("v"), nil)
+		if err != nil || partition != first {
+			t.Errorf("went to partition %d instead of %d, %v", partition, first, err)
+		}
+	}
+	if expected := int32(int(murmur2([]byte("customer-7"))&0x7fffffff) % 8); first != expected {
+		t.Errorf("partition %d, the Java client picks %d", first, expected)
+	}
+}
+
+func TestNotRetriedPastDeadline(t *testing.T) {
+	b := startFakeBroker(t, "orders", 1, ERR_NOT_LEADER_FOR_PARTITION)
+	p := newTestProducer(b)
+	defer p.Close()
+
+	// The first retry waits longer than the deadline leaves
+	deadline := time.Now().Add(RETRY_BACKOFF / 3)
+	if _, _, err := p.ProduceBefore("orders", nil, []byte("v"), nil, deadline); err != ErrorProduceExpired {
+		t.Fatalf("expected ErrorProduceExpired, got %v", err)
+	}
+	if batches := b.batches(); len(batches) != 1 {
+		t.Errorf("%d batches produced", len(batches))
+	}
+
+	if _, _, err := p.ProduceBefore("orders", nil, []byte("v"), nil, time.Now().Add(-time.Second)); err != ErrorProduceExpired {
+		t.Errorf("expected ErrorProduceExpired, got %v", err)
+	}
+	if batches := b.batches(); len(batches) != 1 {
+		t.Errorf("an expired record was sent, %d batches produced", len(batches))
+	}
+}
+
+func TestUncertainPastDeadline(t *testing.T) {
+	b := startFakeBroker(t, "orders", 1, ANSWER_DROP, ERR_NONE)
+	p := newTestProducer(b)
+	defer p.Close()
+
+	deadline := time.Now().Add(RETRY_BACKOFF / 3)
+	if _, _, err := p.ProduceBefore("orders", nil, []byte("v"), nil, deadline); err != ErrorProduceUncertain {
+		t.Fatalf("a record that may be written isn't expired, got %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Api keys and versions spoken by the producer
+const (
+	API_PRODUCE          int16 = 0
+	API_METADATA         int16 = 3
+	API_INIT_PRODUCER_ID int16 = 22
+
+	VERSION_PRODUCE          int16 = 3
+	VERSION_METADATA         int16 = 1
+	VERSION_INIT_PRODUCER_ID int16 = 0
+)
+
+// Broker error codes the producer reacts to
+const (
+	ERR_NONE                       int16 = 0
+	ERR_UNKNOWN_TOPIC_OR_PARTITION int16 = 3
+	ERR_LEADER_NOT_AVAILABLE       int16 = 5
+	ERR_NOT_LEADER_FOR_PARTITION   int16 = 6
+	ERR_REQUEST_TIMED_OUT          int16 = 7
+	ERR_NOT_ENOUGH_REPLICAS        int16 = 19
+	ERR_NOT_ENOUGH_REPLICAS_AFTER  int16 = 20
+	ERR_OUT_OF_ORDER_SEQUENCE      int16 = 45
+	ERR_DUPLICATE_SEQUENCE_NUMBER  int16 = 46
+	ERR_INVALID_PRODUCER_EPOCH     int16 = 47
+	ERR_UNKNOWN_PRODUCER_ID        int16 = 59
+)
+
+const (
+	MAX_RESPONSE_SIZE = 64 * 1024 * 1024
+	REQUEST_TIMEOUT   = 10 * time.Second
+)
+
+var (
+	ErrorMalformedResponse = errors.New("Malformed Kafka response")
+	ErrorCorrelationId     = errors.New("Kafka response correlation id mismatch")
+)
+
+// Request encoder, all integers are big endian
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) putInt8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) putInt16(v int16) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) putInt32(v int32) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) putInt64(v int64) {
+	binary.Write(e, binary.BigEndian, v)
+}
+
+func (e *encoder) putString(s string) {
+	e.putInt16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) putNullableString(s *string) {
+	if s == nil {
+		e.putInt16(-1)
+		return
+	}
+	e.putString(*s)
+}
+
+func (e *encoder) putBytes(b []byte) {
+	e.putInt32(int32(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) putVarint(v int64) {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	size := binary.PutVarint(buffer, v)
+	e.Write(buffer[:size])
+}
+
+func (e *encoder) putVarBytes(b []byte) {
+	if b == nil {
+		e.putVarint(-1)
+		return
+	}
+	e.putVarint(int64(len(b)))
+	e.Write(b)
+}
+
+// Response decoder, the first error sticks and zero values are returned
+type decoder struct {
+	*bytes.Reader
+	err error
+}
+
+func newDecoder(b []byte) *decoder {
+	return &decoder{bytes.NewReader(b), nil}
+}
+
+func (d *decoder) read(v interface{}) {
+	if d.err != nil {
+		return
+	}
+	if err := binary.Read(d, binary.BigEndian, v); err != nil {
+		d.err = ErrorMalformedResponse
+	}
+}
+
+func (d *decoder) getInt8() int8 {
+	var v int8
+	d.read(&v)
+	return v
+}
+
+func (d *decoder) getInt16() int16 {
+	var v int16
+	d.read(&v)
+	return v
+}
+
+func (d *decoder) getInt32() int32 {
+	var v int32
+	d.read(&v)
+	return v
+}
+
+func (d *decoder) getInt64() int64 {
+	var v int64
+	d.read(&v)
+	return v
+}
+
+func (d *decoder) getString() string {
+	size := int(d.getInt16())
+	if size < 0 {
+		return ""
+	}
+	if d.err != nil || size > d.Len() {
+		d.err = ErrorMalformedResponse
+		return ""
+	}
+	data := make([]byte, size)
+	io.ReadFull(d, data)
+	return string(data)
+}
+
+func (d *decoder) getArrayLen() int {
+	size := int(d.getInt32())
+	if size < 0 {
+		return 0
+	}
+	if size > d.Len() {
+		d.err = ErrorMalformedResponse
+		return 0
+	}
+	return size
+}
+
+// Connection to a single broker. Requests are serialized, the producer
+// never pipelines.
+type brokerConn struct {
+	addr           string
+	conn           net.Conn
+	lock           *sync.Mutex
+	correlation_id int32
+}
+
+func dialBroker(addr string) (*brokerConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, REQUEST_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	return &brokerConn{addr, conn, new(sync.Mutex), 0}, nil
+}
+
+// request sends an api request with a v1 header and returns the response
+// body following the correlation id
+func (b *brokerConn) request(client_id string, api_key, api_version int16, body []byte) ([]byte, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.correlation_id++
+
+	header := new(encoder)
+	header.putInt16(api_key)
+	header.putInt16(api_version)
+	header.putInt32(b.correlation_id)
+	header.putString(client_id)
+
+	packet := new(encoder)
+	packet.putInt32(int32(header.Len() + len(body)))
+	packet.Write(header.Bytes())
+	packet.Write(body)
+
+	b.conn.SetDeadline(time.Now().Add(REQUEST_TIMEOUT))
+	defer b.conn.SetDeadline(time.Time{})
+
+	if _, err := b.conn.Write(packet.Bytes()); err != nil {
+		return nil, err
+	}
+
+	size_header := make([]byte, 4)
+	if _, err := io.ReadFull(b.conn, size_header); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(size_header)
+	if size < 4 || size > MAX_RESPONSE_SIZE {
+		return nil, ErrorMalformedResponse
+	}
+
+	response := make([]byte, size)
+	if _, err := io.ReadFull(b.conn, response); err != nil {
+		return nil, err
+	}
+
+	if int32(binary.BigEndian.Uint32(response[0:4])) != b.correlation_id {
+		return nil, ErrorCorrelationId
+	}
+
+	return response[4:], nil
+}
+
+func (b *brokerConn) close() {
+	b.conn.Close()
+}
@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+func TestEncoderDecoderRoundTrip(t *testing.T) {
+	e := new(encoder)
+	e.putInt8(-3)
+	e.putInt16(-2)
+	e.putInt32(70000)
+	e.putInt64(-1 << 40)
+	e.putString("orders")
+	e.putNullableString(nil)
+	e.putInt32(2) // array length
+
+	d := newDecoder(e.Bytes())
+	if v := d.getInt8(); v != -3 {
+		t.Errorf("int8 %d", v)
+	}
+	if v := d.getInt16(); v != -2 {
+		t.Errorf("int16 %d", v)
+	}
+	if v := d.getInt32(); v != 70000 {
+		t.Errorf("int32 %d", v)
+	}
+	if v := d.getInt64(); v != -1<<40 {
+		t.Errorf("int64 %d", v)
+	}
+	if v := d.getString(); v != "orders" {
+		t.Errorf("string %q", v)
+	}
+	if v := d.getString(); v != "" || d.err != nil {
+		t.Errorf("null string %q, %v", v, d.err)
+	}
+	// Longer than what is left
+	if v := d.getArrayLen(); v != 0 || d.err != ErrorMalformedResponse {
+		t.Errorf("array length %d, %v", v, d.err)
+	}
+}
+
+func TestDecoderErrorSticks(t *testing.T) {
+	d := newDecoder([]byte{0, 10, 'a'})
+	if v := d.getString(); v != "" || d.err != ErrorMalformedResponse {
+		t.Errorf("torn string %q, %v", v, d.err)
+	}
+	if v := d.getInt8(); v != 0 || d.err != ErrorMalformedResponse {
+		t.Errorf("read after an error %d, %v", v, d.err)
+	}
+}
+
+func TestVarints(t *testing.T) {
+	e := new(encoder)
+	e.putVarint(-1)
+	e.putVarint(300)
+	e.putVarBytes(nil)
+	e.putVarBytes([]byte("key"))
+
+	data := e.Bytes()
+	for _, expected := range []int64{-1, 300, -1, 3} {
+		v, size := binary.Varint(data)
+		if size <= 0 || v != expected {
+			t.Fatalf("varint %d, expected %d", v, expected)
+		}
+		data = data[size:]
+	}
+	if string(data) != "key" {
+		t.Errorf("bytes %q", data)
+	}
+}
+
+func TestRecordBatch(t *testing.T) {
+	batch := encodeRecordBatch([]byte("k"), []byte("value"), []Header{{"content-type", []byte("text/plain")}},
+		1500000000000, 42, 3, 7)
+
+	d := newDecoder(batch)
+	if v := d.getInt64(); v != 0 {
+		t.Errorf("base offset %d", v)
+	}
+	if v := d.getInt32(); int(v) != len(batch)-12 {
+		t.Errorf("batch length %d of %d bytes", v, len(batch))
+	}
+	d.getInt32() // partition leader epoch
+	if v := d.getInt8(); v != 2 {
+		t.Errorf("magic %d", v)
+	}
+	crc := uint32(d.getInt32())
+	if crc != crc32.Checksum(batch[21:], castagnoli) {
+		t.Error("crc does not cover the rest of the batch")
+	}
+	d.getInt16() // attributes
+	d.getInt32() // last offset delta
+	if v := d.getInt64(); v != 1500000000000 {
+		t.Errorf("first timestamp %d", v)
+	}
+	d.getInt64() // max timestamp
+	if v := d.getInt64(); v != 42 {
+		t.Errorf("producer id %d", v)
+	}
+	if v := d.getInt16(); v != 3 {
+		t.Errorf("producer epoch %d", v)
+	}
+	if v := d.getInt32(); v != 7 {
+		t.Errorf("sequence %d", v)
+	}
+	if v := d.getInt32(); v != 1 {
+		t.Errorf("record count %d", v)
+	}
+	if d.err != nil {
+		t.Error(d.err)
+	}
+}
+
+// Vectors from the Java client, whose default partitioner uses murmur2
+func TestMurmur2(t *testing.T) {
+	for input, expected := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if v := murmur2([]byte(input)); v != expected {
+			t.Errorf("murmur2(%q) = %d, expected %d", input, v, expected)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// encodeRecordBatch builds a v2 record batch holding one record with the
+// producer id, epoch and sequence used by the broker for deduplication.
+func encodeRecordBatch(key, value []byte, headers []Header, timestamp int64,
+	producer_id int64, producer_epoch int16, sequence int32) []byte {
+
+	record := new(encoder)
+	record.putInt8(0)       // attributes
+	record.putVarint(0)     // timestamp delta
+	record.putVarint(0)     // offset delta
+	record.putVarBytes(key) // nil key is encoded as -1
+	record.putVarBytes(value)
+	record.putVarint(int64(len(headers)))
+	for _, h := range headers {
+		record.putVarBytes([]byte(h.Key))
+		record.putVarBytes(h.Value)
+	}
+
+	// Everything after the crc field is covered by the checksum
+	body := new(encoder)
+	body.putInt16(0) // attributes, no compression, not transactional
+	body.putInt32(0) // last offset delta
+	body.putInt64(timestamp)
+	body.putInt64(timestamp)
+	body.putInt64(producer_id)
+	body.putInt16(producer_epoch)
+	body.putInt32(sequence)
+	body.putInt32(1) // record count
+	body.putVarint(int64(record.Len()))
+	body.Write(record.Bytes())
+
+	batch := new(encoder)
+	batch.putInt64(0) // base offset, assigned by the broker
+	// batch length counts from partition leader epoch to the end
+	batch.putInt32(int32(4 + 1 + 4 + body.Len()))
+	batch.putInt32(-1) // partition leader epoch
+	batch.putInt8(2)   // magic
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(body.Bytes(), castagnoli))
+	batch.Write(crc)
+	batch.Write(body.Bytes())
+
+	return batch.Bytes()
+}
+
+// murmur2 matches the hash used by the Java client default partitioner so
+// keyed records land on the same partition regardless of producer
+func murmur2(data []byte) int32 {
+	length := len(data)
+	const seed uint32 = 0x9747b28c
+	const m uint32 = 0x5bd1e995
+	const r = 24
+
+	h := seed ^ uint32(length)
+	length4 := length / 4
+
+	for i := 0; i < length4; i++ {
+		i4 := i * 4
+		k := uint32(data[i4+0]) | uint32(data[i4+1])<<8 | uint32(data[i4+2])<<16 | uint32(data[i4+3])<<24
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	switch length % 4 {
+	case 3:
+		h ^= uint32(data[(length & ^3)+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[(length & ^3)+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[length & ^3])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
@@ -1,10 +1,12 @@
 package message
 
 import (
+	"encoding/json"
 	"errors"
-	"log"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Obj struct {
@@ -12,6 +14,10 @@ type Obj struct {
 	Endpoint    string
 	MessageBody string
 	Expiration  int64
+	ScheduleId  int // Set once the message is stored by a scheduler
+	Priority    int
+	Tenant      string // Whose message it is, for rate limits
+	ValidUntil  int64  // Unix time in ms after which it is not sent, 0 when never
 }
 
 // Message type list
@@ -24,10 +30,28 @@ const (
 	S_WEBSOCKET_NOTIFICATION = 105
 	S_EMAIL_NOTIFICATION     = 106
 	S_REST_NOTIFICATION      = 107
-	S_RABBITMQ_NOTIFICATION  = 108 // todo
+	S_RABBITMQ_NOTIFICATION  = 108
 	S_SMS_NOTIFICATION       = 109
+	S_KAFKA_NOTIFICATION     = 110
 )
 
+// Priority list, messages without one are normal
+const (
+	PRIORITY_BULK     = -1
+	PRIORITY_NORMAL   = 0
+	PRIORITY_HIGH     = 1
+	PRIORITY_CRITICAL = 2
+)
+
+const MAX_TENANT_LENGTH = 64
+
+var priority_names = map[int]string{
+	PRIORITY_BULK:     "bulk",
+	PRIORITY_NORMAL:   "normal",
+	PRIORITY_HIGH:     "high",
+	PRIORITY_CRITICAL: "critical",
+}
+
 // Error list
 var (
 	ErrorInvalidType           = errors.New("Type not exists")
@@ -35,6 +59,11 @@ var (
 	ErrorNegativeExpiration    = errors.New("Negative expiration time")
 	ErrorNoEndpoint            = errors.New("No endpoint provided")
 	ErrorAlgorithmNotSupported = errors.New("Algorithm not supported")
+	ErrorInvalidPayload        = errors.New("Invalid message payload")
+	ErrorInvalidPriority       = errors.New("Priority not exists")
+	ErrorTenantTooLong         = errors.New("Tenant too long")
+	ErrorNegativeLateness      = errors.New("Negative max lateness")
+	ErrorValidUntilBeforeFire  = errors.New("Valid until before the message is due")
 )
 
 // Hashing algorithm list
@@ -51,11 +80,104 @@ func NewMessageObject(msg_type int, endpoint string, msg_body string, exp_time i
 		return nil, ErrorExpirationTooBig
 	} else if exp_time < 0 {
 		return nil, ErrorNegativeExpiration
-	} else if msg_type > 109 || msg_type < 100 {
+	} else if msg_type > S_KAFKA_NOTIFICATION || msg_type < S_DELETE_MESSAGE {
 		return nil, ErrorInvalidType
 	}
 
-	return &Obj{msg_type, endpoint, msg_body, exp_time}, nil
+	return &Obj{msg_type, endpoint, msg_body, exp_time, 0, PRIORITY_NORMAL, "", 0}, nil
+}
+
+// SetValidUntil keeps the message from being sent after valid_until, a
+// Unix time in ms, or more than max_lateness ms after it is due, whichever
+// comes first. 0 leaves either out.
+func (m *Obj) SetValidUntil(valid_until int64, max_lateness int64) error {
+	if max_lateness < 0 {
+		return ErrorNegativeLateness
+	}
+	due := time.Now().UnixNano()/1000000 + m.Expiration
+	if max_lateness > 0 && (valid_until == 0 || due+max_lateness < valid_until) {
+		valid_until = due + max_lateness
+	}
+	if valid_until != 0 && valid_until < due {
+		return ErrorValidUntilBeforeFire
+	}
+	m.ValidUntil = valid_until
+	return nil
+}
+
+func (m *Obj) Expired() bool {
+	return m.ValidUntil != 0 && time.Now().UnixNano()/1000000 > m.ValidUntil
+}
+
+// Target describes where the message goes for logs and API replies, see
+// DescribeEndpoint
+func (m *Obj) Target() string {
+	return DescribeEndpoint(m.MessageType, m.Endpoint)
+}
+
+// DescribeEndpoint leaves credentials out of an endpoint. REST endpoints
+// may carry them in their auth, headers and URL, only the method and the
+// URL without user info, query and fragment are kept.
+func DescribeEndpoint(msg_type int, endpoint string) string {
+	if msg_type != S_REST_NOTIFICATION {
+		return endpoint
+	}
+
+	method, raw_url := "POST", ""
+	if strings.HasPrefix(strings.TrimSpace(endpoint), "{") {
+		var target struct {
+			Method string `json:"method"`
+			Url    string `json:"url"`
+		}
+		if json.Unmarshal([]byte(endpoint), &target) != nil {
+			return "invalid REST target"
+		}
+		if target.Method != "" {
+			method = target.Method
+		}
+		raw_url = target.Url
+	} else {
+		components := strings.Split(endpoint, " ")
+		if len(components) != 3 {
+			return "invalid REST target"
+		}
+		method, raw_url = components[0], components[1]
+	}
+
+	return strings.ToUpper(method) + " " + RedactURL(raw_url)
+}
+
+// RedactURL drops the user info, query and fragment of a URL
+func RedactURL(raw_url string) string {
+	parsed, err := url.Parse(raw_url)
+	if err != nil {
+		return "invalid URL"
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.ForceQuery = false
+	parsed.Fragment = ""
+	return parsed.String()
+}
+
+// ParsePriority reads a priority by name, an empty name is normal
+func ParsePriority(name string) (int, error) {
+	if name == "" {
+		return PRIORITY_NORMAL, nil
+	}
+	for priority, priority_name := range priority_names {
+		if priority_name == name {
+			return priority, nil
+		}
+	}
+	return PRIORITY_NORMAL, ErrorInvalidPriority
+}
+
+func PriorityName(priority int) string {
+	if name, ok := priority_names[priority]; ok {
+		return name
+	}
+	return priority_names[PRIORITY_NORMAL]
 }
 
 // func (o *obj) CreateHashedSchedule(algorithm int) {
@@ -75,21 +197,34 @@ func (o *Obj) GetMessageHashing(algorithm int) (string, error) {
 	}
 }
 
+// FitsV1Payload tells whether GetMessagePayload carries the message to any
+// v1 node, those before v2 framing split the payload on every newline
+func (o *Obj) FitsV1Payload() bool {
+	return !strings.Contains(o.Endpoint, "\n") && !strings.Contains(o.MessageBody, "\n")
+}
+
 func (o *Obj) GetMessagePayload() []byte {
 	return []byte(strconv.Itoa(o.MessageType) + "\n" +
 		o.Endpoint + "\n" + o.MessageBody + "\n" + strconv.FormatInt(o.Expiration, 10))
 }
 
+// NewMessageFromPayload reads the v1 cluster payload built by
+// GetMessagePayload. The body sits between the endpoint and the expiration,
+// so newlines in it are kept.
 func NewMessageFromPayload(payload []byte) (*Obj, error) {
-	message_str := strings.Split(string(payload), "\n")
-	log.Println(string(message_str[0]))
-	log.Println(string(message_str[1]))
-	log.Println(string(message_str[2]))
-	log.Println(string(message_str[3]))
+	message_str := strings.SplitN(string(payload), "\n", 3)
+	if len(message_str) < 3 {
+		return nil, ErrorInvalidPayload
+	}
+	last := strings.LastIndex(message_str[2], "\n")
+	if last < 0 {
+		return nil, ErrorInvalidPayload
+	}
+	msg_body := message_str[2][:last]
 	msg_type, _ := strconv.Atoi(message_str[0])
-	msg_exp, _ := strconv.ParseInt(message_str[3], 10, 64)
+	msg_exp, _ := strconv.ParseInt(message_str[2][last+1:], 10, 64)
 	return NewMessageObject(msg_type, message_str[1],
-		message_str[2], msg_exp)
+		msg_body, msg_exp)
 }
 
 // func (o *obj) SendMessage() {
@@ -2,111 +2,489 @@ package queue
 
 import (
 	"conf"
+	"container/heap"
+	"errors"
+	"log"
 	"message"
 	"sync"
+	"time"
 )
 
+// A GrandmaQueue keeps up to queue_length messages in memory. What happens
+// to more depends on queue_overflow:
+//
+//	spill  they go to a spill file in queue_dir and come back in order as
+//	       the queue drains, without queue_dir the queue blocks
+//	block  PushMessage waits for room
+//	error  PushMessage returns ErrorQueueFull
+//
+// Queues opened with OpenQueue while queue_dir is set are durable: every
+// push and pop is appended to a write-ahead log there, and the messages
+// still queued are replayed when the queue is opened again. A message is
+// done once popped, so one being sent when the process dies is not sent
+// again.
+//
+// Messages are served by priority, critical first and bulk last, in order
+// within a priority. So that a steady flow of urgent messages doesn't hold
+// the others forever, a priority passed over STARVATION_LIMIT times in a
+// row is served next. Spilled messages come back highest priority first.
+//
+// A popped message that has to wait, as one over its rate limit, goes back
+// with Delay. It counts against queue_length and is held aside until it is
+// due, then goes back to the front of its priority. Other messages are
+// served while it waits. The log has it as put at the front, so it comes
+// back first after a restart.
+const (
+	PRIORITY_LEVELS  = message.PRIORITY_CRITICAL - message.PRIORITY_BULK + 1
+	STARVATION_LIMIT = 10
+)
+
+var (
+	ErrorQueueFull = errors.New("Queue is full")
+)
+
+type entry struct {
+	seq uint64
+	msg *message.Obj
+	due time.Time // When a delayed message may go
+}
+
+// delayedEntries is a heap of delayed messages, soonest due first
+type delayedEntries []entry
+
+func (d delayedEntries) Len() int {
+	return len(d)
+}
+
+func (d delayedEntries) Less(i, j int) bool {
+	if d[i].due.Equal(d[j].due) {
+		return d[i].seq < d[j].seq
+	}
+	return d[i].due.Before(d[j].due)
+}
+
+func (d delayedEntries) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+func (d *delayedEntries) Push(x interface{}) {
+	*d = append(*d, x.(entry))
+}
+
+func (d *delayedEntries) Pop() interface{} {
+	old := *d
+	e := old[len(old)-1]
+	old[len(old)-1] = entry{}
+	*d = old[:len(old)-1]
+	return e
+}
+
 type GrandmaQueue struct {
-	queue     []*message.Obj
-	front     int
-	pointer   int
-	varLock   *sync.RWMutex
-	queueLock *sync.Cond
+	levels    [PRIORITY_LEVELS][]entry // In memory, highest priority first, oldest first
+	delayed   delayedEntries           // Held back until due
+	queued    int                      // Messages in memory
+	passed    [PRIORITY_LEVELS]int     // Times each level waited while another was served
+	capacity  int
+	overflow  string
+	spilled   [PRIORITY_LEVELS]int // Messages in the spill files, all behind those in memory
+	log       *wal                 // nil when not durable
+	queueLock *sync.Mutex
+	not_empty *sync.Cond
+	not_full  *sync.Cond
 }
 
 var Main_Queue *GrandmaQueue
 
 func init() {
-	Main_Queue = new(GrandmaQueue)
-	Main_Queue.queue = make([]*message.Obj, conf.GetQueueLength())
-	Main_Queue.varLock = new(sync.RWMutex)
-	Main_Queue.queueLock = sync.NewCond(new(sync.Mutex))
+	Main_Queue = NewQueue()
 }
 
-func increase(i int) int {
+// Setup opens Main_Queue as configured, the config has to be read
+func Setup() error {
+	q, err := OpenQueue("main")
+	if err != nil {
+		return err
+	}
+	Main_Queue = q
+	return nil
+}
 
-	if i == conf.GetQueueLength()-1 {
-		return 0
-	} else {
-		return i + 1
+// NewQueue makes a queue that lives in memory only
+func NewQueue() *GrandmaQueue {
+	q := new(GrandmaQueue)
+	q.capacity = conf.GetQueueLength()
+	q.overflow = conf.GetQueueOverflow()
+	if q.overflow == conf.QUEUE_OVERFLOW_SPILL {
+		q.overflow = conf.QUEUE_OVERFLOW_BLOCK
 	}
+	q.queueLock = new(sync.Mutex)
+	q.not_empty = sync.NewCond(q.queueLock)
+	q.not_full = sync.NewCond(q.queueLock)
+	return q
 }
 
-func decrease(i int) int {
-	if i == 0 {
-		return conf.GetQueueLength() - 1
-	} else {
-		return i - 1
+// level is where msg queues, unknown priorities count as the closest known
+func level(msg *message.Obj) int {
+	l := message.PRIORITY_CRITICAL - msg.Priority
+	if l < 0 {
+		return 0
 	}
+	if l >= PRIORITY_LEVELS {
+		return PRIORITY_LEVELS - 1
+	}
+	return l
 }
 
-func NewQueue() *GrandmaQueue {
-	q := new(GrandmaQueue)
-	q.queue = make([]*message.Obj, conf.GetQueueLength())
-	q.varLock = new(sync.RWMutex)
-	q.queueLock = sync.NewCond(new(sync.Mutex))
+func levelPriority(l int) int {
+	return message.PRIORITY_CRITICAL - l
+}
 
-	return q
+// OpenQueue opens the durable queue called name in queue_dir and replays
+// what it held, without queue_dir the queue lives in memory only
+func OpenQueue(name string) (*GrandmaQueue, error) {
+	q := NewQueue()
+	if conf.GetQueueDir() == "" {
+		return q, nil
+	}
+	q.overflow = conf.GetQueueOverflow()
+
+	w, err := createWAL(conf.GetQueueDir(), name)
+	if err != nil {
+		return nil, err
+	}
+	q.log = w
+
+	// Replayed messages spill over whatever queue_overflow says, memory
+	// stays bounded
+	err = replayWAL(w.path, func(seq uint64, msg *message.Obj) error {
+		if seq > w.last_seq {
+			w.last_seq = seq
+		}
+		q.push(entry{seq, msg, time.Time{}})
+		return nil
+	})
+	if err == nil {
+		err = w.commit()
+	}
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+
+	go q.syncLoop()
+	return q, nil
 }
 
-func (q *GrandmaQueue) PushMessage(obj *message.Obj) {
-	if q.IsFull() {
-		panic("GrandmaQueue full exception")
-		return
+func (q *GrandmaQueue) PushMessage(obj *message.Obj) error {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+
+	if q.totalSpilled() == 0 && q.queued >= q.capacity {
+		switch q.overflow {
+		case conf.QUEUE_OVERFLOW_ERROR:
+			return ErrorQueueFull
+		case conf.QUEUE_OVERFLOW_BLOCK:
+			for q.totalSpilled() == 0 && q.queued >= q.capacity {
+				q.not_full.Wait()
+			}
+		}
 	}
 
-	q.varLock.Lock()
-	q.queue[q.pointer] = obj
-	q.pointer = increase(q.pointer)
-	q.varLock.Unlock()
+	e := entry{0, obj, time.Time{}}
+	if q.log != nil {
+		e.seq = q.log.nextSeq()
+	}
+	q.push(e)
+	return nil
+}
+
+// PushFront puts back a message that was just popped, it never waits
+func (q *GrandmaQueue) PushFront(obj *message.Obj) error {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
 
-	q.queueLock.Signal()
+	e := entry{0, obj, time.Time{}}
+	if q.log != nil {
+		e.seq = q.log.nextSeq()
+		if err := q.log.append(RECORD_FRONT, e); err != nil {
+			q.logFailure(err)
+		}
+	}
+	l := level(obj)
+	q.levels[l] = append([]entry{e}, q.levels[l]...)
+	q.queued++
+	q.not_empty.Signal()
+	return nil
 }
 
-func (q *GrandmaQueue) PushFront(obj *message.Obj) {
-	if q.IsFull() {
-		panic("GrandmaQueue full exception")
-		return
+// Delay puts back a message that was just popped, it is not served again
+// until due. It never waits.
+func (q *GrandmaQueue) Delay(obj *message.Obj, due time.Time) error {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+
+	e := entry{0, obj, due}
+	if q.log != nil {
+		e.seq = q.log.nextSeq()
+		if err := q.log.append(RECORD_FRONT, e); err != nil {
+			q.logFailure(err)
+		}
 	}
+	heap.Push(&q.delayed, e)
+	q.queued++
+	q.not_empty.Signal()
+	return nil
+}
 
-	q.varLock.Lock()
-	q.front = decrease(q.front)
-	q.queue[q.front] = obj
-	q.varLock.Unlock()
+// push logs e and queues it in memory, or spills it when memory is full or
+// others of its priority were spilled before it. The caller holds queueLock.
+func (q *GrandmaQueue) push(e entry) {
+	if q.log != nil {
+		if err := q.log.append(RECORD_PUSH, e); err != nil {
+			q.logFailure(err)
+		}
+	}
 
-	q.queueLock.Signal()
+	l := level(e.msg)
+	if q.log != nil && (q.spilled[l] > 0 || q.queued >= q.capacity) {
+		err := q.log.spill(l, e)
+		if err == nil {
+			q.spilled[l]++
+			q.not_empty.Signal()
+			return
+		}
+		// Kept in memory rather than lost
+		q.logFailure(err)
+	}
+	q.levels[l] = append(q.levels[l], e)
+	q.queued++
+	q.not_empty.Signal()
 }
 
 func (q *GrandmaQueue) PopMessage() *message.Obj {
-	q.queueLock.L.Lock()
-	for q.IsEmpty() {
-		q.queueLock.Wait()
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+
+	var e entry
+	for {
+		for q.size() == 0 {
+			q.not_empty.Wait()
+		}
+		q.undelay()
+		if q.size() == len(q.delayed) {
+			// Only delayed messages, none due yet
+			q.waitFor(time.Until(q.delayed[0].due))
+			continue
+		}
+		l := q.next()
+		if len(q.levels[l]) == 0 {
+			// Everything of this priority is on disk, fetch one past capacity
+			if !q.unspillOne(l) {
+				if q.spilled[l] > 0 {
+					q.waitFor(QUEUE_RETRY_PERIOD)
+				}
+				continue
+			}
+		}
+		e = q.levels[l][0]
+		q.levels[l][0] = entry{}
+		q.levels[l] = q.levels[l][1:]
+		q.queued--
+		break
+	}
+
+	if q.log != nil {
+		if err := q.log.append(RECORD_POP, entry{e.seq, nil, time.Time{}}); err != nil {
+			q.logFailure(err)
+		}
+		q.unspill()
+		if !q.log.compacting && q.log.shouldCompact(q.size()) {
+			q.log.compacting = true
+			go q.compact(q.log.size, q.log.records)
+		}
+	}
+	q.not_full.Signal()
+	return e.msg
+}
+
+// waitFor waits on not_empty for at most d, the caller holds queueLock
+func (q *GrandmaQueue) waitFor(d time.Duration) {
+	timer := time.AfterFunc(d, func() {
+		q.queueLock.Lock()
+		q.not_empty.Broadcast()
+		q.queueLock.Unlock()
+	})
+	q.not_empty.Wait()
+	timer.Stop()
+}
+
+// undelay puts the delayed messages that are due back at the front of their
+// level, soonest due first. The caller holds queueLock.
+func (q *GrandmaQueue) undelay() {
+	var due [PRIORITY_LEVELS][]entry
+	now := time.Now()
+	for len(q.delayed) > 0 && !q.delayed[0].due.After(now) {
+		e := heap.Pop(&q.delayed).(entry)
+		l := level(e.msg)
+		due[l] = append(due[l], e)
 	}
+	for l := range due {
+		if len(due[l]) > 0 {
+			q.levels[l] = append(due[l], q.levels[l]...)
+		}
+	}
+}
 
-	q.varLock.RLock()
-	ret := q.queue[q.front]
-	q.varLock.RUnlock()
+// next picks the level to serve: the highest with messages, unless a lower
+// one was passed over STARVATION_LIMIT times. The caller holds queueLock
+// and the queue is not empty.
+func (q *GrandmaQueue) next() int {
+	picked := -1
+	starved := -1
+	for l := 0; l < PRIORITY_LEVELS; l++ {
+		if len(q.levels[l]) == 0 && q.spilled[l] == 0 {
+			q.passed[l] = 0
+			continue
+		}
+		if picked < 0 {
+			picked = l
+		} else if q.passed[l] >= STARVATION_LIMIT && (starved < 0 || q.passed[l] > q.passed[starved]) {
+			starved = l
+		}
+	}
+	if starved >= 0 {
+		picked = starved
+	}
 
-	q.varLock.Lock()
-	q.front = increase(q.front)
-	q.varLock.Unlock()
+	for l := picked + 1; l < PRIORITY_LEVELS; l++ {
+		if len(q.levels[l]) > 0 || q.spilled[l] > 0 {
+			q.passed[l]++
+		}
+	}
+	q.passed[picked] = 0
+	return picked
+}
 
-	q.queueLock.L.Unlock()
-	return ret
+// unspill moves spilled messages back to memory while there is room,
+// highest priority first. The caller holds queueLock.
+func (q *GrandmaQueue) unspill() {
+	for l := 0; l < PRIORITY_LEVELS; l++ {
+		for q.spilled[l] > 0 && q.queued < q.capacity {
+			if !q.unspillOne(l) {
+				break
+			}
+		}
+	}
+}
+
+// unspillOne moves the next spilled message of level l back to memory, the
+// caller holds queueLock
+func (q *GrandmaQueue) unspillOne(l int) bool {
+	e, err := q.log.unspill(l)
+	if err != nil {
+		q.logFailure(err)
+		if err := q.rebuildSpills(); err != nil {
+			// Still counted, tried again on the next pop
+			q.logFailure(err)
+			return false
+		}
+		if q.spilled[l] == 0 {
+			return false
+		}
+		if e, err = q.log.unspill(l); err != nil {
+			q.logFailure(err)
+			return false
+		}
+	}
+	q.spilled[l]--
+	q.levels[l] = append(q.levels[l], e)
+	q.queued++
+	if q.spilled[l] == 0 {
+		q.log.dropSpill(l)
+	}
+	return true
+}
+
+// rebuildSpills writes the spill files again from the log after one could
+// not be read: what is still queued and not in memory is spilled again. The
+// caller holds queueLock.
+func (q *GrandmaQueue) rebuildSpills() error {
+	in_memory := make(map[uint64]bool)
+	for _, e := range q.delayed {
+		in_memory[e.seq] = true
+	}
+	for l := 0; l < PRIORITY_LEVELS; l++ {
+		for _, e := range q.levels[l] {
+			in_memory[e.seq] = true
+		}
+		q.log.dropSpill(l)
+		q.spilled[l] = 0
+	}
+
+	return replayWAL(q.log.path, func(seq uint64, msg *message.Obj) error {
+		if in_memory[seq] {
+			return nil
+		}
+		l := level(msg)
+		if err := q.log.spill(l, entry{seq, msg, time.Time{}}); err != nil {
+			return err
+		}
+		q.spilled[l]++
+		return nil
+	})
+}
+
+// compact rewrites the log with the messages still queued, the first size
+// bytes of it without queueLock
+func (q *GrandmaQueue) compact(size int64, records int) {
+	file, kept, written, err := q.log.snapshot(size)
+
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	q.log.compacting = false
+	if err == nil {
+		err = q.log.swap(file, kept, written, size, records)
+	}
+	if err != nil {
+		q.logFailure(err)
+	}
+}
+
+func (q *GrandmaQueue) logFailure(err error) {
+	log.Println("Queue " + q.log.name + ": " + err.Error())
+}
+
+// Len counts the messages queued, spilled ones included
+func (q *GrandmaQueue) Len() int {
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	return q.size()
+}
+
+func (q *GrandmaQueue) size() int {
+	return q.queued + q.totalSpilled()
+}
+
+func (q *GrandmaQueue) totalSpilled() int {
+	spilled := 0
+	for _, n := range q.spilled {
+		spilled += n
+	}
+	return spilled
 }
 
 func (q *GrandmaQueue) IsEmpty() bool {
-	q.varLock.RLock()
-	ret := q.front == q.pointer
-	q.varLock.RUnlock()
+	return q.Len() == 0
+}
 
-	return ret
+// Spills tells whether messages that don't fit go to disk
+func (q *GrandmaQueue) Spills() bool {
+	return q.log != nil && q.overflow == conf.QUEUE_OVERFLOW_SPILL
 }
 
+// IsFull tells whether a push would spill, wait or fail
 func (q *GrandmaQueue) IsFull() bool {
-	q.varLock.RLock()
-	ret := q.front == increase(q.pointer)
-	q.varLock.RUnlock()
-
-	return ret
+	q.queueLock.Lock()
+	defer q.queueLock.Unlock()
+	return q.totalSpilled() > 0 || q.queued >= q.capacity
 }
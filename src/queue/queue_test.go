@@ -0,0 +1,213 @@
+package queue
+
+import (
+	"conf"
+	"io/ioutil"
+	"message"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var queue_dir string
+
+// The config is read once, every test opens its own queue in queue_dir
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		panic(err)
+	}
+	queue_dir = filepath.Join(dir, "queues")
+	config := filepath.Join(dir, "grandma.conf")
+	err = ioutil.WriteFile(config, []byte(`{"queue_length": 10, "queue_dir": "`+queue_dir+`", "queue_overflow": "spill"}`), 0600)
+	if err != nil {
+		panic(err)
+	}
+	// Keeps the test flags, ReadFlags parses them all
+	os.Args = append([]string{os.Args[0], "-c", config}, os.Args[1:]...)
+	conf.ReadFlags()
+	conf.Configure()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newMessage(body string, priority int) *message.Obj {
+	return &message.Obj{MessageType: message.S_REST_NOTIFICATION, Endpoint: "POST http://localhost/ text/plain",
+		MessageBody: body, Expiration: 1000, Priority: priority}
+}
+
+func reopen(t *testing.T, q *GrandmaQueue, name string) *GrandmaQueue {
+	q.log.close()
+	q, err := OpenQueue(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func expectBodies(t *testing.T, q *GrandmaQueue, bodies ...string) {
+	if q.Len() != len(bodies) {
+		t.Fatalf("%d messages queued, expected %d", q.Len(), len(bodies))
+	}
+	for _, body := range bodies {
+		if msg := q.PopMessage(); msg.MessageBody != body {
+			t.Fatalf("popped %s, expected %s", msg.MessageBody, body)
+		}
+	}
+}
+
+func TestReplayKeepsWhatWasNotPopped(t *testing.T) {
+	q, err := OpenQueue("replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		q.PushMessage(newMessage("normal-"+strconv.Itoa(i), message.PRIORITY_NORMAL))
+	}
+	q.PushMessage(newMessage("critical", message.PRIORITY_CRITICAL))
+	if msg := q.PopMessage(); msg.MessageBody != "critical" {
+		t.Fatalf("popped %s first", msg.MessageBody)
+	}
+	q.PopMessage()
+
+	q = reopen(t, q, "replay")
+	expectBodies(t, q, "normal-1", "normal-2", "normal-3", "normal-4")
+}
+
+func TestReplaySpilled(t *testing.T) {
+	q, err := OpenQueue("spilled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := make([]string, 25)
+	for i := range bodies {
+		bodies[i] = "m-" + strconv.Itoa(i)
+		q.PushMessage(newMessage(bodies[i], message.PRIORITY_NORMAL))
+	}
+	if q.totalSpilled() != 15 {
+		t.Errorf("%d messages spilled past queue_length", q.totalSpilled())
+	}
+
+	q = reopen(t, q, "spilled")
+	expectBodies(t, q, bodies...)
+}
+
+func TestReplayPutsDelayedFirst(t *testing.T) {
+	q, err := OpenQueue("delayed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.PushMessage(newMessage("first", message.PRIORITY_NORMAL))
+	q.PushMessage(newMessage("second", message.PRIORITY_NORMAL))
+	q.Delay(q.PopMessage(), time.Now().Add(time.Hour))
+
+	q = reopen(t, q, "delayed")
+	expectBodies(t, q, "first", "second")
+}
+
+func TestReplayStopsAtTornRecord(t *testing.T) {
+	q, err := OpenQueue("torn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.PushMessage(newMessage("kept", message.PRIORITY_NORMAL))
+	q.log.close()
+
+	// Half a record, as when the process died while writing it
+	record, err := encodeRecord(RECORD_PUSH, entry{99, newMessage("torn", message.PRIORITY_NORMAL), time.Time{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(filepath.Join(queue_dir, "torn.wal"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record[:len(record)/2])
+	file.Close()
+
+	q, err = OpenQueue("torn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBodies(t, q, "kept")
+}
+
+func TestDelayedLetsOthersGo(t *testing.T) {
+	q := NewQueue()
+	q.PushMessage(newMessage("held", message.PRIORITY_NORMAL))
+	q.Delay(q.PopMessage(), time.Now().Add(100*time.Millisecond))
+	q.PushMessage(newMessage("critical", message.PRIORITY_CRITICAL))
+	q.PushMessage(newMessage("normal", message.PRIORITY_NORMAL))
+
+	start := time.Now()
+	for _, body := range []string{"critical", "normal"} {
+		if msg := q.PopMessage(); msg.MessageBody != body {
+			t.Errorf("popped %s, expected %s", msg.MessageBody, body)
+		}
+	}
+	if waited := time.Since(start); waited > 50*time.Millisecond {
+		t.Errorf("others popped after %s, behind the held message", waited)
+	}
+	if msg := q.PopMessage(); msg.MessageBody != "held" {
+		t.Errorf("popped %s, expected the held message", msg.MessageBody)
+	}
+	if waited := time.Since(start); waited < 80*time.Millisecond {
+		t.Errorf("held message popped after %s", waited)
+	}
+}
+
+// Once due, a delayed message goes before the others of its priority
+func TestDueDelayedGoesFirst(t *testing.T) {
+	q := NewQueue()
+	q.PushMessage(newMessage("late", message.PRIORITY_NORMAL))
+	q.PushMessage(newMessage("early", message.PRIORITY_NORMAL))
+	late := q.PopMessage()
+	early := q.PopMessage()
+	q.Delay(late, time.Now().Add(20*time.Millisecond))
+	q.Delay(early, time.Now().Add(10*time.Millisecond))
+	q.PushMessage(newMessage("normal", message.PRIORITY_NORMAL))
+	q.PushMessage(newMessage("high", message.PRIORITY_HIGH))
+
+	time.Sleep(30 * time.Millisecond)
+	expectBodies(t, q, "high", "early", "late", "normal")
+}
+
+func TestStarvedPriorityIsServed(t *testing.T) {
+	q := NewQueue()
+	q.PushMessage(newMessage("bulk", message.PRIORITY_BULK))
+	q.PushMessage(newMessage("normal", message.PRIORITY_NORMAL))
+
+	// Critical messages keep coming, the others still get their turn
+	served := make([]string, 0)
+	for i := 0; i < 2*STARVATION_LIMIT+2; i++ {
+		q.PushMessage(newMessage("critical", message.PRIORITY_CRITICAL))
+		served = append(served, q.PopMessage().MessageBody)
+	}
+
+	position := make(map[string]int)
+	for i, body := range served {
+		if _, ok := position[body]; !ok {
+			position[body] = i
+		}
+	}
+	if position["normal"] != STARVATION_LIMIT {
+		t.Errorf("normal served at %d, expected %d: %v", position["normal"], STARVATION_LIMIT, served)
+	}
+	bulk, ok := position["bulk"]
+	if !ok || bulk > STARVATION_LIMIT+1 {
+		t.Errorf("bulk served at %d: %v", bulk, served)
+	}
+}
+
+func TestNextWithoutStarvation(t *testing.T) {
+	q := NewQueue()
+	q.PushMessage(newMessage("normal", message.PRIORITY_NORMAL))
+	q.PushMessage(newMessage("high", message.PRIORITY_HIGH))
+	q.PushMessage(newMessage("critical", message.PRIORITY_CRITICAL))
+	q.PushMessage(newMessage("bulk", message.PRIORITY_BULK))
+	expectBodies(t, q, "critical", "high", "normal", "bulk")
+}
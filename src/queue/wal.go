@@ -0,0 +1,381 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"message"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The write-ahead log of a queue is <queue_dir>/<name>.wal, its spill
+// files <name>.<priority>.spill, one per priority. All are a sequence of
+// records:
+//
+//	op | uint64 seq | uint32 length | uint32 CRC-32 | message as JSON
+//
+// RECORD_PUSH appends a message, RECORD_FRONT puts it at the front and
+// RECORD_POP, without a message, takes it off. The CRC covers the op, the
+// seq and the message, a torn record ends the log. The spill files hold
+// RECORD_PUSH only and are rebuilt from the log on every start, and when
+// one can't be read.
+//
+// Records are written as they happen and synced every QUEUE_SYNC_PERIOD, a
+// crash of the process loses nothing, one of the machine at most that
+// period. The log is rewritten with the messages still queued on start and
+// whenever it holds QUEUE_COMPACT_RATIO times more records than that. The
+// latter happens in the background: the log up to then is replayed into a
+// new one, which takes the records written meanwhile and replaces it.
+const (
+	RECORD_PUSH  byte = 'P'
+	RECORD_FRONT byte = 'F'
+	RECORD_POP   byte = 'D'
+
+	RECORD_HEADER_SIZE = 1 + 8 + 4 + 4
+	MAX_RECORD_SIZE    = 16 * 1024 * 1024
+
+	QUEUE_SYNC_PERIOD   = time.Second
+	QUEUE_RETRY_PERIOD  = time.Second // Before reading a spill file again
+	QUEUE_COMPACT_MIN   = 10000       // Records before compacting at all
+	QUEUE_COMPACT_RATIO = 4
+)
+
+var (
+	ErrorCorruptRecord = errors.New("Corrupt queue record")
+)
+
+type wal struct {
+	name       string
+	path       string
+	file       *os.File
+	records    int
+	size       int64 // Bytes written
+	last_seq   uint64
+	dirty      bool
+	compacting bool
+	spills     [PRIORITY_LEVELS]*spillFile
+}
+
+type spillFile struct {
+	file  *os.File
+	read  int64
+	write int64
+}
+
+// createWAL starts a new log next to the current one, commit puts it in
+// place once the current one is replayed into it
+func createWAL(dir string, name string) (*wal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := &wal{name: name, path: filepath.Join(dir, name+".wal")}
+
+	file, err := os.OpenFile(w.path+".new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	for l := range w.spills {
+		spill_name := name + "." + message.PriorityName(levelPriority(l)) + ".spill"
+		spill_file, err := os.OpenFile(filepath.Join(dir, spill_name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.spills[l] = &spillFile{spill_file, 0, 0}
+	}
+	return w, nil
+}
+
+func (w *wal) commit() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(w.path+".new", w.path)
+}
+
+func (w *wal) close() {
+	w.file.Close()
+	for _, spill := range w.spills {
+		if spill != nil {
+			spill.file.Close()
+		}
+	}
+}
+
+func (w *wal) nextSeq() uint64 {
+	w.last_seq++
+	return w.last_seq
+}
+
+func (w *wal) append(op byte, e entry) error {
+	record, err := encodeRecord(op, e)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(record); err != nil {
+		return err
+	}
+	w.records++
+	w.size += int64(len(record))
+	w.dirty = true
+	return nil
+}
+
+func (w *wal) shouldCompact(queued int) bool {
+	return w.records > QUEUE_COMPACT_MIN && w.records > QUEUE_COMPACT_RATIO*queued
+}
+
+// snapshot writes what the first size bytes of the log still hold to a new
+// log and syncs it, it runs without queueLock
+func (w *wal) snapshot(size int64) (*os.File, int, int64, error) {
+	file, err := os.OpenFile(w.path+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	writer := bufio.NewWriter(file)
+	records := 0
+	var written int64 = 0
+	err = replayLog(w.path, size, func(seq uint64, msg *message.Obj) error {
+		record, err := encodeRecord(RECORD_PUSH, entry{seq, msg, time.Time{}})
+		if err != nil {
+			return err
+		}
+		if _, err := writer.Write(record); err != nil {
+			return err
+		}
+		records++
+		written += int64(len(record))
+		return nil
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, 0, err
+	}
+	return file, records, written, nil
+}
+
+// swap puts the snapshot of the first size bytes of the log in its place,
+// after the records written since. The caller holds queueLock.
+func (w *wal) swap(file *os.File, records int, written int64, size int64, records_before int) error {
+	tail := make([]byte, w.size-size)
+	_, err := w.file.ReadAt(tail, size)
+	if err == nil {
+		_, err = file.WriteAt(tail, written)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), w.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	w.file.Close()
+	w.file = file
+	w.file.Seek(0, io.SeekEnd)
+	w.records = records + w.records - records_before
+	w.size = written + int64(len(tail))
+	w.dirty = true
+	return nil
+}
+
+func (w *wal) spill(l int, e entry) error {
+	record, err := encodeRecord(RECORD_PUSH, e)
+	if err != nil {
+		return err
+	}
+	spill := w.spills[l]
+	if _, err := spill.file.WriteAt(record, spill.write); err != nil {
+		return err
+	}
+	spill.write += int64(len(record))
+	return nil
+}
+
+func (w *wal) unspill(l int) (entry, error) {
+	spill := w.spills[l]
+	reader := bufio.NewReader(io.NewSectionReader(spill.file, spill.read, spill.write-spill.read))
+	_, seq, msg, size, err := readRecord(reader)
+	if err != nil {
+		return entry{}, err
+	}
+	spill.read += int64(size)
+	return entry{seq, msg, time.Time{}}, nil
+}
+
+// dropSpill empties the spill file of level l
+func (w *wal) dropSpill(l int) {
+	spill := w.spills[l]
+	if spill.write == 0 {
+		return
+	}
+	spill.file.Truncate(0)
+	spill.read = 0
+	spill.write = 0
+}
+
+// syncLoop flushes the log to disk every QUEUE_SYNC_PERIOD
+func (q *GrandmaQueue) syncLoop() {
+	for range time.Tick(QUEUE_SYNC_PERIOD) {
+		q.queueLock.Lock()
+		file := q.log.file
+		dirty := q.log.dirty
+		q.log.dirty = false
+		q.queueLock.Unlock()
+
+		if dirty {
+			// A log replaced meanwhile is synced on the next round
+			file.Sync()
+		}
+	}
+}
+
+func encodeRecord(op byte, e entry) ([]byte, error) {
+	var payload []byte = nil
+	if e.msg != nil {
+		data, err := json.Marshal(e.msg)
+		if err != nil {
+			return nil, err
+		}
+		payload = data
+	}
+	if len(payload) > MAX_RECORD_SIZE {
+		return nil, ErrorCorruptRecord
+	}
+
+	record := make([]byte, RECORD_HEADER_SIZE+len(payload))
+	record[0] = op
+	binary.BigEndian.PutUint64(record[1:], e.seq)
+	binary.BigEndian.PutUint32(record[9:], uint32(len(payload)))
+	copy(record[RECORD_HEADER_SIZE:], payload)
+	binary.BigEndian.PutUint32(record[13:], recordChecksum(record))
+	return record, nil
+}
+
+func recordChecksum(record []byte) uint32 {
+	crc := crc32.NewIEEE()
+	crc.Write(record[:9])
+	crc.Write(record[RECORD_HEADER_SIZE:])
+	return crc.Sum32()
+}
+
+// readRecord reads one record and its size, io.EOF at a clean end
+func readRecord(reader *bufio.Reader) (byte, uint64, *message.Obj, int, error) {
+	header := make([]byte, RECORD_HEADER_SIZE)
+	n, err := io.ReadFull(reader, header)
+	if err == io.EOF {
+		return 0, 0, nil, 0, io.EOF
+	}
+	if err != nil || n != RECORD_HEADER_SIZE {
+		return 0, 0, nil, 0, ErrorCorruptRecord
+	}
+
+	length := binary.BigEndian.Uint32(header[9:])
+	if length > MAX_RECORD_SIZE {
+		return 0, 0, nil, 0, ErrorCorruptRecord
+	}
+	record := make([]byte, RECORD_HEADER_SIZE+int(length))
+	copy(record, header)
+	if _, err := io.ReadFull(reader, record[RECORD_HEADER_SIZE:]); err != nil {
+		return 0, 0, nil, 0, ErrorCorruptRecord
+	}
+	if recordChecksum(record) != binary.BigEndian.Uint32(header[13:]) {
+		return 0, 0, nil, 0, ErrorCorruptRecord
+	}
+
+	op := header[0]
+	seq := binary.BigEndian.Uint64(header[1:])
+	var msg *message.Obj = nil
+	if op != RECORD_POP {
+		msg = new(message.Obj)
+		if err := json.Unmarshal(record[RECORD_HEADER_SIZE:], msg); err != nil {
+			return 0, 0, nil, 0, ErrorCorruptRecord
+		}
+	}
+	return op, seq, msg, len(record), nil
+}
+
+// replayWAL hands the messages still queued in the log at path to push, in
+// queue order
+func replayWAL(path string, push func(uint64, *message.Obj) error) error {
+	return replayLog(path, -1, push)
+}
+
+// replayLog replays the first size bytes of the log, all of it when size is
+// negative. A first pass finds what was popped and what was put at the
+// front, which goes first, latest first.
+func replayLog(path string, size int64, push func(uint64, *message.Obj) error) error {
+	popped := make(map[uint64]bool)
+	fronts := make([]entry, 0)
+	err := scanWAL(path, size, func(op byte, seq uint64, msg *message.Obj) error {
+		switch op {
+		case RECORD_POP:
+			popped[seq] = true
+		case RECORD_FRONT:
+			fronts = append(fronts, entry{seq, msg, time.Time{}})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(fronts) - 1; i >= 0; i-- {
+		if !popped[fronts[i].seq] {
+			if err := push(fronts[i].seq, fronts[i].msg); err != nil {
+				return err
+			}
+		}
+	}
+	return scanWAL(path, size, func(op byte, seq uint64, msg *message.Obj) error {
+		if op == RECORD_PUSH && !popped[seq] {
+			return push(seq, msg)
+		}
+		return nil
+	})
+}
+
+// scanWAL reads the log up to size, its end or its first torn record
+func scanWAL(path string, size int64, handle func(byte, uint64, *message.Obj) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var source io.Reader = file
+	if size >= 0 {
+		source = io.LimitReader(file, size)
+	}
+	reader := bufio.NewReader(source)
+	for {
+		op, seq, msg, _, err := readRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Written when the process died, nothing after it counts
+			return nil
+		}
+		if err := handle(op, seq, msg); err != nil {
+			return err
+		}
+	}
+}
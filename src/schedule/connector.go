@@ -67,8 +67,10 @@ func initializeMySQLDatabase() error {
 
 	// CREATE TABLE IN NEW DATABASE
 	stmt_create_table, err := conn.Prepare(`CREATE TABLE records_` + strings.Replace(conf.GetGrandmaName(), " ", "_", -1) +
-		` ( id INT(6) UNSIGNED AUTO_INCREMENT PRIMARY KEY, service_type TINYINT NOT NULL, endpoint VARCHAR(512) NOT NULL, 
-		message_body VARCHAR(512), ttl BIGINT(11) UNSIGNED, sent BOOLEAN DEFAULT TRUE, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP );`)
+		` ( id INT(6) UNSIGNED AUTO_INCREMENT PRIMARY KEY, service_type TINYINT NOT NULL, endpoint TEXT NOT NULL, 
+		message_body VARCHAR(512), ttl BIGINT(11) UNSIGNED, sent BOOLEAN DEFAULT TRUE, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		priority TINYINT NOT NULL DEFAULT 0, tenant VARCHAR(64) NOT NULL DEFAULT '',
+		valid_until BIGINT(13) NOT NULL DEFAULT 0 );`)
 
 	if err != nil {
 		return err
@@ -80,3 +82,48 @@ func initializeMySQLDatabase() error {
 
 	return nil
 }
+
+// Columns added to the records table after its first version, in order
+var added_columns = [][2]string{
+	{"priority", "TINYINT NOT NULL DEFAULT 0"},
+	{"tenant", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"valid_until", "BIGINT(13) NOT NULL DEFAULT 0"},
+}
+
+// migrateRecordsTable adds the columns tables made by older versions lack and
+// widens the ones they made too narrow
+func migrateRecordsTable() error {
+	conn, err := getMySQLConnector()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	table := "records_" + strings.Replace(conf.GetGrandmaName(), " ", "_", -1)
+	for _, column := range added_columns {
+		rows, _, err := conn.Query("SHOW COLUMNS FROM " + table + " LIKE '" + column[0] + "'")
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			continue
+		}
+		_, _, err = conn.Query("ALTER TABLE " + table + " ADD COLUMN " + column[0] + " " + column[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Structured REST targets outgrow the VARCHAR older tables used
+	rows, _, err := conn.Query("SHOW COLUMNS FROM " + table + " LIKE 'endpoint'")
+	if err != nil {
+		return err
+	}
+	if len(rows) > 0 && !strings.EqualFold(rows[0].Str(1), "text") {
+		_, _, err = conn.Query("ALTER TABLE " + table + " MODIFY COLUMN endpoint TEXT NOT NULL")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package schedule
+
+import (
+	"conf"
+	"log"
+	"strings"
+)
+
+// Delivery status values recorded against a schedule
+const (
+	DELIVERY_STATUS_SENT        = "sent"
+	DELIVERY_STATUS_QUEUED      = "queued"
+	DELIVERY_STATUS_DELIVERED   = "delivered"
+	DELIVERY_STATUS_UNDELIVERED = "undelivered"
+	DELIVERY_STATUS_FAILED      = "failed"
+	DELIVERY_STATUS_EXPIRED     = "expired"
+)
+
+func deliveryTable() string {
+	return "delivery_" + strings.Replace(conf.GetGrandmaName(), " ", "_", -1)
+}
+
+func initializeDeliveryTable() error {
+	conn, err := getMySQLConnector()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, _, err = conn.Query(`CREATE TABLE IF NOT EXISTS ` + deliveryTable() +
+		` ( id INT(6) UNSIGNED AUTO_INCREMENT PRIMARY KEY, schedule_id INT(6) UNSIGNED NOT NULL,
+		channel VARCHAR(32) NOT NULL, reference VARCHAR(128), status VARCHAR(32) NOT NULL,
+		detail VARCHAR(512), updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+		INDEX (schedule_id), INDEX (reference) );`)
+
+	return err
+}
+
+// RecordDelivery stores the outcome of handing a scheduled message to its
+// channel. reference is the id given by the provider, if any, and is used
+// to match later delivery receipts.
+func RecordDelivery(schedule_id int, channel, reference, status, detail string) error {
+	conn, err := getMySQLConnector()
+	if err != nil {
+		return ErrorInternalDBSettings
+	}
+	defer conn.Close()
+
+	stmt, err := conn.Prepare("INSERT INTO " + deliveryTable() +
+		" (schedule_id, channel, reference, status, detail) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return ErrorInternalDBSettings
+	}
+
+	_, err = stmt.Run(schedule_id, channel, reference, status, detail)
+	if err != nil {
+		log.Println("Failed recording delivery status")
+		return ErrorInternalDBSettings
+	}
+
+	return nil
+}
+
+// UpdateDeliveryByReference applies a provider receipt to the delivery
+// recorded under the provider reference
+func UpdateDeliveryByReference(channel, reference, status, detail string) error {
+	conn, err := getMySQLConnector()
+	if err != nil {
+		return ErrorInternalDBSettings
+	}
+	defer conn.Close()
+
+	stmt, err := conn.Prepare("UPDATE " + deliveryTable() +
+		" SET status = ?, detail = ? WHERE channel = ? AND reference = ?")
+	if err != nil {
+		return ErrorInternalDBSettings
+	}
+
+	_, err = stmt.Run(status, detail, channel, reference)
+	if err != nil {
+		log.Println("Failed updating delivery status")
+		return ErrorInternalDBSettings
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"errors"
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -12,11 +13,22 @@ var (
 	ErrorInvalidScheduleObj = errors.New("Invalid schedule object")
 )
 
+// Milliseconds ahead a schedule must be due for take to move it, the timer
+// runs up to a second behind the clock
+const TAKE_MIN_LEAD = 2000
+
 var data_map = make(map[int64]*list.List)
 var time_table = make(map[int]int64)
 
 var RWMutex = new(sync.RWMutex)
 
+// PendingCount is the number of schedules waiting for their time
+func PendingCount() int {
+	RWMutex.RLock()
+	defer RWMutex.RUnlock()
+	return len(time_table)
+}
+
 func put(s *Schedule) error {
 	if s == nil {
 		return ErrorInvalidScheduleObj
@@ -33,7 +45,6 @@ func put(s *Schedule) error {
 
 	RWMutex.Lock()
 	t, ttok := time_table[s.Id]
-	_, dmok := data_map[exp]
 
 	if ttok == true {
 		temp_l := data_map[t]
@@ -47,6 +58,8 @@ func put(s *Schedule) error {
 		}
 	}
 
+	// Looked up after the move, it may have emptied the same slot
+	_, dmok := data_map[exp]
 	if dmok != true {
 		data_map[exp] = list.New()
 	}
@@ -91,3 +104,43 @@ func getAll() []*Schedule {
 
 	return ret
 }
+
+// take removes up to limit schedules from the key store, those due last
+// first, or all of them with no limit. The schedules taken won't fire, their
+// time slots are returned by id. Schedules due within TAKE_MIN_LEAD are
+// left to fire here, the timer may be about to fire them.
+func take(limit int) map[int]int64 {
+	RWMutex.Lock()
+	defer RWMutex.Unlock()
+
+	earliest := (time.Now().UnixNano()/1000000 + TAKE_MIN_LEAD) / 100
+	ids := make([]int, 0, len(time_table))
+	for id, t := range time_table {
+		if t > earliest {
+			ids = append(ids, id)
+		}
+	}
+	if limit > 0 && limit < len(ids) {
+		sort.Slice(ids, func(i, j int) bool { return time_table[ids[i]] > time_table[ids[j]] })
+		ids = ids[:limit]
+	}
+
+	taken := make(map[int]int64, len(ids))
+	for _, id := range ids {
+		t := time_table[id]
+		taken[id] = t
+		delete(time_table, id)
+
+		l := data_map[t]
+		for e := l.Front(); e != nil; e = e.Next() {
+			if e.Value == id {
+				l.Remove(e)
+				break
+			}
+		}
+		if l.Len() == 0 {
+			delete(data_map, t)
+		}
+	}
+	return taken
+}
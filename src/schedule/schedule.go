@@ -2,11 +2,9 @@ package schedule
 
 import (
 	"conf"
-	"encoding/binary"
 	"errors"
 	"log"
 	"message"
-	"net"
 	"queue"
 	"strings"
 	"sync"
@@ -16,8 +14,21 @@ import (
 var dbConnection = "127.0.0.1:3306"
 var dbUsername = "root"
 var dbPassword = ""
-var tcp *net.TCPConn = nil
-var tcplock = new(sync.Mutex)
+
+// Sends a frame to the master when running as a slave
+var report_to_master func(data []byte) = nil
+var reportLock = new(sync.Mutex)
+
+// Schedules taken out for another node by HandOff, by id
+var handed_off map[int]int64 = nil
+var handOffLock = new(sync.Mutex)
+
+// Delay before a schedule the queue refused fires again, by id
+var queue_retries = make(map[int]int64)
+var retryLock = new(sync.Mutex)
+
+// Asked before a timed schedule fires, false when another node delivers it
+var fire_guard func(id int) bool = nil
 
 type Schedule struct {
 	Id     int
@@ -25,6 +36,13 @@ type Schedule struct {
 	Signal chan bool
 }
 
+// Milliseconds before a schedule refused by a full queue fires again,
+// doubled on each refusal
+const (
+	QUEUE_RETRY_MIN = 1000
+	QUEUE_RETRY_MAX = 60 * 1000
+)
+
 var (
 	COMM_TYPE_CONSUMED byte = 150
 	COMM_TYPE_SCHEDULE byte = 151
@@ -35,60 +53,59 @@ var (
 	ErrorFailedRecoveringFromHistory = errors.New("Failed to recover from crash")
 	ErrorInvalidMessageContent       = errors.New("Invalid message content")
 	ErrorInternalDBSettings          = errors.New("Invalid database settings")
+	ErrorHandOffInProgress           = errors.New("Schedules are already being handed off")
 )
 
-func InitScheduler(c *net.TCPConn) {
-	tcplock.Lock()
-	tcp = c
-	tcplock.Unlock()
+func InitScheduler() {
 	initializeMySQLDatabase()
+	if err := migrateRecordsTable(); err != nil {
+		panic(err)
+	}
+	if err := initializeDeliveryTable(); err != nil {
+		panic(err)
+	}
 	if err := recoverSchedule(); err != nil {
 		panic(err)
 	}
 	startLoop()
 }
 
-func ChangeConnection(c *net.TCPConn) {
-	log.Println("TCP connection changed")
-	tcplock.Lock()
-	tcp = c
-	tcplock.Unlock()
+// SetMasterReporter makes the scheduler report consumed and fired
+// schedules to the master over the cluster link
+func SetMasterReporter(send func(data []byte)) {
+	reportLock.Lock()
+	report_to_master = send
+	reportLock.Unlock()
 }
 
-func reportSchedule() {
-	msg_size_header := make([]byte, 2)
-	binary.BigEndian.PutUint16(msg_size_header, uint16(1))
-
-	tcplock.Lock()
-	_, err := tcp.Write(msg_size_header)
-	_, err = tcp.Write([]byte{COMM_TYPE_FINISHED})
-	tcplock.Unlock()
-
-	if err != nil {
-		log.Println("failed sending msg")
-	}
-
-	log.Println("reported result")
+func getMasterReporter() func(data []byte) {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	return report_to_master
 }
 
-func consumeSchedule(id int32) {
-	buffer := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buffer, uint32(id))
+// SetFireGuard makes the scheduler ask before firing a timed schedule,
+// used by replication to keep a message from being delivered twice
+func SetFireGuard(guard func(id int) bool) {
+	reportLock.Lock()
+	fire_guard = guard
+	reportLock.Unlock()
+}
 
-	to_send := make([]byte, 5)
-	to_send[0] = COMM_TYPE_CONSUMED
+func getFireGuard() func(id int) bool {
+	reportLock.Lock()
+	defer reportLock.Unlock()
+	return fire_guard
+}
 
-	for i := 0; i < 4; i++ {
-		to_send[i+1] = buffer[i]
+func reportSchedule() {
+	send := getMasterReporter()
+	if send == nil {
+		return
 	}
+	send([]byte{COMM_TYPE_FINISHED})
 
-	msg_size_header := make([]byte, 2)
-	binary.BigEndian.PutUint16(msg_size_header, uint16(5))
-	tcplock.Lock()
-	tcp.Write(msg_size_header)
-	tcp.Write(to_send)
-	tcplock.Unlock()
-	log.Println("reported consume")
+	log.Println("reported result")
 }
 
 func recoverSchedule() error {
@@ -115,7 +132,7 @@ func recoverSchedule() error {
 		log.Println(row.Int64(4))
 
 		if current_time+1000 > row.Int64(4) {
-			schedule_to_recover.pushToSendingQueue()
+			go schedule_to_recover.fire()
 		} else {
 			err = put(&schedule_to_recover)
 			if err != nil {
@@ -141,12 +158,12 @@ func NewSchedule(m *message.Obj) (*Schedule, error) {
 	current_time := time.Now().UnixNano() / 1000000
 
 	stmt, err := conn.Prepare("INSERT INTO records_" +
-		strings.Replace(conf.GetGrandmaName(), " ", "_", -1) + " VALUES (NULL, ?, ?, ?, ?, FALSE, NULL)")
+		strings.Replace(conf.GetGrandmaName(), " ", "_", -1) + " VALUES (NULL, ?, ?, ?, ?, FALSE, NULL, ?, ?, ?)")
 	if err != nil {
 		return nil, ErrorInvalidMessageContent
 	}
 
-	stmt.Run(m.MessageType, m.Endpoint, m.MessageBody, current_time+m.Expiration)
+	stmt.Run(m.MessageType, m.Endpoint, m.MessageBody, current_time+m.Expiration, m.Priority, m.Tenant, m.ValidUntil)
 	log.Printf("ttl: %d", current_time+m.Expiration)
 	rows, _, err := conn.Query("SELECT LAST_INSERT_ID()")
 	if err != nil {
@@ -162,9 +179,6 @@ func NewSchedule(m *message.Obj) (*Schedule, error) {
 
 	if m.Expiration < 1000 {
 		s.pushToSendingQueue()
-		if tcp != nil {
-			consumeSchedule(int32(id.Int(0)))
-		}
 		return &s, nil
 	}
 
@@ -174,25 +188,103 @@ func NewSchedule(m *message.Obj) (*Schedule, error) {
 		panic(err)
 	}
 
-	if tcp != nil {
-		consumeSchedule(int32(id.Int(0)))
-	}
 	return &s, nil
 }
 
-func (s *Schedule) pushToSendingQueue() error {
-	log.Println("push message...")
+// fire delivers a schedule whose time has come, unless the fire guard
+// says another node has delivered it
+func (s *Schedule) fire() error {
+	guard := getFireGuard()
+	if guard != nil && !guard(s.Id) {
+		log.Printf("schedule %d was delivered by another node", s.Id)
+		return s.markSent()
+	}
+	return s.pushToSendingQueue()
+}
+
+// HandOff takes up to limit pending schedules, those due last, out of the
+// key store so another node can fire them, all of them with no limit. The
+// messages carry their schedule id and the time left. Schedules moved are
+// given up with Release, the others go back with Restore.
+func HandOff(limit int) ([]*message.Obj, error) {
+	handOffLock.Lock()
+	defer handOffLock.Unlock()
+	if handed_off != nil {
+		return nil, ErrorHandOffInProgress
+	}
 
 	conn, err := getMySQLConnector()
 	if err != nil {
 		panic(err)
 	}
+	rows, _, err := conn.Query("SELECT * FROM records_" +
+		strings.Replace(conf.GetGrandmaName(), " ", "_", -1) + " WHERE sent = FALSE")
+	conn.Close()
+	if err != nil {
+		return nil, ErrorInternalDBSettings
+	}
 
-	rows, _, err := conn.Query("SELECT * FROM records_"+
-		strings.Replace(conf.GetGrandmaName(), " ", "_", -1)+" WHERE id = %d", s.Id)
+	handed_off = take(limit)
+	current_time := time.Now().UnixNano() / 1000000
+	msgs := make([]*message.Obj, 0, len(handed_off))
+	for _, row := range rows {
+		if _, ok := handed_off[row.Int(0)]; !ok {
+			continue
+		}
+		left := row.Int64(4) - current_time
+		if left < 0 {
+			left = 0
+		}
+		msgs = append(msgs, &message.Obj{
+			MessageType: row.Int(1),
+			Endpoint:    row.Str(2),
+			MessageBody: row.Str(3),
+			Expiration:  left,
+			ScheduleId:  row.Int(0),
+			Priority:    row.Int(7),
+			Tenant:      row.Str(8),
+			ValidUntil:  row.Int64(9),
+		})
+	}
+	return msgs, nil
+}
+
+// Release gives up handed off schedules another node took
+func Release(ids []int) {
+	handOffLock.Lock()
+	defer handOffLock.Unlock()
+	for _, id := range ids {
+		if _, ok := handed_off[id]; ok {
+			delete(handed_off, id)
+			(&Schedule{id, 0, nil}).markSent()
+		}
+	}
+}
+
+// Restore puts back the handed off schedules nobody took
+func Restore() {
+	handOffLock.Lock()
+	defer handOffLock.Unlock()
+
+	current_time := time.Now().UnixNano() / 1000000
+	for id, t := range handed_off {
+		s := &Schedule{id, t*100 - current_time, make(chan bool, 1)}
+		if s.Exp < 1000 {
+			// Its time passed while it was away
+			go s.fire()
+		} else {
+			put(s)
+		}
+	}
+	handed_off = nil
+}
+
+func (s *Schedule) markSent() error {
+	conn, err := getMySQLConnector()
 	if err != nil {
-		return ErrorInternalDBSettings
+		panic(err)
 	}
+	defer conn.Close()
 
 	stmt, err := conn.Prepare("UPDATE records_" +
 		strings.Replace(conf.GetGrandmaName(), " ", "_", -1) + " SET sent = TRUE WHERE id = ?")
@@ -200,22 +292,54 @@ func (s *Schedule) pushToSendingQueue() error {
 		return ErrorInternalDBSettings
 	}
 	stmt.Run(s.Id)
+	return nil
+}
 
-	conn.Close()
+func (s *Schedule) pushToSendingQueue() error {
+	log.Println("push message...")
 
-	row := rows[0]
-	msg_to_push := new(message.Obj)
+	conn, err := getMySQLConnector()
+	if err != nil {
+		panic(err)
+	}
+
+	defer conn.Close()
 
-	log.Println(msg_to_push.Endpoint)
+	rows, _, err := conn.Query("SELECT * FROM records_"+
+		strings.Replace(conf.GetGrandmaName(), " ", "_", -1)+" WHERE id = %d", s.Id)
+	if err != nil {
+		return ErrorInternalDBSettings
+	}
 
+	row := rows[0]
+	msg_to_push := new(message.Obj)
+	msg_to_push.ScheduleId = s.Id
 	msg_to_push.MessageType = row.Int(1)
 	msg_to_push.Endpoint = row.Str(2)
 	msg_to_push.MessageBody = row.Str(3)
 	msg_to_push.Expiration = 0
+	msg_to_push.Priority = row.Int(7)
+	msg_to_push.Tenant = row.Str(8)
+	msg_to_push.ValidUntil = row.Int64(9)
 
-	queue.Main_Queue.PushMessage(msg_to_push)
+	// Marked sent only once queued, a schedule the queue refused goes back
+	// to the key store and fires again later
+	err = queue.Main_Queue.PushMessage(msg_to_push)
+	if err != nil {
+		log.Printf("Queue refused schedule %d: %s", s.Id, err.Error())
+		s.retryLater()
+		return err
+	}
+	forgetRetries(s.Id)
 
-	if tcp == nil {
+	stmt, err := conn.Prepare("UPDATE records_" +
+		strings.Replace(conf.GetGrandmaName(), " ", "_", -1) + " SET sent = TRUE WHERE id = ?")
+	if err != nil {
+		return ErrorInternalDBSettings
+	}
+	stmt.Run(s.Id)
+
+	if getMasterReporter() == nil {
 		s.Signal <- true
 	} else {
 		reportSchedule()
@@ -223,3 +347,25 @@ func (s *Schedule) pushToSendingQueue() error {
 
 	return nil
 }
+
+// retryLater puts a schedule the queue refused back in the key store, due
+// again after a delay that doubles up to QUEUE_RETRY_MAX
+func (s *Schedule) retryLater() {
+	retryLock.Lock()
+	delay := queue_retries[s.Id] * 2
+	if delay < QUEUE_RETRY_MIN {
+		delay = QUEUE_RETRY_MIN
+	} else if delay > QUEUE_RETRY_MAX {
+		delay = QUEUE_RETRY_MAX
+	}
+	queue_retries[s.Id] = delay
+	retryLock.Unlock()
+
+	put(&Schedule{s.Id, delay, s.Signal})
+}
+
+func forgetRetries(id int) {
+	retryLock.Lock()
+	delete(queue_retries, id)
+	retryLock.Unlock()
+}
@@ -0,0 +1,36 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefusedScheduleFiresAgain(t *testing.T) {
+	s := &Schedule{41, 0, make(chan bool, 1)}
+	defer forgetRetries(s.Id)
+
+	for _, delay := range []int64{QUEUE_RETRY_MIN, 2 * QUEUE_RETRY_MIN, 4 * QUEUE_RETRY_MIN} {
+		now := time.Now().UnixNano() / 1000000
+		s.retryLater()
+		slot := get(s.Id)
+		if slot == nil {
+			t.Fatal("refused schedule not back in the key store")
+		}
+		if due := slot.Exp*100 - now; due < delay-100 || due > delay+100 {
+			t.Errorf("due in %dms, expected %dms", due, delay)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		s.retryLater()
+	}
+	retryLock.Lock()
+	delay := queue_retries[s.Id]
+	retryLock.Unlock()
+	if delay != QUEUE_RETRY_MAX {
+		t.Errorf("retried after %dms, expected at most %dms", delay, QUEUE_RETRY_MAX)
+	}
+
+	forgetRetries(s.Id)
+	take(0)
+}
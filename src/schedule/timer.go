@@ -32,18 +32,30 @@ func tickingFunc() {
 		current_time = current_time + 62
 	}
 
-	l, dmok := data_map[current_time/100]
+	// The slot is emptied under the lock, so take and put never change a
+	// list being walked
+	slot := current_time / 100
+	RWMutex.Lock()
+	l, dmok := data_map[slot]
 	if dmok == false {
+		RWMutex.Unlock()
 		return
-	} else {
-		go func() {
-			for e := l.Front(); e != nil; e = e.Next() {
-				s := get(e.Value.(int))
-				log.Printf("push scheduled msg at %d", current_time/100)
-				go s.pushToSendingQueue()
-				delete(time_table, s.Id)
-			}
-			delete(data_map, current_time/100)
-		}()
+	}
+	delete(data_map, slot)
+	ids := make([]int, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		id := e.Value.(int)
+		if t, ok := time_table[id]; !ok || t != slot {
+			continue
+		}
+		delete(time_table, id)
+		ids = append(ids, id)
+	}
+	RWMutex.Unlock()
+
+	for _, id := range ids {
+		log.Printf("push scheduled msg at %d", slot)
+		s := &Schedule{id, slot, make(chan bool, 1)}
+		go s.fire()
 	}
 }
@@ -11,8 +11,14 @@ import (
 )
 
 func VToken(method, time, path string) string {
+	return Sign(conf.GetRestSecret(), method, time, path)
+}
+
+// Sign builds the same signature as VToken with an arbitrary secret, used
+// to sign outgoing webhook calls
+func Sign(secret, method, time, path string) string {
 	str_to_sign := method + "\n" + time + "\n" + path
-	key := []byte(conf.GetRestSecret())
+	key := []byte(secret)
 	h := hmac.New(sha256.New, key)
 	h.Write([]byte(str_to_sign))
 	hash := hex.EncodeToString(h.Sum(nil))
@@ -0,0 +1,174 @@
+package ws
+
+import (
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"jsonwrapper"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Clients that connect with acks enabled get every message wrapped in an
+// envelope and confirm it by id:
+//
+//	server: {"id":"gss-1/42","data":"hello"}
+//	client: {"ack":"gss-1/42"}
+//
+// Messages not acked within ackTimeout are sent again, up to ackAttempts
+// times. Messages still pending or not yet written when the client goes
+// away are sent again to the id's other connections, the cluster or the
+// mailbox. Messages past
+// their ValidUntil are never sent again.
+const (
+	ackTimeout     = 30 * time.Second
+	ackAttempts    = 3
+	ackCheckPeriod = time.Second
+)
+
+// Statuses passed to OnDeliveryStatus
+const (
+	STATUS_DELIVERED   = "delivered"
+	STATUS_UNDELIVERED = "undelivered"
+	STATUS_EXPIRED     = "expired"
+)
+
+// OnDeliveryStatus is told when a client acks a message with a message id,
+// or gives up acking it
+var OnDeliveryStatus func(msg_id string, status string, detail string) = nil
+
+type pendingAck struct {
+	event    *Event
+	sent     time.Time
+	attempts int
+}
+
+type envelope struct {
+	Id   string `json:"id"`
+	Data string `json:"data"`
+}
+
+// EnableAcks switches the client to envelopes and acks, call it before
+// Join
+func (c *connection) EnableAcks() {
+	c.acks = true
+}
+
+// ackId is the message id, or the event id for messages sent without one
+func ackId(event *Event) string {
+	if event.MessageId != "" {
+		return event.MessageId
+	}
+	return strconv.FormatUint(event.Id, 10)
+}
+
+func reportDelivery(event *Event, status string, detail string) {
+	if event.MessageId != "" && OnDeliveryStatus != nil {
+		OnDeliveryStatus(event.MessageId, status, detail)
+	}
+}
+
+func reportExpired(event *Event) {
+	reportDelivery(event, STATUS_EXPIRED, "valid until "+strconv.FormatInt(event.ValidUntil, 10))
+}
+
+func (c *connection) writeEvent(event *Event) error {
+	if !c.acks {
+		return c.write(websocket.TextMessage, event.Data)
+	}
+
+	id := ackId(event)
+	c.pendingLock.Lock()
+	pending, ok := c.pending[id]
+	if !ok {
+		pending = &pendingAck{event, time.Now(), 0}
+		c.pending[id] = pending
+	}
+	pending.sent = time.Now()
+	pending.attempts++
+	c.pendingLock.Unlock()
+
+	payload, err := json.Marshal(envelope{id, string(event.Data)})
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, payload)
+}
+
+// redeliverPending sends unacked messages again once ackTimeout passes and
+// gives up on them after ackAttempts
+func (c *connection) redeliverPending() error {
+	now := time.Now()
+	resend := make([]*Event, 0)
+
+	c.pendingLock.Lock()
+	for id, pending := range c.pending {
+		if now.Sub(pending.sent) < ackTimeout {
+			continue
+		}
+		if pending.event.expired() {
+			delete(c.pending, id)
+			go reportExpired(pending.event)
+			continue
+		}
+		if pending.attempts >= ackAttempts {
+			delete(c.pending, id)
+			log.Println("No ack for wsmessage " + id)
+			go reportDelivery(pending.event, STATUS_UNDELIVERED, "No ack after "+strconv.Itoa(ackAttempts)+" attempts")
+			continue
+		}
+		resend = append(resend, pending.event)
+	}
+	c.pendingLock.Unlock()
+
+	for _, event := range resend {
+		if err := c.writeEvent(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleAck reads a {"ack": "<id>"} frame from the client
+func (c *connection) handleAck(frame []byte) {
+	obj, err := jsonwrapper.NewObjectFromBytes(frame)
+	if err != nil {
+		return
+	}
+	id, err := obj.GetString("ack")
+	if err != nil {
+		return
+	}
+
+	c.pendingLock.Lock()
+	pending, ok := c.pending[id]
+	delete(c.pending, id)
+	c.pendingLock.Unlock()
+
+	if ok {
+		go reportDelivery(pending.event, STATUS_DELIVERED, "")
+	}
+}
+
+// requeuePending sends the messages a departed client never acked, and
+// those still waiting in its buffer, to wherever the id can still be
+// reached. The connection has left and its writer has stopped.
+func (c *connection) requeuePending() {
+	c.pendingLock.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*pendingAck)
+	c.pendingLock.Unlock()
+
+	for _, p := range pending {
+		c.requeue(p.event)
+	}
+	for event := range c.msg {
+		c.requeue(event)
+	}
+}
+
+func (c *connection) requeue(event *Event) {
+	if Send(c.id, c.key, event.MessageId, string(event.Data), event.ValidUntil) == ErrorMessageExpired {
+		reportExpired(event)
+	}
+}
@@ -0,0 +1,220 @@
+package ws
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// acceptClient serves one websocket client the way routes.go does and
+// hands over its connection
+func acceptClient(t *testing.T, id string, key string, acks bool) (*websocket.Conn, *connection, func()) {
+	accepted := make(chan *connection, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c := NewWs(conn, id, key)
+		if acks {
+			c.EnableAcks()
+		}
+		if err := c.Join(); err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- c
+		go c.Heartbeat()
+		go c.GetHeartbeat()
+	}))
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return client, <-accepted, server.Close
+}
+
+// expectEvents reads the data of count events from a subscriber
+func expectEvents(t *testing.T, sub *connection, count int) map[string]bool {
+	got := make(map[string]bool)
+	for len(got) < count {
+		select {
+		case event := <-sub.Events():
+			got[string(event.Data)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("got %v, expected %d events", got, count)
+		}
+	}
+	return got
+}
+
+func TestRequeueOnDisconnect(t *testing.T) {
+	client, c, stop := acceptClient(t, "requeue", "app", true)
+	defer stop()
+
+	Send("requeue", "app", "m-1", "in flight", 0)
+	if _, frame, err := client.ReadMessage(); err != nil || !strings.Contains(string(frame), "in flight") {
+		t.Fatalf("read %s, %v", frame, err)
+	}
+
+	// The writer stops on the pending lock, what follows stays buffered
+	c.pendingLock.Lock()
+	Send("requeue", "app", "m-2", "buffered 1", 0)
+	Send("requeue", "app", "m-3", "buffered 2", 0)
+	client.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	// Joins once the client left, it gets only what was requeued
+	sub, err := Subscribe("requeue", "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Leave()
+	c.pendingLock.Unlock()
+
+	got := expectEvents(t, sub, 3)
+	for _, data := range []string{"in flight", "buffered 1", "buffered 2"} {
+		if !got[data] {
+			t.Errorf("%s was not requeued: %v", data, got)
+		}
+	}
+}
+
+func TestAckedNotRequeued(t *testing.T) {
+	client, _, stop := acceptClient(t, "acked", "app", true)
+	defer stop()
+
+	statuses := make(chan string, 2)
+	OnDeliveryStatus = func(msg_id string, status string, detail string) { statuses <- msg_id + " " + status }
+	defer func() { OnDeliveryStatus = nil }()
+
+	Send("acked", "app", "m-4", "acked", 0)
+	_, frame, err := client.ReadMessage()
+	if err != nil || !strings.Contains(string(frame), `"id":"m-4"`) {
+		t.Fatalf("read %s, %v", frame, err)
+	}
+	client.WriteMessage(websocket.TextMessage, []byte(`{"ack":"m-4"}`))
+	if status := <-statuses; status != "m-4 delivered" {
+		t.Errorf("status %s", status)
+	}
+
+	client.Close()
+	time.Sleep(50 * time.Millisecond)
+	sub, err := Subscribe("acked", "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Leave()
+
+	select {
+	case event := <-sub.Events():
+		t.Errorf("acked message %s sent again", event.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// overdue makes a pending message wait for its ack past ackTimeout
+func overdue(c *connection, id string) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	if pending := c.pending[id]; pending != nil {
+		pending.sent = time.Now().Add(-ackTimeout)
+	}
+}
+
+func TestRedeliverPending(t *testing.T) {
+	client, c, stop := acceptClient(t, "redeliver", "app", true)
+	defer stop()
+	defer client.Close()
+
+	statuses := make(chan string, 2)
+	OnDeliveryStatus = func(msg_id string, status string, detail string) { statuses <- msg_id + " " + status }
+	defer func() { OnDeliveryStatus = nil }()
+	expectStatus := func(expected string) {
+		select {
+		case status := <-statuses:
+			if status != expected {
+				t.Errorf("status %s, expected %s", status, expected)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("no status, expected %s", expected)
+		}
+	}
+
+	// Sent again until ackAttempts, then given up
+	Send("redeliver", "app", "m-5", "again", 0)
+	for attempt := 1; attempt <= ackAttempts; attempt++ {
+		if _, frame, err := client.ReadMessage(); err != nil || !strings.Contains(string(frame), `"id":"m-5"`) {
+			t.Fatalf("attempt %d: read %s, %v", attempt, frame, err)
+		}
+		overdue(c, "m-5")
+	}
+	expectStatus("m-5 undelivered")
+
+	// Expired ones are not sent again
+	valid_until := time.Now().Add(100*time.Millisecond).UnixNano() / 1000000
+	Send("redeliver", "app", "m-6", "expiring", valid_until)
+	if _, frame, err := client.ReadMessage(); err != nil || !strings.Contains(string(frame), `"id":"m-6"`) {
+		t.Fatalf("read %s, %v", frame, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	overdue(c, "m-6")
+	expectStatus("m-6 expired")
+
+	c.pendingLock.Lock()
+	left := len(c.pending)
+	c.pendingLock.Unlock()
+	if left != 0 {
+		t.Errorf("%d messages still pending", left)
+	}
+}
+
+func TestHandleAck(t *testing.T) {
+	statuses := make(chan string, 2)
+	OnDeliveryStatus = func(msg_id string, status string, detail string) { statuses <- msg_id + " " + status }
+	defer func() { OnDeliveryStatus = nil }()
+
+	c := NewWs(nil, "acks", "")
+	c.pending["m-7"] = &pendingAck{&Event{1, []byte("hello"), "m-7", 0}, time.Now(), 1}
+	for _, frame := range []string{"not json", `{"other":"m-7"}`, `{"ack":7}`, `{"ack":"m-8"}`} {
+		c.handleAck([]byte(frame))
+	}
+	if _, ok := c.pending["m-7"]; !ok {
+		t.Fatal("acked by a junk frame")
+	}
+
+	c.handleAck([]byte(`{"ack":"m-7"}`))
+	select {
+	case status := <-statuses:
+		if status != "m-7 delivered" {
+			t.Errorf("status %s", status)
+		}
+	case <-time.After(time.Second):
+		t.Error("no status")
+	}
+	if len(c.pending) != 0 {
+		t.Errorf("still pending %v", c.pending)
+	}
+	select {
+	case status := <-statuses:
+		t.Errorf("extra status %s", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAckId(t *testing.T) {
+	for expected, event := range map[string]*Event{
+		"m-9": {Id: 42, MessageId: "m-9"},
+		"42":  {Id: 42},
+	} {
+		if id := ackId(event); id != expected {
+			t.Errorf("ack id %s, expected %s", id, expected)
+		}
+	}
+}
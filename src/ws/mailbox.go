@@ -0,0 +1,121 @@
+package ws
+
+import (
+	"conf"
+	"sync"
+	"time"
+)
+
+const mailboxSweepPeriod = time.Minute
+
+type mailboxEntry struct {
+	key     string
+	event   *Event
+	expires time.Time
+}
+
+// Messages waiting for ids with no live connection, oldest first. Guarded
+// by connLock like conn_map so a message can't slip between a Send finding
+// no connection and the client joining.
+var mailboxes = make(map[string][]*mailboxEntry)
+var startSweeper = new(sync.Once)
+
+// storeInMailbox keeps msg for id until its ttl passes, dropping the oldest
+// entry when the mailbox is full. The caller holds connLock.
+func storeInMailbox(id string, key string, event *Event) bool {
+	ttl := conf.GetWsMailboxTTL()
+	if ttl <= 0 {
+		return false
+	}
+	startSweeper.Do(func() { go sweepMailboxes() })
+
+	box := append(expireEntries(mailboxes[id]), &mailboxEntry{key, event, time.Now().Add(time.Duration(ttl) * time.Second)})
+	if size := conf.GetWsMailboxSize(); len(box) > size {
+		box = box[len(box)-size:]
+	}
+	mailboxes[id] = box
+	return true
+}
+
+// flushMailbox hands a joining connection the unexpired messages addressed
+// to its key, skipping those it already got from the replay buffer.
+// Messages that don't fit its buffer stay for the next connection. The
+// caller holds connLock.
+func flushMailbox(c *connection, replayed map[uint64]bool) {
+	box := expireEntries(mailboxes[c.id])
+
+	kept := box[:0]
+	for _, entry := range box {
+		if entry.key != "" && entry.key != c.key {
+			kept = append(kept, entry)
+			continue
+		}
+		if replayed[entry.event.Id] || entry.event.expired() {
+			continue
+		}
+		select {
+		case c.msg <- entry.event:
+		default:
+			kept = append(kept, entry)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(mailboxes, c.id)
+	} else {
+		mailboxes[c.id] = kept
+	}
+}
+
+// Message kept in a mailbox, handed to another node by TakeMailbox
+type MailboxMessage struct {
+	Key        string
+	MessageId  string
+	Message    string
+	ValidUntil int64
+}
+
+// TakeMailbox removes and returns the unexpired messages kept for id, used
+// when the id comes online on another node of the cluster
+func TakeMailbox(id string) []MailboxMessage {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	box := expireEntries(mailboxes[id])
+	delete(mailboxes, id)
+
+	taken := make([]MailboxMessage, 0, len(box))
+	for _, entry := range box {
+		if !entry.event.expired() {
+			taken = append(taken, MailboxMessage{entry.key, entry.event.MessageId, string(entry.event.Data), entry.event.ValidUntil})
+		}
+	}
+	return taken
+}
+
+func expireEntries(box []*mailboxEntry) []*mailboxEntry {
+	now := time.Now()
+	for len(box) > 0 && now.After(box[0].expires) {
+		box = box[1:]
+	}
+	return box
+}
+
+// sweepMailboxes drops expired messages and replay events of ids that
+// never reconnect
+func sweepMailboxes() {
+	ticker := time.NewTicker(mailboxSweepPeriod)
+	for range ticker.C {
+		connLock.Lock()
+		sweepReplays()
+		for id, box := range mailboxes {
+			box = expireEntries(box)
+			if len(box) == 0 {
+				delete(mailboxes, id)
+			} else {
+				mailboxes[id] = box
+			}
+		}
+		connLock.Unlock()
+	}
+}
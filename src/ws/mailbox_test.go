@@ -0,0 +1,198 @@
+package ws
+
+import (
+	"conf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mailboxes of every test in the package keep three messages for a
+// minute, tests use their own ids
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "ws")
+	if err != nil {
+		panic(err)
+	}
+	config := filepath.Join(dir, "grandma.conf")
+	if err := ioutil.WriteFile(config, []byte(`{"ws_mailbox_ttl": 60, "ws_mailbox_size": 3}`), 0600); err != nil {
+		panic(err)
+	}
+	// Keeps the test flags, ReadFlags parses them all
+	os.Args = append([]string{os.Args[0], "-c", config}, os.Args[1:]...)
+	conf.ReadFlags()
+	conf.Configure()
+	OnPresence = func(id string, online bool) {
+		watchLock.Lock()
+		defer watchLock.Unlock()
+		if changes := presence_watchers[id]; changes != nil {
+			changes <- online
+		}
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Presence changes by id, for the tests watching them
+var presence_watchers = make(map[string]chan bool)
+var watchLock = new(sync.Mutex)
+
+func watchPresence(id string) chan bool {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	presence_watchers[id] = make(chan bool, 10)
+	return presence_watchers[id]
+}
+
+// expectNoEvent fails when the subscriber gets anything soon
+func expectNoEvent(t *testing.T, sub *connection) {
+	select {
+	case event := <-sub.Events():
+		t.Errorf("unexpected event %s", event.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMailboxKeepsForOfflineIds(t *testing.T) {
+	for i := 1; i <= 5; i++ {
+		if err := Send("offline", "", "", "m"+strconv.Itoa(i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Send("offline", "other-app", "", "for the other app", 0)
+
+	// The oldest are dropped past ws_mailbox_size
+	sub, err := Subscribe("offline", "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Leave()
+	got := expectEvents(t, sub, 2)
+	if !got["m4"] || !got["m5"] {
+		t.Errorf("got %v", got)
+	}
+	expectNoEvent(t, sub)
+
+	// What was kept for another key waits for it
+	taken := TakeMailbox("offline")
+	if len(taken) != 1 || taken[0].Key != "other-app" || taken[0].Message != "for the other app" {
+		t.Errorf("mailbox left %+v", taken)
+	}
+	if taken := TakeMailbox("offline"); len(taken) != 0 {
+		t.Errorf("taken twice: %+v", taken)
+	}
+}
+
+func TestMailboxDropsExpired(t *testing.T) {
+	valid_until := time.Now().Add(30*time.Millisecond).UnixNano() / 1000000
+	Send("expiring", "", "", "late", valid_until)
+	Send("expiring", "", "", "on time", 0)
+	time.Sleep(60 * time.Millisecond)
+
+	if err := Send("expiring", "", "", "expired", valid_until); err != ErrorMessageExpired {
+		t.Errorf("expected ErrorMessageExpired, got %v", err)
+	}
+	sub, err := Subscribe("expiring", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Leave()
+	if got := expectEvents(t, sub, 1); !got["on time"] {
+		t.Errorf("got %v", got)
+	}
+	expectNoEvent(t, sub)
+}
+
+func TestSlowConsumerEvicted(t *testing.T) {
+	slow, err := Subscribe("slow", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < sendBuffer; i++ {
+		Send("slow", "", "", "m"+strconv.Itoa(i), 0)
+	}
+	if ids := OnlineIds(); !contains(ids, "slow") {
+		t.Fatalf("online %v", ids)
+	}
+
+	// One more than it buffers, the id goes offline and the message waits
+	Send("slow", "", "", "overflow", 0)
+	if ids := OnlineIds(); contains(ids, "slow") {
+		t.Errorf("slow consumer still online")
+	}
+	count := 0
+	for range slow.Events() {
+		count++
+	}
+	if count != sendBuffer {
+		t.Errorf("evicted consumer had %d events", count)
+	}
+
+	next, err := Subscribe("slow", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Leave()
+	if got := expectEvents(t, next, 1); !got["overflow"] {
+		t.Errorf("got %v", got)
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMaxConnections(t *testing.T) {
+	for i := 0; i < maxConn; i++ {
+		sub, err := Subscribe("crowded", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Leave()
+	}
+	if _, err := Subscribe("crowded", "", ""); err != ErrorExceedsMaxConn {
+		t.Errorf("expected ErrorExceedsMaxConn, got %v", err)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	changes := watchPresence("present")
+	expect := func(expected bool) {
+		select {
+		case online := <-changes:
+			if online != expected {
+				t.Errorf("online %v, expected %v", online, expected)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("no presence change, expected online %v", expected)
+		}
+	}
+
+	// Only the first connection and the last one leaving change presence
+	first, _ := Subscribe("present", "a", "")
+	second, _ := Subscribe("present", "b", "")
+	expect(true)
+	first.Leave()
+	if err := first.Leave(); err != ErrorNoLiveConnection {
+		t.Errorf("left twice: %v", err)
+	}
+	second.Leave()
+	expect(false)
+
+	select {
+	case online := <-changes:
+		t.Errorf("extra change to online %v", online)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
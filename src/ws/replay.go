@@ -0,0 +1,73 @@
+package ws
+
+import (
+	"time"
+)
+
+const (
+	replaySize = 50              // Events kept per id for resuming clients
+	replayTTL  = 5 * time.Minute // How long an event can be resumed
+)
+
+type replayEntry struct {
+	key   string
+	event *Event
+	at    time.Time
+}
+
+// Recent events by id, oldest first, guarded by connLock. Clients that
+// reconnect with the last event id they saw get what they missed.
+var replays = make(map[string][]*replayEntry)
+
+// recordReplay keeps an event for resuming clients, the caller holds
+// connLock
+func recordReplay(id string, key string, event *Event) {
+	startSweeper.Do(func() { go sweepMailboxes() })
+
+	buffer := append(expireReplay(replays[id]), &replayEntry{key, event, time.Now()})
+	if len(buffer) > replaySize {
+		buffer = buffer[len(buffer)-replaySize:]
+	}
+	replays[id] = buffer
+}
+
+// replaySince hands a joining connection the events for its key after
+// last_event_id and returns their ids. The caller holds connLock.
+func replaySince(c *connection, last_event_id uint64) map[uint64]bool {
+	replayed := make(map[uint64]bool)
+	for _, entry := range expireReplay(replays[c.id]) {
+		if entry.event.Id <= last_event_id {
+			continue
+		}
+		if (entry.key != "" && entry.key != c.key) || entry.event.expired() {
+			continue
+		}
+		select {
+		case c.msg <- entry.event:
+			replayed[entry.event.Id] = true
+		default:
+			return replayed
+		}
+	}
+	return replayed
+}
+
+func expireReplay(buffer []*replayEntry) []*replayEntry {
+	cutoff := time.Now().Add(-replayTTL)
+	for len(buffer) > 0 && buffer[0].at.Before(cutoff) {
+		buffer = buffer[1:]
+	}
+	return buffer
+}
+
+// sweepReplays drops expired events of idle ids, the caller holds connLock
+func sweepReplays() {
+	for id, buffer := range replays {
+		buffer = expireReplay(buffer)
+		if len(buffer) == 0 {
+			delete(replays, id)
+		} else {
+			replays[id] = buffer
+		}
+	}
+}
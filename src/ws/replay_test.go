@@ -0,0 +1,114 @@
+package ws
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// sent sends msg to a subscriber and returns the event it got
+func sent(t *testing.T, sub *connection, id string, key string, msg string) *Event {
+	if err := Send(id, key, "", msg, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-sub.Events():
+		if string(event.Data) != msg {
+			t.Fatalf("got %s, expected %s", event.Data, msg)
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("%s not delivered", msg)
+	}
+	return nil
+}
+
+func TestReplaySince(t *testing.T) {
+	sub, err := Subscribe("replay", "app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := sent(t, sub, "replay", "app", "r1")
+	sent(t, sub, "replay", "app", "r2")
+	sent(t, sub, "replay", "", "r3")
+	sub.Leave()
+
+	// Only what came after the last event seen
+	resumed, err := Subscribe("replay", "app", strconv.FormatUint(first.Id, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Leave()
+	if got := expectEvents(t, resumed, 2); !got["r2"] || !got["r3"] {
+		t.Errorf("got %v", got)
+	}
+	expectNoEvent(t, resumed)
+
+	// Another key gets what was sent to every key
+	other, err := Subscribe("replay", "other", strconv.FormatUint(first.Id-1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Leave()
+	if got := expectEvents(t, other, 1); !got["r3"] {
+		t.Errorf("got %v", got)
+	}
+	expectNoEvent(t, other)
+
+	// Not an event id, no replay
+	fresh, err := Subscribe("replay", "app", "junk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Leave()
+	expectNoEvent(t, fresh)
+}
+
+func TestReplayAndMailboxNotDuplicated(t *testing.T) {
+	sub, err := Subscribe("resume", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := sent(t, sub, "resume", "", "seen")
+	sub.Leave()
+
+	// Kept while offline, it is both in the mailbox and the replay buffer
+	if err := Send("resume", "", "", "missed", 0); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := Subscribe("resume", "", strconv.FormatUint(last.Id, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Leave()
+	if got := expectEvents(t, resumed, 1); !got["missed"] {
+		t.Errorf("got %v", got)
+	}
+	expectNoEvent(t, resumed)
+	if taken := TakeMailbox("resume"); len(taken) != 0 {
+		t.Errorf("mailbox left %+v", taken)
+	}
+}
+
+func TestReplayCapped(t *testing.T) {
+	sub, err := Subscribe("capped", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < replaySize+10; i++ {
+		sent(t, sub, "capped", "", "m"+strconv.Itoa(i))
+	}
+	sub.Leave()
+
+	// The oldest are dropped past replaySize
+	resumed, err := Subscribe("capped", "", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Leave()
+	got := expectEvents(t, resumed, replaySize)
+	if got["m9"] || !got["m10"] || !got["m"+strconv.Itoa(replaySize+9)] {
+		t.Errorf("replayed %d events: %v", len(got), got)
+	}
+	expectNoEvent(t, resumed)
+}
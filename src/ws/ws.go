@@ -1,10 +1,11 @@
 package ws
 
 import (
-	"container/list"
 	"errors"
 	"github.com/gorilla/websocket"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -13,55 +14,164 @@ const (
 	pongWait       = 15 * time.Second
 	pingPeriod     = pongWait * 4 / 5
 	writeWait      = 10 * time.Second
-	maxMessageSize = 64
+	maxMessageSize = 512
+	sendBuffer     = 64 // Messages queued per connection before it is evicted
 )
 
 var (
 	ErrorExceedsMaxConn   = errors.New("Exceeds max connections allowed")
 	ErrorNoLiveConnection = errors.New("No connection under this id")
+	ErrorMessageExpired   = errors.New("Message expired")
 )
 
+// Event is one message delivered to a client. Ids increase over the life
+// of the process and across restarts, so clients can resume after the
+// last id they saw.
+type Event struct {
+	Id         uint64
+	Data       []byte
+	MessageId  string // Set for scheduled messages, used in acks
+	ValidUntil int64  // Milliseconds, 0 if it never expires
+}
+
+func (e *Event) expired() bool {
+	return pastValidUntil(e.ValidUntil)
+}
+
+func pastValidUntil(valid_until int64) bool {
+	return valid_until != 0 && time.Now().UnixNano()/1000000 > valid_until
+}
+
+// A client subscribed to an id. conn is nil for SSE and long-poll clients,
+// which read Events directly.
 type connection struct {
 	id   string
 	key  string
 	conn *websocket.Conn
-	msg  chan []byte
+	msg  chan *Event
+
+	acks        bool // Client gets envelopes and acks them, see ack.go
+	pending     map[string]*pendingAck
+	pendingLock *sync.Mutex
+	writer_done chan bool // Closed once Heartbeat stops writing
 }
 
-var conn_map = make(map[string]*list.List)
+// Live connections by id. conn_map and the msg channels of its connections
+// are only touched while holding connLock, a connection's msg channel is
+// closed exactly once when it is removed from the map.
+var conn_map = make(map[string]map[*connection]bool)
+var connLock = new(sync.Mutex)
+
+// Presence changes waiting for notifyPresence, in the order they happened
+// in conn_map. Queued under connLock, reported by one goroutine so that a
+// slow OnPresence never holds connLock.
+type presenceChange struct {
+	id     string
+	online bool
+}
+
+var presence_changes = make([]presenceChange, 0)
+var presence_wake = make(chan bool, 1)
+var presenceLock = new(sync.Mutex)
+var startPresence = new(sync.Once)
+
+// Next event id, guarded by connLock
+var next_event_id = uint64(time.Now().UnixNano())
+
+// Cluster hooks, set by clustering when running in cluster mode.
+// OnPresence is called when the first connection of an id joins this node
+// and when the last one leaves. Forward hands a message with no local
+// connection to the cluster and reports whether it was sent on.
+var (
+	OnPresence func(id string, online bool)                                                   = nil
+	Forward    func(id string, key string, msg_id string, msg string, valid_until int64) bool = nil
+)
 
 func (c *connection) Join() error {
+	return c.join(0, false)
+}
+
+// join adds the connection to conn_map. When resuming, it first gets the
+// events after last_event_id from the replay buffer.
+func (c *connection) join(last_event_id uint64, resume bool) error {
+	connLock.Lock()
+
 	id := c.id
-	if conn_map[id] == nil {
-		conn_map[id] = list.New()
+	if len(conn_map[id]) >= maxConn {
+		connLock.Unlock()
+		return ErrorExceedsMaxConn
 	}
 
-	if conn_map[id].Len() > maxConn {
-		return ErrorExceedsMaxConn
+	first := conn_map[id] == nil
+	if first {
+		conn_map[id] = make(map[*connection]bool)
 	}
+	conn_map[id][c] = true
 
-	conn_map[id].PushBack(c)
+	var replayed map[uint64]bool = nil
+	if resume {
+		replayed = replaySince(c, last_event_id)
+	}
+	flushMailbox(c, replayed)
+	unlockAndNotify(id, first, true)
 	return nil
 }
 
 func (c *connection) Leave() error {
-	id := c.id
-	if conn_map[id] == nil {
-		return ErrorNoLiveConnection
+	connLock.Lock()
+	last, err := c.remove()
+	unlockAndNotify(c.id, last, false)
+	return err
+}
+
+// unlockAndNotify queues a presence change for notifyPresence and releases
+// connLock
+func unlockAndNotify(id string, changed bool, online bool) {
+	if changed {
+		startPresence.Do(func() { go notifyPresence() })
+		presenceLock.Lock()
+		presence_changes = append(presence_changes, presenceChange{id, online})
+		presenceLock.Unlock()
+		select {
+		case presence_wake <- true:
+		default:
+		}
 	}
+	connLock.Unlock()
+}
 
-	p := conn_map[id]
-	for e := p.Front(); e != nil; e = e.Next() {
-		if e.Value == c {
-			p.Remove(e)
-			if p.Len() == 0 {
-				delete(conn_map, id)
+// notifyPresence hands the queued presence changes to OnPresence
+func notifyPresence() {
+	for range presence_wake {
+		presenceLock.Lock()
+		changes := presence_changes
+		presence_changes = make([]presenceChange, 0)
+		presenceLock.Unlock()
+
+		for _, change := range changes {
+			if OnPresence != nil {
+				OnPresence(change.id, change.online)
 			}
-			return nil
 		}
 	}
+}
 
-	return ErrorNoLiveConnection
+// remove takes the connection out of conn_map and stops its writer. It
+// reports whether this was the id's last connection, the caller holds
+// connLock.
+func (c *connection) remove() (bool, error) {
+	conns := conn_map[c.id]
+	if !conns[c] {
+		return false, ErrorNoLiveConnection
+	}
+
+	delete(conns, c)
+	close(c.msg)
+	if len(conns) == 0 {
+		delete(conn_map, c.id)
+		return true, nil
+	}
+	return false, nil
 }
 
 func NewWs(c *websocket.Conn, id string, key string) *connection {
@@ -69,32 +179,128 @@ func NewWs(c *websocket.Conn, id string, key string) *connection {
 	conn.id = id
 	conn.key = key
 	conn.conn = c
-	conn.msg = make(chan []byte)
+	conn.msg = make(chan *Event, sendBuffer)
+	conn.pending = make(map[string]*pendingAck)
+	conn.pendingLock = new(sync.Mutex)
+	conn.writer_done = make(chan bool)
 
 	return conn
 }
 
-func Send(id string, key string, msg string) error {
-	if conn_map[id] == nil {
-		log.Println("id not found")
-		return ErrorNoLiveConnection
+// Subscribe joins a client without a websocket. With last_event_id set it
+// first receives the buffered events it missed.
+func Subscribe(id string, key string, last_event_id string) (*connection, error) {
+	c := NewWs(nil, id, key)
+
+	after, err := strconv.ParseUint(last_event_id, 10, 64)
+	if err = c.join(after, err == nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Events delivers the client's messages, the channel is closed when the
+// client leaves or is evicted
+func (c *connection) Events() <-chan *Event {
+	return c.msg
+}
+
+// Send delivers msg to the connections of id opened with key, or all of
+// them when key is empty. With no live connection on this node the message
+// goes to the cluster, or is kept in the id's mailbox if ws_mailbox_ttl is
+// set. msg_id identifies a scheduled message in acks and delivery status,
+// it may be empty.
+func Send(id string, key string, msg_id string, msg string, valid_until int64) error {
+	if pastValidUntil(valid_until) {
+		return ErrorMessageExpired
 	}
 
-	log.Println("wsmessage sent")
+	if deliverLocal(id, key, msg_id, []byte(msg), valid_until) {
+		log.Println("wsmessage sent")
+		return nil
+	}
 
-	for e := conn_map[id].Front(); e != nil; e = e.Next() {
-		c := e.Value.(*connection)
+	if Forward != nil && Forward(id, key, msg_id, msg, valid_until) {
+		log.Println("wsmessage forwarded")
+		return nil
+	}
 
-		if key != "" {
-			if c.key == key {
-				c.msg <- []byte(msg)
-			}
-		} else {
-			c.msg <- []byte(msg)
+	return keep(id, key, msg_id, []byte(msg), valid_until)
+}
+
+// newEvent numbers a message, the caller holds connLock
+func newEvent(msg_id string, data []byte, valid_until int64) *Event {
+	next_event_id++
+	return &Event{next_event_id, data, msg_id, valid_until}
+}
+
+// Deliver is Send for messages forwarded by another node, which are never
+// sent back to the cluster
+func Deliver(id string, key string, msg_id string, msg string, valid_until int64) error {
+	if pastValidUntil(valid_until) {
+		return ErrorMessageExpired
+	}
+
+	if deliverLocal(id, key, msg_id, []byte(msg), valid_until) {
+		log.Println("wsmessage sent")
+		return nil
+	}
+
+	return keep(id, key, msg_id, []byte(msg), valid_until)
+}
+
+// deliverLocal queues msg on the matching connections without blocking.
+// Connections whose buffer is full can't keep up and are evicted.
+func deliverLocal(id string, key string, msg_id string, msg []byte, valid_until int64) bool {
+	connLock.Lock()
+	delivered := false
+	offline := false
+	event := newEvent(msg_id, msg, valid_until)
+	for c := range conn_map[id] {
+		if key != "" && c.key != key {
+			continue
 		}
+		select {
+		case c.msg <- event:
+			delivered = true
+		default:
+			log.Println("Evicting slow websocket consumer " + c.id)
+			last, _ := c.remove()
+			offline = offline || last
+		}
+	}
+	if delivered {
+		recordReplay(id, key, event)
 	}
+	unlockAndNotify(id, offline, false)
+	return delivered
+}
 
-	return nil
+func keep(id string, key string, msg_id string, msg []byte, valid_until int64) error {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	event := newEvent(msg_id, msg, valid_until)
+	recordReplay(id, key, event)
+	if storeInMailbox(id, key, event) {
+		log.Println("wsmessage kept for offline id " + id)
+		return nil
+	}
+
+	log.Println("id not found")
+	return ErrorNoLiveConnection
+}
+
+// OnlineIds lists the ids with a live connection on this node
+func OnlineIds() []string {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	ids := make([]string, 0, len(conn_map))
+	for id := range conn_map {
+		ids = append(ids, id)
+	}
+	return ids
 }
 
 func (c *connection) write(mt int, payload []byte) error {
@@ -104,19 +310,30 @@ func (c *connection) write(mt int, payload []byte) error {
 
 func (c *connection) Heartbeat() {
 	ticker := time.NewTicker(pingPeriod)
+	var ack_check <-chan time.Time = nil
+	if c.acks {
+		ack_ticker := time.NewTicker(ackCheckPeriod)
+		defer ack_ticker.Stop()
+		ack_check = ack_ticker.C
+	}
 	defer func() {
 		log.Println("see you")
 		ticker.Stop()
 		c.conn.Close()
+		close(c.writer_done)
 	}()
 	for {
 		select {
-		case message, ok := <-c.msg:
+		case event, ok := <-c.msg:
 			if !ok {
 				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
-			if err := c.write(websocket.TextMessage, message); err != nil {
+			if err := c.writeEvent(event); err != nil {
+				return
+			}
+		case <-ack_check:
+			if err := c.redeliverPending(); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -127,18 +344,25 @@ func (c *connection) Heartbeat() {
 	}
 }
 
+// GetHeartbeat reads the client's pongs and acks until it goes away, then
+// waits for Heartbeat to stop and sends on what the client never got
 func (c *connection) GetHeartbeat() {
 	defer func() {
 		c.Leave()
 		c.conn.Close()
+		<-c.writer_done
+		c.requeuePending()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, frame, err := c.conn.ReadMessage()
 		if err != nil {
 			break
 		}
+		if c.acks {
+			c.handleAck(frame)
+		}
 	}
 }